@@ -1,49 +1,343 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"net"
 	"os"
-	"time"
+	"os/signal"
+	"runtime/debug"
+	"syscall"
 
+	"github.com/M4THYOU/some_mqtt_broker/internal/auth"
+	"github.com/M4THYOU/some_mqtt_broker/internal/broker"
 	"github.com/M4THYOU/some_mqtt_broker/internal/client"
-	"github.com/M4THYOU/some_mqtt_broker/internal/defaults"
-	"github.com/M4THYOU/some_mqtt_broker/pkg/packet"
+	"github.com/M4THYOU/some_mqtt_broker/internal/config"
+	"github.com/M4THYOU/some_mqtt_broker/internal/listener"
+	"github.com/M4THYOU/some_mqtt_broker/internal/logging"
 )
 
 func listen(c *client.Client) {
-	defer c.Conn.Close()
-	// to timeout hanging/broken connections.
-	c.Conn.SetDeadline(time.Now().Add(time.Second * 60))
+	defer c.Close()
+	// a bug triggered by one client only closes its own connection.
+	defer func() {
+		if r := recover(); r != nil {
+			logging.Errorf("Panic processing a packet from %v: %v\n%s", c.Conn.RemoteAddr(), r, debug.Stack())
+		}
+	}()
 	for {
 		err := c.ProcessPacket()
-		if err != nil {
-			fmt.Println("Error processing:", err.Error())
+		if err == client.ErrDisconnect {
+			break
+		} else if err != nil {
+			logging.Infof("Error processing: %v\n", err.Error())
 			break
 		}
 	}
 
 }
 
+// watchRedirect redirects clients to the server in the redirect file whenever the process gets SIGUSR1.
+// If the file is missing or empty, new connections are accepted again.
+func watchRedirect(s *server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	for range sigs {
+		c := s.config().Redirect
+		r, err := broker.ReadRedirect(c.File)
+		if err != nil {
+			logging.Errorf("Error reading redirect: %v\n", err.Error())
+			continue
+		}
+		s.broker.SetRedirect(r)
+		if r == nil {
+			logging.Infof("Redirect cleared, accepting new connections.\n")
+			continue
+		}
+		logging.Infof("Redirecting clients to %v (moved: %t)\n", r.ServerReference, r.Moved)
+		go s.broker.Drain(c.DrainPeriod)
+	}
+}
+
+// scramAuthenticators returns the SCRAM authenticators for the credentials in the file.
+// Returns none if no file is configured.
+func scramAuthenticators(path string) ([]auth.Authenticator, error) {
+	if path == "" {
+		return nil, nil
+	}
+	store, err := auth.ReadScramStore(path)
+	if err != nil {
+		return nil, err
+	}
+	authenticators := make([]auth.Authenticator, 0)
+	for _, method := range []string{auth.ScramSha256, auth.ScramSha1} {
+		a, err := auth.NewScram(method, store)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, a)
+	}
+	return authenticators, nil
+}
+
+// brokerOptions returns the settings of the broker, with the authentication files of the configuration read.
+// A configured file that is missing is an error, rather than leaving the broker open.
+func brokerOptions(cfg *config.Config) (broker.Options, error) {
+	strategy, err := broker.ParseStrategy(cfg.Broker.SharedSubStrategy)
+	if err != nil {
+		return broker.Options{}, errors.New("configuring shared subscriptions: " + err.Error())
+	}
+	authenticators, err := scramAuthenticators(cfg.Auth.ScramFile)
+	if err != nil {
+		return broker.Options{}, errors.New("reading SCRAM credentials: " + err.Error())
+	}
+	passwordCheckers := make(auth.PasswordCheckers, 0)
+	if cfg.Auth.PasswordFile != "" {
+		passwords, err := auth.ReadPasswordFile(cfg.Auth.PasswordFile)
+		if err != nil {
+			return broker.Options{}, errors.New("reading passwords: " + err.Error())
+		}
+		passwordCheckers = append(passwordCheckers, passwords)
+	}
+	if cfg.Auth.JWKSFile != "" {
+		jwt, err := auth.ReadJWKS(cfg.Auth.JWKSFile)
+		if err != nil {
+			return broker.Options{}, errors.New("reading JWT keys: " + err.Error())
+		}
+		passwordCheckers = append(passwordCheckers, jwt)
+		authenticators = append(authenticators, jwt)
+	}
+	authorizers := make(auth.Authorizers, 0)
+	if cfg.Auth.ACLFile != "" {
+		acl, err := auth.ReadACL(cfg.Auth.ACLFile)
+		if err != nil {
+			return broker.Options{}, errors.New("reading ACL: " + err.Error())
+		}
+		authorizers = append(authorizers, acl)
+	}
+	if cfg.Auth.Webhook.URL != "" {
+		webhook := auth.NewWebhook(auth.WebhookOptions{
+			URL:      cfg.Auth.Webhook.URL,
+			Timeout:  cfg.Auth.Webhook.Timeout,
+			CacheTTL: cfg.Auth.Webhook.CacheTTL,
+			FailOpen: cfg.Auth.Webhook.FailOpen,
+		})
+		passwordCheckers = append(passwordCheckers, webhook)
+		authorizers = append(authorizers, webhook)
+	}
+	var passwordChecker auth.PasswordChecker // nil => every client is accepted.
+	if len(passwordCheckers) > 0 {
+		passwordChecker = passwordCheckers
+	} else {
+		logging.Infof("No password file, JWT keys or webhook, clients are not asked for a password.\n")
+	}
+	var authorizer auth.Authorizer // nil => every topic is allowed.
+	if len(authorizers) > 0 {
+		authorizer = authorizers
+	} else {
+		logging.Infof("No ACL file or webhook, clients may use every topic.\n")
+	}
+	var certIdentity *auth.CertIdentity
+	if cfg.Auth.CertIdentity != "" {
+		certIdentity, err = auth.NewCertIdentity(cfg.Auth.CertIdentity, cfg.Auth.CertAsClientId)
+		if err != nil {
+			return broker.Options{}, errors.New("configuring certificate identities: " + err.Error())
+		}
+	}
+	return broker.Options{
+		SharedSubStrategy:     strategy,
+		ResponseInfo:          cfg.Broker.ResponseInfo,
+		GrantResponseTopics:   cfg.Broker.GrantResponseTopics,
+		RejectNonCharacters:   cfg.Broker.RejectNonCharacters,
+		ValidatePayloadFormat: cfg.Broker.ValidatePayloadFormat,
+		Authenticators:        authenticators,
+		PasswordChecker:       passwordChecker,
+		Authorizer:            authorizer,
+		CertIdentity:          certIdentity,
+		MaxPacketSize:         cfg.Limits.MaxPacketSize,
+		ConnectTimeout:        cfg.Limits.ConnectTimeout,
+	}, nil
+}
+
+// listenerConfig is a listener, and the settings of the clients connecting through it.
+type listenerConfig struct {
+	listener.Config
+	Client *client.Listener
+}
+
+// listenerConfigs returns the configured listeners. With check, their TLS files are read too.
+func listenerConfigs(cfg *config.Config, check bool) ([]listenerConfig, error) {
+	listeners := make([]listenerConfig, 0)
+	for i := range cfg.Listeners {
+		l, err := cfg.Listeners[i].ListenerConfig()
+		if err != nil {
+			return nil, err
+		}
+		settings, err := cfg.Listeners[i].ClientListener()
+		if err != nil {
+			return nil, err
+		}
+		if check && l.TLS != nil {
+			if _, _, err := listener.NewTLSConfig(*l.TLS); err != nil {
+				msg := fmt.Sprintf("listener %v: %v", l.String(), err.Error())
+				return nil, errors.New(msg)
+			}
+		}
+		listeners = append(listeners, listenerConfig{Config: l, Client: settings})
+	}
+	return listeners, nil
+}
+
 func main() {
-	fmt.Println("Starting the server...")
-	host := defaults.Host + ":" + defaults.Port
-	l, err := net.Listen(defaults.ConType, host)
+	cfg, opts, err := loadConfig()
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Println("Error reading the configuration:", err.Error())
+		os.Exit(1)
+	}
+	if opts.CheckConfig {
+		if _, err = listenerConfigs(cfg, true); err == nil {
+			_, err = brokerOptions(cfg)
+		}
+		if err != nil {
+			fmt.Println("Error in the configuration:", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Configuration OK")
+		return
+	}
+	if cfg.Logging.File != "" {
+		f, err := os.OpenFile(cfg.Logging.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			fmt.Println("Error opening the log file:", err.Error())
+			os.Exit(1)
+		}
+		defer f.Close()
+		os.Stdout = f
+	}
+	level, err := logging.ParseLevel(cfg.Logging.Level)
+	if err != nil {
+		fmt.Println("Error in the configuration:", err.Error())
+		os.Exit(1)
+	}
+	logging.SetLevel(level)
+
+	logging.Infof("Starting the server...\n")
+	if opts.ConfigFile != "" {
+		logging.Infof("Configuration file: %v\n", opts.ConfigFile)
+	}
+	brokerOpts, err := brokerOptions(cfg)
 	if err != nil {
-		fmt.Println("Error listening:", err.Error())
+		logging.Errorf("Error %v\n", err.Error())
 		os.Exit(1)
 	}
-	defer l.Close()
+	listeners, err := listenerConfigs(cfg, false)
+	if err != nil {
+		logging.Errorf("Error configuring listeners: %v\n", err.Error())
+		os.Exit(1)
+	}
+	s := &server{started: cfg, cfg: cfg, broker: broker.New(brokerOpts), listeners: make(map[string]*runningListener)}
+	if cfg.Persistence.File != "" {
+		sessions, err := broker.ReadSessions(cfg.Persistence.File)
+		if err != nil {
+			logging.Errorf("Error reading sessions: %v\n", err.Error())
+			os.Exit(1)
+		}
+		s.broker.Restore(sessions)
+		logging.Infof("Read %d sessions from %v\n", len(sessions), cfg.Persistence.File)
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	failed := make(chan error, len(listeners))
+	for _, lc := range listeners {
+		l, certs, err := listener.Listen(lc.Config)
+		if err != nil {
+			logging.Errorf("Error starting listener %v: %v\n", lc.String(), err.Error())
+			os.Exit(1)
+		}
+		if certs != nil {
+			go certs.Watch(cfg.Broker.TLSReloadInterval, nil)
+		}
+		rl := &runningListener{Listener: l, certs: certs, settings: lc.Client}
+		s.listeners[lc.Name] = rl
+		logging.Infof("Listener %v on %v %v\n", lc.String(), lc.Type, lc.Address)
+		go func() {
+			failed <- serve(rl, s.broker)
+		}()
+	}
+	go watchReload(s)
+	go watchRedirect(s)
+	logging.Infof("\n")
+
+	stopped := false // by a listener, rather than a signal.
+	select {
+	case sig := <-sigs:
+		logging.Infof("Got %v, shutting down...\n", sig)
+	case err := <-failed:
+		stopped = true
+		// serve returns nil if the listener was closed, like a WebSocket listener whose HTTP server stopped.
+		if err != nil {
+			logging.Errorf("Error accepting, shutting down: %v\n", err.Error())
+		} else {
+			logging.Errorf("Listener closed, shutting down...\n")
+		}
+	}
+	if err := s.shutdown(); err != nil {
+		logging.Errorf("Error saving the sessions: %v\n", err.Error())
+		os.Exit(2)
+	}
+	if stopped {
+		os.Exit(2)
+	}
+	logging.Infof("Shut down.\n")
+}
+
+// loadConfig returns the configuration from the file, environment and flags the process was started with.
+func loadConfig() (*config.Config, *config.Options, error) {
+	cfg, opts, err := config.Load(os.Args[0], os.Args[1:], os.LookupEnv)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, opts, nil
+}
 
-	fmt.Printf("Listening on %v\n\n", host)
+// serve accepts connections on the listener until it fails, or is closed, which returns nil.
+func serve(l *runningListener, b *broker.Broker) error {
 	for {
 		conn, err := l.Accept()
-		if err != nil {
-			fmt.Println("Error accepting: ", err.Error())
-			os.Exit(2)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
 		}
-		client := &client.Client{Conn: conn, Rdr: packet.NewReader(conn, 0)}
-		go listen(client)
+		c := client.New(conn, b)
+		c.Listener = l.clientSettings()
+		go listen(c)
 	}
+}
 
+// shutdown stops accepting connections, then disconnects every client with Server shutting down,
+// once its QoS 1 and 2 handshakes are complete or the shutdown timeout is over.
+// The sessions that outlive their connection are then saved to the persistence file, if there is one.
+func (s *server) shutdown() error {
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.broker.Shutdown(s.config().Broker.ShutdownTimeout)
+	// the file that was read on start, persistence.file only applies on restart.
+	path := s.started.Persistence.File
+	if path == "" {
+		return nil
+	}
+	sessions := s.broker.Sessions()
+	if err := broker.WriteSessions(path, sessions); err != nil {
+		return err
+	}
+	logging.Infof("Saved %d sessions to %v\n", len(sessions), path)
+	return nil
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/M4THYOU/some_mqtt_broker/internal/broker"
+	"github.com/M4THYOU/some_mqtt_broker/internal/client"
+	"github.com/M4THYOU/some_mqtt_broker/internal/config"
+	"github.com/M4THYOU/some_mqtt_broker/internal/listener"
+	"github.com/M4THYOU/some_mqtt_broker/internal/logging"
+)
+
+// server is the running broker and its listeners, whose configuration can be reloaded.
+type server struct {
+	started   *config.Config // the configuration the listeners were started with.
+	broker    *broker.Broker
+	listeners map[string]*runningListener // name => listener.
+
+	mu  sync.Mutex
+	cfg *config.Config // the configuration last loaded.
+}
+
+// config returns the configuration last loaded.
+func (s *server) config() *config.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// runningListener is a listener accepting connections, whose TLS settings and client settings can be replaced.
+type runningListener struct {
+	net.Listener
+	certs *listener.CertReloader // nil => no TLS.
+
+	mu       sync.RWMutex
+	settings *client.Listener // for the next clients that connect.
+}
+
+func (l *runningListener) clientSettings() *client.Listener {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.settings
+}
+
+func (l *runningListener) setClientSettings(settings *client.Listener) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.settings = settings
+}
+
+// reload applies the configuration while clients stay connected. The authentication files are read again,
+// and the new settings apply to the next packets, or the next clients that connect. The log level applies at once.
+// Changes that need a restart are reported, and compared with the configuration the broker started with,
+// so they are reported on every reload until then.
+func (s *server) reload(cfg *config.Config) error {
+	level, err := logging.ParseLevel(cfg.Logging.Level)
+	if err != nil {
+		return err
+	}
+	opts, err := brokerOptions(cfg)
+	if err != nil {
+		return err
+	}
+	listeners, err := listenerConfigs(cfg, false)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	logging.SetLevel(level)
+	s.broker.SetOptions(opts)
+	for _, lc := range listeners {
+		l, ok := s.listeners[lc.Name]
+		if !ok {
+			continue
+		}
+		if l.certs != nil && lc.TLS != nil {
+			if err := l.certs.SetOptions(*lc.TLS); err != nil {
+				logging.Errorf("Error reloading the TLS settings of listener %v, keeping the previous ones: %v\n", lc.String(), err.Error())
+			}
+		}
+		l.setClientSettings(lc.Client)
+	}
+	for _, change := range s.started.RestartChanges(cfg) {
+		logging.Infof("Not applied until the broker is restarted: %v\n", change)
+	}
+	s.cfg = cfg
+	return nil
+}
+
+// watchReload reloads the configuration whenever the process gets SIGHUP.
+// If it is invalid, the previous one is kept.
+func watchReload(s *server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		cfg, _, err := loadConfig()
+		if err == nil {
+			err = s.reload(cfg)
+		}
+		if err != nil {
+			logging.Errorf("Error reloading the configuration, keeping the previous one: %v\n", err.Error())
+			continue
+		}
+		logging.Infof("Reloaded the configuration.\n")
+	}
+}
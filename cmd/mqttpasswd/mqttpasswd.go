@@ -0,0 +1,118 @@
+// mqttpasswd manages the password file the broker checks User Names and Passwords against.
+//
+//	mqttpasswd add [-algorithm bcrypt|argon2id] <file> <user> [password]
+//	mqttpasswd remove <file> <user>
+//	mqttpasswd verify <file> <user> [password]
+//
+// If the password isn't given, it is read from the first line of stdin.
+// Send SIGHUP to the broker afterwards so it reads the file again.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/M4THYOU/some_mqtt_broker/internal/auth"
+)
+
+const usage = `usage:
+  mqttpasswd add [-algorithm bcrypt|argon2id] <file> <user> [password]
+  mqttpasswd remove <file> <user>
+  mqttpasswd verify <file> <user> [password]`
+
+// readPassword returns args[0] if given, otherwise the first line of stdin.
+func readPassword(args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.New("no password given")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func add(args []string) error {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	algorithm := fs.String("algorithm", auth.Bcrypt, "password hashing algorithm, bcrypt or argon2id")
+	fs.Parse(args)
+	if fs.NArg() < 2 || fs.NArg() > 3 {
+		return errors.New(usage)
+	}
+	path, user := fs.Arg(0), fs.Arg(1)
+	passwords, err := auth.ReadPasswordFile(path)
+	if os.IsNotExist(err) {
+		passwords = auth.NewPasswordFile(path)
+	} else if err != nil {
+		return err
+	}
+	password, err := readPassword(fs.Args()[2:])
+	if err != nil {
+		return err
+	}
+	if err := passwords.Set(user, password, *algorithm); err != nil {
+		return err
+	}
+	return passwords.Write()
+}
+
+func remove(args []string) error {
+	if len(args) != 2 {
+		return errors.New(usage)
+	}
+	passwords, err := auth.ReadPasswordFile(args[0])
+	if err != nil {
+		return err
+	}
+	if !passwords.Remove(args[1]) {
+		msg := fmt.Sprintf("no user %v in %v", args[1], args[0])
+		return errors.New(msg)
+	}
+	return passwords.Write()
+}
+
+func verify(args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return errors.New(usage)
+	}
+	passwords, err := auth.ReadPasswordFile(args[0])
+	if err != nil {
+		return err
+	}
+	password, err := readPassword(args[2:])
+	if err != nil {
+		return err
+	}
+	if _, err := passwords.CheckPassword("", args[1], []byte(password)); err != nil {
+		return err
+	}
+	fmt.Println("Password is correct.")
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "add":
+		err = add(os.Args[2:])
+	case "remove":
+		err = remove(os.Args[2:])
+	case "verify":
+		err = verify(os.Args[2:])
+	default:
+		err = errors.New(usage)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
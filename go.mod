@@ -2,4 +2,8 @@ module github.com/M4THYOU/some_mqtt_broker
 
 go 1.16
 
-require github.com/google/go-cmp v0.5.5
+require (
+	github.com/google/go-cmp v0.5.5
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+)
+
+// Access is what a client is trying to do with a topic.
+type Access byte
+
+const (
+	AccessPublish   Access = 1 << iota // publish to a topic name.
+	AccessSubscribe                    // subscribe to a topic filter.
+	AccessBoth      = AccessPublish | AccessSubscribe
+)
+
+// Authorizer decides which topics each client may publish and subscribe to.
+type Authorizer interface {
+	// Authorize checks if the client may publish to the topic name, or subscribe to the topic filter.
+	// Shared subscriptions are checked without their $share/{ShareName}/ prefix. userName is empty if the client has none.
+	Authorize(clientId, userName string, access Access, topic string) bool
+}
+
+// Authorizers only allows what every one of its authorizers allows.
+type Authorizers []Authorizer
+
+func (authorizers Authorizers) Authorize(clientId, userName string, access Access, topic string) bool {
+	for _, a := range authorizers {
+		if !a.Authorize(clientId, userName, access, topic) {
+			return false
+		}
+	}
+	return true
+}
+
+// aclRule is a single allow or deny line of an ACL file.
+type aclRule struct {
+	allow    bool
+	access   Access
+	pattern  string // topic filter. %u => user name, %c => client ID.
+	userName string // the rule only applies to this user. Empty => any.
+	clientId string // the rule only applies to this client. Empty => any.
+}
+
+// ACL authorizes clients with the rules of an ACL file. Each rule is a line of the form:
+//
+//	<allow|deny> <publish|subscribe|both> <topic filter>
+//
+// %u and %c in the topic filter are replaced by the client's User Name and Client ID.
+// A `user <name>` or `client <id>` line makes the rules after it only apply to that user or client,
+// until the next such line. `all` goes back to rules for every client.
+// Blank lines and lines starting with # are ignored.
+//
+// The first rule that matches decides, and anything no rule matches is denied.
+// An allow rule matches a subscription if its filter covers the whole subscription,
+// while a deny rule matches as soon as they have a topic in common.
+type ACL struct {
+	path  string
+	mu    sync.RWMutex
+	rules []aclRule
+}
+
+// ReadACL reads the ACL file at path.
+func ReadACL(path string) (*ACL, error) {
+	a := &ACL{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads the file again, so the rules apply to the next PUBLISH and SUBSCRIBE packets.
+// Existing subscriptions are not affected. If the file is invalid, the previous rules are kept.
+func (a *ACL) Reload() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rules := make([]aclRule, 0)
+	var userName, clientId string
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch {
+		case fields[0] == "all" && len(fields) == 1:
+			userName, clientId = "", ""
+		case fields[0] == "user" && len(fields) == 2:
+			userName, clientId = fields[1], ""
+		case fields[0] == "client" && len(fields) == 2:
+			userName, clientId = "", fields[1]
+		default:
+			rule, err := parseACLRule(fields)
+			if err != nil {
+				msg := fmt.Sprintf("%v:%d: %v", a.path, lineNum, err.Error())
+				return errors.New(msg)
+			}
+			rule.userName, rule.clientId = userName, clientId
+			rules = append(rules, *rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules = rules
+	return nil
+}
+
+func parseACLRule(fields []string) (*aclRule, error) {
+	if len(fields) != 3 {
+		return nil, errors.New("expected: <allow|deny> <publish|subscribe|both> <topic filter>, or user/client/all")
+	}
+	rule := &aclRule{pattern: fields[2]}
+	switch fields[0] {
+	case "allow":
+		rule.allow = true
+	case "deny":
+		rule.allow = false
+	default:
+		msg := fmt.Sprintf("invalid permission `%v`, expected allow or deny", fields[0])
+		return nil, errors.New(msg)
+	}
+	switch fields[1] {
+	case "publish":
+		rule.access = AccessPublish
+	case "subscribe":
+		rule.access = AccessSubscribe
+	case "both":
+		rule.access = AccessBoth
+	default:
+		msg := fmt.Sprintf("invalid access `%v`, expected publish, subscribe or both", fields[1])
+		return nil, errors.New(msg)
+	}
+	if !mqtt.ValidTopicFilter(rule.pattern) {
+		msg := fmt.Sprintf("invalid topic filter `%v`", rule.pattern)
+		return nil, errors.New(msg)
+	}
+	return rule, nil
+}
+
+func (a *ACL) Authorize(clientId, userName string, access Access, topic string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, rule := range a.rules {
+		if rule.access&access == 0 || (rule.userName != "" && rule.userName != userName) || (rule.clientId != "" && rule.clientId != clientId) {
+			continue
+		}
+		pattern, ok := rule.substitute(clientId, userName)
+		if !ok {
+			// a user name or client ID that would change the meaning of the pattern gets nothing from it.
+			if rule.allow {
+				continue
+			}
+			return false
+		}
+		if rule.matches(pattern, access, topic) {
+			return rule.allow
+		}
+	}
+	return false
+}
+
+// substitute replaces %u and %c in the rule's pattern.
+// Returns false if the pattern uses a value that is empty or contains wildcards or level separators.
+func (rule *aclRule) substitute(clientId, userName string) (string, bool) {
+	for placeholder, value := range map[string]string{"%u": userName, "%c": clientId} {
+		if strings.Contains(rule.pattern, placeholder) && (value == "" || strings.ContainsAny(value, "+#/")) {
+			return "", false
+		}
+	}
+	return strings.NewReplacer("%u", userName, "%c", clientId).Replace(rule.pattern), true
+}
+
+func (rule *aclRule) matches(pattern string, access Access, topic string) bool {
+	if access == AccessPublish {
+		return mqtt.TopicMatches(pattern, topic)
+	} else if rule.allow {
+		return mqtt.FilterCovers(pattern, topic)
+	}
+	return mqtt.FiltersOverlap(pattern, topic)
+}
+
+// TopicGrants only allows the topics under a set of topic filters, e.g. the ones listed in a client's token.
+type TopicGrants struct {
+	Publish   []string // topic filters the client may publish to. nil => any.
+	Subscribe []string // topic filters the client may subscribe to, or to part of. nil => any.
+}
+
+func (g *TopicGrants) Authorize(clientId, userName string, access Access, topic string) bool {
+	if access == AccessPublish {
+		if g.Publish == nil {
+			return true
+		}
+		for _, filter := range g.Publish {
+			if mqtt.ValidTopicFilter(filter) && mqtt.TopicMatches(filter, topic) {
+				return true
+			}
+		}
+		return false
+	}
+	if g.Subscribe == nil {
+		return true
+	}
+	for _, filter := range g.Subscribe {
+		if mqtt.ValidTopicFilter(filter) && mqtt.FilterCovers(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+const testACL = `# the first matching rule decides, so admin's rules go first.
+user admin
+allow both #
+
+# every tenant owns its own subtree.
+all
+allow both tenants/%u/#
+deny subscribe devices/+/secrets
+allow publish devices/%c/#
+allow subscribe devices/#
+
+client gateway-7
+allow publish plant/#
+
+all
+allow subscribe public/+
+`
+
+func readTestACL(t *testing.T, contents string) (*ACL, string) {
+	path := filepath.Join(t.TempDir(), "acl.conf")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := ReadACL(path)
+	if err != nil {
+		t.Fatalf("ReadACL failed: %v", err.Error())
+	}
+	return a, path
+}
+
+func checkAuthorize(t *testing.T, a *ACL, clientId, userName string, access Access, topic string, expected bool) {
+	if res := a.Authorize(clientId, userName, access, topic); res != expected {
+		t.Fatalf("Authorize(%q, %q, %d, %q) got %v, expected %v", clientId, userName, access, topic, res, expected)
+	}
+}
+
+func TestACL(t *testing.T) {
+	a, _ := readTestACL(t, testACL)
+	checkAuthorize(t, a, "c1", "alice", AccessPublish, "tenants/alice/temp", true)
+	checkAuthorize(t, a, "c1", "alice", AccessSubscribe, "tenants/alice/#", true)
+	checkAuthorize(t, a, "c1", "alice", AccessPublish, "tenants/bob/temp", false)
+	checkAuthorize(t, a, "c1", "alice", AccessSubscribe, "tenants/+/temp", false)
+	checkAuthorize(t, a, "c1", "", AccessPublish, "tenants//temp", false)
+	checkAuthorize(t, a, "c1", "+", AccessSubscribe, "tenants/+/temp", false)
+
+	checkAuthorize(t, a, "sensor-1", "", AccessPublish, "devices/sensor-1/temp", true)
+	checkAuthorize(t, a, "sensor-1", "", AccessPublish, "devices/sensor-2/temp", false)
+	checkAuthorize(t, a, "sensor-1", "", AccessSubscribe, "devices/sensor-2/temp", true)
+	// the deny rule comes first, and overlaps with anything that could receive secrets.
+	checkAuthorize(t, a, "sensor-1", "", AccessSubscribe, "devices/sensor-2/secrets", false)
+	checkAuthorize(t, a, "sensor-1", "", AccessSubscribe, "devices/#", false)
+
+	checkAuthorize(t, a, "c2", "admin", AccessSubscribe, "#", true)
+	checkAuthorize(t, a, "c2", "alice", AccessSubscribe, "#", false)
+	checkAuthorize(t, a, "gateway-7", "", AccessPublish, "plant/valve", true)
+	checkAuthorize(t, a, "gateway-8", "", AccessPublish, "plant/valve", false)
+	checkAuthorize(t, a, "gateway-8", "", AccessSubscribe, "public/news", true)
+	checkAuthorize(t, a, "gateway-8", "", AccessPublish, "public/news", false)
+}
+
+func TestACLReload(t *testing.T) {
+	a, path := readTestACL(t, "allow both #\n")
+	checkAuthorize(t, a, "c1", "", AccessPublish, "a/b", true)
+	if err := ioutil.WriteFile(path, []byte("deny both #\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err.Error())
+	}
+	checkAuthorize(t, a, "c1", "", AccessPublish, "a/b", false)
+
+	// an invalid file keeps the previous rules.
+	for _, contents := range []string{"allow everything #\n", "permit both #\n", "allow both a/#/b\n", "user\n"} {
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Reload(); err == nil {
+			t.Fatalf("Reload should have failed for %q", contents)
+		}
+	}
+	checkAuthorize(t, a, "c1", "", AccessPublish, "a/b", false)
+}
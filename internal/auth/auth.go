@@ -0,0 +1,68 @@
+package auth
+
+// Authenticator is an enhanced authentication method, like SCRAM-SHA-256.
+// The client picks it with the Authentication Method of its CONNECT packet, then both sides exchange
+// Authentication Data in AUTH packets until the server accepts or refuses the client.
+type Authenticator interface {
+	// Method returns the name of the Authentication Method, as sent by clients.
+	Method() string
+	// Start begins authenticating a client, when it connects or re-authenticates.
+	Start(clientId string) Exchange
+}
+
+// Exchange is a single authentication in progress. It is only used by the client's own goroutine.
+type Exchange interface {
+	// Next processes the Authentication Data sent by the client, and returns the data to send back, nil => none.
+	// done is true once the client is authenticated, otherwise the client must answer with more data.
+	// Returns a ReasonError if the client is refused, usually with Not authorized.
+	Next(data []byte) (reply []byte, done bool, err error)
+	// Identity returns who the client authenticated as, once done. nil => the User Name from CONNECT.
+	Identity() *Identity
+}
+
+// Identity is who a client authenticated as, and what it was granted along the way.
+type Identity struct {
+	UserName string // replaces the User Name from CONNECT. Empty => it is kept.
+	// Authorizer restricts the topics of this client only, on top of the broker's Authorizer. nil => no restriction.
+	Authorizer Authorizer
+}
+
+// PasswordChecker checks the User Name and Password that clients send in CONNECT.
+type PasswordChecker interface {
+	// CheckPassword returns a ReasonError if the client is refused, usually Bad user name or password.
+	// userName is empty and password nil if the client didn't send them. The Identity may be nil.
+	CheckPassword(clientId, userName string, password []byte) (*Identity, error)
+}
+
+// undecidedChecker is a PasswordChecker that can accept a client only because it couldn't decide, like a webhook that fails open.
+type undecidedChecker interface {
+	// checkPassword is CheckPassword, where decided is false if the client was accepted without a decision.
+	checkPassword(clientId, userName string, password []byte) (id *Identity, decided bool, err error)
+}
+
+// PasswordCheckers accepts a client as soon as one of its checkers does, in order.
+// If they all refuse it, the reason from the last one is returned.
+// A checker that accepts the client without deciding only counts if no other checker refused it.
+type PasswordCheckers []PasswordChecker
+
+func (checkers PasswordCheckers) CheckPassword(clientId, userName string, password []byte) (*Identity, error) {
+	var err error
+	for _, c := range checkers {
+		u, ok := c.(undecidedChecker)
+		if !ok {
+			id, cErr := c.CheckPassword(clientId, userName, password)
+			if cErr == nil {
+				return id, nil
+			}
+			err = cErr
+			continue
+		}
+		id, decided, cErr := u.checkPassword(clientId, userName, password)
+		if cErr == nil && decided {
+			return id, nil
+		} else if cErr != nil {
+			err = cErr
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// Fields of a client certificate that can identify the client.
+const (
+	CertCommonName = "cn"    // the Subject's Common Name.
+	CertDNSName    = "dns"   // the first DNS name SAN.
+	CertEmail      = "email" // the first email address SAN.
+	CertURI        = "uri"   // the first URI SAN.
+)
+
+// CertIdentity takes the identity of clients from their verified TLS certificate, instead of a password.
+type CertIdentity struct {
+	field      string
+	asClientId bool
+}
+
+// NewCertIdentity returns a CertIdentity using the given field of the certificate, one of the Cert* constants.
+// asClientId => the identity replaces the Client ID, otherwise the User Name.
+func NewCertIdentity(field string, asClientId bool) (*CertIdentity, error) {
+	switch field {
+	case CertCommonName, CertDNSName, CertEmail, CertURI:
+		return &CertIdentity{field, asClientId}, nil
+	default:
+		msg := fmt.Sprintf("invalid certificate field `%v`, expected one of: cn, dns, email, uri", field)
+		return nil, errors.New(msg)
+	}
+}
+
+// AsClientId checks if the identity replaces the Client ID, rather than the User Name.
+func (c *CertIdentity) AsClientId() bool {
+	return c.asClientId
+}
+
+// Identify returns the identity in the certificate. Empty => the certificate doesn't have the field.
+func (c *CertIdentity) Identify(cert *x509.Certificate) string {
+	switch c.field {
+	case CertCommonName:
+		return cert.Subject.CommonName
+	case CertDNSName:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case CertEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case CertURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	}
+	return ""
+}
+
+// IdentifyCommonName returns the identity of a client whose certificate a TLS terminating proxy verified.
+// Proxies only forward the certificate's Common Name, so it's empty unless that's the field used.
+func (c *CertIdentity) IdentifyCommonName(commonName string) string {
+	if c.field != CertCommonName {
+		return ""
+	}
+	return commonName
+}
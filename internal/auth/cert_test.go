@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+)
+
+func checkCertIdentity(t *testing.T, field string, cert *x509.Certificate, expected string) {
+	c, err := NewCertIdentity(field, false)
+	if err != nil {
+		t.Fatalf("NewCertIdentity failed: %v", err.Error())
+	}
+	if res := c.Identify(cert); res != expected {
+		t.Fatalf("Identify with %v got %q, expected %q", field, res, expected)
+	}
+}
+
+func TestCertIdentity(t *testing.T) {
+	uri, _ := url.Parse("spiffe://example.com/gateway-7")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "gateway-7"},
+		DNSNames:       []string{"gateway-7.example.com", "gateway.example.com"},
+		EmailAddresses: []string{"ops@example.com"},
+		URIs:           []*url.URL{uri},
+	}
+	checkCertIdentity(t, CertCommonName, cert, "gateway-7")
+	checkCertIdentity(t, CertDNSName, cert, "gateway-7.example.com")
+	checkCertIdentity(t, CertEmail, cert, "ops@example.com")
+	checkCertIdentity(t, CertURI, cert, "spiffe://example.com/gateway-7")
+	checkCertIdentity(t, CertEmail, &x509.Certificate{}, "")
+
+	// proxies only forward the Common Name.
+	cn, _ := NewCertIdentity(CertCommonName, false)
+	dns, _ := NewCertIdentity(CertDNSName, false)
+	if cn.IdentifyCommonName("gateway-7") != "gateway-7" || dns.IdentifyCommonName("gateway-7") != "" {
+		t.Fatalf("only the Common Name field should identify clients from a proxy")
+	}
+
+	if _, err := NewCertIdentity("serial", false); err == nil {
+		t.Fatalf("NewCertIdentity should have failed for serial")
+	}
+}
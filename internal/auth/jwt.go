@@ -0,0 +1,313 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers SHA-256 for crypto.Hash.
+	_ "crypto/sha512" // registers SHA-384 and SHA-512 for crypto.Hash.
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+)
+
+const (
+	JWTMethod = "JWT" // the Authentication Method for sending the token in AUTH, rather than as the password.
+
+	jwtLeeway = time.Second * 30 // allowed clock difference with the identity provider when checking exp and nbf.
+)
+
+// jwk is a verification key from a JWK Set, as defined by RFC 7517.
+type jwk struct {
+	kid    string
+	alg    string // empty => any algorithm of the key's type.
+	secret []byte // kty "oct".
+	rsa    *rsa.PublicKey
+	ecdsa  *ecdsa.PublicKey
+}
+
+// jwtClaims are the claims of a token that the broker uses.
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+	Publish   []string `json:"publish"`   // nil => the token doesn't restrict publishing.
+	Subscribe []string `json:"subscribe"` // nil => the token doesn't restrict subscribing.
+}
+
+// JWT authenticates clients with a signed JSON Web Token, sent either as the CONNECT password,
+// or as the Authentication Data of the JWT Authentication Method.
+// Tokens are verified with the keys of a local JWK Set file: "oct" keys for HS256/384/512,
+// "RSA" keys for RS256/384/512, and "EC" keys for ES256/384/512. exp and nbf are checked when the client
+// connects or re-authenticates.
+//
+// The client authenticates as the token's sub. The publish and subscribe claims, if present,
+// are lists of topic filters the client is limited to.
+type JWT struct {
+	path string
+	mu   sync.RWMutex
+	keys []*jwk
+}
+
+// ReadJWKS reads the JWK Set file at path.
+func ReadJWKS(path string) (*JWT, error) {
+	j := &JWT{path: path}
+	if err := j.Reload(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Reload reads the JWK Set file again, for rotated keys. If the file is invalid, the previous keys are kept.
+func (j *JWT) Reload() error {
+	buf, err := ioutil.ReadFile(j.path)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(buf)
+	if err != nil {
+		msg := fmt.Sprintf("%v: %v", j.path, err.Error())
+		return errors.New(msg)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.keys = keys
+	return nil
+}
+
+func parseJWKS(buf []byte) ([]*jwk, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			K   string `json:"k"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(buf, &set); err != nil {
+		return nil, err
+	}
+	dec := base64.RawURLEncoding.DecodeString
+	keys := make([]*jwk, 0, len(set.Keys))
+	for i, k := range set.Keys {
+		key := &jwk{kid: k.Kid, alg: k.Alg}
+		var err error
+		switch k.Kty {
+		case "oct":
+			key.secret, err = dec(k.K)
+			if err == nil && len(key.secret) == 0 {
+				err = errors.New("empty secret")
+			}
+		case "RSA":
+			var n, e []byte
+			if n, err = dec(k.N); err == nil {
+				e, err = dec(k.E)
+			}
+			exponent := new(big.Int).SetBytes(e)
+			if err == nil && (len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1) {
+				err = errors.New("invalid modulus or exponent")
+			}
+			key.rsa = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				err = errors.New("unsupported curve " + k.Crv)
+			}
+			var x, y []byte
+			if err == nil {
+				if x, err = dec(k.X); err == nil {
+					y, err = dec(k.Y)
+				}
+			}
+			if err == nil {
+				key.ecdsa = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+				if !curve.IsOnCurve(key.ecdsa.X, key.ecdsa.Y) {
+					err = errors.New("point is not on the curve")
+				}
+			}
+		default:
+			err = errors.New("unsupported key type " + k.Kty)
+		}
+		if err != nil {
+			msg := fmt.Sprintf("key %d: %v", i, err.Error())
+			return nil, errors.New(msg)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// jwtHash returns the hash used by the signing algorithm, or 0 if it isn't supported.
+func jwtHash(alg string) crypto.Hash {
+	switch alg[len(alg)-3:] {
+	case "256":
+		return crypto.SHA256
+	case "384":
+		return crypto.SHA384
+	case "512":
+		return crypto.SHA512
+	default:
+		return 0
+	}
+}
+
+var errJWTInvalid = mqtt.NewReasonError(mqtt.ReasonBadUserNameOrPassword, "invalid token")
+
+// Verify checks the token's signature, exp and nbf, and returns who it was issued to.
+// Returns a ReasonError if the token isn't valid, or has no sub.
+func (j *JWT) Verify(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errJWTInvalid
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var claims jwtClaims
+	if err := jwtDecodePart(parts[0], &header); err != nil {
+		return nil, errJWTInvalid
+	} else if err := jwtDecodePart(parts[1], &claims); err != nil {
+		return nil, errJWTInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(header.Alg) != 5 || jwtHash(header.Alg) == 0 {
+		// also refuses "none".
+		return nil, errJWTInvalid
+	}
+	h := jwtHash(header.Alg).New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	j.mu.RLock()
+	keys := j.keys
+	j.mu.RUnlock()
+	verified := false
+	for _, key := range keys {
+		if (header.Kid != "" && key.kid != header.Kid) || (key.alg != "" && key.alg != header.Alg) {
+			continue
+		}
+		if key.verify(header.Alg, parts[0]+"."+parts[1], digest, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errJWTInvalid
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt != nil && now.After(jwtTime(*claims.ExpiresAt).Add(jwtLeeway)) {
+		return nil, mqtt.NewReasonError(mqtt.ReasonBadUserNameOrPassword, "token has expired")
+	} else if claims.NotBefore != nil && now.Add(jwtLeeway).Before(jwtTime(*claims.NotBefore)) {
+		return nil, mqtt.NewReasonError(mqtt.ReasonBadUserNameOrPassword, "token is not valid yet")
+	} else if claims.Subject == "" {
+		// the client would otherwise keep the User Name it chose, which ACLs trust.
+		return nil, mqtt.NewReasonError(mqtt.ReasonBadUserNameOrPassword, "token has no sub")
+	}
+	id := &Identity{UserName: claims.Subject}
+	if claims.Publish != nil || claims.Subscribe != nil {
+		id.Authorizer = &TopicGrants{Publish: claims.Publish, Subscribe: claims.Subscribe}
+	}
+	return id, nil
+}
+
+func jwtDecodePart(part string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+func jwtTime(seconds float64) time.Time {
+	return time.Unix(int64(seconds), 0)
+}
+
+// jwtCurves is the curve each ECDSA algorithm must be used with.
+var jwtCurves = map[string]string{"ES256": "P-256", "ES384": "P-384", "ES512": "P-521"}
+
+// verify checks the signature with this key. Keys are only ever used with the algorithms of their own type.
+func (key *jwk) verify(alg, signingInput string, digest, sig []byte) bool {
+	switch {
+	case strings.HasPrefix(alg, "HS") && key.secret != nil:
+		mac := hmac.New(jwtHash(alg).New, key.secret)
+		mac.Write([]byte(signingInput))
+		return hmac.Equal(mac.Sum(nil), sig)
+	case strings.HasPrefix(alg, "RS") && key.rsa != nil:
+		return rsa.VerifyPKCS1v15(key.rsa, jwtHash(alg), digest, sig) == nil
+	case strings.HasPrefix(alg, "ES") && key.ecdsa != nil:
+		// the signature is r || s, each the size of the curve.
+		params := key.ecdsa.Curve.Params()
+		size := (params.BitSize + 7) / 8
+		if len(sig) != 2*size || params.Name != jwtCurves[alg] {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key.ecdsa, digest, r, s)
+	default:
+		return false
+	}
+}
+
+// CheckPassword accepts clients whose password is a valid token. The User Name is replaced by the token's sub.
+func (j *JWT) CheckPassword(clientId, userName string, password []byte) (*Identity, error) {
+	if password == nil {
+		return nil, mqtt.NewReasonError(mqtt.ReasonNotAuthorized, "a token is required as the password")
+	}
+	return j.Verify(string(password))
+}
+
+func (j *JWT) Method() string {
+	return JWTMethod
+}
+
+func (j *JWT) Start(clientId string) Exchange {
+	return &jwtExchange{jwt: j}
+}
+
+// jwtExchange takes the token as the Authentication Data of the first step.
+type jwtExchange struct {
+	jwt *JWT
+	id  *Identity
+}
+
+func (e *jwtExchange) Next(data []byte) ([]byte, bool, error) {
+	if len(data) == 0 {
+		return nil, false, mqtt.NewReasonError(mqtt.ReasonNotAuthorized, "a token is required as the Authentication Data")
+	}
+	id, err := e.jwt.Verify(string(data))
+	if err != nil {
+		// Bad user name or password is for CONNECT's fields, not enhanced authentication.
+		return nil, false, mqtt.NewReasonError(mqtt.ReasonNotAuthorized, err.Error())
+	}
+	e.id = id
+	return nil, true, nil
+}
+
+func (e *jwtExchange) Identity() *Identity {
+	return e.id
+}
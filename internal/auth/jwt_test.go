@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+)
+
+// jwtTestKeys are the private halves of the keys in the test JWK Set.
+type jwtTestKeys struct {
+	secret []byte
+	rsa    *rsa.PrivateKey
+	ecdsa  *ecdsa.PrivateKey
+}
+
+func newJWTTestKeys(t *testing.T) (*jwtTestKeys, *JWT) {
+	keys := &jwtTestKeys{secret: []byte("a shared secret of 32 bytes long")}
+	var err error
+	if keys.rsa, err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+		t.Fatal(err)
+	} else if keys.ecdsa, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	enc := base64.RawURLEncoding.EncodeToString
+	jwks := fmt.Sprintf(`{"keys": [
+		{"kty": "oct", "kid": "hmac", "k": "%v"},
+		{"kty": "RSA", "kid": "rsa", "alg": "RS256", "n": "%v", "e": "%v"},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": "%v", "y": "%v"}
+	]}`, enc(keys.secret), enc(keys.rsa.N.Bytes()), enc(big.NewInt(int64(keys.rsa.E)).Bytes()),
+		enc(keys.ecdsa.X.Bytes()), enc(keys.ecdsa.Y.Bytes()))
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(path, []byte(jwks), 0600); err != nil {
+		t.Fatal(err)
+	}
+	j, err := ReadJWKS(path)
+	if err != nil {
+		t.Fatalf("ReadJWKS failed: %v", err.Error())
+	}
+	return keys, j
+}
+
+// sign builds a token with the algorithm and kid, signed with the matching test key.
+func (keys *jwtTestKeys) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := enc(header) + "." + enc(payload)
+	h := crypto.SHA256.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	var err error
+	switch alg {
+	case "HS256":
+		mac := hmac.New(crypto.SHA256.New, keys.secret)
+		mac.Write([]byte(signingInput))
+		sig = mac.Sum(nil)
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, keys.rsa, crypto.SHA256, digest)
+	case "ES256":
+		r, s, err2 := ecdsa.Sign(rand.Reader, keys.ecdsa, digest)
+		sig, err = make([]byte, 64), err2
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + enc(sig)
+}
+
+func checkVerifyJWT(t *testing.T, j *JWT, token, expectedUser string, shouldPass bool) *Identity {
+	id, err := j.Verify(token)
+	if err != nil && shouldPass {
+		t.Fatalf("Verify failed: %v", err.Error())
+	} else if err == nil && !shouldPass {
+		t.Fatalf("Verify should have failed for %v", token)
+	} else if err != nil && mqtt.GetReasonCode(err) != mqtt.ReasonBadUserNameOrPassword {
+		t.Fatalf("Verify failed with reason code %#x, expected Bad user name or password", mqtt.GetReasonCode(err))
+	} else if shouldPass && id.UserName != expectedUser {
+		t.Fatalf("authenticated as %v, expected %v", id.UserName, expectedUser)
+	}
+	return id
+}
+
+func TestJWT(t *testing.T) {
+	keys, j := newJWTTestKeys(t)
+	now := time.Now().Unix()
+	valid := map[string]interface{}{"sub": "app-42", "exp": now + 60}
+	checkVerifyJWT(t, j, keys.sign(t, "HS256", "hmac", valid), "app-42", true)
+	checkVerifyJWT(t, j, keys.sign(t, "RS256", "rsa", valid), "app-42", true)
+	checkVerifyJWT(t, j, keys.sign(t, "ES256", "ec", valid), "app-42", true)
+	checkVerifyJWT(t, j, keys.sign(t, "ES256", "", valid), "app-42", true)
+
+	checkVerifyJWT(t, j, keys.sign(t, "HS256", "hmac", map[string]interface{}{"sub": "app-42", "exp": now - 60}), "", false)
+	checkVerifyJWT(t, j, keys.sign(t, "HS256", "hmac", map[string]interface{}{"sub": "app-42", "nbf": now + 60}), "", false)
+	// a token must say who it was issued to, or the client would keep any User Name it sent.
+	checkVerifyJWT(t, j, keys.sign(t, "HS256", "hmac", map[string]interface{}{"exp": now + 60}), "", false)
+	checkVerifyJWT(t, j, keys.sign(t, "HS256", "hmac", map[string]interface{}{"sub": "", "exp": now + 60}), "", false)
+	// signed with the right key, but claiming another one.
+	checkVerifyJWT(t, j, keys.sign(t, "HS256", "rsa", valid), "", false)
+	checkVerifyJWT(t, j, keys.sign(t, "HS256", "hmac", valid)+"x", "", false)
+	checkVerifyJWT(t, j, keys.sign(t, "none", "", valid), "", false)
+	checkVerifyJWT(t, j, "not.a.token", "", false)
+	checkVerifyJWT(t, j, "password", "", false)
+}
+
+func TestJWTClaims(t *testing.T) {
+	keys, j := newJWTTestKeys(t)
+	id := checkVerifyJWT(t, j, keys.sign(t, "HS256", "hmac", map[string]interface{}{"sub": "app-42"}), "app-42", true)
+	if id.Authorizer != nil {
+		t.Fatalf("a token without publish or subscribe claims should not restrict topics")
+	}
+
+	claims := map[string]interface{}{"sub": "app-42", "publish": []string{"apps/app-42/#"}, "subscribe": []string{}}
+	id = checkVerifyJWT(t, j, keys.sign(t, "HS256", "hmac", claims), "app-42", true)
+	if id.Authorizer == nil {
+		t.Fatalf("a token with publish and subscribe claims should restrict topics")
+	} else if !id.Authorizer.Authorize("c1", "app-42", AccessPublish, "apps/app-42/status") {
+		t.Fatalf("the token should allow publishing to apps/app-42/status")
+	} else if id.Authorizer.Authorize("c1", "app-42", AccessPublish, "apps/app-43/status") {
+		t.Fatalf("the token should not allow publishing to apps/app-43/status")
+	} else if id.Authorizer.Authorize("c1", "app-42", AccessSubscribe, "apps/app-42/#") {
+		t.Fatalf("the token should not allow any subscription")
+	}
+}
+
+func TestJWTExchange(t *testing.T) {
+	keys, j := newJWTTestKeys(t)
+	ex := j.Start("c1")
+	token := keys.sign(t, "HS256", "hmac", map[string]interface{}{"sub": "app-42"})
+	if _, done, err := ex.Next([]byte(token)); err != nil || !done {
+		t.Fatalf("JWT exchange should be done after the token, err: %v", err)
+	} else if ex.Identity().UserName != "app-42" {
+		t.Fatalf("authenticated as %v, expected app-42", ex.Identity().UserName)
+	}
+	if _, _, err := j.Start("c1").Next([]byte("password")); mqtt.GetReasonCode(err) != mqtt.ReasonNotAuthorized {
+		t.Fatalf("JWT exchange should fail with Not authorized, got: %v", err)
+	}
+}
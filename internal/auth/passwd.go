@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/M4THYOU/some_mqtt_broker/internal/logging"
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms supported in password files.
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+)
+
+// Argon2id parameters for new hashes, as recommended by RFC 9106 for memory constrained environments.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+	argon2KeyLen  = 32
+
+	// limits on the parameters of hashes read from a password file, so a hand edited line can't crash or stall the broker.
+	argon2MaxTime   = 100
+	argon2MaxMemory = 4 * 1024 * 1024 // KiB
+)
+
+// HashPassword hashes the password with the given algorithm, for storing in a password file.
+func HashPassword(password, algorithm string) (string, error) {
+	switch algorithm {
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	case Argon2id:
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		enc := base64.RawStdEncoding.EncodeToString
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%v$%v", argon2.Version, argon2Memory, argon2Time, argon2Threads, enc(salt), enc(key)), nil
+	default:
+		msg := fmt.Sprintf("unsupported password hashing algorithm %v, expected %v or %v", algorithm, Bcrypt, Argon2id)
+		return "", errors.New(msg)
+	}
+}
+
+// VerifyPassword checks the password against a hash from HashPassword. The algorithm is taken from the hash.
+// Returns an error only if the hash is invalid.
+func VerifyPassword(hash string, password []byte) (bool, error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return verifyArgon2id(hash, password)
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), password)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func verifyArgon2id(hash string, password []byte) (bool, error) {
+	// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, errors.New("malformed argon2id hash")
+	}
+	var version int
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errors.New("unsupported argon2id version")
+	} else if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, errors.New("malformed argon2id parameters")
+	} else if time < 1 || time > argon2MaxTime || threads < 1 || memory > argon2MaxMemory {
+		msg := fmt.Sprintf("invalid argon2id parameters m=%d,t=%d,p=%d", memory, time, threads)
+		return false, errors.New(msg)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	} else if len(key) == 0 {
+		return false, errors.New("empty argon2id key")
+	}
+	got := argon2.IDKey(password, salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(got, key) == 1, nil
+}
+
+// PasswordFile checks the User Name and Password of CONNECT packets against a mosquitto style password file.
+// Each line of the file is <user>:<hash>, where hash comes from HashPassword. Blank lines and lines starting with # are ignored.
+type PasswordFile struct {
+	path   string
+	mu     sync.RWMutex
+	hashes map[string]string // user -> hash.
+	// dummy is one of the hashes, checked for unknown users so they take as long to refuse as a wrong password.
+	dummy string
+}
+
+// ReadPasswordFile reads the password file at path.
+func ReadPasswordFile(path string) (*PasswordFile, error) {
+	p := &PasswordFile{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// NewPasswordFile returns an empty password file that will be written to path.
+func NewPasswordFile(path string) *PasswordFile {
+	return &PasswordFile{path: path, hashes: make(map[string]string)}
+}
+
+// Reload reads the file again, so changes apply to the next clients that connect.
+// If the file is invalid, the previous users are kept.
+func (p *PasswordFile) Reload() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hashes := make(map[string]string)
+	dummy := ""
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 || i == len(line)-1 {
+			msg := fmt.Sprintf("%v:%d: expected <user>:<hash>", p.path, lineNum)
+			return errors.New(msg)
+		}
+		hashes[line[:i]] = line[i+1:]
+		if dummy == "" {
+			dummy = line[i+1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hashes = hashes
+	p.dummy = dummy
+	return nil
+}
+
+// CheckPassword refuses clients that don't send the User Name and Password of a user in the file.
+func (p *PasswordFile) CheckPassword(clientId, userName string, password []byte) (*Identity, error) {
+	if userName == "" || password == nil {
+		return nil, mqtt.NewReasonError(mqtt.ReasonNotAuthorized, "a user name and password are required")
+	}
+	p.mu.RLock()
+	hash, ok := p.hashes[userName]
+	dummy := p.dummy
+	p.mu.RUnlock()
+	if !ok {
+		// the response time mustn't tell which users exist.
+		if dummy != "" {
+			VerifyPassword(dummy, password)
+		}
+		return nil, mqtt.NewReasonError(mqtt.ReasonBadUserNameOrPassword, "bad user name or password")
+	}
+	match, err := VerifyPassword(hash, password)
+	if err != nil {
+		// the client is only told what it would be told for a wrong password.
+		logging.Errorf("Invalid password hash for user %v: %v\n", userName, err.Error())
+		return nil, mqtt.NewReasonError(mqtt.ReasonBadUserNameOrPassword, "bad user name or password")
+	} else if !match {
+		return nil, mqtt.NewReasonError(mqtt.ReasonBadUserNameOrPassword, "bad user name or password")
+	}
+	return nil, nil
+}
+
+// Set adds the user, or replaces its password.
+func (p *PasswordFile) Set(user, password, algorithm string) error {
+	if user == "" || strings.Contains(user, ":") {
+		msg := fmt.Sprintf("invalid user name `%v`, it must not be empty or contain `:`", user)
+		return errors.New(msg)
+	}
+	hash, err := HashPassword(password, algorithm)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hashes[user] = hash
+	if p.dummy == "" {
+		p.dummy = hash
+	}
+	return nil
+}
+
+// Remove removes the user. Returns false if there was no such user.
+func (p *PasswordFile) Remove(user string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.hashes[user]; !ok {
+		return false
+	}
+	delete(p.hashes, user)
+	return true
+}
+
+// Write saves the users back to the file, sorted by user name. Comments are not kept.
+func (p *PasswordFile) Write() error {
+	p.mu.RLock()
+	users := make([]string, 0, len(p.hashes))
+	for user := range p.hashes {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	var b strings.Builder
+	for _, user := range users {
+		b.WriteString(user + ":" + p.hashes[user] + "\n")
+	}
+	p.mu.RUnlock()
+	return ioutil.WriteFile(p.path, []byte(b.String()), 0600)
+}
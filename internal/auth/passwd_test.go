@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+)
+
+func checkHashPassword(t *testing.T, algorithm string) {
+	hash, err := HashPassword("wonderland", algorithm)
+	if err != nil {
+		t.Fatalf("HashPassword failed for %v: %v", algorithm, err.Error())
+	}
+	if ok, err := VerifyPassword(hash, []byte("wonderland")); err != nil || !ok {
+		t.Fatalf("%v hash %v should match its password, err: %v", algorithm, hash, err)
+	}
+	if ok, err := VerifyPassword(hash, []byte("looking-glass")); err != nil || ok {
+		t.Fatalf("%v hash %v should not match another password, err: %v", algorithm, hash, err)
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	checkHashPassword(t, Bcrypt)
+	checkHashPassword(t, Argon2id)
+	if _, err := HashPassword("wonderland", "md5"); err == nil {
+		t.Fatalf("HashPassword should have failed for md5")
+	}
+	if _, err := VerifyPassword("$argon2id$v=19$nonsense", []byte("wonderland")); err == nil {
+		t.Fatalf("VerifyPassword should have failed for a malformed hash")
+	}
+	// parameters argon2 can't use fail instead of panicking.
+	for _, params := range []string{"m=65536,t=0,p=4", "m=65536,t=3,p=0", "m=4294967295,t=3,p=4", "m=65536,t=3,p=300"} {
+		hash := "$argon2id$v=19$" + params + "$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+		if _, err := VerifyPassword(hash, []byte("wonderland")); err == nil {
+			t.Fatalf("VerifyPassword should have failed for %v", params)
+		}
+	}
+	if _, err := VerifyPassword("$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$", []byte("wonderland")); err == nil {
+		t.Fatalf("VerifyPassword should have failed for an empty key")
+	}
+}
+
+func checkCheckPassword(t *testing.T, p *PasswordFile, user, password string, expectedCode byte) {
+	_, err := p.CheckPassword("client", user, []byte(password))
+	if expectedCode == mqtt.ReasonSuccess && err != nil {
+		t.Fatalf("%v:%v should be accepted, got: %v", user, password, err.Error())
+	} else if expectedCode != mqtt.ReasonSuccess && mqtt.GetReasonCode(err) != expectedCode {
+		t.Fatalf("%v:%v got %v, expected reason code %#x", user, password, err, expectedCode)
+	}
+}
+
+func TestPasswordFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwd")
+	p := NewPasswordFile(path)
+	if err := p.Set("alice", "wonderland", Bcrypt); err != nil {
+		t.Fatal(err)
+	} else if err := p.Set("carol", "hunter2", Argon2id); err != nil {
+		t.Fatal(err)
+	} else if err := p.Set("mallory:admin", "x", Bcrypt); err == nil {
+		t.Fatalf("Set should have failed for a user name containing `:`")
+	}
+	if err := p.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ReadPasswordFile(path)
+	if err != nil {
+		t.Fatalf("ReadPasswordFile failed: %v", err.Error())
+	}
+	checkCheckPassword(t, p, "alice", "wonderland", mqtt.ReasonSuccess)
+	checkCheckPassword(t, p, "carol", "hunter2", mqtt.ReasonSuccess)
+	checkCheckPassword(t, p, "alice", "hunter2", mqtt.ReasonBadUserNameOrPassword)
+	checkCheckPassword(t, p, "bob", "wonderland", mqtt.ReasonBadUserNameOrPassword)
+	if _, err := p.CheckPassword("client", "", nil); mqtt.GetReasonCode(err) != mqtt.ReasonNotAuthorized {
+		t.Fatalf("a client without credentials should be Not authorized, got: %v", err)
+	}
+
+	// removing alice only takes effect once the file is reloaded.
+	other := NewPasswordFile(path)
+	other.Set("carol", "hunter2", Argon2id)
+	if err := other.Write(); err != nil {
+		t.Fatal(err)
+	}
+	checkCheckPassword(t, p, "alice", "wonderland", mqtt.ReasonSuccess)
+	if err := p.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err.Error())
+	}
+	checkCheckPassword(t, p, "alice", "wonderland", mqtt.ReasonBadUserNameOrPassword)
+
+	// a hand edited hash with bad parameters refuses the user.
+	if err := ioutil.WriteFile(path, []byte("dave:$argon2id$v=19$m=65536,t=0,p=0$c2FsdA$a2V5\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err.Error())
+	}
+	checkCheckPassword(t, p, "dave", "x", mqtt.ReasonBadUserNameOrPassword)
+	checkCheckPassword(t, p, "erin", "x", mqtt.ReasonBadUserNameOrPassword)
+	// the reason doesn't tell that dave exists.
+	_, daveErr := p.CheckPassword("client", "dave", []byte("x"))
+	_, erinErr := p.CheckPassword("client", "erin", []byte("x"))
+	if daveErr.Error() != erinErr.Error() {
+		t.Fatalf("got reasons %q and %q, expected the same for both", daveErr.Error(), erinErr.Error())
+	}
+
+	// an invalid file keeps the previous users.
+	if err := ioutil.WriteFile(path, []byte("# users\nnocolon\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Reload(); err == nil {
+		t.Fatalf("Reload should have failed for a line without `:`")
+	}
+	checkCheckPassword(t, p, "dave", "x", mqtt.ReasonBadUserNameOrPassword)
+}
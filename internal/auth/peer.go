@@ -0,0 +1,16 @@
+package auth
+
+import (
+	"fmt"
+	"os/user"
+)
+
+// LocalUserName returns the name of the local user with the ID, for clients identified by Unix peer credentials.
+// A user without a name is named after the ID, like "uid:1000".
+func LocalUserName(uid uint32) string {
+	u, err := user.LookupId(fmt.Sprint(uid))
+	if err != nil {
+		return fmt.Sprintf("uid:%d", uid)
+	}
+	return u.Username
+}
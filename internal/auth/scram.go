@@ -0,0 +1,362 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+)
+
+// SCRAM Authentication Methods, as defined by RFC 5802 and RFC 7677.
+const (
+	ScramSha1   = "SCRAM-SHA-1"
+	ScramSha256 = "SCRAM-SHA-256"
+
+	ScramIterations = 4096 // the minimum recommended by RFC 7677.
+	scramNonceLen   = 24
+)
+
+// scramHash returns the hash function used by the SCRAM method, or nil if it isn't one.
+func scramHash(method string) func() hash.Hash {
+	switch method {
+	case ScramSha1:
+		return sha1.New
+	case ScramSha256:
+		return sha256.New
+	default:
+		return nil
+	}
+}
+
+// ScramCredential is what the server stores for a SCRAM user. The password itself can't be recovered from it.
+type ScramCredential struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramCredential derives the credential for the password, with a random salt.
+func NewScramCredential(method, password string, iterations int) (*ScramCredential, error) {
+	h := scramHash(method)
+	if h == nil {
+		msg := fmt.Sprintf("unsupported SCRAM method %v", method)
+		return nil, errors.New(msg)
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	saltedPassword := scramHi(h, []byte(password), salt, iterations)
+	clientKey := scramHmac(h, saltedPassword, "Client Key")
+	storedKey := h()
+	storedKey.Write(clientKey)
+	return &ScramCredential{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey.Sum(nil),
+		ServerKey:  scramHmac(h, saltedPassword, "Server Key"),
+	}, nil
+}
+
+// scramHi is the Hi function of RFC 5802, which is PBKDF2 with a single block.
+func scramHi(h func() hash.Hash, password, salt []byte, iterations int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func scramHmac(h func() hash.Hash, key []byte, s string) []byte {
+	mac := hmac.New(h, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// ScramStore holds the SCRAM credentials of every user, for each method.
+// The file it is read from has one credential per line:
+//
+//	<user> <method> <iterations> <base64 salt> <base64 StoredKey> <base64 ServerKey>
+//
+// Blank lines and lines starting with # are ignored.
+type ScramStore struct {
+	mu    sync.RWMutex
+	creds map[string]map[string]*ScramCredential // method -> user -> credential.
+}
+
+// NewScramStore returns an empty store.
+func NewScramStore() *ScramStore {
+	return &ScramStore{creds: make(map[string]map[string]*ScramCredential)}
+}
+
+// ReadScramStore reads the store from the file at path.
+func ReadScramStore(path string) (*ScramStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	store := NewScramStore()
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, method, cred, err := parseScramLine(line)
+		if err != nil {
+			msg := fmt.Sprintf("%v:%d: %v", path, lineNum, err.Error())
+			return nil, errors.New(msg)
+		}
+		store.Set(method, user, cred)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func parseScramLine(line string) (string, string, *ScramCredential, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 6 {
+		return "", "", nil, errors.New("expected: <user> <method> <iterations> <salt> <StoredKey> <ServerKey>")
+	} else if scramHash(fields[1]) == nil {
+		msg := fmt.Sprintf("unsupported SCRAM method %v", fields[1])
+		return "", "", nil, errors.New(msg)
+	}
+	iterations, err := strconv.Atoi(fields[2])
+	if err != nil || iterations < 1 {
+		msg := fmt.Sprintf("invalid iteration count %v", fields[2])
+		return "", "", nil, errors.New(msg)
+	}
+	cred := &ScramCredential{Iterations: iterations}
+	for i, dst := range []*[]byte{&cred.Salt, &cred.StoredKey, &cred.ServerKey} {
+		*dst, err = base64.StdEncoding.DecodeString(fields[3+i])
+		if err != nil {
+			return "", "", nil, err
+		}
+	}
+	return fields[0], fields[1], cred, nil
+}
+
+// FormatScramLine returns the line of a store file holding the credential.
+func FormatScramLine(user, method string, cred *ScramCredential) string {
+	enc := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("%v %v %d %v %v %v", user, method, cred.Iterations, enc(cred.Salt), enc(cred.StoredKey), enc(cred.ServerKey))
+}
+
+// Get returns the user's credential for the method, or nil if there is none.
+func (s *ScramStore) Get(method, user string) *ScramCredential {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.creds[method][user]
+}
+
+// Set adds or replaces the user's credential for the method.
+func (s *ScramStore) Set(method, user string, cred *ScramCredential) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.creds[method] == nil {
+		s.creds[method] = make(map[string]*ScramCredential)
+	}
+	s.creds[method][user] = cred
+}
+
+// Scram authenticates clients with SCRAM, so the password never crosses the wire.
+// Channel binding is not supported.
+type Scram struct {
+	method string
+	hash   func() hash.Hash
+	store  *ScramStore
+}
+
+// NewScram returns an authenticator for the SCRAM method, either ScramSha1 or ScramSha256.
+func NewScram(method string, store *ScramStore) (*Scram, error) {
+	h := scramHash(method)
+	if h == nil {
+		msg := fmt.Sprintf("unsupported SCRAM method %v", method)
+		return nil, errors.New(msg)
+	}
+	return &Scram{method, h, store}, nil
+}
+
+func (s *Scram) Method() string {
+	return s.method
+}
+
+func (s *Scram) Start(clientId string) Exchange {
+	return &scramExchange{scram: s}
+}
+
+// scramExchange goes through the two round trips of RFC 5802:
+// client-first-message => server-first-message, then client-final-message => server-final-message.
+type scramExchange struct {
+	scram *Scram
+	step  int
+
+	user            string
+	cred            *ScramCredential
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+}
+
+var errScramFailed = mqtt.NewReasonError(mqtt.ReasonNotAuthorized, "SCRAM authentication failed")
+
+func (e *scramExchange) Next(data []byte) ([]byte, bool, error) {
+	e.step++
+	switch e.step {
+	case 1:
+		reply, err := e.clientFirst(string(data))
+		return reply, false, err
+	case 2:
+		reply, err := e.clientFinal(string(data))
+		return reply, err == nil, err
+	default:
+		return nil, false, mqtt.NewReasonError(mqtt.ReasonProtocolError, "SCRAM exchange is already complete")
+	}
+}
+
+// Identity returns the user that authenticated.
+func (e *scramExchange) Identity() *Identity {
+	return &Identity{UserName: e.user}
+}
+
+func (e *scramExchange) clientFirst(msg string) ([]byte, error) {
+	// gs2-header is: gs2-cbind-flag "," [authzid] ","
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, mqtt.NewReasonError(mqtt.ReasonMalformedPacket, "malformed SCRAM client-first-message")
+	} else if parts[0] != "n" && parts[0] != "y" {
+		return nil, mqtt.NewReasonError(mqtt.ReasonBadAuthenticationMethod, "SCRAM channel binding is not supported")
+	} else if parts[1] != "" {
+		return nil, mqtt.NewReasonError(mqtt.ReasonNotAuthorized, "SCRAM authorization identity is not supported")
+	}
+	e.gs2Header = parts[0] + ",,"
+	e.clientFirstBare = parts[2]
+
+	attrs, err := scramAttrs(e.clientFirstBare)
+	if err != nil {
+		return nil, err
+	}
+	user, clientNonce := attrs["n"], attrs["r"]
+	if user == "" || clientNonce == "" {
+		return nil, mqtt.NewReasonError(mqtt.ReasonMalformedPacket, "SCRAM client-first-message needs a user name and nonce")
+	}
+	e.user = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(user)
+
+	e.cred = e.scram.store.Get(e.scram.method, e.user)
+	if e.cred == nil {
+		// carry on with a credential nobody can match, so unknown users can't be told apart from wrong passwords.
+		salt, err := scramDummySalt(e.scram.hash, e.user)
+		if err != nil {
+			return nil, err
+		}
+		e.cred = &ScramCredential{Salt: salt, Iterations: ScramIterations}
+	}
+	serverNonce := make([]byte, scramNonceLen)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, err
+	}
+	e.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(serverNonce)
+	salt := base64.StdEncoding.EncodeToString(e.cred.Salt)
+	e.serverFirst = fmt.Sprintf("r=%v,s=%v,i=%d", e.nonce, salt, e.cred.Iterations)
+	return []byte(e.serverFirst), nil
+}
+
+func (e *scramExchange) clientFinal(msg string) ([]byte, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, mqtt.NewReasonError(mqtt.ReasonMalformedPacket, "SCRAM client-final-message has no proof")
+	}
+	withoutProof := msg[:i]
+	attrs, err := scramAttrs(withoutProof)
+	if err != nil {
+		return nil, err
+	}
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(e.gs2Header)) || attrs["r"] != e.nonce {
+		return nil, errScramFailed
+	}
+	proof, err := base64.StdEncoding.DecodeString(msg[i+len(",p="):])
+	if err != nil {
+		return nil, mqtt.NewReasonError(mqtt.ReasonMalformedPacket, "SCRAM proof is not valid base64")
+	}
+
+	h := e.scram.hash
+	authMessage := e.clientFirstBare + "," + e.serverFirst + "," + withoutProof
+	clientSignature := scramHmac(h, e.cred.StoredKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return nil, errScramFailed
+	}
+	clientKey := make([]byte, len(proof))
+	for j := range proof {
+		clientKey[j] = proof[j] ^ clientSignature[j]
+	}
+	storedKey := h()
+	storedKey.Write(clientKey)
+	if subtle.ConstantTimeCompare(storedKey.Sum(nil), e.cred.StoredKey) != 1 {
+		return nil, errScramFailed
+	}
+	serverSignature := scramHmac(h, e.cred.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+var (
+	scramSecretOnce sync.Once
+	scramSecret     []byte // for the salts of unknown users. nil => it couldn't be generated.
+)
+
+// scramDummySalt returns the salt sent for a user without a credential. Like a real user's, it is the same on every attempt
+// for as long as the broker runs, so two attempts don't tell whether the user exists.
+func scramDummySalt(h func() hash.Hash, user string) ([]byte, error) {
+	scramSecretOnce.Do(func() {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err == nil {
+			scramSecret = secret
+		}
+	})
+	if scramSecret == nil {
+		return nil, errors.New("no secret for the salts of unknown SCRAM users")
+	}
+	return scramHmac(h, scramSecret, user)[:16], nil
+}
+
+// scramAttrs parses comma separated attributes like "n=user,r=nonce". Later duplicates are ignored.
+func scramAttrs(s string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(s, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			msg := fmt.Sprintf("malformed SCRAM attribute `%v`", attr)
+			return nil, mqtt.NewReasonError(mqtt.ReasonMalformedPacket, msg)
+		}
+		if _, ok := attrs[attr[:1]]; !ok {
+			attrs[attr[:1]] = attr[2:]
+		}
+	}
+	return attrs, nil
+}
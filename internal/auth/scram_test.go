@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+)
+
+func TestScramHi(t *testing.T) {
+	// PBKDF2-HMAC-SHA1 test vectors from RFC 6070.
+	got := hex.EncodeToString(scramHi(sha1.New, []byte("password"), []byte("salt"), 1))
+	if expected := "0c60c80f961f0e71f3a9b524af6012062fe037a6"; got != expected {
+		t.Fatalf("Got:\n%v\nExpected:\n%v", got, expected)
+	}
+	got = hex.EncodeToString(scramHi(sha1.New, []byte("password"), []byte("salt"), 4096))
+	if expected := "4b007901b765489abead49d926f721d065a429c1"; got != expected {
+		t.Fatalf("Got:\n%v\nExpected:\n%v", got, expected)
+	}
+}
+
+// scramClient runs the client side of a SCRAM exchange and returns the error the server finished with.
+func scramClient(t *testing.T, s *Scram, user, password string) (Exchange, error) {
+	h := scramHash(s.Method())
+	ex := s.Start("client")
+	clientFirstBare := "n=" + user + ",r=fyko+d2lbbFgONRv9qkxdawL"
+	serverFirst, done, err := ex.Next([]byte("n,," + clientFirstBare))
+	if err != nil {
+		return ex, err
+	} else if done {
+		t.Fatalf("SCRAM exchange should not be done after the client-first-message")
+	}
+	attrs, err := scramAttrs(string(serverFirst))
+	if err != nil {
+		t.Fatalf("invalid server-first-message: %v", err.Error())
+	}
+	salt, _ := base64.StdEncoding.DecodeString(attrs["s"])
+	if !strings.HasPrefix(attrs["r"], "fyko+d2lbbFgONRv9qkxdawL") || attrs["i"] != "4096" {
+		t.Fatalf("invalid server-first-message: %v", string(serverFirst))
+	}
+
+	withoutProof := "c=biws,r=" + attrs["r"]
+	authMessage := clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+	saltedPassword := scramHi(h, []byte(password), salt, 4096)
+	clientKey := scramHmac(h, saltedPassword, "Client Key")
+	storedKey := h()
+	storedKey.Write(clientKey)
+	clientSignature := scramHmac(h, storedKey.Sum(nil), authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= clientSignature[i]
+	}
+	serverFinal, done, err := ex.Next([]byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientKey)))
+	if err != nil {
+		return ex, err
+	} else if !done {
+		t.Fatalf("SCRAM exchange should be done after the client-final-message")
+	}
+	serverSignature := scramHmac(h, scramHmac(h, saltedPassword, "Server Key"), authMessage)
+	if string(serverFinal) != "v="+base64.StdEncoding.EncodeToString(serverSignature) {
+		t.Fatalf("invalid server-final-message: %v", string(serverFinal))
+	}
+	return ex, nil
+}
+
+func checkScram(t *testing.T, method, user, password string, shouldPass bool) {
+	store := NewScramStore()
+	cred, err := NewScramCredential(method, "pencil", ScramIterations)
+	if err != nil {
+		t.Fatalf("NewScramCredential failed: %v", err.Error())
+	}
+	store.Set(method, "user", cred)
+	s, err := NewScram(method, store)
+	if err != nil {
+		t.Fatalf("NewScram failed: %v", err.Error())
+	}
+	ex, err := scramClient(t, s, user, password)
+	if err != nil && shouldPass {
+		t.Fatalf("SCRAM exchange failed: %v", err.Error())
+	} else if err == nil && !shouldPass {
+		t.Fatalf("SCRAM exchange should have failed for %v:%v", user, password)
+	} else if err != nil && mqtt.GetReasonCode(err) != mqtt.ReasonNotAuthorized {
+		t.Fatalf("SCRAM exchange failed with reason code %#x, expected Not authorized", mqtt.GetReasonCode(err))
+	} else if shouldPass && ex.Identity().UserName != user {
+		t.Fatalf("authenticated as %v, expected %v", ex.Identity().UserName, user)
+	}
+}
+func TestScram(t *testing.T) {
+	checkScram(t, ScramSha256, "user", "pencil", true)
+	checkScram(t, ScramSha1, "user", "pencil", true)
+	checkScram(t, ScramSha256, "user", "pen", false)
+	checkScram(t, ScramSha256, "nobody", "pencil", false)
+	if _, err := NewScram("SCRAM-MD5", NewScramStore()); err == nil {
+		t.Fatalf("NewScram should have failed for SCRAM-MD5")
+	}
+}
+
+// scramSalt returns the salt in the server-first-message sent to the user.
+func scramSalt(t *testing.T, s *Scram, user string) string {
+	serverFirst, _, err := s.Start("client").Next([]byte("n,,n=" + user + ",r=fyko+d2lbbFgONRv9qkxdawL"))
+	if err != nil {
+		t.Fatalf("client-first-message failed: %v", err.Error())
+	}
+	attrs, err := scramAttrs(string(serverFirst))
+	if err != nil {
+		t.Fatalf("invalid server-first-message: %v", err.Error())
+	}
+	return attrs["s"]
+}
+
+func TestScramUnknownUser(t *testing.T) {
+	s, err := NewScram(ScramSha256, NewScramStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// like a real user's, the salt doesn't change between attempts.
+	if a, b := scramSalt(t, s, "nobody"), scramSalt(t, s, "nobody"); a != b {
+		t.Fatalf("got salts %v and %v for the same unknown user", a, b)
+	} else if a == scramSalt(t, s, "somebody") {
+		t.Fatalf("got the same salt %v for two unknown users", a)
+	}
+}
+
+func TestReadScramStore(t *testing.T) {
+	cred, err := NewScramCredential(ScramSha256, "pencil", ScramIterations)
+	if err != nil {
+		t.Fatalf("NewScramCredential failed: %v", err.Error())
+	}
+	path := filepath.Join(t.TempDir(), "scram.conf")
+	content := "# users\n\n" + FormatScramLine("user", ScramSha256, cred) + "\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := ReadScramStore(path)
+	if err != nil {
+		t.Fatalf("ReadScramStore failed: %v", err.Error())
+	}
+	got := store.Get(ScramSha256, "user")
+	if got == nil || FormatScramLine("user", ScramSha256, got) != FormatScramLine("user", ScramSha256, cred) {
+		t.Fatalf("Got:\n%v\nExpected:\n%v", got, cred)
+	} else if store.Get(ScramSha1, "user") != nil {
+		t.Fatalf("credential should only be stored for %v", ScramSha256)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("user SCRAM-MD5 4096 c2FsdA== a2V5 a2V5\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadScramStore(path); err == nil {
+		t.Fatalf("ReadScramStore should have failed for SCRAM-MD5")
+	}
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/M4THYOU/some_mqtt_broker/internal/logging"
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+)
+
+// Webhook actions, as sent to the endpoint.
+const (
+	WebhookConnect   = "connect"
+	WebhookPublish   = "publish"
+	WebhookSubscribe = "subscribe"
+
+	webhookMaxCacheEntries = 10000 // expired decisions are only dropped once the cache is this big.
+)
+
+// WebhookOptions configure a Webhook.
+type WebhookOptions struct {
+	URL      string
+	Timeout  time.Duration // for the whole request. 0 => no timeout.
+	CacheTTL time.Duration // how long decisions are remembered. 0 => the endpoint is asked every time.
+	// FailOpen allows what can't be decided because the endpoint is unreachable or answers with an error.
+	// false => it is refused.
+	FailOpen bool
+}
+
+// webhookRequest is the JSON body POSTed to the endpoint.
+type webhookRequest struct {
+	Action   string `json:"action"`
+	ClientId string `json:"client_id"`
+	UserName string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"` // connect only.
+	Topic    string `json:"topic,omitempty"`    // publish and subscribe only.
+}
+
+// webhookCacheKey identifies a decision. The password is hashed, so it isn't kept in memory.
+type webhookCacheKey struct {
+	action, clientId, userName, topic string
+	password                          [sha256.Size]byte
+}
+
+type webhookDecision struct {
+	allow   bool
+	expires time.Time
+}
+
+// Webhook asks an HTTP endpoint whether clients may connect, publish and subscribe.
+// Each decision is a POST of a JSON object with action, client_id, username, password and topic,
+// which the endpoint answers with a 200 and {"allow": true} or {"allow": false}.
+type Webhook struct {
+	opts   WebhookOptions
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[webhookCacheKey]webhookDecision
+}
+
+// NewWebhook returns a webhook that asks the endpoint at opts.URL.
+func NewWebhook(opts WebhookOptions) *Webhook {
+	return &Webhook{
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+		cache:  make(map[webhookCacheKey]webhookDecision),
+	}
+}
+
+// decide returns the endpoint's decision, from the cache if possible.
+// Returns an error if there is none, because the endpoint couldn't be asked.
+func (w *Webhook) decide(req *webhookRequest) (bool, error) {
+	key := webhookCacheKey{req.Action, req.ClientId, req.UserName, req.Topic, sha256.Sum256([]byte(req.Password))}
+	now := time.Now()
+	w.mu.Lock()
+	d, ok := w.cache[key]
+	w.mu.Unlock()
+	if ok && now.Before(d.expires) {
+		return d.allow, nil
+	}
+
+	allow, err := w.ask(req)
+	if err != nil {
+		return false, err
+	}
+	if w.opts.CacheTTL > 0 {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if len(w.cache) >= webhookMaxCacheEntries {
+			for k, d := range w.cache {
+				if !now.Before(d.expires) {
+					delete(w.cache, k)
+				}
+			}
+		}
+		if len(w.cache) < webhookMaxCacheEntries {
+			w.cache[key] = webhookDecision{allow, now.Add(w.opts.CacheTTL)}
+		}
+	}
+	return allow, nil
+}
+
+func (w *Webhook) ask(req *webhookRequest) (bool, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+	resp, err := w.client.Post(w.opts.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg := fmt.Sprintf("webhook answered %v", resp.Status)
+		return false, errors.New(msg)
+	}
+	var decision struct {
+		Allow *bool `json:"allow"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return false, err
+	} else if decision.Allow == nil {
+		return false, errors.New("webhook answer has no allow field")
+	}
+	return *decision.Allow, nil
+}
+
+// CheckPassword asks the endpoint whether the client may connect.
+func (w *Webhook) CheckPassword(clientId, userName string, password []byte) (*Identity, error) {
+	id, _, err := w.checkPassword(clientId, userName, password)
+	return id, err
+}
+
+// checkPassword is CheckPassword, where decided is false if the client was only accepted because the webhook fails open.
+func (w *Webhook) checkPassword(clientId, userName string, password []byte) (*Identity, bool, error) {
+	allow, err := w.decide(&webhookRequest{Action: WebhookConnect, ClientId: clientId, UserName: userName, Password: string(password)})
+	if err != nil {
+		// the error can name the endpoint, which clients mustn't see.
+		logging.Errorf("Webhook error authenticating %v: %v\n", clientId, err.Error())
+		if w.opts.FailOpen {
+			return nil, false, nil
+		}
+		return nil, true, mqtt.NewReasonError(mqtt.ReasonServerUnavailable, "authentication is unavailable")
+	} else if !allow {
+		return nil, true, mqtt.NewReasonError(mqtt.ReasonNotAuthorized, "not authorized")
+	}
+	return nil, true, nil
+}
+
+// Authorize asks the endpoint whether the client may publish or subscribe to the topic.
+func (w *Webhook) Authorize(clientId, userName string, access Access, topic string) bool {
+	action := WebhookSubscribe
+	if access == AccessPublish {
+		action = WebhookPublish
+	}
+	allow, err := w.decide(&webhookRequest{Action: action, ClientId: clientId, UserName: userName, Topic: topic})
+	if err != nil {
+		logging.Errorf("Webhook error authorizing %v to %v %v: %v\n", clientId, action, topic, err.Error())
+		return w.opts.FailOpen
+	}
+	return allow
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+)
+
+// startTestWebhook starts an endpoint that allows alice:wonderland to connect, and every topic under tenants/<username>/.
+// The returned counter is the number of requests it got.
+func startTestWebhook(t *testing.T) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		var req webhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		allow := false
+		switch req.Action {
+		case WebhookConnect:
+			allow = req.UserName == "alice" && req.Password == "wonderland"
+		case WebhookPublish, WebhookSubscribe:
+			allow = strings.HasPrefix(req.Topic, "tenants/"+req.UserName+"/")
+		}
+		json.NewEncoder(w).Encode(map[string]bool{"allow": allow})
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func checkWebhookConnect(t *testing.T, w *Webhook, userName, password string, expectedCode byte) {
+	_, err := w.CheckPassword("c1", userName, []byte(password))
+	if expectedCode == mqtt.ReasonSuccess && err != nil {
+		t.Fatalf("%v:%v should be accepted, got: %v", userName, password, err.Error())
+	} else if expectedCode != mqtt.ReasonSuccess && mqtt.GetReasonCode(err) != expectedCode {
+		t.Fatalf("%v:%v got %v, expected reason code %#x", userName, password, err, expectedCode)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	server, _ := startTestWebhook(t)
+	w := NewWebhook(WebhookOptions{URL: server.URL, Timeout: time.Second})
+	checkWebhookConnect(t, w, "alice", "wonderland", mqtt.ReasonSuccess)
+	checkWebhookConnect(t, w, "alice", "looking-glass", mqtt.ReasonNotAuthorized)
+	if !w.Authorize("c1", "alice", AccessPublish, "tenants/alice/temp") {
+		t.Fatalf("alice should be allowed to publish to tenants/alice/temp")
+	} else if w.Authorize("c1", "alice", AccessSubscribe, "tenants/bob/#") {
+		t.Fatalf("alice should not be allowed to subscribe to tenants/bob/#")
+	}
+}
+
+func TestWebhookCache(t *testing.T) {
+	server, requests := startTestWebhook(t)
+	w := NewWebhook(WebhookOptions{URL: server.URL, Timeout: time.Second, CacheTTL: time.Millisecond * 100})
+	for i := 0; i < 3; i++ {
+		w.Authorize("c1", "alice", AccessPublish, "tenants/alice/temp")
+		checkWebhookConnect(t, w, "alice", "wonderland", mqtt.ReasonSuccess)
+	}
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Fatalf("got %d requests, expected 2 with the rest cached", n)
+	}
+	// a different password isn't the same decision.
+	checkWebhookConnect(t, w, "alice", "looking-glass", mqtt.ReasonNotAuthorized)
+	if n := atomic.LoadInt32(requests); n != 3 {
+		t.Fatalf("got %d requests, expected 3", n)
+	}
+	time.Sleep(time.Millisecond * 150)
+	w.Authorize("c1", "alice", AccessPublish, "tenants/alice/temp")
+	if n := atomic.LoadInt32(requests); n != 4 {
+		t.Fatalf("got %d requests, expected 4 once the decision expired", n)
+	}
+}
+
+func TestWebhookUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	closed := NewWebhook(WebhookOptions{URL: server.URL, Timeout: time.Second})
+	checkWebhookConnect(t, closed, "alice", "wonderland", mqtt.ReasonServerUnavailable)
+	if closed.Authorize("c1", "alice", AccessPublish, "tenants/alice/temp") {
+		t.Fatalf("a fail-closed webhook should deny what it can't decide")
+	}
+	open := NewWebhook(WebhookOptions{URL: server.URL, Timeout: time.Second, FailOpen: true})
+	checkWebhookConnect(t, open, "alice", "wonderland", mqtt.ReasonSuccess)
+	if !open.Authorize("c1", "alice", AccessPublish, "tenants/alice/temp") {
+		t.Fatalf("a fail-open webhook should allow what it can't decide")
+	}
+	// failing open doesn't override another checker that refused the client.
+	if _, err := (PasswordCheckers{open}).CheckPassword("c1", "alice", []byte("wonderland")); err != nil {
+		t.Fatalf("a fail-open webhook alone should accept the client, got %v", err)
+	}
+	nobody := NewPasswordFile(filepath.Join(t.TempDir(), "passwd"))
+	_, err := (PasswordCheckers{nobody, open}).CheckPassword("c1", "alice", []byte("wonderland"))
+	if mqtt.GetReasonCode(err) != mqtt.ReasonBadUserNameOrPassword {
+		t.Fatalf("the password file's refusal should stand, got %v", err)
+	}
+
+	// nothing listening at all, and the dial error naming the endpoint isn't sent to clients.
+	server.Close()
+	checkWebhookConnect(t, closed, "alice", "wonderland", mqtt.ReasonServerUnavailable)
+	if _, err := closed.CheckPassword("c1", "alice", []byte("wonderland")); strings.Contains(err.Error(), server.URL) {
+		t.Fatalf("the reason should not name the endpoint, got %v", err.Error())
+	}
+}
@@ -0,0 +1,528 @@
+package broker
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/M4THYOU/some_mqtt_broker/internal/auth"
+	"github.com/M4THYOU/some_mqtt_broker/internal/logging"
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+)
+
+// Subscriber is a connected client that the broker can deliver messages to.
+type Subscriber interface {
+	// NextPacketId reserves a packet identifier for a QoS > 0 message that will then be passed to Deliver.
+	NextPacketId() (uint16, error)
+	// Deliver sends the message to the client. msg is a copy made for this client only.
+	Deliver(msg *mqtt.Message) error
+	// SendDisconnect sends a DISCONNECT packet to the client and closes its connection.
+	// serverReference is only included if it's not empty.
+	SendDisconnect(reasonCode byte, serverReference string) error
+	// Inflight returns how many QoS 1 and 2 messages, sent or received, are waiting for the rest of their handshake.
+	Inflight() int
+	// Session returns what must be kept of the client's session if the broker restarts, without its subscriptions,
+	// or nil if the session ends with the connection.
+	Session() *Session
+}
+
+type Subscription struct {
+	ClientId  string
+	Filter    string // topic filter, without the $share/{ShareName}/ prefix.
+	ShareName string // empty if this is not a shared subscription.
+	Options   mqtt.SubscriptionOptions
+	Id        uint32 // Subscription Identifier. 0 => not set.
+}
+
+// key returns the topic filter exactly as the client subscribed to it.
+func (sub *Subscription) key() string {
+	if sub.ShareName == "" {
+		return sub.Filter
+	}
+	return mqtt.SharePrefix + "/" + sub.ShareName + "/" + sub.Filter
+}
+
+// delivery is a message ready to be sent to a single subscriber, once the broker's lock is released.
+type delivery struct {
+	to       Subscriber
+	clientId string
+	msg      *mqtt.Message
+	group    *SharedGroup // tracking msg until it is acknowledged. nil => not sent through a shared subscription.
+}
+
+// Options are the broker-wide settings.
+type Options struct {
+	SharedSubStrategy Strategy // how messages are distributed between the members of a shared subscription.
+	// ResponseInfo is the Response Information sent to clients that request it, usually the prefix of their response topics.
+	// %c is replaced by the client ID. Empty => none is sent.
+	ResponseInfo string
+	// GrantResponseTopics allows every client to subscribe and publish under its own Response Information,
+	// regardless of any access control rules.
+	GrantResponseTopics   bool
+	RejectNonCharacters   bool                 // UTF-8 strings containing Unicode non-characters are malformed.
+	ValidatePayloadFormat bool                 // payloads with a Payload Format Indicator of 1 must be valid UTF-8.
+	Authenticators        []auth.Authenticator // the enhanced authentication methods clients may use.
+	// PasswordChecker checks the User Name and Password of clients that don't use enhanced authentication.
+	// nil => every client is accepted.
+	PasswordChecker auth.PasswordChecker
+	Authorizer      auth.Authorizer // decides which topics clients may publish and subscribe to. nil => all of them.
+	// CertIdentity takes the identity of clients with a verified TLS certificate from it, instead of asking for a password.
+	// nil => certificates don't identify clients.
+	CertIdentity  *auth.CertIdentity
+	MaxPacketSize uint32 // the biggest packet clients may send, in bytes. 0 => no limit.
+	// ConnectTimeout is how long new connections have to send CONNECT and complete any enhanced authentication.
+	// 0 => no limit.
+	ConnectTimeout time.Duration
+}
+
+// Broker keeps track of the connected clients and their subscriptions, and routes published messages between them.
+type Broker struct {
+	mu       sync.Mutex
+	clients  map[string]Subscriber
+	subs     map[string]map[string]*Subscription // clientId -> topic filter -> subscription.
+	shared   map[string]*SharedGroup             // $share/{ShareName}/{filter} -> group.
+	stored   map[string]*Session                 // clientId -> session from a previous run, until the client resumes it.
+	redirect *Redirect                           // nil => new connections are accepted.
+	closing  bool                                // Shutdown was called, so new connections are refused.
+
+	optsMu         sync.RWMutex // guards opts and authenticators, which SetOptions replaces.
+	opts           Options
+	authenticators map[string]auth.Authenticator // Authentication Method -> authenticator.
+}
+
+// New returns an empty broker with the given settings.
+func New(opts Options) *Broker {
+	b := &Broker{
+		clients: make(map[string]Subscriber),
+		subs:    make(map[string]map[string]*Subscription),
+		shared:  make(map[string]*SharedGroup),
+		stored:  make(map[string]*Session),
+	}
+	b.SetOptions(opts)
+	return b
+}
+
+// SetOptions replaces the settings, while clients stay connected. The new ones apply to the next packets,
+// except the shared subscription strategy, which only applies to groups created from then on.
+func (b *Broker) SetOptions(opts Options) {
+	authenticators := make(map[string]auth.Authenticator)
+	for _, a := range opts.Authenticators {
+		authenticators[a.Method()] = a
+	}
+	b.optsMu.Lock()
+	defer b.optsMu.Unlock()
+	b.opts = opts
+	b.authenticators = authenticators
+}
+
+// options returns the current settings.
+func (b *Broker) options() Options {
+	b.optsMu.RLock()
+	defer b.optsMu.RUnlock()
+	return b.opts
+}
+
+// Authenticator returns the authenticator for the given Authentication Method, or nil if it isn't supported.
+func (b *Broker) Authenticator(method string) auth.Authenticator {
+	b.optsMu.RLock()
+	defer b.optsMu.RUnlock()
+	return b.authenticators[method]
+}
+
+// ResponseInfo returns the Response Information for the client, or an empty string if none should be sent.
+// Client IDs with wildcards or level separators get none with %c, since their topics would overlap other clients'.
+func (b *Broker) ResponseInfo(clientId string) string {
+	info := b.options().ResponseInfo
+	if strings.Contains(info, "%c") && strings.ContainsAny(clientId, "+#/") {
+		return ""
+	}
+	return strings.ReplaceAll(info, "%c", clientId)
+}
+
+// GrantResponseTopics checks if clients are always allowed to use the topics under their own Response Information.
+func (b *Broker) GrantResponseTopics() bool {
+	opts := b.options()
+	return opts.GrantResponseTopics && opts.ResponseInfo != ""
+}
+
+// CheckPassword checks the User Name and Password from CONNECT. Returns a ReasonError if the client is refused.
+// The Identity may be nil.
+func (b *Broker) CheckPassword(clientId, userName string, password []byte) (*auth.Identity, error) {
+	checker := b.options().PasswordChecker
+	if checker == nil {
+		return nil, nil
+	}
+	return checker.CheckPassword(clientId, userName, password)
+}
+
+// Authorize checks if the client may publish to the topic name, or subscribe to the topic filter.
+func (b *Broker) Authorize(clientId, userName string, access auth.Access, topic string) bool {
+	authorizer := b.options().Authorizer
+	if authorizer == nil {
+		return true
+	}
+	return b.IsResponseTopic(clientId, access, topic) || authorizer.Authorize(clientId, userName, access, topic)
+}
+
+// IsResponseTopic checks if the topic is under the client's Response Information, and clients are granted those.
+// Client IDs with wildcards or level separators are granted nothing, since their topics would overlap other clients'.
+func (b *Broker) IsResponseTopic(clientId string, access auth.Access, topic string) bool {
+	info := b.ResponseInfo(clientId)
+	if !b.GrantResponseTopics() || info == "" || strings.ContainsAny(clientId, "+#/") {
+		return false
+	}
+	responseTopics := strings.TrimSuffix(info, "/") + "/#"
+	if access == auth.AccessPublish {
+		return mqtt.TopicMatches(responseTopics, topic)
+	}
+	return mqtt.FilterCovers(responseTopics, topic)
+}
+
+// MaxPacketSize returns the biggest packet clients may send, in bytes. 0 => no limit.
+func (b *Broker) MaxPacketSize() uint32 {
+	return b.options().MaxPacketSize
+}
+
+// ConnectTimeout returns how long new connections have to send CONNECT and complete any enhanced authentication.
+// 0 => no limit.
+func (b *Broker) ConnectTimeout() time.Duration {
+	return b.options().ConnectTimeout
+}
+
+// CertIdentity returns how clients are identified by their TLS certificate, or nil if they aren't.
+func (b *Broker) CertIdentity() *auth.CertIdentity {
+	return b.options().CertIdentity
+}
+
+// RejectNonCharacters checks if UTF-8 strings containing Unicode non-characters must be rejected.
+func (b *Broker) RejectNonCharacters() bool {
+	return b.options().RejectNonCharacters
+}
+
+// ValidatePayloadFormat checks if payloads that claim to be UTF-8 must be validated.
+func (b *Broker) ValidatePayloadFormat() bool {
+	return b.options().ValidatePayloadFormat
+}
+
+// Connect registers the client so messages can be routed to it.
+// If another connection already uses this client ID, it is replaced and returned,
+// and the caller must disconnect it with the reason code Session taken over. Returns nil otherwise.
+// Sessions don't outlive their connection, so the replaced one's subscriptions are removed, like in Disconnect.
+func (b *Broker) Connect(clientId string, s Subscriber) Subscriber {
+	b.mu.Lock()
+	replaced := b.clients[clientId]
+	b.clients[clientId] = s
+	if replaced == nil || replaced == s {
+		b.mu.Unlock()
+		return nil
+	}
+	deliveries := b.removeSession(clientId, true)
+	b.mu.Unlock()
+
+	// the caller may be holding its own connection's write lock, which another client's delivery could be waiting on.
+	go b.deliver(deliveries)
+	return replaced
+}
+
+// Connected checks if s is still the connection registered for the client ID, and wasn't taken over by another one.
+func (b *Broker) Connected(clientId string, s Subscriber) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.clients[clientId] == s
+}
+
+// Disconnect removes the client and all of its subscriptions.
+// Any unacknowledged QoS 1 and 2 messages it received through a shared subscription are sent to another member of that group.
+// Once Shutdown was called, a session that outlives its connection is kept for Sessions instead, with those messages.
+// Does nothing if the client ID has since been taken over by another connection.
+func (b *Broker) Disconnect(clientId string, s Subscriber) {
+	b.mu.Lock()
+	if b.clients[clientId] != s {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.clients, clientId)
+	kept := b.closing && b.keep(clientId, s)
+	deliveries := b.removeSession(clientId, !kept)
+	b.mu.Unlock()
+
+	b.deliver(deliveries)
+}
+
+// keep stores the client's session with its subscriptions, if it outlives the connection. Returns false if it doesn't.
+// Must be called with b.mu held.
+func (b *Broker) keep(clientId string, s Subscriber) bool {
+	session := s.Session()
+	if session == nil {
+		return false
+	}
+	keys := make([]string, 0, len(b.subs[clientId]))
+	for key := range b.subs[clientId] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		session.Subscriptions = append(session.Subscriptions, b.subs[clientId][key])
+	}
+	b.stored[clientId] = session
+	return true
+}
+
+// removeSession removes all of the client's subscriptions. With redeliver, it returns the unacknowledged QoS 1 and 2
+// messages it received through a shared subscription, ready to be sent to another member of that group.
+// Must be called with b.mu held.
+func (b *Broker) removeSession(clientId string, redeliver bool) []*delivery {
+	delete(b.subs, clientId)
+	deliveries := make([]*delivery, 0)
+	for key, g := range b.shared {
+		orphans := g.remove(clientId)
+		if !redeliver {
+			orphans = nil // they stay with the session that was kept.
+		}
+		for _, o := range orphans {
+			d := b.sharedDelivery(g, o.from, o.msg)
+			if d != nil {
+				deliveries = append(deliveries, d)
+			}
+		}
+		if g.empty() {
+			delete(b.shared, key)
+		}
+	}
+	return deliveries
+}
+
+// Subscribe adds the subscription, replacing any existing subscription of that client with the same topic filter.
+func (b *Broker) Subscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clientSubs, ok := b.subs[sub.ClientId]
+	if !ok {
+		clientSubs = make(map[string]*Subscription)
+		b.subs[sub.ClientId] = clientSubs
+	}
+	key := sub.key()
+	clientSubs[key] = sub
+	if sub.ShareName == "" {
+		return
+	}
+	g, ok := b.shared[key]
+	if !ok {
+		g = newSharedGroup(sub.ShareName, sub.Filter, b.options().SharedSubStrategy)
+		b.shared[key] = g
+	}
+	g.add(sub)
+}
+
+// Unsubscribe removes the client's subscription to the topic filter, exactly as it was subscribed to.
+// Returns false if no such subscription existed.
+func (b *Broker) Unsubscribe(clientId, filter string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clientSubs, ok := b.subs[clientId]
+	if !ok {
+		return false
+	}
+	sub, ok := clientSubs[filter]
+	if !ok {
+		return false
+	}
+	delete(clientSubs, filter)
+	if sub.ShareName != "" {
+		g := b.shared[filter]
+		g.leave(clientId)
+		if g.empty() {
+			delete(b.shared, filter)
+		}
+	}
+	return true
+}
+
+// Publish routes the message to every matching subscription. from is the client ID of the publisher.
+// Each shared subscription group that matches receives the message only once.
+// Returns the number of clients the message was sent to.
+func (b *Broker) Publish(from string, msg *mqtt.Message) int {
+	b.mu.Lock()
+	deliveries := make([]*delivery, 0)
+	for clientId, clientSubs := range b.subs {
+		var out *mqtt.Message
+		for _, sub := range clientSubs {
+			if sub.ShareName != "" || !mqtt.TopicMatches(sub.Filter, msg.Topic) {
+				continue
+			} else if sub.Options.NoLocal && clientId == from {
+				continue
+			}
+			// A client with overlapping subscriptions gets the message once, with the highest QoS and every identifier.
+			if out == nil {
+				out = msg.Copy()
+				out.Qos = 0
+				out.Retain = false
+				out.Dup = false // set independently of the incoming DUP flag.
+			}
+			if qos := minQos(msg.Qos, sub.Options.Qos); qos > out.Qos {
+				out.Qos = qos
+			}
+			if sub.Options.RetainAsPublished {
+				out.Retain = msg.Retain
+			}
+			if sub.Id != 0 {
+				out.SubscriptionIds = append(out.SubscriptionIds, sub.Id)
+			}
+		}
+		if out == nil {
+			continue
+		}
+		d := b.newDelivery(clientId, out)
+		if d != nil {
+			deliveries = append(deliveries, d)
+		}
+	}
+	for _, g := range b.shared {
+		if !mqtt.TopicMatches(g.Filter, msg.Topic) {
+			continue
+		}
+		d := b.sharedDelivery(g, from, msg)
+		if d != nil {
+			deliveries = append(deliveries, d)
+		}
+	}
+	b.mu.Unlock()
+
+	return b.deliver(deliveries)
+}
+
+// Ack tells the broker the client has received the QoS 1 or 2 message sent with the given packet identifier.
+func (b *Broker) Ack(clientId string, packetId uint16) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, g := range b.shared {
+		if g.ack(clientId, packetId) && g.empty() {
+			delete(b.shared, key)
+		}
+	}
+}
+
+// newDelivery reserves a packet identifier if needed and prepares msg to be sent to the client.
+// Must be called with b.mu held.
+func (b *Broker) newDelivery(clientId string, msg *mqtt.Message) *delivery {
+	s, ok := b.clients[clientId]
+	if !ok {
+		return nil
+	}
+	msg.PacketId = 0
+	if msg.Qos > 0 {
+		packetId, err := s.NextPacketId()
+		if err != nil {
+			logging.Errorf("Dropping message on %v for %v: %v\n", msg.Topic, clientId, err.Error())
+			return nil
+		}
+		msg.PacketId = packetId
+	}
+	return &delivery{to: s, clientId: clientId, msg: msg}
+}
+
+// sharedDelivery picks the member of the group that receives msg, and keeps track of it until it is acknowledged.
+// Must be called with b.mu held.
+func (b *Broker) sharedDelivery(g *SharedGroup, from string, msg *mqtt.Message) *delivery {
+	sub := g.pick(from)
+	if sub == nil {
+		return nil
+	}
+	out := msg.Copy()
+	out.Qos = minQos(msg.Qos, sub.Options.Qos)
+	out.Retain = false
+	out.Dup = false // set independently of the incoming DUP flag.
+	if sub.Id != 0 {
+		out.SubscriptionIds = []uint32{sub.Id}
+	}
+	d := b.newDelivery(sub.ClientId, out)
+	if d != nil && out.Qos > 0 {
+		g.track(sub.ClientId, out.PacketId, from, msg)
+		d.group = g
+	}
+	return d
+}
+
+// deliver sends every message. Must be called without b.mu held, since it writes to the network.
+// Returns the number of messages successfully sent.
+func (b *Broker) deliver(deliveries []*delivery) int {
+	n := 0
+	for _, d := range deliveries {
+		err := d.to.Deliver(d.msg)
+		if err != nil {
+			logging.Errorf("Error delivering message on %v: %v\n", d.msg.Topic, err.Error())
+			if d.group != nil {
+				b.untrack(d)
+			}
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// untrack stops tracking a shared subscription message that couldn't be sent, so it doesn't count against the member.
+func (b *Broker) untrack(d *delivery) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := mqtt.SharePrefix + "/" + d.group.ShareName + "/" + d.group.Filter
+	if d.group.ack(d.clientId, d.msg.PacketId) && d.group.empty() && b.shared[key] == d.group {
+		delete(b.shared, key)
+	}
+}
+
+func minQos(a, b uint8) uint8 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// shutdownPollInterval is how often Shutdown checks if clients completed their QoS 1 and 2 handshakes.
+const shutdownPollInterval = time.Millisecond * 10
+
+// Shutdown disconnects every client with the reason code Server shutting down, and refuses new connections.
+// Each client is first given up to timeout to complete the QoS 1 and 2 handshakes in flight, so those messages aren't lost.
+// Sessions that outlive their connection are kept with the messages still in flight, see Sessions.
+// Returns once every client is disconnected.
+func (b *Broker) Shutdown(timeout time.Duration) {
+	b.mu.Lock()
+	b.closing = true
+	b.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		b.mu.Lock()
+		clients := make(map[string]Subscriber, len(b.clients))
+		for clientId, s := range b.clients {
+			clients[clientId] = s
+		}
+		b.mu.Unlock()
+		if len(clients) == 0 {
+			return
+		}
+
+		late := time.Now().After(deadline)
+		for clientId, s := range clients {
+			if n := s.Inflight(); n > 0 && !late {
+				continue
+			} else if n > 0 {
+				logging.Infof("Disconnecting %v with %d messages still in flight\n", clientId, n)
+			}
+			if err := s.SendDisconnect(mqtt.ReasonServerShuttingDown, ""); err != nil {
+				logging.Errorf("Error disconnecting %v: %v\n", clientId, err.Error())
+			}
+			// the client's connection may take a while to close, it mustn't be disconnected twice.
+			b.Disconnect(clientId, s)
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+}
+
+// ShuttingDown checks if Shutdown was called, in which case new connections must be refused.
+func (b *Broker) ShuttingDown() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closing
+}
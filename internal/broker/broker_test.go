@@ -0,0 +1,219 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/M4THYOU/some_mqtt_broker/internal/auth"
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+)
+
+// fakeSubscriber records every message delivered to it instead of writing them to a connection.
+type fakeSubscriber struct {
+	nextId          uint16
+	delivered       []*mqtt.Message
+	reasonCode      byte   // of the DISCONNECT packet.
+	serverReference string // of the DISCONNECT packet.
+	disconnected    bool
+	inflight        int
+	failing         bool     // Deliver returns an error.
+	session         *Session // returned by Session, nil => it ends with the connection.
+}
+
+func (s *fakeSubscriber) NextPacketId() (uint16, error) {
+	s.nextId++
+	return s.nextId, nil
+}
+func (s *fakeSubscriber) Deliver(msg *mqtt.Message) error {
+	if s.failing {
+		return errors.New("delivery failed")
+	}
+	s.delivered = append(s.delivered, msg)
+	return nil
+}
+
+func (s *fakeSubscriber) SendDisconnect(reasonCode byte, serverReference string) error {
+	s.reasonCode = reasonCode
+	s.serverReference = serverReference
+	s.disconnected = true
+	return nil
+}
+
+func (s *fakeSubscriber) Inflight() int {
+	return s.inflight
+}
+
+func (s *fakeSubscriber) Session() *Session {
+	return s.session
+}
+
+func connectFake(b *Broker, clientId string) *fakeSubscriber {
+	s := &fakeSubscriber{}
+	b.Connect(clientId, s)
+	return s
+}
+
+func checkDelivered(t *testing.T, s *fakeSubscriber, expected int) {
+	if len(s.delivered) != expected {
+		t.Fatalf("delivered %d messages, expected %d", len(s.delivered), expected)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	b := New(Options{SharedSubStrategy: RoundRobin})
+	a := connectFake(b, "a")
+	c := connectFake(b, "c")
+	b.Subscribe(&Subscription{ClientId: "a", Filter: "sensors/+", Options: mqtt.SubscriptionOptions{Qos: 1}, Id: 7})
+	b.Subscribe(&Subscription{ClientId: "a", Filter: "sensors/#", Options: mqtt.SubscriptionOptions{Qos: 2}, Id: 9})
+	b.Subscribe(&Subscription{ClientId: "c", Filter: "other"})
+
+	n := b.Publish("p", &mqtt.Message{Topic: "sensors/1", Qos: 2, Payload: []byte("hi")})
+	if n != 1 {
+		t.Fatalf("sent to %d clients, expected 1", n)
+	}
+	checkDelivered(t, a, 1)
+	checkDelivered(t, c, 0)
+	msg := a.delivered[0]
+	if msg.Qos != 2 {
+		t.Fatalf("overlapping subscriptions should use the highest QoS, got %d", msg.Qos)
+	} else if len(msg.SubscriptionIds) != 2 {
+		t.Fatalf("expected both subscription identifiers, got %v", msg.SubscriptionIds)
+	} else if msg.PacketId == 0 {
+		t.Fatalf("QoS 2 message should have a packet identifier")
+	}
+
+	// QoS is downgraded to the one granted.
+	b.Publish("p", &mqtt.Message{Topic: "other", Qos: 2})
+	checkDelivered(t, c, 1)
+	if c.delivered[0].Qos != 0 || c.delivered[0].PacketId != 0 {
+		t.Fatalf("expected QoS 0 without packet identifier, got QoS %d id %d", c.delivered[0].Qos, c.delivered[0].PacketId)
+	}
+
+	// No Local
+	b.Subscribe(&Subscription{ClientId: "c", Filter: "other", Options: mqtt.SubscriptionOptions{NoLocal: true}})
+	b.Publish("c", &mqtt.Message{Topic: "other"})
+	checkDelivered(t, c, 1)
+
+	if !b.Unsubscribe("c", "other") {
+		t.Fatalf("Unsubscribe should have found the subscription")
+	} else if b.Unsubscribe("c", "other") {
+		t.Fatalf("Unsubscribe should not find the subscription twice")
+	}
+	if n := b.Publish("p", &mqtt.Message{Topic: "other"}); n != 0 {
+		t.Fatalf("sent to %d clients after unsubscribing, expected 0", n)
+	}
+}
+
+func TestPublishDup(t *testing.T) {
+	b := New(Options{SharedSubStrategy: RoundRobin})
+	a := connectFake(b, "a")
+	w := subscribeShared(b, "w", 1)
+	b.Subscribe(&Subscription{ClientId: "a", Filter: "jobs/#"})
+
+	// a retransmitted QoS 1 message is new to its subscribers, and QoS 0 ones can't have DUP set.
+	b.Publish("p", &mqtt.Message{Topic: "jobs/a", Qos: 1, Dup: true, PacketId: 3})
+	checkDelivered(t, a, 1)
+	checkDelivered(t, w, 1)
+	if a.delivered[0].Dup || a.delivered[0].Qos != 0 {
+		t.Fatalf("expected QoS 0 without DUP, got QoS %d DUP %t", a.delivered[0].Qos, a.delivered[0].Dup)
+	} else if w.delivered[0].Dup || w.delivered[0].Qos != 1 {
+		t.Fatalf("expected QoS 1 without DUP, got QoS %d DUP %t", w.delivered[0].Qos, w.delivered[0].Dup)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	b := New(Options{SharedSubStrategy: RoundRobin})
+	a := connectFake(b, "a")
+	b.Subscribe(&Subscription{ClientId: "a", Filter: "t"})
+
+	// a newer connection with the same client ID takes over, and is not removed by the old one.
+	a2 := &fakeSubscriber{}
+	if replaced := b.Connect("a", a2); replaced != a {
+		t.Fatalf("Connect should have returned the connection it replaced, got %v", replaced)
+	} else if b.Connected("a", a) || !b.Connected("a", a2) {
+		t.Fatalf("only the newer connection should be connected")
+	}
+	b.Disconnect("a", a)
+	// the old connection's subscriptions went with it.
+	if n := b.Publish("p", &mqtt.Message{Topic: "t"}); n != 0 {
+		t.Fatalf("sent to %d clients after the takeover, expected 0", n)
+	}
+	b.Subscribe(&Subscription{ClientId: "a", Filter: "t"})
+	b.Publish("p", &mqtt.Message{Topic: "t"})
+	checkDelivered(t, a2, 1)
+	checkDelivered(t, a, 0)
+
+	b.Disconnect("a", a2)
+	if n := b.Publish("p", &mqtt.Message{Topic: "t"}); n != 0 {
+		t.Fatalf("sent to %d clients after disconnecting, expected 0", n)
+	}
+}
+
+func TestResponseInfo(t *testing.T) {
+	b := New(Options{ResponseInfo: "reply/%c/", GrantResponseTopics: true})
+	if info := b.ResponseInfo("abc"); info != "reply/abc/" {
+		t.Fatalf("Got %v, expected reply/abc/", info)
+	} else if !b.GrantResponseTopics() {
+		t.Fatalf("GrantResponseTopics should be true")
+	}
+	if !b.IsResponseTopic("a", auth.AccessPublish, "reply/a/x") || !b.IsResponseTopic("a", auth.AccessSubscribe, "reply/a/#") {
+		t.Fatalf("the client should be granted its own response topics")
+	}
+	// client a/b's response topics would be under client a's, so it gets none.
+	if info := b.ResponseInfo("a/b"); info != "" {
+		t.Fatalf("Got %v, expected no Response Information for a client ID with a level separator", info)
+	}
+	if b.IsResponseTopic("a/b", auth.AccessPublish, "reply/a/b/x") || b.IsResponseTopic("a/b", auth.AccessSubscribe, "reply/a/b/#") {
+		t.Fatalf("a client ID with a level separator should not be granted response topics")
+	}
+	if b.IsResponseTopic("a+", auth.AccessSubscribe, "reply/a+/#") {
+		t.Fatalf("a client ID with a wildcard should not be granted response topics")
+	}
+	b = New(Options{GrantResponseTopics: true})
+	if info := b.ResponseInfo("abc"); info != "" {
+		t.Fatalf("Got %v, expected no Response Information", info)
+	} else if b.GrantResponseTopics() {
+		t.Fatalf("nothing can be granted without Response Information")
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	b := New(Options{ResponseInfo: "reply/%c/", MaxPacketSize: 100})
+	s := connectFake(b, "s")
+	b.Subscribe(&Subscription{ClientId: "s", Filter: "t"})
+
+	b.SetOptions(Options{ResponseInfo: "resp/%c/", MaxPacketSize: 200})
+	if info := b.ResponseInfo("abc"); info != "resp/abc/" {
+		t.Fatalf("Got %v, expected resp/abc/", info)
+	} else if max := b.MaxPacketSize(); max != 200 {
+		t.Fatalf("Got a maximum packet size of %d, expected 200", max)
+	}
+	// clients and their subscriptions are kept.
+	b.Publish("p", &mqtt.Message{Topic: "t"})
+	checkDelivered(t, s, 1)
+}
+
+func TestShutdown(t *testing.T) {
+	b := New(Options{})
+	idle := connectFake(b, "idle")
+	busy := connectFake(b, "busy")
+	busy.inflight = 1
+
+	start := time.Now()
+	b.Shutdown(time.Millisecond * 50)
+	if time.Since(start) < time.Millisecond*50 {
+		t.Fatalf("Shutdown should have waited for the message in flight")
+	}
+	for _, s := range []*fakeSubscriber{idle, busy} {
+		if !s.disconnected || s.reasonCode != mqtt.ReasonServerShuttingDown {
+			t.Fatalf("every client should be disconnected with Server shutting down, got %+v", s)
+		}
+	}
+	if !b.ShuttingDown() {
+		t.Fatalf("ShuttingDown should be true")
+	}
+	if n := b.Publish("p", &mqtt.Message{Topic: "t"}); n != 0 {
+		t.Fatalf("sent to %d clients after shutting down, expected 0", n)
+	}
+}
@@ -0,0 +1,103 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/M4THYOU/some_mqtt_broker/internal/logging"
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+)
+
+// Redirect tells clients to use another server instead of this one.
+type Redirect struct {
+	ServerReference string
+	Moved           bool // true => the other server should be used from now on, false => only temporarily.
+}
+
+// ReasonCode returns the reason code to send, in CONNACK or DISCONNECT, to clients being redirected.
+func (r *Redirect) ReasonCode() byte {
+	if r.Moved {
+		return mqtt.ReasonServerMoved
+	}
+	return mqtt.ReasonUseAnotherServer
+}
+
+// ReadRedirect reads the redirect from the file at path. The file holds the server reference, optionally followed by "moved".
+// Returns nil if the file is missing or empty, meaning clients should not be redirected.
+func ReadRedirect(path string) (*Redirect, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(buf))
+	switch len(fields) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &Redirect{ServerReference: fields[0]}, nil
+	case 2:
+		if fields[1] != "moved" {
+			msg := fmt.Sprintf("invalid redirect mode `%v` in %v, expected `moved`", fields[1], path)
+			return nil, errors.New(msg)
+		}
+		return &Redirect{ServerReference: fields[0], Moved: true}, nil
+	default:
+		msg := fmt.Sprintf("too many fields in %v, expected: <server reference> [moved]", path)
+		return nil, errors.New(msg)
+	}
+}
+
+// SetRedirect makes the broker refuse new connections, telling them to use another server. nil accepts them again.
+// Clients that are already connected stay connected until Drain is called.
+func (b *Broker) SetRedirect(r *Redirect) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.redirect = r
+}
+
+// Redirect returns the current redirect, or nil if new connections are accepted.
+func (b *Broker) Redirect() *Redirect {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.redirect
+}
+
+// Drain disconnects every connected client, telling them to use the server of the current redirect.
+// Disconnections are spread evenly over period so the clients don't all reconnect to the other server at once.
+// Stops early if the redirect is changed or cleared in the meantime.
+func (b *Broker) Drain(period time.Duration) {
+	b.mu.Lock()
+	r := b.redirect
+	clients := make(map[string]Subscriber, len(b.clients))
+	for clientId, s := range b.clients {
+		clients[clientId] = s
+	}
+	b.mu.Unlock()
+	if r == nil || len(clients) == 0 {
+		return
+	}
+
+	interval := period / time.Duration(len(clients))
+	for clientId, s := range clients {
+		b.mu.Lock()
+		stop := b.redirect != r
+		connected := b.clients[clientId] == s
+		b.mu.Unlock()
+		if stop {
+			return
+		} else if !connected {
+			continue
+		}
+		err := s.SendDisconnect(r.ReasonCode(), r.ServerReference)
+		if err != nil {
+			logging.Errorf("Error redirecting %v: %v\n", clientId, err.Error())
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,71 @@
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+	"github.com/google/go-cmp/cmp"
+)
+
+func checkReadRedirect(t *testing.T, contents string, expected *Redirect, shouldPass bool) {
+	dir, err := ioutil.TempDir("", "redirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "redirect.conf")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := ReadRedirect(path)
+	if err != nil && shouldPass {
+		t.Fatalf("ReadRedirect failed: %v", err.Error())
+	} else if err == nil && !shouldPass {
+		t.Fatalf("ReadRedirect should have failed: %q", contents)
+	} else if !cmp.Equal(r, expected) && shouldPass {
+		t.Fatalf("Got:\n%v\nExpected:\n%v", r, expected)
+	}
+}
+func TestReadRedirect(t *testing.T) {
+	checkReadRedirect(t, "", nil, true)
+	checkReadRedirect(t, "  \n", nil, true)
+	checkReadRedirect(t, "broker2:1883\n", &Redirect{"broker2:1883", false}, true)
+	checkReadRedirect(t, "broker2:1883 moved\n", &Redirect{"broker2:1883", true}, true)
+	checkReadRedirect(t, "broker2:1883 gone", nil, false)
+	checkReadRedirect(t, "broker2:1883 moved now", nil, false)
+
+	r, err := ReadRedirect(filepath.Join(os.TempDir(), "does-not-exist", "redirect.conf"))
+	if err != nil || r != nil {
+		t.Fatalf("a missing file should mean no redirect, got %v %v", r, err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	b := New(Options{})
+	a := connectFake(b, "a")
+	c := connectFake(b, "c")
+
+	// nothing happens without a redirect.
+	b.Drain(0)
+	if a.disconnected || c.disconnected {
+		t.Fatalf("clients should not be disconnected without a redirect")
+	}
+
+	b.SetRedirect(&Redirect{ServerReference: "other:1883", Moved: true})
+	b.Drain(0)
+	for _, s := range []*fakeSubscriber{a, c} {
+		if !s.disconnected {
+			t.Fatalf("every client should be disconnected")
+		} else if s.reasonCode != mqtt.ReasonServerMoved || s.serverReference != "other:1883" {
+			t.Fatalf("got reason code %d and reference %v", s.reasonCode, s.serverReference)
+		}
+	}
+
+	b.SetRedirect(nil)
+	if b.Redirect() != nil {
+		t.Fatalf("redirect should have been cleared")
+	}
+}
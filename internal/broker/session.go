@@ -0,0 +1,106 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+)
+
+// Session is what is kept of a client's session across a restart of the broker, until the client resumes it.
+type Session struct {
+	ClientId      string
+	Expires       time.Time // zero => never.
+	Subscriptions []*Subscription
+	// Messages are the QoS 1 and 2 messages sent to the client that it hasn't acknowledged, with their packet identifiers.
+	Messages []*mqtt.Message
+	// Released are the packet identifiers of the QoS 2 Messages the client has received, which are only waiting for PUBCOMP.
+	Released []uint16
+	// Received are the packet identifiers of the QoS 2 messages received from the client that it hasn't released yet.
+	Received []uint16
+}
+
+// expired checks if the session has outlived its Session Expiry Interval.
+func (s *Session) expired(now time.Time) bool {
+	return !s.Expires.IsZero() && !now.Before(s.Expires)
+}
+
+// ReadSessions reads the sessions kept in the file at path by a previous run.
+// Returns none if the file is missing, as it is the first time the broker runs.
+func ReadSessions(path string) ([]*Session, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sessions := make([]*Session, 0)
+	if err := json.Unmarshal(buf, &sessions); err != nil {
+		msg := fmt.Sprintf("%v: %v", path, err.Error())
+		return nil, errors.New(msg)
+	}
+	return sessions, nil
+}
+
+// WriteSessions replaces the file at path with the sessions, for ReadSessions in the next run.
+// The file is written next to it first, so the previous sessions are kept if writing fails.
+func WriteSessions(path string, sessions []*Session) error {
+	buf, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+	// the messages can hold anything clients published, so only the broker may read them.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Sessions returns the sessions to keep for the next run: those of the clients disconnected since Shutdown was called
+// that outlive their connection, and those from the previous run that weren't resumed. Expired ones are left out.
+func (b *Broker) Sessions() []*Session {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sessions := make([]*Session, 0, len(b.stored))
+	for _, s := range b.stored {
+		if !s.expired(now) {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ClientId < sessions[j].ClientId
+	})
+	return sessions
+}
+
+// Restore keeps the sessions from a previous run until their clients resume them. Those that expired are dropped.
+func (b *Broker) Restore(sessions []*Session) {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range sessions {
+		if !s.expired(now) {
+			b.stored[s.ClientId] = s
+		}
+	}
+}
+
+// Resume returns the session kept for the client from a previous run, and forgets it, since the client now holds it.
+// Returns nil if there is none, it expired, or the client asked for a new one with Clean Start, which discards it.
+func (b *Broker) Resume(clientId string, cleanStart bool) *Session {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.stored[clientId]
+	delete(b.stored, clientId)
+	if s == nil || cleanStart || s.expired(time.Now()) {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,119 @@
+package broker
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+	"github.com/google/go-cmp/cmp"
+)
+
+const testSessions = `[
+  {
+    "ClientId": "sensor-1",
+    "Expires": "2030-01-02T03:04:05Z",
+    "Subscriptions": [{"ClientId": "sensor-1", "Filter": "cmd/#", "Options": {"Qos": 1}, "Id": 4}],
+    "Messages": [{"Topic": "cmd/reboot", "Payload": "bm93", "Qos": 2, "PacketId": 12}],
+    "Released": [12],
+    "Received": [3]
+  }
+]`
+
+func TestReadSessions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sessions.json")
+	if err := ioutil.WriteFile(path, []byte(testSessions), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := ReadSessions(path)
+	if err != nil {
+		t.Fatalf("ReadSessions failed: %v", err.Error())
+	}
+	expected := []*Session{{
+		ClientId:      "sensor-1",
+		Expires:       time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+		Subscriptions: []*Subscription{{ClientId: "sensor-1", Filter: "cmd/#", Options: mqtt.SubscriptionOptions{Qos: 1}, Id: 4}},
+		Messages:      []*mqtt.Message{{Topic: "cmd/reboot", Payload: []byte("now"), Qos: 2, PacketId: 12}},
+		Released:      []uint16{12},
+		Received:      []uint16{3},
+	}}
+	if !cmp.Equal(sessions, expected) {
+		t.Fatalf("Got:\n%v\nExpected:\n%v", sessions, expected)
+	}
+
+	sessions, err = ReadSessions(filepath.Join(dir, "missing.json"))
+	if err != nil || sessions != nil {
+		t.Fatalf("a missing file should mean no sessions, got %v %v", sessions, err)
+	}
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSessions(path); err == nil {
+		t.Fatalf("ReadSessions should have failed for invalid JSON")
+	}
+}
+
+func TestResume(t *testing.T) {
+	b := New(Options{})
+	b.Restore([]*Session{
+		{ClientId: "kept"},
+		{ClientId: "expired", Expires: time.Now().Add(-time.Second)},
+		{ClientId: "later", Expires: time.Now().Add(time.Hour)},
+		{ClientId: "clean"},
+	})
+	if b.Resume("expired", false) != nil {
+		t.Fatalf("an expired session should not be resumed")
+	}
+	if b.Resume("clean", true) != nil {
+		t.Fatalf("Clean Start should not resume the session")
+	} else if b.Resume("clean", false) != nil {
+		t.Fatalf("Clean Start should discard the session")
+	}
+	if s := b.Resume("later", false); s == nil || s.ClientId != "later" {
+		t.Fatalf("the session of later should be resumed, got %v", s)
+	}
+	if s := b.Resume("kept", false); s == nil {
+		t.Fatalf("a session without expiry should be resumed")
+	} else if b.Resume("kept", false) != nil {
+		t.Fatalf("a session should only be resumed once")
+	}
+	if b.Resume("unknown", false) != nil {
+		t.Fatalf("there is no session for unknown")
+	}
+}
+
+func TestShutdownSessions(t *testing.T) {
+	b := New(Options{SharedSubStrategy: RoundRobin})
+	b.Restore([]*Session{{ClientId: "old"}})
+	p := subscribeShared(b, "p", 1)
+	p.session = &Session{ClientId: "p"}
+	w := subscribeShared(b, "w", 1)
+	w.inflight = 1 // so it is still connected when p is disconnected.
+	b.Publish("x", &mqtt.Message{Topic: "jobs/a", Qos: 1})
+	checkDelivered(t, p, 1)
+
+	b.Shutdown(time.Millisecond * 50)
+	// the message stays with p's session, instead of being sent to w too.
+	checkDelivered(t, w, 0)
+	sessions := b.Sessions()
+	expected := []*Session{
+		{ClientId: "old"},
+		{ClientId: "p", Subscriptions: []*Subscription{{ClientId: "p", ShareName: "workers", Filter: "jobs/#", Options: mqtt.SubscriptionOptions{Qos: 1}}}},
+	}
+	if !cmp.Equal(sessions, expected) {
+		t.Fatalf("Got:\n%v\nExpected:\n%v", sessions, expected)
+	}
+
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	if err := WriteSessions(path, sessions); err != nil {
+		t.Fatalf("WriteSessions failed: %v", err.Error())
+	}
+	read, err := ReadSessions(path)
+	if err != nil {
+		t.Fatalf("ReadSessions failed: %v", err.Error())
+	} else if !cmp.Equal(read, expected) {
+		t.Fatalf("Got:\n%v\nExpected:\n%v", read, expected)
+	}
+}
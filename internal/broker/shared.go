@@ -0,0 +1,200 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+)
+
+// Strategy decides which member of a shared subscription group receives each message.
+type Strategy int
+
+const (
+	RoundRobin    Strategy = iota // members take turns, in the order they joined.
+	Random                        // any member, chosen uniformly at random.
+	Sticky                        // every message from the same publisher goes to the same member, for as long as it stays in the group.
+	LeastInflight                 // the member with the fewest unacknowledged QoS 1 and 2 messages.
+)
+
+var strategyNames = map[Strategy]string{
+	RoundRobin:    "round-robin",
+	Random:        "random",
+	Sticky:        "sticky",
+	LeastInflight: "least-inflight",
+}
+
+func (s Strategy) String() string {
+	if name, ok := strategyNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Strategy(%d)", int(s))
+}
+
+// ParseStrategy returns the strategy with the given name, as returned by String.
+func ParseStrategy(name string) (Strategy, error) {
+	for s, n := range strategyNames {
+		if n == name {
+			return s, nil
+		}
+	}
+	msg := fmt.Sprintf("unknown shared subscription strategy `%v`", name)
+	return 0, errors.New(msg)
+}
+
+// inflight is a message sent to a member that the member has not acknowledged yet.
+type inflight struct {
+	from string        // client ID of the publisher.
+	msg  *mqtt.Message // as published, before being adjusted for the member.
+}
+
+// SharedGroup is every subscription to $share/{ShareName}/{Filter}. Each message matching Filter goes to only one member.
+// Not safe for concurrent use; the Broker guards it with its own lock.
+type SharedGroup struct {
+	ShareName string
+	Filter    string
+
+	strategy Strategy
+	members  []*Subscription
+	next     int                             // index of the next member for RoundRobin and LeastInflight.
+	sticky   map[string]string               // publisher client ID -> member client ID.
+	inflight map[string]map[uint16]*inflight // member client ID -> packet ID -> message.
+}
+
+func newSharedGroup(shareName, filter string, strategy Strategy) *SharedGroup {
+	return &SharedGroup{
+		ShareName: shareName,
+		Filter:    filter,
+		strategy:  strategy,
+		members:   make([]*Subscription, 0),
+		sticky:    make(map[string]string),
+		inflight:  make(map[string]map[uint16]*inflight),
+	}
+}
+
+// add makes the subscription a member of the group, replacing the client's previous subscription if it had one.
+func (g *SharedGroup) add(sub *Subscription) {
+	for i, m := range g.members {
+		if m.ClientId == sub.ClientId {
+			g.members[i] = sub
+			return
+		}
+	}
+	g.members = append(g.members, sub)
+}
+
+// leave removes the client from the members of the group. Messages it has not acknowledged yet are still tracked.
+func (g *SharedGroup) leave(clientId string) {
+	for i, m := range g.members {
+		if m.ClientId != clientId {
+			continue
+		}
+		g.members = append(g.members[:i], g.members[i+1:]...)
+		if g.next > i {
+			g.next--
+		}
+		break
+	}
+	for from, to := range g.sticky {
+		if to == clientId {
+			delete(g.sticky, from)
+		}
+	}
+}
+
+// remove removes the client from the group entirely, for when it disconnects.
+// Returns the messages it had not acknowledged, so they can be sent to another member.
+func (g *SharedGroup) remove(clientId string) []*inflight {
+	g.leave(clientId)
+	orphans := make([]*inflight, 0)
+	for _, m := range g.inflight[clientId] {
+		orphans = append(orphans, m)
+	}
+	delete(g.inflight, clientId)
+	return orphans
+}
+
+// empty checks if the group has no members and nothing left to track.
+func (g *SharedGroup) empty() bool {
+	return len(g.members) == 0 && len(g.inflight) == 0
+}
+
+// pick chooses the member that receives the next message published by from.
+// Returns nil if the group has no members.
+func (g *SharedGroup) pick(from string) *Subscription {
+	n := len(g.members)
+	if n == 0 {
+		return nil
+	}
+	switch g.strategy {
+	case Random:
+		return g.members[rand.Intn(n)]
+	case Sticky:
+		if clientId, ok := g.sticky[from]; ok {
+			if sub := g.member(clientId); sub != nil {
+				return sub
+			}
+		}
+		sub := g.roundRobin()
+		g.sticky[from] = sub.ClientId
+		return sub
+	case LeastInflight:
+		// start from the round robin position so ties are spread evenly.
+		best := g.next % n
+		for i := 1; i < n; i++ {
+			idx := (g.next + i) % n
+			if len(g.inflight[g.members[idx].ClientId]) < len(g.inflight[g.members[best].ClientId]) {
+				best = idx
+			}
+		}
+		g.next = best + 1
+		return g.members[best]
+	default:
+		return g.roundRobin()
+	}
+}
+
+func (g *SharedGroup) roundRobin() *Subscription {
+	if g.next >= len(g.members) {
+		g.next = 0
+	}
+	sub := g.members[g.next]
+	g.next++
+	return sub
+}
+
+func (g *SharedGroup) member(clientId string) *Subscription {
+	for _, m := range g.members {
+		if m.ClientId == clientId {
+			return m
+		}
+	}
+	return nil
+}
+
+// track remembers a QoS 1 or 2 message sent to a member until the member acknowledges it.
+func (g *SharedGroup) track(clientId string, packetId uint16, from string, msg *mqtt.Message) {
+	msgs, ok := g.inflight[clientId]
+	if !ok {
+		msgs = make(map[uint16]*inflight)
+		g.inflight[clientId] = msgs
+	}
+	msgs[packetId] = &inflight{from, msg}
+}
+
+// ack stops tracking the message. Returns false if it was not sent through this group.
+func (g *SharedGroup) ack(clientId string, packetId uint16) bool {
+	msgs, ok := g.inflight[clientId]
+	if !ok {
+		return false
+	}
+	if _, ok := msgs[packetId]; !ok {
+		return false
+	}
+	delete(msgs, packetId)
+	if len(msgs) == 0 {
+		delete(g.inflight, clientId)
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+)
+
+func subscribeShared(b *Broker, clientId string, qos uint8) *fakeSubscriber {
+	s := connectFake(b, clientId)
+	b.Subscribe(&Subscription{ClientId: clientId, ShareName: "workers", Filter: "jobs/#", Options: mqtt.SubscriptionOptions{Qos: qos}})
+	return s
+}
+
+func checkParseStrategy(t *testing.T, name string, expected Strategy, shouldPass bool) {
+	s, err := ParseStrategy(name)
+	if err != nil && shouldPass {
+		t.Fatalf("ParseStrategy failed: %v", err.Error())
+	} else if err == nil && !shouldPass {
+		t.Fatalf("ParseStrategy should have failed: %v", name)
+	} else if s != expected && shouldPass {
+		t.Fatalf("Got %v, expected %v", s, expected)
+	}
+}
+func TestParseStrategy(t *testing.T) {
+	checkParseStrategy(t, "round-robin", RoundRobin, true)
+	checkParseStrategy(t, "random", Random, true)
+	checkParseStrategy(t, "sticky", Sticky, true)
+	checkParseStrategy(t, "least-inflight", LeastInflight, true)
+	checkParseStrategy(t, LeastInflight.String(), LeastInflight, true)
+	checkParseStrategy(t, "fastest", 0, false)
+}
+
+func TestSharedRoundRobin(t *testing.T) {
+	b := New(Options{SharedSubStrategy: RoundRobin})
+	w1 := subscribeShared(b, "w1", 0)
+	w2 := subscribeShared(b, "w2", 0)
+	w3 := subscribeShared(b, "w3", 0)
+	for i := 0; i < 6; i++ {
+		if n := b.Publish("p", &mqtt.Message{Topic: "jobs/a"}); n != 1 {
+			t.Fatalf("shared message sent to %d clients, expected 1", n)
+		}
+	}
+	checkDelivered(t, w1, 2)
+	checkDelivered(t, w2, 2)
+	checkDelivered(t, w3, 2)
+}
+
+func TestSharedRandom(t *testing.T) {
+	b := New(Options{SharedSubStrategy: Random})
+	w1 := subscribeShared(b, "w1", 0)
+	w2 := subscribeShared(b, "w2", 0)
+	for i := 0; i < 20; i++ {
+		b.Publish("p", &mqtt.Message{Topic: "jobs/a"})
+	}
+	if len(w1.delivered)+len(w2.delivered) != 20 {
+		t.Fatalf("delivered %d messages, expected 20", len(w1.delivered)+len(w2.delivered))
+	}
+}
+
+func TestSharedSticky(t *testing.T) {
+	b := New(Options{SharedSubStrategy: Sticky})
+	w1 := subscribeShared(b, "w1", 0)
+	w2 := subscribeShared(b, "w2", 0)
+	for i := 0; i < 3; i++ {
+		b.Publish("p1", &mqtt.Message{Topic: "jobs/a", Payload: []byte("p1")})
+		b.Publish("p2", &mqtt.Message{Topic: "jobs/a", Payload: []byte("p2")})
+	}
+	checkDelivered(t, w1, 3)
+	checkDelivered(t, w2, 3)
+	for _, msg := range w1.delivered {
+		if string(msg.Payload) != "p1" {
+			t.Fatalf("w1 should only get messages from p1, got one from %s", msg.Payload)
+		}
+	}
+
+	// once the member leaves, its publishers stick to another one.
+	b.Disconnect("w1", w1)
+	b.Publish("p1", &mqtt.Message{Topic: "jobs/a"})
+	checkDelivered(t, w2, 4)
+}
+
+func TestSharedLeastInflight(t *testing.T) {
+	b := New(Options{SharedSubStrategy: LeastInflight})
+	w1 := subscribeShared(b, "w1", 1)
+	w2 := subscribeShared(b, "w2", 1)
+	b.Publish("p", &mqtt.Message{Topic: "jobs/a", Qos: 1})
+	b.Publish("p", &mqtt.Message{Topic: "jobs/a", Qos: 1})
+	checkDelivered(t, w1, 1)
+	checkDelivered(t, w2, 1)
+
+	// w1 acknowledges, w2 doesn't. So w1 gets the next two.
+	b.Ack("w1", w1.delivered[0].PacketId)
+	b.Publish("p", &mqtt.Message{Topic: "jobs/a", Qos: 1})
+	checkDelivered(t, w1, 2)
+	b.Ack("w1", w1.delivered[1].PacketId)
+	b.Publish("p", &mqtt.Message{Topic: "jobs/a", Qos: 1})
+	checkDelivered(t, w1, 3)
+	checkDelivered(t, w2, 1)
+}
+
+func TestSharedDeliveryFailed(t *testing.T) {
+	b := New(Options{SharedSubStrategy: LeastInflight})
+	w1 := subscribeShared(b, "w1", 1)
+	w1.failing = true
+	if n := b.Publish("p", &mqtt.Message{Topic: "jobs/a", Qos: 1}); n != 0 {
+		t.Fatalf("shared message sent to %d clients, expected 0", n)
+	}
+	// the message never reached w1, so it isn't waiting for an acknowledgement.
+	if g := b.shared["$share/workers/jobs/#"]; len(g.inflight) != 0 {
+		t.Fatalf("expected nothing in flight, got %v", g.inflight)
+	}
+}
+
+func TestSharedRedistribution(t *testing.T) {
+	b := New(Options{SharedSubStrategy: RoundRobin})
+	w1 := subscribeShared(b, "w1", 1)
+	w2 := subscribeShared(b, "w2", 1)
+	b.Publish("p", &mqtt.Message{Topic: "jobs/a", Qos: 1, Payload: []byte("1")})
+	b.Publish("p", &mqtt.Message{Topic: "jobs/b", Qos: 1, Payload: []byte("2")})
+	b.Publish("p", &mqtt.Message{Topic: "jobs/c", Qos: 0, Payload: []byte("3")})
+	checkDelivered(t, w1, 2)
+	checkDelivered(t, w2, 1)
+
+	// w1 acknowledged nothing, so the QoS 1 message goes to w2. The QoS 0 one is lost.
+	b.Disconnect("w1", w1)
+	checkDelivered(t, w2, 2)
+	if string(w2.delivered[1].Payload) != "1" {
+		t.Fatalf("expected the unacknowledged message to be redistributed, got %s", w2.delivered[1].Payload)
+	}
+
+	// acknowledged messages are not redistributed.
+	w3 := subscribeShared(b, "w3", 1)
+	b.Ack("w2", w2.delivered[0].PacketId)
+	b.Ack("w2", w2.delivered[1].PacketId)
+	b.Disconnect("w2", w2)
+	checkDelivered(t, w3, 0)
+
+	// the group goes away with its last member.
+	b.Disconnect("w3", w3)
+	if len(b.shared) != 0 {
+		t.Fatalf("expected no shared groups left, got %d", len(b.shared))
+	}
+}
@@ -3,20 +3,91 @@ package client
 import (
 	"errors"
 	"fmt"
-	"log"
 	"net"
+	"sync"
+	"time"
 
+	"github.com/M4THYOU/some_mqtt_broker/internal/auth"
+	"github.com/M4THYOU/some_mqtt_broker/internal/broker"
+	"github.com/M4THYOU/some_mqtt_broker/internal/logging"
 	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
 	"github.com/M4THYOU/some_mqtt_broker/pkg/packet"
 )
 
+// ErrDisconnect is returned by ProcessPacket once the client has sent a DISCONNECT packet.
+var ErrDisconnect = errors.New("client disconnected")
+
+// ConnState is where a connection is in its lifecycle. Each state only accepts some packets, others are a Protocol Error.
+type ConnState int
+
+const (
+	AwaitingConnect ConnState = iota // only CONNECT is accepted.
+	Authenticating                   // CONNECT started an enhanced authentication, only AUTH and DISCONNECT are accepted.
+	Connected                        // the CONNACK accepting the connection was sent, anything but CONNECT is accepted.
+	Disconnecting                    // the connection is being closed, nothing is accepted.
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case AwaitingConnect:
+		return "awaiting CONNECT"
+	case Authenticating:
+		return "authenticating"
+	case Connected:
+		return "connected"
+	case Disconnecting:
+		return "disconnecting"
+	}
+	return fmt.Sprintf("state %d", int(s))
+}
+
+// Listener holds the settings of the listener clients connected through.
+type Listener struct {
+	Name string // for logging.
+	// ProtocolLevels are the MQTT versions accepted, as mqtt.ProtocolLevel constants. nil => every supported version.
+	ProtocolLevels []byte
+	// Anonymous accepts clients without checking their password, and lets them use every topic. For trusted networks.
+	Anonymous bool
+	// PeerCredentials names clients on Unix sockets after the local user running the process that connected,
+	// instead of asking for a password.
+	PeerCredentials bool
+}
+
+// acceptsProtocolLevel checks if clients may connect with the MQTT version.
+func (l *Listener) acceptsProtocolLevel(level byte) bool {
+	if l == nil || l.ProtocolLevels == nil {
+		return true
+	}
+	for _, v := range l.ProtocolLevels {
+		if v == level {
+			return true
+		}
+	}
+	return false
+}
+
+// anonymous checks if clients are neither authenticated nor authorized.
+func (l *Listener) anonymous() bool {
+	return l != nil && l.Anonymous
+}
+
+// peerCredentials checks if clients are identified by their Unix peer credentials.
+func (l *Listener) peerCredentials() bool {
+	return l != nil && l.PeerCredentials
+}
+
 type Client struct {
-	Conn         net.Conn
-	Rdr          *packet.Reader
-	connectFlags *mqtt.ConnectFlags
-	KeepAlive    uint16
-	UserName     string
-	Password     []byte
+	Conn          net.Conn
+	Rdr           *packet.Reader
+	Broker        *broker.Broker
+	Listener      *Listener // the settings of the listener the client connected through. nil => the broker's defaults.
+	flags         byte      // flags from the fixed header of the packet currently being processed.
+	connectFlags  *mqtt.ConnectFlags
+	ProtocolLevel byte // from CONNECT, one of the mqtt.ProtocolLevel constants. Every packet is encoded for this version.
+	ClientId      string
+	KeepAlive     uint16
+	UserName      string
+	Password      []byte
 
 	// Connect Properties
 	SessionExpiryInterval uint32
@@ -24,11 +95,71 @@ type Client struct {
 	MaxPacketSize         uint32 // because go is go, the default value is 0. However, according to spec the client must not set this to zero. Therefore, 0 => no limit.
 	TopicAliasMaximum     uint16
 	ReturnResponseInfo    bool // if true, return response info to the client in connack.
-	ReturnProblemInfo     bool // if true, maybe send proper reason string to client (CONNACK & DISCONNECT). Depends on log level though.
+	ReturnProblemInfo     bool // if false, Reason Strings and User Properties are only sent in PUBLISH, CONNACK, and DISCONNECT.
 	AuthMethod            string
 	AuthData              []byte
 
-	WillProps *mqtt.WillProps
+	ResponseInfo string // prefix of the client's response topics. Only sent in CONNACK if ReturnResponseInfo.
+
+	// Connack
+	connackErr      error  // why the connection is refused. nil => accepted.
+	serverReference string // sent with the reason codes Use another server and Server moved.
+	state           ConnState
+	connectDeadline time.Time // for CONNECT and any enhanced authentication to be done. Zero => no limit.
+	// maxPacketSize is the limit sent in CONNACK, which stays the same for the whole connection. 0 => no limit.
+	maxPacketSize uint32
+
+	authExchange   auth.Exchange   // the enhanced authentication in progress, if any.
+	serverAuthData []byte          // Authentication Data for the CONNACK, from the last step of the exchange.
+	authorizer     auth.Authorizer // restricts this client's topics on top of the broker's. nil => no restriction.
+	// identified is true if the client was identified by its connection, from its TLS certificate or Unix peer credentials,
+	// so it needs no password.
+	identified       bool
+	assignedClientId string // sent in CONNACK if the Client ID was replaced by the server.
+	sessionPresent   bool   // a session kept from before the broker restarted was resumed.
+
+	WillProps *mqtt.WillProps // nil => no Will Message, or the client discarded it with a normal DISCONNECT.
+
+	incoming       *mqtt.Message // the PUBLISH packet currently being processed.
+	subscriptionId uint32        // of the SUBSCRIBE packet currently being processed. 0 => not set.
+
+	writeMu      sync.Mutex // messages from other clients are delivered from their goroutines, so writes must not interleave.
+	mu           sync.Mutex // guards everything below.
+	nextPacketId uint16
+	outbound     map[uint16]*mqtt.Message // QoS 1 and 2 messages sent to the client that are not complete yet.
+	released     map[uint16]bool          // QoS 2 messages of outbound the client has received, so PUBREL was sent.
+	inboundQos2  map[uint16]bool          // QoS 2 packet IDs received from the client and not yet released.
+}
+
+// New returns a client for the newly accepted connection, which has yet to send its CONNECT packet.
+func New(conn net.Conn, b *broker.Broker) *Client {
+	rdr := packet.NewReader(conn, 0)
+	rdr.SetRejectNonCharacters(b.RejectNonCharacters())
+	client := &Client{
+		Conn:        conn,
+		Rdr:         rdr,
+		Broker:      b,
+		outbound:    make(map[uint16]*mqtt.Message),
+		released:    make(map[uint16]bool),
+		inboundQos2: make(map[uint16]bool),
+	}
+	if timeout := b.ConnectTimeout(); timeout > 0 {
+		client.connectDeadline = time.Now().Add(timeout)
+	}
+	return client
+}
+
+// hasProps checks if the client's protocol version has properties and reason codes, which were added in MQTT v5.0.
+func (client *Client) hasProps() bool {
+	return client.ProtocolLevel >= mqtt.ProtocolLevel5
+}
+
+// Close removes the client from the broker and closes its connection.
+func (client *Client) Close() error {
+	if client.ClientId != "" {
+		client.Broker.Disconnect(client.ClientId, client)
+	}
+	return client.Conn.Close()
 }
 
 // processFixedHeader processes the fixed header.
@@ -38,26 +169,38 @@ func (client *Client) processFixedHeader() (byte, int, error) {
 	if err != nil {
 		return 0x00, 0, err
 	}
-	fmt.Println("(fixed header)")
+	logging.Debugf("(fixed header)\n")
 
 	reqType := mqtt.GetRequestType(b1)
-	if reqType == mqtt.PublishCode {
-		// TODO Do thing with flags!
-		// flags := (b1 & 0xF)
-		log.Fatalln("Not yet implemented.")
+	client.flags = b1 & 0x0F
+	// only PUBLISH has flags that vary, every other packet type has fixed values for them.
+	if reqType != mqtt.PublishCode && b1 != mqtt.SetRequestType(reqType, false, false, 0) {
+		msg := fmt.Sprintf("invalid fixed header flags %04b for request type: %d", client.flags, reqType)
+		return 0x00, 0, mqtt.NewReasonError(mqtt.ReasonMalformedPacket, msg)
 	}
 
-	_, remainingLength, err := client.Rdr.ReadVarByteInt()
+	n, remainingLength, err := client.Rdr.ReadVarByteInt()
 	if err != nil {
 		return 0x00, 0, err
 	}
+	max := client.maxPacketSize
+	if client.state != Connected {
+		max = client.Broker.MaxPacketSize()
+	}
+	if max != 0 && 1+uint32(n)+remainingLength > max {
+		msg := fmt.Sprintf("packet of %d bytes is bigger than the maximum of %d", 1+uint32(n)+remainingLength, max)
+		return 0x00, 0, mqtt.NewReasonError(mqtt.ReasonPacketTooLarge, msg)
+	}
 
 	return reqType, int(remainingLength), nil
 }
 
 // processVarHeader processes the variable header and payload of the packet (if payload exists)
 func (client *Client) processVarHeader(reqType byte) (err error) {
-	fmt.Println("(var header and payload)")
+	logging.Debugf("(var header and payload)\n")
+	if err := client.checkState(reqType); err != nil {
+		return err
+	}
 
 	switch reqType {
 	case mqtt.ConnectCode:
@@ -89,17 +232,105 @@ func (client *Client) processVarHeader(reqType byte) (err error) {
 	case mqtt.DisconnectCode:
 		err = client.handleDisconnect()
 	case mqtt.AuthCode:
+		if !client.hasProps() {
+			return mqtt.NewReasonError(mqtt.ReasonProtocolError, "AUTH packets are only valid in MQTT v5.0")
+		}
 		err = client.handleAuth()
 	default:
 		msg := fmt.Sprintf("No matching case for request type: %d", reqType)
-		return errors.New(msg)
+		return mqtt.NewReasonError(mqtt.ReasonProtocolError, msg)
 	}
 	return err
 
 }
 
+// checkState checks that the packet is allowed in the connection's current state. Returns a Protocol Error if it isn't,
+// or Session taken over once another connection has used the same client ID.
+func (client *Client) checkState(reqType byte) error {
+	var allowed bool
+	switch client.state {
+	case AwaitingConnect:
+		allowed = reqType == mqtt.ConnectCode
+	case Authenticating:
+		allowed = reqType == mqtt.AuthCode || reqType == mqtt.DisconnectCode
+	case Connected:
+		allowed = reqType != mqtt.ConnectCode
+		if !client.Broker.Connected(client.ClientId, client) {
+			return mqtt.NewReasonError(mqtt.ReasonSessionTakenOver, "another connection took over the session")
+		}
+	}
+	if allowed {
+		return nil
+	}
+	msg := fmt.Sprintf("%v is not allowed while %v", mqtt.PacketName(reqType), client.state)
+	reasonErr := mqtt.NewReasonError(mqtt.ReasonProtocolError, msg)
+	if client.state == Authenticating {
+		// there's no DISCONNECT before CONNACK.
+		return client.refuse(reasonErr)
+	}
+	return reasonErr
+}
+
+// ProcessPacket reads and handles the next packet from the client. Any error means the connection must be closed.
+// If the error has a reason code, and the connection was accepted, the client is first sent a DISCONNECT with it.
 func (client *Client) ProcessPacket() error {
-	fmt.Println("Waiting for packet...")
+	err := client.processPacket()
+	if err == nil {
+		return nil
+	}
+	var reasonErr *mqtt.ReasonError
+	if client.state == Connected && errors.As(err, &reasonErr) && reasonErr.Code >= mqtt.ReasonUnspecifiedError {
+		// the connection is closed either way, so failing to send it doesn't matter.
+		client.SendDisconnect(reasonErr.Code, "")
+	}
+	if client.state == Connected {
+		client.publishWill()
+	}
+	client.state = Disconnecting
+	return err
+}
+
+// publishWill publishes the client's Will Message, if it still has one, with its User Properties unchanged.
+// Sessions only outlive their connection across a restart, so the Will Delay Interval never applies.
+func (client *Client) publishWill() {
+	will := client.WillProps
+	client.WillProps = nil
+	if will == nil {
+		return
+	} else if !client.authorize(auth.AccessPublish, will.Topic) {
+		logging.Infof("Dropping the will of %v on %v: not authorized\n", client.ClientId, will.Topic)
+		return
+	}
+	client.Broker.Publish(client.ClientId, &mqtt.Message{
+		Topic:                  will.Topic,
+		Payload:                will.Payload,
+		Qos:                    client.connectFlags.WillQos,
+		PayloadFormatIndicator: will.PayloadFormatIndicator,
+		MessageExpiryInterval:  will.MessageExpiryInterval,
+		ContentType:            will.ContentType,
+		ResponseTopic:          will.ResponseTopic,
+		CorrelationData:        will.CorrelationData,
+		UserProperties:         will.UserProperty,
+	})
+}
+
+// readDeadline returns when the next packet must have arrived by. Zero => no limit.
+func (client *Client) readDeadline() time.Time {
+	if client.state != Connected {
+		return client.connectDeadline
+	} else if client.KeepAlive > 0 {
+		// the spec allows one and a half times the Keep Alive between packets.
+		return time.Now().Add(time.Duration(client.KeepAlive) * time.Second * 3 / 2)
+	}
+	return time.Time{}
+}
+
+func (client *Client) processPacket() error {
+	if client.state == Disconnecting {
+		return errors.New("connection is closing")
+	}
+	client.Conn.SetReadDeadline(client.readDeadline())
+	logging.Debugf("Waiting for packet...\n")
 	// fixed header can be up to 5 bytes, so set that as the limit.
 	client.Rdr.SetRemainingLength(5)
 	reqType, remLen, err := client.processFixedHeader() // make this guy return remaining length!
@@ -108,6 +339,6 @@ func (client *Client) ProcessPacket() error {
 	}
 	client.Rdr.SetRemainingLength(remLen)
 	err = client.processVarHeader(reqType)
-	fmt.Printf("Packet processed.\n\n")
+	logging.Debugf("Packet processed.\n\n")
 	return err
 }
@@ -1,5 +1,1260 @@
 package client
 
-import "testing"
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
 
-var _ = testing.CoverMode
+	"github.com/M4THYOU/some_mqtt_broker/internal/auth"
+	"github.com/M4THYOU/some_mqtt_broker/internal/broker"
+	"github.com/M4THYOU/some_mqtt_broker/internal/listener"
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+	"github.com/M4THYOU/some_mqtt_broker/pkg/packet"
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// buildTestPacket builds a whole packet, so tests can write it to the client's connection.
+func buildTestPacket(t *testing.T, firstByte byte, build func(w *packet.Writer)) []byte {
+	w := packet.NewWriter()
+	build(w)
+	body, err := w.Bytes()
+	if err != nil {
+		t.Fatalf("failed to build test packet: %v", err.Error())
+	}
+	buf, err := mqtt.BuildPacket(firstByte, body)
+	if err != nil {
+		t.Fatalf("failed to build test packet: %v", err.Error())
+	}
+	return buf
+}
+
+func connectPacket(t *testing.T, clientId string) []byte {
+	return connectPacketWithProps(t, clientId, []byte{})
+}
+
+// connectPacketWithProps builds a CONNECT packet with the given, already encoded, properties.
+func connectPacketWithProps(t *testing.T, clientId string, props []byte) []byte {
+	return buildTestPacket(t, mqtt.SetRequestType(mqtt.ConnectCode, false, false, 0), func(w *packet.Writer) {
+		w.PutUtf8Str("MQTT")
+		w.PutByte(5)    // protocol version
+		w.PutByte(0x02) // Clean Start
+		w.PutUint16(60) // Keep Alive
+		w.PutVarByteInt(uint32(len(props)))
+		w.PutBytes(props)
+		w.PutUtf8Str(clientId) // payload
+	})
+}
+
+// connectPacketV311 builds an MQTT v3.1.1 CONNECT packet, which has no properties.
+func connectPacketV311(t *testing.T, clientId string) []byte {
+	return connectPacketLegacy(t, mqtt.ProtocolName, mqtt.ProtocolLevel311, clientId)
+}
+
+// connectPacketLegacy builds a CONNECT packet for a protocol version before v5.0.
+func connectPacketLegacy(t *testing.T, protocolName string, protocolLevel byte, clientId string) []byte {
+	return buildTestPacket(t, mqtt.SetRequestType(mqtt.ConnectCode, false, false, 0), func(w *packet.Writer) {
+		w.PutUtf8Str(protocolName)
+		w.PutByte(protocolLevel)
+		w.PutByte(0x02) // Clean Session
+		w.PutUint16(60) // Keep Alive
+		w.PutUtf8Str(clientId)
+	})
+}
+
+// connectPacketWithPassword builds a CONNECT packet with a User Name and Password, for the given protocol level.
+func connectPacketWithPassword(t *testing.T, protocolLevel byte, clientId, userName, password string) []byte {
+	return buildTestPacket(t, mqtt.SetRequestType(mqtt.ConnectCode, false, false, 0), func(w *packet.Writer) {
+		w.PutUtf8Str(mqtt.ProtocolName)
+		w.PutByte(protocolLevel)
+		w.PutByte(0xC2) // User Name, Password and Clean Start
+		w.PutUint16(60)
+		if protocolLevel == mqtt.ProtocolLevel5 {
+			w.PutVarByteInt(0)
+		}
+		w.PutUtf8Str(clientId)
+		w.PutUtf8Str(userName)
+		w.PutBinaryData([]byte(password))
+	})
+}
+
+// subscribePacket311 builds a SUBSCRIBE packet for a protocol version before v5.0, which has no properties.
+func subscribePacket311(t *testing.T, packetId uint16, filter string, qos byte) []byte {
+	return buildTestPacket(t, mqtt.SetRequestType(mqtt.SubscribeCode, false, false, 0), func(w *packet.Writer) {
+		w.PutUint16(packetId)
+		w.PutUtf8Str(filter)
+		w.PutByte(qos)
+	})
+}
+
+func subscribePacket(t *testing.T, packetId uint16, filter string, opts byte) []byte {
+	return buildTestPacket(t, mqtt.SetRequestType(mqtt.SubscribeCode, false, false, 0), func(w *packet.Writer) {
+		w.PutUint16(packetId)
+		w.PutVarByteInt(0)
+		w.PutUtf8Str(filter)
+		w.PutByte(opts)
+	})
+}
+
+func publishPacket(t *testing.T, topic string, qos int, packetId uint16, payload string) []byte {
+	return buildTestPacket(t, mqtt.SetRequestType(mqtt.PublishCode, false, false, qos), func(w *packet.Writer) {
+		w.PutUtf8Str(topic)
+		if qos > 0 {
+			w.PutUint16(packetId)
+		}
+		w.PutVarByteInt(0)
+		w.PutBytes([]byte(payload))
+	})
+}
+
+// readTestPacket reads a single packet sent by the client. Returns the first byte and everything after the remaining length.
+func readTestPacket(t *testing.T, conn net.Conn) (byte, []byte) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	rdr := packet.NewReader(conn, 5)
+	firstByte, err := rdr.ReadByte()
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err.Error())
+	}
+	_, remLen, err := rdr.ReadVarByteInt()
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err.Error())
+	}
+	// the Reader is buffered, so read the body straight from it before it's discarded.
+	rdr.SetRemainingLength(int(remLen))
+	body := make([]byte, remLen)
+	for i := range body {
+		body[i], err = rdr.ReadByte()
+		if err != nil {
+			t.Fatalf("failed to read packet body: %v", err.Error())
+		}
+	}
+	return firstByte, body
+}
+
+func writeTestPacket(t *testing.T, conn net.Conn, buf []byte) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatalf("failed to write packet: %v", err.Error())
+	}
+}
+
+// startTestClient starts a client on one end of a pipe and returns the other end, without connecting.
+func startTestClient(t *testing.T, b *broker.Broker) net.Conn {
+	server, conn := net.Pipe()
+	serveTestClient(b, server, nil)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// serveTestClient starts a client on the server's side of a connection, through a listener with the settings.
+func serveTestClient(b *broker.Broker, server net.Conn, settings *Listener) {
+	c := New(server, b)
+	c.Listener = settings
+	go func() {
+		defer c.Close()
+		for {
+			if err := c.ProcessPacket(); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// connectTestClient starts a client on one end of a pipe, connects it, and returns the other end.
+func connectTestClient(t *testing.T, b *broker.Broker, clientId string) net.Conn {
+	conn := startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacket(t, clientId))
+	firstByte, body := readTestPacket(t, conn)
+	if mqtt.GetRequestType(firstByte) != mqtt.ConnackCode {
+		t.Fatalf("expected CONNACK, got packet type %d", mqtt.GetRequestType(firstByte))
+	} else if body[1] != mqtt.ReasonSuccess {
+		t.Fatalf("expected successful CONNACK, got reason code %d", body[1])
+	}
+	return conn
+}
+
+func checkTestPacket(t *testing.T, conn net.Conn, expectedFirstByte byte, expectedBody []byte) {
+	firstByte, body := readTestPacket(t, conn)
+	if firstByte != expectedFirstByte {
+		t.Fatalf("got first byte %08b, expected %08b", firstByte, expectedFirstByte)
+	} else if !cmp.Equal(body, expectedBody) {
+		t.Fatalf("Got:\n%v\nExpected:\n%v", body, expectedBody)
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	b := broker.New(broker.Options{SharedSubStrategy: broker.RoundRobin})
+	sub := connectTestClient(t, b, "sub")
+	pub := connectTestClient(t, b, "pub")
+
+	writeTestPacket(t, sub, subscribePacket(t, 1, "a/+", 0x01))
+	checkTestPacket(t, sub, mqtt.SetRequestType(mqtt.SubackCode, false, false, 0), []byte{0x00, 0x01, 0x00, mqtt.ReasonGrantedQoS1})
+
+	// nobody subscribed to this one.
+	writeTestPacket(t, pub, publishPacket(t, "b", 1, 7, "x"))
+	reason := "no subscribers for topic b"
+	expected := []byte{0x00, 0x07, mqtt.ReasonNoMatchingSubscribers, byte(3 + len(reason)), mqtt.ReasonStringCode, 0x00, byte(len(reason))}
+	expected = append(expected, []byte(reason)...)
+	checkTestPacket(t, pub, mqtt.SetRequestType(mqtt.PubackCode, false, false, 0), expected)
+
+	// the subscriber has to read its PUBLISH before the publisher gets its PUBACK, since pipes aren't buffered.
+	writeTestPacket(t, pub, publishPacket(t, "a/b", 1, 8, "hi"))
+	expected = []byte{0x00, 0x03, 'a', '/', 'b', 0x00, 0x01, 0x00, 'h', 'i'}
+	checkTestPacket(t, sub, mqtt.SetRequestType(mqtt.PublishCode, false, false, 1), expected)
+	checkTestPacket(t, pub, mqtt.SetRequestType(mqtt.PubackCode, false, false, 0), []byte{0x00, 0x08})
+}
+
+func TestSessionTakeover(t *testing.T) {
+	b := broker.New(broker.Options{})
+	old := connectTestClient(t, b, "c1")
+	writeTestPacket(t, old, subscribePacket(t, 1, "t", 0x00))
+	checkTestPacket(t, old, mqtt.SetRequestType(mqtt.SubackCode, false, false, 0), []byte{0x00, 0x01, 0x00, mqtt.ReasonSuccess})
+	writeTestPacket(t, old, subscribePacket(t, 2, "$share/g/t", 0x00))
+	checkTestPacket(t, old, mqtt.SetRequestType(mqtt.SubackCode, false, false, 0), []byte{0x00, 0x02, 0x00, mqtt.ReasonSuccess})
+
+	conn := connectTestClient(t, b, "c1")
+	checkTestPacket(t, old, mqtt.SetRequestType(mqtt.DisconnectCode, false, false, 0), []byte{mqtt.ReasonSessionTakenOver, 0x00})
+	checkClosed(t, old)
+	// the new session starts empty, so nothing is sent to it on the old filters.
+	pub := connectTestClient(t, b, "pub")
+	writeTestPacket(t, pub, publishPacket(t, "t", 1, 1, "x"))
+	if firstByte, body := readTestPacket(t, pub); mqtt.GetRequestType(firstByte) != mqtt.PubackCode || body[2] != mqtt.ReasonNoMatchingSubscribers {
+		t.Fatalf("expected a PUBACK with No matching subscribers, got %08b %v", firstByte, body)
+	}
+	// the old connection closing doesn't disconnect the new one.
+	writeTestPacket(t, conn, []byte{mqtt.SetRequestType(mqtt.PingreqCode, false, false, 0), 0x00})
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.PingrespCode, false, false, 0), []byte{})
+}
+
+// connectPacketResume builds a CONNECT packet without Clean Start, for the given protocol level.
+func connectPacketResume(t *testing.T, protocolLevel byte, clientId string) []byte {
+	return buildTestPacket(t, mqtt.SetRequestType(mqtt.ConnectCode, false, false, 0), func(w *packet.Writer) {
+		w.PutUtf8Str(mqtt.ProtocolName)
+		w.PutByte(protocolLevel)
+		w.PutByte(0x00)
+		w.PutUint16(60)
+		if protocolLevel == mqtt.ProtocolLevel5 {
+			w.PutVarByteInt(0)
+		}
+		w.PutUtf8Str(clientId)
+	})
+}
+
+func TestResumeSession(t *testing.T) {
+	b := broker.New(broker.Options{Authorizer: prefixAuthorizer{}})
+	b.Restore([]*broker.Session{
+		{
+			ClientId: "c1",
+			Subscriptions: []*broker.Subscription{
+				{ClientId: "c1", Filter: "allowed/#", Options: mqtt.SubscriptionOptions{Qos: 1}},
+				{ClientId: "c1", Filter: "secret/#", Options: mqtt.SubscriptionOptions{Qos: 1}},
+			},
+			Messages: []*mqtt.Message{
+				{Topic: "allowed/t", Payload: []byte("a"), Qos: 1, PacketId: 5},
+				{Topic: "secret/t", Payload: []byte("b"), Qos: 2, PacketId: 6},
+				{Topic: "secret/t", Payload: []byte("c"), Qos: 1, PacketId: 7},
+			},
+			Released: []uint16{6},
+			Received: []uint16{9},
+		},
+		{ClientId: "c2", Subscriptions: []*broker.Subscription{{ClientId: "c2", Filter: "allowed/c2"}}},
+		{ClientId: "c3"},
+	})
+
+	conn := startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacketResume(t, mqtt.ProtocolLevel5, "c1"))
+	if firstByte, body := readTestPacket(t, conn); mqtt.GetRequestType(firstByte) != mqtt.ConnackCode || body[0] != 0x01 || body[1] != mqtt.ReasonSuccess {
+		t.Fatalf("expected a CONNACK with Session Present, got %08b %v", firstByte, body)
+	}
+	// the messages in flight are sent again with their packet identifiers, except the one the client may no longer see.
+	expected := []byte{0x00, 0x09, 'a', 'l', 'l', 'o', 'w', 'e', 'd', '/', 't', 0x00, 0x05, 0x00, 'a'}
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.PublishCode, true, false, 1), expected)
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.PubrelCode, false, false, 0), []byte{0x00, 0x06})
+	writeTestPacket(t, conn, buildTestPacket(t, mqtt.SetRequestType(mqtt.PubrelCode, false, false, 0), func(w *packet.Writer) {
+		w.PutUint16(9)
+	}))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.PubcompCode, false, false, 0), []byte{0x00, 0x09})
+
+	// only the subscription the client may still use is back, and new messages don't reuse the packet identifiers in flight.
+	pub := connectTestClient(t, b, "pub")
+	writeTestPacket(t, pub, publishPacket(t, "allowed/x", 1, 1, "d"))
+	firstByte, body := readTestPacket(t, conn)
+	if firstByte != mqtt.SetRequestType(mqtt.PublishCode, false, false, 1) || string(body[len(body)-1:]) != "d" || body[12] == 5 || body[12] == 6 {
+		t.Fatalf("expected a new PUBLISH on allowed/x, got %08b %v", firstByte, body)
+	}
+	checkTestPacket(t, pub, mqtt.SetRequestType(mqtt.PubackCode, false, false, 0), []byte{0x00, 0x01})
+
+	// Clean Start discards the session.
+	fresh := startTestClient(t, b)
+	writeTestPacket(t, fresh, connectPacket(t, "c2"))
+	if firstByte, body := readTestPacket(t, fresh); mqtt.GetRequestType(firstByte) != mqtt.ConnackCode || body[0] != 0x00 {
+		t.Fatalf("expected a CONNACK without Session Present, got %08b %v", firstByte, body)
+	}
+	if b.Resume("c2", false) != nil {
+		t.Fatalf("the session of c2 should have been discarded")
+	}
+
+	// v3.1.1 clients are told too.
+	legacy := startTestClient(t, b)
+	writeTestPacket(t, legacy, connectPacketResume(t, mqtt.ProtocolLevel311, "c3"))
+	checkTestPacket(t, legacy, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), []byte{0x01, mqtt.ReturnCodeAccepted})
+}
+
+// connectAssigned connects a client without a client ID, and returns the connection and the client ID it was assigned.
+func connectAssigned(t *testing.T, b *broker.Broker) (net.Conn, string) {
+	conn := startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacket(t, ""))
+	firstByte, body := readTestPacket(t, conn)
+	if mqtt.GetRequestType(firstByte) != mqtt.ConnackCode || body[1] != mqtt.ReasonSuccess {
+		t.Fatalf("expected a successful CONNACK, got %08b %v", firstByte, body)
+	}
+	// Retain Available, then the Assigned Client Identifier.
+	props := body[3:]
+	if len(props) < 5 || props[2] != mqtt.AssignedClientIdCode || len(props) != 5+int(props[4]) {
+		t.Fatalf("expected an Assigned Client Identifier, got properties %v", props)
+	}
+	return conn, string(props[5:])
+}
+
+func TestAssignedClientId(t *testing.T) {
+	b := broker.New(broker.Options{})
+	c1, id1 := connectAssigned(t, b)
+	c2, id2 := connectAssigned(t, b)
+	if id1 == id2 || len(id1) == 0 || len(id1) > mqtt.MaxClientIdLength31 {
+		t.Fatalf("expected two different client IDs of 1 to 23 characters, got %v and %v", id1, id2)
+	}
+	// neither takes over the other.
+	for _, conn := range []net.Conn{c1, c2} {
+		writeTestPacket(t, conn, []byte{mqtt.SetRequestType(mqtt.PingreqCode, false, false, 0), 0x00})
+		checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.PingrespCode, false, false, 0), []byte{})
+	}
+}
+
+func TestSharedSubscription(t *testing.T) {
+	b := broker.New(broker.Options{SharedSubStrategy: broker.RoundRobin})
+	w1 := connectTestClient(t, b, "w1")
+	w2 := connectTestClient(t, b, "w2")
+	pub := connectTestClient(t, b, "pub")
+	suback := mqtt.SetRequestType(mqtt.SubackCode, false, false, 0)
+	publish := mqtt.SetRequestType(mqtt.PublishCode, false, false, 1)
+
+	writeTestPacket(t, w1, subscribePacket(t, 1, "$share/g/jobs", 0x01))
+	checkTestPacket(t, w1, suback, []byte{0x00, 0x01, 0x00, mqtt.ReasonGrantedQoS1})
+	writeTestPacket(t, w2, subscribePacket(t, 1, "$share/g/jobs", 0x01))
+	checkTestPacket(t, w2, suback, []byte{0x00, 0x01, 0x00, mqtt.ReasonGrantedQoS1})
+
+	// No Local on a shared subscription is a protocol error, so the connection is closed.
+	bad := connectTestClient(t, b, "bad")
+	writeTestPacket(t, bad, subscribePacket(t, 1, "$share/g/jobs", 0x05))
+	checkTestPacket(t, bad, mqtt.SetRequestType(mqtt.DisconnectCode, false, false, 0), []byte{mqtt.ReasonProtocolError, 0x00})
+	checkClosed(t, bad)
+
+	// w1 gets the first job but never acknowledges it.
+	writeTestPacket(t, pub, publishPacket(t, "jobs", 1, 1, "1"))
+	checkTestPacket(t, w1, publish, []byte{0x00, 0x04, 'j', 'o', 'b', 's', 0x00, 0x01, 0x00, '1'})
+	readTestPacket(t, pub)
+
+	// w2 gets the second, then the first once w1 goes away.
+	writeTestPacket(t, pub, publishPacket(t, "jobs", 1, 2, "2"))
+	checkTestPacket(t, w2, publish, []byte{0x00, 0x04, 'j', 'o', 'b', 's', 0x00, 0x01, 0x00, '2'})
+	readTestPacket(t, pub)
+	w1.Close()
+	checkTestPacket(t, w2, publish, []byte{0x00, 0x04, 'j', 'o', 'b', 's', 0x00, 0x02, 0x00, '1'})
+}
+
+func TestResponseInfo(t *testing.T) {
+	b := broker.New(broker.Options{ResponseInfo: "reply/%c/"})
+	connack := mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0)
+
+	// only sent when requested.
+	conn := startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacket(t, "rpc"))
+	checkTestPacket(t, conn, connack, []byte{0x00, 0x00, 0x02, mqtt.RetainAvailableCode, 0x00})
+
+	conn = startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacketWithProps(t, "rpc", []byte{mqtt.RequestResponseInfoCode, 0x01}))
+	expected := []byte{0x00, 0x00, 0x0F, mqtt.RetainAvailableCode, 0x00, mqtt.ResponseInfoCode, 0x00, 0x0A}
+	expected = append(expected, []byte("reply/rpc/")...)
+	checkTestPacket(t, conn, connack, expected)
+}
+
+func TestPublishRequestResponse(t *testing.T) {
+	b := broker.New(broker.Options{})
+	sub := connectTestClient(t, b, "service")
+	pub := connectTestClient(t, b, "caller")
+	writeTestPacket(t, sub, subscribePacket(t, 1, "rpc/add", 0x00))
+	readTestPacket(t, sub)
+
+	// Response Topic and Correlation Data are forwarded untouched.
+	props := []byte{mqtt.ResponseTopicCode, 0x00, 0x03, 'r', '/', 'c', mqtt.CorrelationDataCode, 0x00, 0x02, 0xCA, 0xFE}
+	writeTestPacket(t, pub, buildTestPacket(t, mqtt.SetRequestType(mqtt.PublishCode, false, false, 0), func(w *packet.Writer) {
+		w.PutUtf8Str("rpc/add")
+		w.PutVarByteInt(uint32(len(props)))
+		w.PutBytes(props)
+		w.PutBytes([]byte("1+1"))
+	}))
+	expected := []byte{0x00, 0x07, 'r', 'p', 'c', '/', 'a', 'd', 'd', byte(len(props))}
+	expected = append(expected, props...)
+	expected = append(expected, []byte("1+1")...)
+	checkTestPacket(t, sub, mqtt.SetRequestType(mqtt.PublishCode, false, false, 0), expected)
+}
+
+func TestForwardUserProperties(t *testing.T) {
+	b := broker.New(broker.Options{})
+	sub := connectTestClient(t, b, "sub")
+	pub := connectTestClient(t, b, "pub")
+	writeTestPacket(t, sub, subscribePacket(t, 1, "traced", 0x00))
+	readTestPacket(t, sub)
+
+	// repeated names are allowed, and the order must not change.
+	props := []byte{
+		mqtt.UserPropertyCode, 0x00, 0x03, 't', 'i', 'd', 0x00, 0x01, '9',
+		mqtt.UserPropertyCode, 0x00, 0x01, 'a', 0x00, 0x01, '2',
+		mqtt.UserPropertyCode, 0x00, 0x03, 't', 'i', 'd', 0x00, 0x01, '1',
+	}
+	writeTestPacket(t, pub, buildTestPacket(t, mqtt.SetRequestType(mqtt.PublishCode, false, false, 0), func(w *packet.Writer) {
+		w.PutUtf8Str("traced")
+		w.PutVarByteInt(uint32(len(props)))
+		w.PutBytes(props)
+		w.PutBytes([]byte("hi"))
+	}))
+	expected := []byte{0x00, 0x06, 't', 'r', 'a', 'c', 'e', 'd', byte(len(props))}
+	expected = append(expected, props...)
+	expected = append(expected, []byte("hi")...)
+	checkTestPacket(t, sub, mqtt.SetRequestType(mqtt.PublishCode, false, false, 0), expected)
+}
+
+// connectPacketWithWill builds a CONNECT packet with a QoS 0 Will Message, with the given, already encoded, will properties.
+func connectPacketWithWill(t *testing.T, clientId, topic string, willProps []byte) []byte {
+	return buildTestPacket(t, mqtt.SetRequestType(mqtt.ConnectCode, false, false, 0), func(w *packet.Writer) {
+		w.PutUtf8Str(mqtt.ProtocolName)
+		w.PutByte(mqtt.ProtocolLevel5)
+		w.PutByte(0x06) // Will Flag and Clean Start
+		w.PutUint16(60)
+		w.PutVarByteInt(0)
+		w.PutUtf8Str(clientId)
+		w.PutVarByteInt(uint32(len(willProps)))
+		w.PutBytes(willProps)
+		w.PutUtf8Str(topic)
+		w.PutBinaryData([]byte("gone"))
+	})
+}
+
+func TestWill(t *testing.T) {
+	b := broker.New(broker.Options{})
+	sub := connectTestClient(t, b, "sub")
+	writeTestPacket(t, sub, subscribePacket(t, 1, "status/#", 0x00))
+	readTestPacket(t, sub)
+	connack := mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0)
+	publish := mqtt.SetRequestType(mqtt.PublishCode, false, false, 0)
+
+	// the will is published when the connection is lost, with its User Properties in the same order.
+	props := []byte{
+		mqtt.UserPropertyCode, 0x00, 0x01, 'b', 0x00, 0x01, '1',
+		mqtt.UserPropertyCode, 0x00, 0x01, 'a', 0x00, 0x01, '2',
+	}
+	conn := startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacketWithWill(t, "w1", "status/w1", props))
+	checkTestPacket(t, conn, connack, []byte{0x00, 0x00, 0x02, mqtt.RetainAvailableCode, 0x00})
+	conn.Close()
+	expected := []byte{0x00, 0x09, 's', 't', 'a', 't', 'u', 's', '/', 'w', '1', byte(len(props))}
+	expected = append(expected, props...)
+	expected = append(expected, []byte("gone")...)
+	checkTestPacket(t, sub, publish, expected)
+
+	// a normal DISCONNECT discards it.
+	conn = startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacketWithWill(t, "w2", "status/w2", []byte{}))
+	readTestPacket(t, conn)
+	writeTestPacket(t, conn, []byte{mqtt.SetRequestType(mqtt.DisconnectCode, false, false, 0), 0x00})
+	checkClosed(t, conn)
+	writeTestPacket(t, sub, []byte{mqtt.SetRequestType(mqtt.PingreqCode, false, false, 0), 0x00})
+	checkTestPacket(t, sub, mqtt.SetRequestType(mqtt.PingrespCode, false, false, 0), []byte{})
+
+	// unless it asks for the will to be published.
+	conn = startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacketWithWill(t, "w3", "status/w3", []byte{}))
+	readTestPacket(t, conn)
+	writeTestPacket(t, conn, []byte{mqtt.SetRequestType(mqtt.DisconnectCode, false, false, 0), 0x01, mqtt.ReasonDisconnectWithWill})
+	checkTestPacket(t, sub, publish, []byte{0x00, 0x09, 's', 't', 'a', 't', 'u', 's', '/', 'w', '3', 0x00, 'g', 'o', 'n', 'e'})
+
+	// an invalid will topic refuses the connection.
+	conn = startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacketWithWill(t, "w4", "status/#", []byte{}))
+	if firstByte, body := readTestPacket(t, conn); mqtt.GetRequestType(firstByte) != mqtt.ConnackCode || body[1] != mqtt.ReasonTopicNameInvalid {
+		t.Fatalf("expected a CONNACK with Topic Name invalid, got %08b %v", firstByte, body)
+	}
+}
+
+func TestPayloadFormat(t *testing.T) {
+	b := broker.New(broker.Options{ValidatePayloadFormat: true})
+	sub := connectTestClient(t, b, "sub")
+	pub := connectTestClient(t, b, "pub")
+	writeTestPacket(t, sub, subscribePacket(t, 1, "text", 0x00))
+	readTestPacket(t, sub)
+
+	publish := func(payload []byte) []byte {
+		return buildTestPacket(t, mqtt.SetRequestType(mqtt.PublishCode, false, false, 1), func(w *packet.Writer) {
+			w.PutUtf8Str("text")
+			w.PutUint16(7)
+			w.PutVarByteInt(2)
+			w.PutBytes([]byte{mqtt.PayloadFormatIndicatorCode, 0x01})
+			w.PutBytes(payload)
+		})
+	}
+	writeTestPacket(t, pub, publish([]byte{'o', 0xC3, 0xA9}))
+	readTestPacket(t, sub)
+	checkTestPacket(t, pub, mqtt.SetRequestType(mqtt.PubackCode, false, false, 0), []byte{0x00, 0x07})
+
+	// not forwarded to the subscriber.
+	writeTestPacket(t, pub, publish([]byte{'o', 0xC3}))
+	reason := "payload published to text is not valid UTF-8"
+	expected := []byte{0x00, 0x07, mqtt.ReasonPayloadFormatInvalid, byte(3 + len(reason)), mqtt.ReasonStringCode, 0x00, byte(len(reason))}
+	expected = append(expected, []byte(reason)...)
+	checkTestPacket(t, pub, mqtt.SetRequestType(mqtt.PubackCode, false, false, 0), expected)
+}
+
+func TestRedirect(t *testing.T) {
+	b := broker.New(broker.Options{})
+	conn := connectTestClient(t, b, "old")
+
+	b.SetRedirect(&broker.Redirect{ServerReference: "b2"})
+	reason := "redirected to b2"
+	expected := []byte{0x00, mqtt.ReasonUseAnotherServer, byte(8 + len(reason)), mqtt.ServerReferenceCode, 0x00, 0x02, 'b', '2', mqtt.ReasonStringCode, 0x00, byte(len(reason))}
+	expected = append(expected, []byte(reason)...)
+	refused := startTestClient(t, b)
+	writeTestPacket(t, refused, connectPacket(t, "new"))
+	checkTestPacket(t, refused, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), expected)
+
+	go b.Drain(0)
+	expected = []byte{mqtt.ReasonUseAnotherServer, 0x05, mqtt.ServerReferenceCode, 0x00, 0x02, 'b', '2'}
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.DisconnectCode, false, false, 0), expected)
+}
+
+func TestRequestProblemInfo(t *testing.T) {
+	b := broker.New(broker.Options{})
+	conn := startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacketWithProps(t, "quiet", []byte{mqtt.RequestProblemInfoCode, 0x00}))
+	readTestPacket(t, conn)
+
+	// the reason code is still sent, but without a Reason String.
+	writeTestPacket(t, conn, publishPacket(t, "nobody/listens", 1, 3, "x"))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.PubackCode, false, false, 0), []byte{0x00, 0x03, mqtt.ReasonNoMatchingSubscribers})
+	writeTestPacket(t, conn, subscribePacket(t, 4, "a/#/b", 0x00))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.SubackCode, false, false, 0), []byte{0x00, 0x04, 0x00, mqtt.ReasonTopicFilterInvalid})
+}
+
+func TestMqtt311(t *testing.T) {
+	b := broker.New(broker.Options{ResponseInfo: "reply/%c/"})
+	sub := startTestClient(t, b)
+	writeTestPacket(t, sub, connectPacketV311(t, "legacy"))
+	checkTestPacket(t, sub, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), []byte{0x00, mqtt.ReturnCodeAccepted})
+	pub := connectTestClient(t, b, "modern")
+
+	// no properties, and a single failure code.
+	writeTestPacket(t, sub, buildTestPacket(t, mqtt.SetRequestType(mqtt.SubscribeCode, false, false, 0), func(w *packet.Writer) {
+		w.PutUint16(1)
+		w.PutUtf8Str("sensors/#")
+		w.PutByte(0x01)
+		w.PutUtf8Str("bad/#/filter")
+		w.PutByte(0x00)
+	}))
+	checkTestPacket(t, sub, mqtt.SetRequestType(mqtt.SubackCode, false, false, 0), []byte{0x00, 0x01, 0x01, mqtt.ReturnCodeSubackFailure})
+
+	// v5.0 properties are stripped.
+	props := []byte{mqtt.ContentTypeCode, 0x00, 0x01, 'x', mqtt.UserPropertyCode, 0x00, 0x01, 'k', 0x00, 0x01, 'v'}
+	writeTestPacket(t, pub, buildTestPacket(t, mqtt.SetRequestType(mqtt.PublishCode, false, false, 1), func(w *packet.Writer) {
+		w.PutUtf8Str("sensors/1")
+		w.PutUint16(9)
+		w.PutVarByteInt(uint32(len(props)))
+		w.PutBytes(props)
+		w.PutBytes([]byte("21"))
+	}))
+	expected := []byte{0x00, 0x09, 's', 'e', 'n', 's', 'o', 'r', 's', '/', '1', 0x00, 0x01, '2', '1'}
+	checkTestPacket(t, sub, mqtt.SetRequestType(mqtt.PublishCode, false, false, 1), expected)
+	readTestPacket(t, pub)
+	writeTestPacket(t, sub, buildTestPacket(t, mqtt.SetRequestType(mqtt.PubackCode, false, false, 0), func(w *packet.Writer) {
+		w.PutUint16(1)
+	}))
+
+	// and the other way around, with v3.1.1 acks.
+	writeTestPacket(t, pub, subscribePacket(t, 1, "cmd", 0x00))
+	readTestPacket(t, pub)
+	writeTestPacket(t, sub, buildTestPacket(t, mqtt.SetRequestType(mqtt.PublishCode, false, false, 1), func(w *packet.Writer) {
+		w.PutUtf8Str("cmd")
+		w.PutUint16(4)
+		w.PutBytes([]byte("on"))
+	}))
+	checkTestPacket(t, pub, mqtt.SetRequestType(mqtt.PublishCode, false, false, 0), []byte{0x00, 0x03, 'c', 'm', 'd', 0x00, 'o', 'n'})
+	checkTestPacket(t, sub, mqtt.SetRequestType(mqtt.PubackCode, false, false, 0), []byte{0x00, 0x04})
+
+	// v3.1.1 has no way to say retained messages aren't supported, so they are published like any other.
+	writeTestPacket(t, sub, buildTestPacket(t, mqtt.SetRequestType(mqtt.PublishCode, false, true, 1), func(w *packet.Writer) {
+		w.PutUtf8Str("cmd")
+		w.PutUint16(5)
+		w.PutBytes([]byte("on"))
+	}))
+	checkTestPacket(t, pub, mqtt.SetRequestType(mqtt.PublishCode, false, false, 0), []byte{0x00, 0x03, 'c', 'm', 'd', 0x00, 'o', 'n'})
+	checkTestPacket(t, sub, mqtt.SetRequestType(mqtt.PubackCode, false, false, 0), []byte{0x00, 0x05})
+
+	// a client ID is only assigned with Clean Session.
+	conn := startTestClient(t, b)
+	writeTestPacket(t, conn, buildTestPacket(t, mqtt.SetRequestType(mqtt.ConnectCode, false, false, 0), func(w *packet.Writer) {
+		w.PutUtf8Str(mqtt.ProtocolName)
+		w.PutByte(mqtt.ProtocolLevel311)
+		w.PutByte(0x00)
+		w.PutUint16(60)
+		w.PutUtf8Str("")
+	}))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), []byte{0x00, mqtt.ReturnCodeIdentifierRejected})
+	checkClosed(t, conn)
+	conn = startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacketV311(t, ""))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), []byte{0x00, mqtt.ReturnCodeAccepted})
+}
+
+func TestUnsupportedProtocolVersion(t *testing.T) {
+	conn := startTestClient(t, broker.New(broker.Options{}))
+	writeTestPacket(t, conn, buildTestPacket(t, mqtt.SetRequestType(mqtt.ConnectCode, false, false, 0), func(w *packet.Writer) {
+		w.PutUtf8Str("MQTT")
+		w.PutByte(6)
+		w.PutByte(0x02)
+		w.PutUint16(60)
+		w.PutUtf8Str("future")
+	}))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), []byte{0x00, mqtt.ReturnCodeUnacceptableProtocol})
+}
+
+func TestMqtt31(t *testing.T) {
+	b := broker.New(broker.Options{})
+	sub := startTestClient(t, b)
+	writeTestPacket(t, sub, connectPacketLegacy(t, mqtt.ProtocolName31, mqtt.ProtocolLevel31, "gateway-7"))
+	checkTestPacket(t, sub, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), []byte{0x00, mqtt.ReturnCodeAccepted})
+	writeTestPacket(t, sub, subscribePacket311(t, 1, "plant/#", 0x00))
+	checkTestPacket(t, sub, mqtt.SetRequestType(mqtt.SubackCode, false, false, 0), []byte{0x00, 0x01, 0x00})
+
+	pub := connectTestClient(t, b, "modern")
+	writeTestPacket(t, pub, publishPacket(t, "plant/valve", 0, 0, "open"))
+	expected := []byte{0x00, 0x0B, 'p', 'l', 'a', 'n', 't', '/', 'v', 'a', 'l', 'v', 'e', 'o', 'p', 'e', 'n'}
+	checkTestPacket(t, sub, mqtt.SetRequestType(mqtt.PublishCode, false, false, 0), expected)
+
+	tooLong := startTestClient(t, b)
+	writeTestPacket(t, tooLong, connectPacketLegacy(t, mqtt.ProtocolName31, mqtt.ProtocolLevel31, "a-client-id-of-24-chars!"))
+	checkTestPacket(t, tooLong, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), []byte{0x00, mqtt.ReturnCodeIdentifierRejected})
+	// the limit is in characters, not bytes.
+	wide := startTestClient(t, b)
+	writeTestPacket(t, wide, connectPacketLegacy(t, mqtt.ProtocolName31, mqtt.ProtocolLevel31, "capteur-température-été"))
+	checkTestPacket(t, wide, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), []byte{0x00, mqtt.ReturnCodeAccepted})
+	// v3.1 servers don't assign client IDs.
+	empty := startTestClient(t, b)
+	writeTestPacket(t, empty, connectPacketLegacy(t, mqtt.ProtocolName31, mqtt.ProtocolLevel31, ""))
+	checkTestPacket(t, empty, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), []byte{0x00, mqtt.ReturnCodeIdentifierRejected})
+
+	// MQIsdp only goes with v3.1.
+	wrongLevel := startTestClient(t, b)
+	writeTestPacket(t, wrongLevel, connectPacketLegacy(t, mqtt.ProtocolName31, mqtt.ProtocolLevel311, "mixed"))
+	checkTestPacket(t, wrongLevel, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), []byte{0x00, mqtt.ReturnCodeUnacceptableProtocol})
+}
+
+// challengeAuth is an authentication method that sends a single challenge, and expects "answer" back.
+type challengeAuth struct{}
+
+func (challengeAuth) Method() string { return "CHALLENGE" }
+
+func (challengeAuth) Start(clientId string) auth.Exchange { return &challengeExchange{} }
+
+type challengeExchange struct {
+	challenged bool
+}
+
+func (e *challengeExchange) Next(data []byte) ([]byte, bool, error) {
+	if !e.challenged {
+		e.challenged = true
+		return []byte("question"), false, nil
+	} else if string(data) != "answer" {
+		return nil, false, errors.New("wrong answer")
+	}
+	return []byte("ok"), true, nil
+}
+
+func (e *challengeExchange) Identity() *auth.Identity { return nil }
+
+// authPacket builds an AUTH packet from the client for the CHALLENGE method.
+func authPacket(t *testing.T, reasonCode byte, data string) []byte {
+	return buildTestPacket(t, mqtt.SetRequestType(mqtt.AuthCode, false, false, 0), func(w *packet.Writer) {
+		w.PutByte(reasonCode)
+		props := packet.NewWriter()
+		props.PutByte(mqtt.AuthenticationMethodCode)
+		props.PutUtf8Str("CHALLENGE")
+		props.PutByte(mqtt.AuthenticationDataCode)
+		props.PutBinaryData([]byte(data))
+		buf, _ := props.Bytes()
+		w.PutVarByteInt(uint32(len(buf)))
+		w.PutBytes(buf)
+	})
+}
+
+func TestEnhancedAuth(t *testing.T) {
+	b := broker.New(broker.Options{Authenticators: []auth.Authenticator{challengeAuth{}}})
+	method := []byte{mqtt.AuthenticationMethodCode, 0x00, 0x09, 'C', 'H', 'A', 'L', 'L', 'E', 'N', 'G', 'E'}
+	conn := startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacketWithProps(t, "secure", method))
+	expected := []byte{mqtt.ReasonContinueAuthentication, byte(len(method) + 11)}
+	expected = append(expected, method...)
+	expected = append(expected, mqtt.AuthenticationDataCode, 0x00, 0x08, 'q', 'u', 'e', 's', 't', 'i', 'o', 'n')
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.AuthCode, false, false, 0), expected)
+
+	writeTestPacket(t, conn, authPacket(t, mqtt.ReasonContinueAuthentication, "answer"))
+	expected = []byte{0x00, mqtt.ReasonSuccess, byte(2 + len(method) + 5), mqtt.RetainAvailableCode, 0x00}
+	expected = append(expected, method...)
+	expected = append(expected, mqtt.AuthenticationDataCode, 0x00, 0x02, 'o', 'k')
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), expected)
+
+	// re-authentication goes through the same exchange, but ends with AUTH instead of CONNACK.
+	writeTestPacket(t, conn, authPacket(t, mqtt.ReasonReAuthenticate, ""))
+	readTestPacket(t, conn)
+	writeTestPacket(t, conn, authPacket(t, mqtt.ReasonContinueAuthentication, "answer"))
+	expected = []byte{mqtt.ReasonSuccess, byte(len(method) + 5)}
+	expected = append(expected, method...)
+	expected = append(expected, mqtt.AuthenticationDataCode, 0x00, 0x02, 'o', 'k')
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.AuthCode, false, false, 0), expected)
+
+	// failing re-authentication disconnects the client.
+	writeTestPacket(t, conn, authPacket(t, mqtt.ReasonReAuthenticate, ""))
+	readTestPacket(t, conn)
+	writeTestPacket(t, conn, authPacket(t, mqtt.ReasonContinueAuthentication, "guess"))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.DisconnectCode, false, false, 0), []byte{mqtt.ReasonNotAuthorized, 0x00})
+}
+
+func TestReAuthRemovedMethod(t *testing.T) {
+	b := broker.New(broker.Options{Authenticators: []auth.Authenticator{challengeAuth{}}})
+	conn := startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacketWithProps(t, "secure", []byte{mqtt.AuthenticationMethodCode, 0x00, 0x09, 'C', 'H', 'A', 'L', 'L', 'E', 'N', 'G', 'E'}))
+	readTestPacket(t, conn)
+	writeTestPacket(t, conn, authPacket(t, mqtt.ReasonContinueAuthentication, "answer"))
+	readTestPacket(t, conn)
+
+	// a reload can remove the method the client connected with.
+	b.SetOptions(broker.Options{})
+	writeTestPacket(t, conn, authPacket(t, mqtt.ReasonReAuthenticate, ""))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.DisconnectCode, false, false, 0), []byte{mqtt.ReasonBadAuthenticationMethod, 0x00})
+}
+
+func TestEnhancedAuthRefused(t *testing.T) {
+	b := broker.New(broker.Options{Authenticators: []auth.Authenticator{challengeAuth{}}})
+	conn := startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacketWithProps(t, "secure", []byte{mqtt.AuthenticationMethodCode, 0x00, 0x03, 'F', 'O', 'O'}))
+	reason := "unsupported authentication method FOO"
+	expected := []byte{0x00, mqtt.ReasonBadAuthenticationMethod, byte(3 + len(reason)), mqtt.ReasonStringCode, 0x00, byte(len(reason))}
+	expected = append(expected, []byte(reason)...)
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), expected)
+
+	conn = startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacketWithProps(t, "secure", []byte{mqtt.AuthenticationMethodCode, 0x00, 0x09, 'C', 'H', 'A', 'L', 'L', 'E', 'N', 'G', 'E'}))
+	readTestPacket(t, conn)
+	writeTestPacket(t, conn, authPacket(t, mqtt.ReasonContinueAuthentication, "guess"))
+	reason = "wrong answer"
+	expected = []byte{0x00, mqtt.ReasonNotAuthorized, byte(3 + len(reason)), mqtt.ReasonStringCode, 0x00, byte(len(reason))}
+	expected = append(expected, []byte(reason)...)
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), expected)
+}
+
+// checkPasswordConnect connects with the User Name and Password, and checks the CONNACK reason code.
+func checkPasswordConnect(t *testing.T, b *broker.Broker, protocolLevel byte, userName, password string, expectedCode byte) {
+	conn := startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacketWithPassword(t, protocolLevel, "sensor", userName, password))
+	firstByte, body := readTestPacket(t, conn)
+	if firstByte != mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0) || len(body) < 2 {
+		t.Fatalf("expected a CONNACK, got %#x %v", firstByte, body)
+	} else if body[1] != expectedCode {
+		t.Fatalf("%v:%v got CONNACK code %#x, expected %#x", userName, password, body[1], expectedCode)
+	}
+}
+
+func TestPasswordFile(t *testing.T) {
+	// the lowest cost keeps each check well within readTestPacket's deadline, even with -race.
+	hash, err := bcrypt.GenerateFromPassword([]byte("wonderland"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "passwd")
+	if err := ioutil.WriteFile(path, []byte("alice:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	passwords, err := auth.ReadPasswordFile(path)
+	if err != nil {
+		t.Fatalf("ReadPasswordFile failed: %v", err.Error())
+	}
+	b := broker.New(broker.Options{PasswordChecker: passwords})
+	checkPasswordConnect(t, b, mqtt.ProtocolLevel5, "alice", "wonderland", mqtt.ReasonSuccess)
+	checkPasswordConnect(t, b, mqtt.ProtocolLevel5, "alice", "looking-glass", mqtt.ReasonBadUserNameOrPassword)
+	checkPasswordConnect(t, b, mqtt.ProtocolLevel5, "bob", "wonderland", mqtt.ReasonBadUserNameOrPassword)
+	checkPasswordConnect(t, b, mqtt.ProtocolLevel311, "alice", "wonderland", mqtt.ReturnCodeAccepted)
+	checkPasswordConnect(t, b, mqtt.ProtocolLevel311, "alice", "looking-glass", mqtt.ReturnCodeBadUserNameOrPassword)
+
+	conn := startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacket(t, "anonymous"))
+	firstByte, body := readTestPacket(t, conn)
+	if firstByte != mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0) || len(body) < 2 || body[1] != mqtt.ReasonNotAuthorized {
+		t.Fatalf("client without a password should be refused with Not authorized, got %#x %v", firstByte, body)
+	}
+}
+
+// prefixAuthorizer only allows topics under allowed/.
+type prefixAuthorizer struct{}
+
+func (prefixAuthorizer) Authorize(clientId, userName string, access auth.Access, topic string) bool {
+	return strings.HasPrefix(topic, "allowed/")
+}
+
+func TestAuthorize(t *testing.T) {
+	b := broker.New(broker.Options{Authorizer: prefixAuthorizer{}, ResponseInfo: "reply/%c/", GrantResponseTopics: true})
+	conn := connectTestClient(t, b, "c1")
+	writeTestPacket(t, conn, subscribePacket(t, 1, "secret/#", 0x01))
+	reason := "not authorized to use topic secret/#"
+	expected := []byte{0x00, 0x01, byte(3 + len(reason)), mqtt.ReasonStringCode, 0x00, byte(len(reason))}
+	expected = append(expected, []byte(reason)...)
+	expected = append(expected, mqtt.ReasonNotAuthorized)
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.SubackCode, false, false, 0), expected)
+
+	// the client's own response topics are always allowed.
+	writeTestPacket(t, conn, subscribePacket(t, 2, "reply/c1/#", 0x01))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.SubackCode, false, false, 0), []byte{0x00, 0x02, 0x00, mqtt.ReasonGrantedQoS1})
+	writeTestPacket(t, conn, subscribePacket(t, 3, "reply/c2/#", 0x01))
+	firstByte, body := readTestPacket(t, conn)
+	if firstByte != mqtt.SetRequestType(mqtt.SubackCode, false, false, 0) || body[len(body)-1] != mqtt.ReasonNotAuthorized {
+		t.Fatalf("subscribing to another client's response topics should be denied, got %#x %v", firstByte, body)
+	}
+
+	reason = "not authorized to use topic secret/x"
+	writeTestPacket(t, conn, publishPacket(t, "secret/x", 1, 7, "x"))
+	expected = []byte{0x00, 0x07, mqtt.ReasonNotAuthorized, byte(3 + len(reason)), mqtt.ReasonStringCode, 0x00, byte(len(reason))}
+	expected = append(expected, []byte(reason)...)
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.PubackCode, false, false, 0), expected)
+	writeTestPacket(t, conn, publishPacket(t, "secret/x", 2, 8, "x"))
+	expected[1] = 0x08
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.PubrecCode, false, false, 0), expected)
+
+	// QoS 0 messages are dropped without closing the connection.
+	writeTestPacket(t, conn, publishPacket(t, "secret/x", 0, 0, "x"))
+	writeTestPacket(t, conn, publishPacket(t, "allowed/x", 1, 9, "x"))
+	firstByte, body = readTestPacket(t, conn)
+	if firstByte != mqtt.SetRequestType(mqtt.PubackCode, false, false, 0) || body[2] != mqtt.ReasonNoMatchingSubscribers {
+		t.Fatalf("publishing to an allowed topic should be accepted, got %#x %v", firstByte, body)
+	}
+}
+
+// tokenChecker accepts the password "token", which only grants publishing under apps/app-42/.
+type tokenChecker struct{}
+
+func (tokenChecker) CheckPassword(clientId, userName string, password []byte) (*auth.Identity, error) {
+	if string(password) != "token" {
+		return nil, mqtt.NewReasonError(mqtt.ReasonBadUserNameOrPassword, "invalid token")
+	}
+	return &auth.Identity{UserName: "app-42", Authorizer: &auth.TopicGrants{Publish: []string{"apps/app-42/#"}}}, nil
+}
+
+func TestIdentityAuthorizer(t *testing.T) {
+	b := broker.New(broker.Options{PasswordChecker: tokenChecker{}})
+	checkPasswordConnect(t, b, mqtt.ProtocolLevel5, "ignored", "other", mqtt.ReasonBadUserNameOrPassword)
+
+	conn := startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacketWithPassword(t, mqtt.ProtocolLevel5, "phone", "ignored", "token"))
+	readTestPacket(t, conn)
+	writeTestPacket(t, conn, publishPacket(t, "apps/app-43/status", 1, 1, "x"))
+	firstByte, body := readTestPacket(t, conn)
+	if firstByte != mqtt.SetRequestType(mqtt.PubackCode, false, false, 0) || body[2] != mqtt.ReasonNotAuthorized {
+		t.Fatalf("publishing outside the granted topics should be denied, got %#x %v", firstByte, body)
+	}
+	writeTestPacket(t, conn, publishPacket(t, "apps/app-42/status", 1, 2, "x"))
+	firstByte, body = readTestPacket(t, conn)
+	if firstByte != mqtt.SetRequestType(mqtt.PubackCode, false, false, 0) || body[2] != mqtt.ReasonNoMatchingSubscribers {
+		t.Fatalf("publishing to the granted topics should be accepted, got %#x %v", firstByte, body)
+	}
+	// subscribing isn't restricted by the grants.
+	writeTestPacket(t, conn, subscribePacket(t, 3, "apps/#", 0x00))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.SubackCode, false, false, 0), []byte{0x00, 0x03, 0x00, mqtt.ReasonSuccess})
+}
+
+// testClientCert returns a self-signed certificate for both ends of a TLS connection, with the common name.
+func testClientCert(t *testing.T, commonName string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// startTestTLSClient starts a client behind TLS on one end of a pipe, and returns the other end using the certificate.
+func startTestTLSClient(t *testing.T, b *broker.Broker, cert tls.Certificate, cas *x509.CertPool) net.Conn {
+	server, conn := net.Pipe()
+	serveTestClient(b, tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: cas}), nil)
+	// closing the pipe rather than the TLS connection, which would wait for the close alert to be read.
+	t.Cleanup(func() { conn.Close() })
+	return tls.Client(conn, &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true})
+}
+
+// userAuthorizer only allows topics under devices/<username>/.
+type userAuthorizer struct{}
+
+func (userAuthorizer) Authorize(clientId, userName string, access auth.Access, topic string) bool {
+	return strings.HasPrefix(topic, "devices/"+userName+"/")
+}
+
+func TestCertIdentity(t *testing.T) {
+	cert, cas := testClientCert(t, "gateway-7")
+	userNames, err := auth.NewCertIdentity(auth.CertCommonName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the certificate is enough, no password is checked.
+	b := broker.New(broker.Options{PasswordChecker: tokenChecker{}, Authorizer: userAuthorizer{}, CertIdentity: userNames})
+	conn := startTestTLSClient(t, b, cert, cas)
+	writeTestPacket(t, conn, connectPacket(t, "phone"))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), []byte{0x00, mqtt.ReasonSuccess, 0x02, mqtt.RetainAvailableCode, 0x00})
+	writeTestPacket(t, conn, subscribePacket(t, 1, "devices/gateway-7/#", 0x00))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.SubackCode, false, false, 0), []byte{0x00, 0x01, 0x00, mqtt.ReasonSuccess})
+
+	clientIds, err := auth.NewCertIdentity(auth.CertCommonName, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = broker.New(broker.Options{PasswordChecker: tokenChecker{}, Authorizer: userAuthorizer{}, CertIdentity: clientIds})
+	conn = startTestTLSClient(t, b, cert, cas)
+	writeTestPacket(t, conn, connectPacketWithPassword(t, mqtt.ProtocolLevel5, "phone", "victim", "guess"))
+	expected := []byte{0x00, mqtt.ReasonSuccess, 14, mqtt.RetainAvailableCode, 0x00, mqtt.AssignedClientIdCode, 0x00, 9}
+	expected = append(expected, []byte("gateway-7")...)
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), expected)
+	// the unchecked User Name is replaced too, so it grants none of that user's topics.
+	writeTestPacket(t, conn, subscribePacket(t, 1, "devices/victim/#", 0x00))
+	if _, body := readTestPacket(t, conn); body[len(body)-1] != mqtt.ReasonNotAuthorized {
+		t.Fatalf("subscribing to the topics of the User Name sent should be denied, got %v", body)
+	}
+	writeTestPacket(t, conn, subscribePacket(t, 2, "devices/gateway-7/#", 0x00))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.SubackCode, false, false, 0), []byte{0x00, 0x02, 0x00, mqtt.ReasonSuccess})
+
+	// without a certificate, the client needs a password.
+	b = broker.New(broker.Options{PasswordChecker: tokenChecker{}, CertIdentity: userNames})
+	server, pipe := net.Pipe()
+	defer pipe.Close()
+	serveTestClient(b, tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: cas}), nil)
+	conn = tls.Client(pipe, &tls.Config{InsecureSkipVerify: true})
+	writeTestPacket(t, conn, connectPacket(t, "phone"))
+	firstByte, body := readTestPacket(t, conn)
+	if firstByte != mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0) || len(body) < 2 || body[1] != mqtt.ReasonBadUserNameOrPassword {
+		t.Fatalf("client without a certificate or password should be refused, got %#x %v", firstByte, body)
+	}
+}
+
+// proxiedConn is a connection from a proxy that terminated TLS, as a listener with the PROXY protocol returns it.
+type proxiedConn struct {
+	net.Conn
+	header *listener.ProxyHeader
+}
+
+func (c *proxiedConn) ProxyHeader() *listener.ProxyHeader {
+	return c.header
+}
+
+func TestProxiedCertIdentity(t *testing.T) {
+	userNames, err := auth.NewCertIdentity(auth.CertCommonName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := broker.New(broker.Options{PasswordChecker: tokenChecker{}, Authorizer: userAuthorizer{}, CertIdentity: userNames})
+	server, conn := net.Pipe()
+	defer conn.Close()
+	serveTestClient(b, &proxiedConn{server, &listener.ProxyHeader{Version: 2, TLS: &listener.ProxyTLS{CommonName: "gateway-7", CertVerified: true}}}, nil)
+	writeTestPacket(t, conn, connectPacket(t, "phone"))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), []byte{0x00, mqtt.ReasonSuccess, 0x02, mqtt.RetainAvailableCode, 0x00})
+	writeTestPacket(t, conn, subscribePacket(t, 1, "devices/gateway-7/#", 0x00))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.SubackCode, false, false, 0), []byte{0x00, 0x01, 0x00, mqtt.ReasonSuccess})
+
+	// a certificate the proxy didn't verify identifies nobody.
+	server, conn = net.Pipe()
+	defer conn.Close()
+	serveTestClient(b, &proxiedConn{server, &listener.ProxyHeader{Version: 2, TLS: &listener.ProxyTLS{CommonName: "gateway-7"}}}, nil)
+	writeTestPacket(t, conn, connectPacket(t, "phone"))
+	firstByte, body := readTestPacket(t, conn)
+	if firstByte != mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0) || len(body) < 2 || body[1] != mqtt.ReasonBadUserNameOrPassword {
+		t.Fatalf("client with an unverified certificate should be refused, got %#x %v", firstByte, body)
+	}
+}
+
+func TestListenerSettings(t *testing.T) {
+	b := broker.New(broker.Options{PasswordChecker: tokenChecker{}, Authorizer: prefixAuthorizer{}})
+	server, conn := net.Pipe()
+	defer conn.Close()
+	serveTestClient(b, server, &Listener{Name: "v5 only", ProtocolLevels: []byte{mqtt.ProtocolLevel5}})
+	writeTestPacket(t, conn, connectPacketWithPassword(t, mqtt.ProtocolLevel311, "c1", "app-42", "token"))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), []byte{0x00, mqtt.ReturnCodeUnacceptableProtocol})
+
+	// anonymous listeners neither check passwords nor authorize topics.
+	server, conn = net.Pipe()
+	defer conn.Close()
+	serveTestClient(b, server, &Listener{Name: "internal", Anonymous: true})
+	writeTestPacket(t, conn, connectPacket(t, "c2"))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), []byte{0x00, mqtt.ReasonSuccess, 0x02, mqtt.RetainAvailableCode, 0x00})
+	writeTestPacket(t, conn, subscribePacket(t, 1, "secret/#", 0x00))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.SubackCode, false, false, 0), []byte{0x00, 0x01, 0x00, mqtt.ReasonSuccess})
+}
+
+// peerConn is a connection with the credentials of a local process, like a Unix socket.
+type peerConn struct {
+	net.Conn
+	uid uint32
+}
+
+func (c *peerConn) PeerCredentials() (uid, gid uint32, ok bool) {
+	return c.uid, 0, true
+}
+
+func TestPeerCredentials(t *testing.T) {
+	uid := uint32(os.Getuid())
+	b := broker.New(broker.Options{PasswordChecker: tokenChecker{}, Authorizer: userAuthorizer{}})
+	server, conn := net.Pipe()
+	defer conn.Close()
+	serveTestClient(b, &peerConn{server, uid}, &Listener{Name: "unix", PeerCredentials: true})
+	writeTestPacket(t, conn, connectPacket(t, "c1"))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), []byte{0x00, mqtt.ReasonSuccess, 0x02, mqtt.RetainAvailableCode, 0x00})
+	topic := "devices/" + auth.LocalUserName(uid) + "/#"
+	writeTestPacket(t, conn, subscribePacket(t, 1, topic, 0x00))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.SubackCode, false, false, 0), []byte{0x00, 0x01, 0x00, mqtt.ReasonSuccess})
+
+	// other listeners ignore the credentials.
+	server, conn = net.Pipe()
+	defer conn.Close()
+	serveTestClient(b, &peerConn{server, uid}, nil)
+	writeTestPacket(t, conn, connectPacket(t, "c2"))
+	firstByte, body := readTestPacket(t, conn)
+	if firstByte != mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0) || len(body) < 2 || body[1] != mqtt.ReasonBadUserNameOrPassword {
+		t.Fatalf("client without a password should be refused, got %#x %v", firstByte, body)
+	}
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	b := broker.New(broker.Options{MaxPacketSize: 64})
+	conn := startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacket(t, "c1"))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0),
+		[]byte{0x00, mqtt.ReasonSuccess, 0x07, mqtt.RetainAvailableCode, 0x00, mqtt.MaxPacketSizeCode, 0x00, 0x00, 0x00, 64})
+	writeTestPacket(t, conn, publishPacket(t, "small", 0, 0, strings.Repeat("x", 50)))
+	writeTestPacket(t, conn, publishPacket(t, "big", 0, 0, strings.Repeat("x", 60)))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.DisconnectCode, false, false, 0), []byte{mqtt.ReasonPacketTooLarge, 0x00})
+}
+
+func TestShutdown(t *testing.T) {
+	b := broker.New(broker.Options{})
+	sub := connectTestClient(t, b, "sub")
+	pub := connectTestClient(t, b, "pub")
+	writeTestPacket(t, sub, subscribePacket(t, 1, "t", 0x01))
+	checkTestPacket(t, sub, mqtt.SetRequestType(mqtt.SubackCode, false, false, 0), []byte{0x00, 0x01, 0x00, mqtt.ReasonGrantedQoS1})
+	writeTestPacket(t, pub, publishPacket(t, "t", 1, 8, "hi"))
+	checkTestPacket(t, sub, mqtt.SetRequestType(mqtt.PublishCode, false, false, 1), []byte{0x00, 0x01, 't', 0x00, 0x01, 0x00, 'h', 'i'})
+	checkTestPacket(t, pub, mqtt.SetRequestType(mqtt.PubackCode, false, false, 0), []byte{0x00, 0x08})
+
+	done := make(chan struct{})
+	go func() {
+		b.Shutdown(time.Second * 5)
+		close(done)
+	}()
+	disconnect := mqtt.SetRequestType(mqtt.DisconnectCode, false, false, 0)
+	checkTestPacket(t, pub, disconnect, []byte{mqtt.ReasonServerShuttingDown, 0x00})
+	// the subscriber stays connected until its message is acknowledged.
+	writeTestPacket(t, sub, buildTestPacket(t, mqtt.SetRequestType(mqtt.PubackCode, false, false, 0), func(w *packet.Writer) {
+		w.PutUint16(1)
+	}))
+	checkTestPacket(t, sub, disconnect, []byte{mqtt.ReasonServerShuttingDown, 0x00})
+	<-done
+
+	refused := startTestClient(t, b)
+	writeTestPacket(t, refused, connectPacket(t, "new"))
+	if firstByte, body := readTestPacket(t, refused); mqtt.GetRequestType(firstByte) != mqtt.ConnackCode || body[1] != mqtt.ReasonServerUnavailable {
+		t.Fatalf("expected a CONNACK with Server unavailable, got %08b %v", firstByte, body)
+	}
+}
+
+func TestShutdownSessions(t *testing.T) {
+	b := broker.New(broker.Options{})
+	// a session that never expires outlives the connection, one that expires at once doesn't.
+	sub := startTestClient(t, b)
+	writeTestPacket(t, sub, connectPacketWithProps(t, "sub", []byte{mqtt.SessionExpiryIntervalCode, 0xFF, 0xFF, 0xFF, 0xFF}))
+	readTestPacket(t, sub)
+	pub := connectTestClient(t, b, "pub")
+	writeTestPacket(t, sub, subscribePacket(t, 1, "t", 0x01))
+	checkTestPacket(t, sub, mqtt.SetRequestType(mqtt.SubackCode, false, false, 0), []byte{0x00, 0x01, 0x00, mqtt.ReasonGrantedQoS1})
+	writeTestPacket(t, pub, publishPacket(t, "t", 1, 8, "hi"))
+	checkTestPacket(t, sub, mqtt.SetRequestType(mqtt.PublishCode, false, false, 1), []byte{0x00, 0x01, 't', 0x00, 0x01, 0x00, 'h', 'i'})
+	checkTestPacket(t, pub, mqtt.SetRequestType(mqtt.PubackCode, false, false, 0), []byte{0x00, 0x08})
+
+	// the message is never acknowledged, so it is still in flight once the timeout is over.
+	done := make(chan struct{})
+	go func() {
+		b.Shutdown(time.Millisecond * 50)
+		close(done)
+	}()
+	disconnect := mqtt.SetRequestType(mqtt.DisconnectCode, false, false, 0)
+	checkTestPacket(t, pub, disconnect, []byte{mqtt.ReasonServerShuttingDown, 0x00})
+	checkTestPacket(t, sub, disconnect, []byte{mqtt.ReasonServerShuttingDown, 0x00})
+	<-done
+
+	sessions := b.Sessions()
+	if len(sessions) != 1 || sessions[0].ClientId != "sub" || !sessions[0].Expires.IsZero() {
+		t.Fatalf("expected the session of sub only, without expiry, got %+v", sessions)
+	}
+	s := sessions[0]
+	if len(s.Subscriptions) != 1 || s.Subscriptions[0].Filter != "t" || s.Subscriptions[0].Options.Qos != 1 {
+		t.Fatalf("expected the subscription to t, got %+v", s.Subscriptions)
+	} else if len(s.Messages) != 1 || s.Messages[0].PacketId != 1 || string(s.Messages[0].Payload) != "hi" {
+		t.Fatalf("expected the message in flight, got %+v", s.Messages)
+	}
+}
+
+func TestPing(t *testing.T) {
+	b := broker.New(broker.Options{})
+	conn := connectTestClient(t, b, "c1")
+	writeTestPacket(t, conn, []byte{mqtt.SetRequestType(mqtt.PingreqCode, false, false, 0), 0x00})
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.PingrespCode, false, false, 0), []byte{})
+}
+
+func checkServerOnlyPacket(t *testing.T, b *broker.Broker, packetCode uint8) {
+	conn := connectTestClient(t, b, "c1")
+	writeTestPacket(t, conn, []byte{mqtt.SetRequestType(packetCode, false, false, 0), 0x00})
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.DisconnectCode, false, false, 0), []byte{mqtt.ReasonProtocolError, 0x00})
+	// only that connection is closed.
+	other := connectTestClient(t, b, "c2")
+	writeTestPacket(t, other, []byte{mqtt.SetRequestType(mqtt.PingreqCode, false, false, 0), 0x00})
+	checkTestPacket(t, other, mqtt.SetRequestType(mqtt.PingrespCode, false, false, 0), []byte{})
+}
+
+func TestServerOnlyPackets(t *testing.T) {
+	b := broker.New(broker.Options{})
+	checkServerOnlyPacket(t, b, mqtt.ConnackCode)
+	checkServerOnlyPacket(t, b, mqtt.SubackCode)
+	checkServerOnlyPacket(t, b, mqtt.UnsubackCode)
+	checkServerOnlyPacket(t, b, mqtt.PingrespCode)
+
+	// older clients can't be sent a DISCONNECT, their connection is only closed.
+	conn := startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacketV311(t, "old"))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), []byte{0x00, 0x00})
+	writeTestPacket(t, conn, []byte{mqtt.SetRequestType(mqtt.PingrespCode, false, false, 0), 0x00})
+	checkClosed(t, conn)
+}
+
+// checkRefusedPacket checks that the packet disconnects the client with the reason code.
+func checkRefusedPacket(t *testing.T, b *broker.Broker, p []byte, expectedReason byte) {
+	conn := connectTestClient(t, b, "c1")
+	writeTestPacket(t, conn, p)
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.DisconnectCode, false, false, 0), []byte{expectedReason, 0x00})
+	checkClosed(t, conn)
+}
+
+func TestRefusedPacketReasons(t *testing.T) {
+	b := broker.New(broker.Options{})
+	retained := publishPacket(t, "t", 0, 0, "x")
+	retained[0] |= 0x01
+	checkRefusedPacket(t, b, retained, mqtt.ReasonRetainNotSupported)
+	checkRefusedPacket(t, b, publishPacket(t, "t/+", 0, 0, "x"), mqtt.ReasonTopicNameInvalid)
+	aliased := buildTestPacket(t, mqtt.SetRequestType(mqtt.PublishCode, false, false, 0), func(w *packet.Writer) {
+		w.PutUtf8Str("t")
+		w.PutVarByteInt(3)
+		w.PutBytes([]byte{mqtt.TopicAliasCode, 0x00, 0x01})
+	})
+	checkRefusedPacket(t, b, aliased, mqtt.ReasonTopicAliasInvalid)
+	// SUBSCRIBE must have the flags 0010.
+	checkRefusedPacket(t, b, []byte{mqtt.SubscribeCode << 4, 0x00}, mqtt.ReasonMalformedPacket)
+	checkRefusedPacket(t, b, []byte{mqtt.SetRequestType(mqtt.PingreqCode, false, false, 0), 0x01, 0x00}, mqtt.ReasonMalformedPacket)
+	serverReference := []byte{mqtt.SetRequestType(mqtt.DisconnectCode, false, false, 0), 0x06, 0x00, 0x04, mqtt.ServerReferenceCode, 0x00, 0x01, 'x'}
+	checkRefusedPacket(t, b, serverReference, mqtt.ReasonProtocolError)
+
+	// invalid properties in CONNECT refuse the connection, with a reason string meant for the client.
+	conn := startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacketWithProps(t, "c1", []byte{mqtt.ReceiveMaxCode, 0x00, 0x00}))
+	reason := "invalid Receive Maximum 0"
+	expected := []byte{0x00, mqtt.ReasonProtocolError, byte(3 + len(reason)), mqtt.ReasonStringCode, 0x00, byte(len(reason))}
+	expected = append(expected, []byte(reason)...)
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), expected)
+
+	// re-authentication must keep the Authentication Method from CONNECT.
+	b = broker.New(broker.Options{Authenticators: []auth.Authenticator{challengeAuth{}}})
+	conn = startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacketWithProps(t, "secure", []byte{mqtt.AuthenticationMethodCode, 0x00, 0x09, 'C', 'H', 'A', 'L', 'L', 'E', 'N', 'G', 'E'}))
+	readTestPacket(t, conn)
+	writeTestPacket(t, conn, authPacket(t, mqtt.ReasonContinueAuthentication, "answer"))
+	readTestPacket(t, conn)
+	writeTestPacket(t, conn, []byte{mqtt.SetRequestType(mqtt.AuthCode, false, false, 0), 0x08, mqtt.ReasonReAuthenticate, 0x06, mqtt.AuthenticationMethodCode, 0x00, 0x03, 'F', 'O', 'O'})
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.DisconnectCode, false, false, 0), []byte{mqtt.ReasonProtocolError, 0x00})
+}
+
+// checkClosed checks that the client closed the connection without sending anything.
+func checkClosed(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestConnectFirst(t *testing.T) {
+	b := broker.New(broker.Options{Authenticators: []auth.Authenticator{challengeAuth{}}})
+	conn := startTestClient(t, b)
+	writeTestPacket(t, conn, publishPacket(t, "t", 0, 0, "x"))
+	checkClosed(t, conn)
+
+	// a second CONNECT is a Protocol Error.
+	conn = connectTestClient(t, b, "c1")
+	writeTestPacket(t, conn, connectPacket(t, "c1"))
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.DisconnectCode, false, false, 0), []byte{mqtt.ReasonProtocolError, 0x00})
+
+	// only AUTH and DISCONNECT may follow a CONNECT starting an enhanced authentication.
+	conn = startTestClient(t, b)
+	writeTestPacket(t, conn, connectPacketWithProps(t, "secure", []byte{mqtt.AuthenticationMethodCode, 0x00, 0x09, 'C', 'H', 'A', 'L', 'L', 'E', 'N', 'G', 'E'}))
+	readTestPacket(t, conn)
+	writeTestPacket(t, conn, subscribePacket(t, 1, "t", 0x00))
+	reason := "SUBSCRIBE is not allowed while authenticating"
+	expected := []byte{0x00, mqtt.ReasonProtocolError, byte(3 + len(reason)), mqtt.ReasonStringCode, 0x00, byte(len(reason))}
+	expected = append(expected, []byte(reason)...)
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.ConnackCode, false, false, 0), expected)
+}
+
+func TestConnectTimeout(t *testing.T) {
+	b := broker.New(broker.Options{ConnectTimeout: time.Millisecond * 50})
+	checkClosed(t, startTestClient(t, b))
+
+	// the timeout doesn't apply once connected.
+	conn := connectTestClient(t, b, "c1")
+	time.Sleep(time.Millisecond * 100)
+	writeTestPacket(t, conn, []byte{mqtt.SetRequestType(mqtt.PingreqCode, false, false, 0), 0x00})
+	checkTestPacket(t, conn, mqtt.SetRequestType(mqtt.PingrespCode, false, false, 0), []byte{})
+}
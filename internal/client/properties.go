@@ -18,8 +18,8 @@ func (client *Client) setConnectProps(props map[int][]byte) error {
 	if v, ok := props[mqtt.ReceiveMaxCode]; ok {
 		v_i := binary.BigEndian.Uint16(v)
 		if v_i <= 0 {
-			msg := fmt.Sprintf("setProperties: invalid ReceiveMax %d for Connect", v_i)
-			return errors.New(msg)
+			msg := fmt.Sprintf("invalid Receive Maximum %d", v_i)
+			return mqtt.NewReasonError(mqtt.ReasonProtocolError, msg)
 		}
 		client.ReceiveMaximum = v_i
 	} else {
@@ -28,8 +28,8 @@ func (client *Client) setConnectProps(props map[int][]byte) error {
 	if v, ok := props[mqtt.MaxPacketSizeCode]; ok {
 		v_i := binary.BigEndian.Uint32(v)
 		if v_i <= 0 {
-			msg := fmt.Sprintf("setProperties: invalid MaxPacketSize %d for Connect", v_i)
-			return errors.New(msg)
+			msg := fmt.Sprintf("invalid Maximum Packet Size %d", v_i)
+			return mqtt.NewReasonError(mqtt.ReasonProtocolError, msg)
 		}
 		client.MaxPacketSize = v_i
 	} // no default, unlimited.
@@ -41,8 +41,8 @@ func (client *Client) setConnectProps(props map[int][]byte) error {
 	if v, ok := props[mqtt.RequestResponseInfoCode]; ok {
 		v_i := uint(v[0]) // it's a single byte that can only be 0 or 1.
 		if v_i != 0 && v_i != 1 {
-			msg := fmt.Sprintf("setProperties: invalid RequestResponseInfo %d for Connect", v_i)
-			return errors.New(msg)
+			msg := fmt.Sprintf("invalid Request Response Information %d", v_i)
+			return mqtt.NewReasonError(mqtt.ReasonProtocolError, msg)
 		}
 		client.ReturnResponseInfo = (v_i == 1)
 	} else {
@@ -51,8 +51,8 @@ func (client *Client) setConnectProps(props map[int][]byte) error {
 	if v, ok := props[mqtt.RequestProblemInfoCode]; ok {
 		v_i := uint(v[0]) // it's a single byte that can only be 0 or 1.
 		if v_i != 0 && v_i != 1 {
-			msg := fmt.Sprintf("setProperties: invalid RequestProblemInfo %d for Connect", v_i)
-			return errors.New(msg)
+			msg := fmt.Sprintf("invalid Request Problem Information %d", v_i)
+			return mqtt.NewReasonError(mqtt.ReasonProtocolError, msg)
 		}
 		client.ReturnProblemInfo = (v_i == 1)
 	} else {
@@ -63,7 +63,7 @@ func (client *Client) setConnectProps(props map[int][]byte) error {
 	}
 	if v, ok := props[mqtt.AuthenticationDataCode]; ok {
 		if client.AuthMethod == "" {
-			return errors.New("setProperties: cannot set AuthData without AuthMethod")
+			return mqtt.NewReasonError(mqtt.ReasonProtocolError, "Authentication Data without an Authentication Method")
 		}
 		client.AuthData = v
 	}
@@ -73,29 +73,76 @@ func (client *Client) setConnectProps(props map[int][]byte) error {
 func (client *Client) setConnackProps(props map[int][]byte) error {
 	return errors.New("setProperties: Case not implemented yet for Connack")
 }
+
+// setPublishProps sets the properties of client.incoming, the message currently being received.
 func (client *Client) setPublishProps(props map[int][]byte) error {
-	return errors.New("setProperties: Case not implemented yet for Publish")
+	if client.incoming == nil {
+		return errors.New("setProperties: no incoming message for Publish")
+	}
+	if v, ok := props[mqtt.PayloadFormatIndicatorCode]; ok {
+		v_i := uint8(v[0]) // it's a single byte that can only be 0 or 1.
+		if v_i != 0 && v_i != 1 {
+			msg := fmt.Sprintf("invalid Payload Format Indicator %d", v_i)
+			return mqtt.NewReasonError(mqtt.ReasonProtocolError, msg)
+		}
+		client.incoming.PayloadFormatIndicator = v_i
+	}
+	if v, ok := props[mqtt.MessageExpiryIntervalCode]; ok {
+		client.incoming.MessageExpiryInterval = binary.BigEndian.Uint32(v)
+	} else {
+		client.incoming.MessageExpiryInterval = defaults.DefaultMessageExpiryInterval
+	}
+	if v, ok := props[mqtt.ContentTypeCode]; ok {
+		client.incoming.ContentType = string(v)
+	}
+	if v, ok := props[mqtt.ResponseTopicCode]; ok {
+		if !mqtt.ValidTopicName(string(v)) {
+			msg := fmt.Sprintf("invalid Response Topic `%v`", string(v))
+			return mqtt.NewReasonError(mqtt.ReasonProtocolError, msg)
+		}
+		client.incoming.ResponseTopic = string(v)
+	}
+	if v, ok := props[mqtt.CorrelationDataCode]; ok {
+		client.incoming.CorrelationData = v
+	}
+	if _, ok := props[mqtt.TopicAliasCode]; ok {
+		// CONNACK doesn't set Topic Alias Maximum, so the client may not use any.
+		return mqtt.NewReasonError(mqtt.ReasonTopicAliasInvalid, "Topic Alias is not supported")
+	}
+	if _, ok := props[mqtt.SubscriptionIdCode]; ok {
+		return mqtt.NewReasonError(mqtt.ReasonProtocolError, "PUBLISH from the client cannot have a Subscription Identifier")
+	}
+	return nil
 }
+
+// The Reason String and User Properties of acks are only informational.
 func (client *Client) setPubackProps(props map[int][]byte) error {
-	return errors.New("setProperties: Case not implemented yet for Puback")
+	return nil
 }
 func (client *Client) setPubrecProps(props map[int][]byte) error {
-	return errors.New("setProperties: Case not implemented yet for Pubrec")
+	return nil
 }
 func (client *Client) setPubrelProps(props map[int][]byte) error {
-	return errors.New("setProperties: Case not implemented yet for Pubrel")
+	return nil
 }
 func (client *Client) setPubcompProps(props map[int][]byte) error {
-	return errors.New("setProperties: Case not implemented yet for Pubcomp")
+	return nil
 }
 func (client *Client) setSubscribeProps(props map[int][]byte) error {
-	return errors.New("setProperties: Case not implemented yet for Subscribe")
+	if v, ok := props[mqtt.SubscriptionIdCode]; ok {
+		v_i := binary.BigEndian.Uint32(v)
+		if v_i == 0 {
+			return mqtt.NewReasonError(mqtt.ReasonProtocolError, "invalid Subscription Identifier 0")
+		}
+		client.subscriptionId = v_i
+	}
+	return nil
 }
 func (client *Client) setSubackProps(props map[int][]byte) error {
 	return errors.New("setProperties: Case not implemented yet for Suback")
 }
 func (client *Client) setUnsubscribeProps(props map[int][]byte) error {
-	return errors.New("setProperties: Case not implemented yet for Unsubscribe")
+	return nil // only User Properties are allowed.
 }
 func (client *Client) setUnsubackProps(props map[int][]byte) error {
 	return errors.New("setProperties: Case not implemented yet for Unsuback")
@@ -107,10 +154,29 @@ func (client *Client) setPingrespProps(props map[int][]byte) error {
 	return errors.New("setProperties: Case not implemented yet for Pingresp")
 }
 func (client *Client) setDisconnectProps(props map[int][]byte) error {
-	return errors.New("setProperties: Case not implemented yet for Disconnect")
+	if v, ok := props[mqtt.SessionExpiryIntervalCode]; ok {
+		v_i := binary.BigEndian.Uint32(v)
+		if client.SessionExpiryInterval == 0 && v_i != 0 {
+			msg := fmt.Sprintf("invalid Session Expiry Interval %d in DISCONNECT, it was 0 in CONNECT", v_i)
+			return mqtt.NewReasonError(mqtt.ReasonProtocolError, msg)
+		}
+		client.SessionExpiryInterval = v_i
+	}
+	if _, ok := props[mqtt.ServerReferenceCode]; ok {
+		return mqtt.NewReasonError(mqtt.ReasonProtocolError, "DISCONNECT from the client cannot have a Server Reference")
+	}
+	return nil
 }
 func (client *Client) setAuthProps(props map[int][]byte) error {
-	return errors.New("setProperties: Case not implemented yet for Auth")
+	v, ok := props[mqtt.AuthenticationMethodCode]
+	if !ok || string(v) != client.AuthMethod {
+		msg := fmt.Sprintf("the Authentication Method of AUTH must be %v, the one from CONNECT", client.AuthMethod)
+		return mqtt.NewReasonError(mqtt.ReasonProtocolError, msg)
+	}
+	if v, ok := props[mqtt.AuthenticationDataCode]; ok {
+		client.AuthData = v
+	}
+	return nil
 }
 
 // Not part of spec.
@@ -121,8 +187,8 @@ func (client *Client) setWillProps(props map[int][]byte) error {
 	if v, ok := props[mqtt.PayloadFormatIndicatorCode]; ok {
 		v_i := uint8(v[0]) // it's a single byte that can only be 0 or 1.
 		if v_i != 0 && v_i != 1 {
-			msg := fmt.Sprintf("setProperties: invalid PayloadFormatIndicator %d for WillProps", v_i)
-			return errors.New(msg)
+			msg := fmt.Sprintf("invalid Payload Format Indicator %d for the will", v_i)
+			return mqtt.NewReasonError(mqtt.ReasonProtocolError, msg)
 		}
 		client.WillProps.PayloadFormatIndicator = v_i
 	}
@@ -148,6 +214,19 @@ func (client *Client) setWillProps(props map[int][]byte) error {
 	return nil
 }
 
+// readProps reads the property length and properties of the packet currently being processed.
+// Versions before MQTT v5.0 have no properties, so nothing is read for them.
+func (client *Client) readProps(packetCode int) (map[int][]byte, []mqtt.UserProperty, error) {
+	if !client.hasProps() {
+		return map[int][]byte{}, nil, nil
+	}
+	_, propLength, err := client.Rdr.ReadVarByteInt()
+	if err != nil {
+		return nil, nil, err
+	}
+	return mqtt.GetProps(client.Rdr, int(propLength), packetCode)
+}
+
 func (client *Client) setProperties(packetType int, props map[int][]byte) (err error) {
 	// need a switch for each packet type.
 	switch packetType {
@@ -1,27 +1,43 @@
 package client
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/M4THYOU/some_mqtt_broker/internal/auth"
+	"github.com/M4THYOU/some_mqtt_broker/internal/broker"
+	"github.com/M4THYOU/some_mqtt_broker/internal/listener"
+	"github.com/M4THYOU/some_mqtt_broker/internal/logging"
 	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+	"github.com/M4THYOU/some_mqtt_broker/pkg/utils"
 )
 
 func (client *Client) handleConnect() error {
-	// verify the protocol is set to 'MQTT'
-	err := mqtt.VerifyProtocol(client.Rdr)
+	// verify the protocol is set to 'MQTT', or 'MQIsdp' for v3.1.
+	protocolName, err := mqtt.VerifyProtocol(client.Rdr)
 	if err != nil {
 		return err
 	}
 
-	// Check protocol version. Currently only supports v5.0
+	// Check protocol version. Supports v3.1, v3.1.1 and v5.0, every packet after this one is encoded for it.
+	// v3.1 is handled exactly like v3.1.1 apart from CONNECT.
 	b, err := client.Rdr.ReadByte()
 	if err != nil {
 		return err
-	} else if b != 5 {
-		msg := fmt.Sprintf("This broker currently only supports MQTT v5.0. You specified: %d", b)
-		return errors.New(msg)
+	} else if !mqtt.ValidProtocolLevel(protocolName, b) {
+		// a client that doesn't speak v5.0 can't be expected to understand its CONNACK, so refuse it the v3.1.1 way.
+		client.ProtocolLevel = mqtt.ProtocolLevel311
+		msg := fmt.Sprintf("This broker only supports MQTT v3.1, v3.1.1 and v5.0. You specified: %v %d", protocolName, b)
+		return client.refuse(mqtt.NewReasonError(mqtt.ReasonUnsupportedProtocolVersion, msg))
+	}
+	client.ProtocolLevel = b
+	if !client.Listener.acceptsProtocolLevel(b) {
+		msg := fmt.Sprintf("This listener doesn't accept %v %d", protocolName, b)
+		return client.refuse(mqtt.NewReasonError(mqtt.ReasonUnsupportedProtocolVersion, msg))
 	}
 
 	// Check the connect flags!
@@ -43,18 +59,17 @@ func (client *Client) handleConnect() error {
 	client.KeepAlive = keepAlive
 
 	// Handle the properties!
-	_, propLength, err := client.Rdr.ReadVarByteInt()
+	props, userProps, err := client.readProps(mqtt.ConnectCode)
 	if err != nil {
 		return err
 	}
-	props, userProps, err := mqtt.GetProps(client.Rdr, int(propLength), mqtt.ConnectCode)
+	logging.Debugf("Flags: %v\n", client.connectFlags)
+	logging.Debugf("Props: %v\n", props)
+	logging.Debugf("User Props: %v\n", userProps)
+	err = client.setProperties(mqtt.ConnectCode, props)
 	if err != nil {
-		return err
+		return client.refuseOnReason(err)
 	}
-	fmt.Printf("Flags: %v\n", client.connectFlags)
-	fmt.Printf("Props: %v\n", props)
-	fmt.Printf("User Props: %v\n", userProps)
-	client.setProperties(mqtt.ConnectCode, props)
 
 	//// Process the payload ////
 
@@ -64,24 +79,45 @@ func (client *Client) handleConnect() error {
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Client ID: %v\n", clientId)
+	logging.Infof("Client ID: %v from %v\n", clientId, client.Conn.RemoteAddr())
+	if client.ProtocolLevel == mqtt.ProtocolLevel31 && (clientId == "" || utf8.RuneCountInString(clientId) > mqtt.MaxClientIdLength31) {
+		// unlike later versions, v3.1 has no client IDs assigned by the server.
+		msg := fmt.Sprintf("client ID `%v` must be 1 to %d characters", clientId, mqtt.MaxClientIdLength31)
+		return client.refuse(mqtt.NewReasonError(mqtt.ReasonClientIdNotValid, msg))
+	}
+	if clientId == "" && client.ProtocolLevel == mqtt.ProtocolLevel311 && !client.connectFlags.CleanStart {
+		// v3.1.1 only assigns client IDs to sessions that end with the connection.
+		return client.refuse(mqtt.NewReasonError(mqtt.ReasonClientIdNotValid, "a client ID is needed without Clean Session"))
+	}
+	if clientId == "" {
+		clientId, err = mqtt.NewClientId()
+		if err != nil {
+			return err
+		}
+		client.assignedClientId = clientId
+	}
+	client.ClientId = clientId
+	client.ResponseInfo = client.Broker.ResponseInfo(clientId)
 
 	// Check for will things in the payload.
 	if client.connectFlags.WillFlag {
-		_, propLength, err = client.Rdr.ReadVarByteInt()
+		willProps, willUserProps, err := client.readProps(mqtt.WillPropsCode)
 		if err != nil {
 			return err
 		}
-		willProps, _, err := mqtt.GetProps(client.Rdr, int(propLength), mqtt.WillPropsCode)
+		err = client.setWillProps(willProps)
 		if err != nil {
-			return err
+			return client.refuseOnReason(err)
 		}
-		client.setWillProps(willProps)
+		client.WillProps.UserProperty = willUserProps
 
 		// will topic, UTF-8 enc string
 		_, willTopic, err := client.Rdr.ReadUtf8Str()
 		if err != nil {
 			return err
+		} else if !mqtt.ValidTopicName(willTopic) {
+			msg := fmt.Sprintf("invalid will topic name `%v`", willTopic)
+			return client.refuse(mqtt.NewReasonError(mqtt.ReasonTopicNameInvalid, msg))
 		}
 		client.WillProps.Topic = willTopic
 		// will payload, binary data
@@ -105,73 +141,685 @@ func (client *Client) handleConnect() error {
 		}
 		client.Password = password
 	}
+	client.applyCertIdentity()
+	client.applyPeerCredentials()
+
+	if client.connectFlags.WillRetain && client.hasProps() {
+		// CONNACK can't tell the client Retain Available is 0 before it sends a retained will.
+		return client.refuse(mqtt.NewReasonError(mqtt.ReasonRetainNotSupported, "retained messages are not supported"))
+	}
+
+	if client.Broker.ShuttingDown() {
+		return client.refuse(mqtt.NewReasonError(mqtt.ReasonServerUnavailable, "server shutting down"))
+	}
+	// refuse the connection if the operator wants clients to go elsewhere.
+	if r := client.Broker.Redirect(); r != nil {
+		msg := fmt.Sprintf("redirected to %v", r.ServerReference)
+		client.serverReference = r.ServerReference
+		return client.refuse(mqtt.NewReasonError(r.ReasonCode(), msg))
+	}
+
+	if client.AuthMethod != "" {
+		a := client.Broker.Authenticator(client.AuthMethod)
+		if a == nil {
+			msg := fmt.Sprintf("unsupported authentication method %v", client.AuthMethod)
+			return client.refuse(mqtt.NewReasonError(mqtt.ReasonBadAuthenticationMethod, msg))
+		}
+		client.authExchange = a.Start(client.ClientId)
+		client.state = Authenticating
+		return client.continueAuth(client.AuthData)
+	}
+	if client.identified || client.Listener.anonymous() {
+		return client.accept()
+	}
+	id, err := client.Broker.CheckPassword(client.ClientId, client.UserName, client.Password)
+	if err != nil {
+		return client.refuse(authError(err))
+	}
+	client.setIdentity(id)
+	return client.accept()
+}
+
+// applyCertIdentity replaces the User Name, and the Client ID if configured, with the identity in the client's
+// verified TLS certificate, if any. No password is checked then, so the User Name the client sent can't be kept.
+// The certificate may also have been verified by a proxy that terminated TLS, and said so in its PROXY protocol header.
+func (client *Client) applyCertIdentity() {
+	certIdentity := client.Broker.CertIdentity()
+	if certIdentity == nil {
+		return
+	}
+	id := ""
+	if conn, ok := client.Conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		if chains := conn.ConnectionState().VerifiedChains; len(chains) > 0 {
+			id = certIdentity.Identify(chains[0][0])
+		}
+	}
+	if h := listener.ProxyHeaderOf(client.Conn); id == "" && h != nil && h.TLS != nil && h.TLS.CertVerified {
+		id = certIdentity.IdentifyCommonName(h.TLS.CommonName)
+	}
+	if id == "" {
+		return
+	}
+	client.identified = true
+	client.UserName = id
+	if !certIdentity.AsClientId() {
+		return
+	}
+	if id != client.ClientId {
+		client.assignedClientId = id
+	}
+	client.ClientId = id
+	client.ResponseInfo = client.Broker.ResponseInfo(id)
+}
+
+// applyPeerCredentials replaces the User Name with the local user that opened the client's Unix socket,
+// if the listener identifies clients that way.
+func (client *Client) applyPeerCredentials() {
+	conn, ok := client.Conn.(interface{ PeerCredentials() (uint32, uint32, bool) })
+	if !client.Listener.peerCredentials() || !ok {
+		return
+	}
+	uid, _, ok := conn.PeerCredentials()
+	if !ok {
+		return
+	}
+	client.identified = true
+	client.UserName = auth.LocalUserName(uid)
+}
+
+// accept sends a CONNACK accepting the connection, and registers the client with the broker.
+// A session kept from before the broker restarted is resumed, unless the client asked for a new one.
+func (client *Client) accept() error {
+	client.maxPacketSize = client.Broker.MaxPacketSize()
+	session := client.Broker.Resume(client.ClientId, client.connectFlags.CleanStart)
+	client.sessionPresent = session != nil
+	resend, err := client.restoreInflight(session)
+	if err != nil {
+		return err
+	}
+	packet, err := client.buildPacket(mqtt.ConnackCode)
+	if err != nil {
+		return err
+	}
+	// register with the broker while holding the write lock, so nothing is delivered before the CONNACK.
+	client.writeMu.Lock()
+	replaced := client.Broker.Connect(client.ClientId, client)
+	client.restoreSubscriptions(session)
+	client.state = Connected
+	client.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	err = mqtt.SendPacket(client.Conn, packet)
+	// the messages that were in flight go before any new one.
+	for _, p := range resend {
+		if err == nil {
+			err = mqtt.SendPacket(client.Conn, p)
+		}
+	}
+	client.writeMu.Unlock()
+	if replaced != nil {
+		// the old connection may be slow to take its DISCONNECT, which mustn't hold up this one.
+		go replaced.SendDisconnect(mqtt.ReasonSessionTakenOver, "")
+	}
+	return err
+}
+
+// restoreInflight takes back the QoS 1 and 2 messages that were in flight in the resumed session, nil => none.
+// Returns the PUBLISH packets to send again, flagged as duplicates, and the PUBREL packets of those already received,
+// with their original packet identifiers. Messages on topics the client may no longer subscribe to are dropped.
+func (client *Client) restoreInflight(session *broker.Session) ([][]byte, error) {
+	if session == nil {
+		return nil, nil
+	}
+	released := make(map[uint16]bool)
+	for _, packetId := range session.Released {
+		released[packetId] = true
+	}
+	resend := make([][]byte, 0)
+	inflight := make(map[uint16]*mqtt.Message)
+	for _, msg := range session.Messages {
+		if released[msg.PacketId] {
+			// the client already has the message, only the end of the handshake is left.
+			packet, err := client.buildAck(mqtt.PubrelCode, msg.PacketId, nil, false)
+			if err != nil {
+				return nil, err
+			}
+			inflight[msg.PacketId] = msg
+			resend = append(resend, packet)
+			continue
+		} else if !client.authorize(auth.AccessSubscribe, msg.Topic) {
+			logging.Infof("Dropping the message on %v resumed by %v: not authorized\n", msg.Topic, client.ClientId)
+			continue
+		}
+		msg.Dup = true
+		packet, err := client.buildPublish(msg)
+		if err != nil {
+			return nil, err
+		} else if client.tooLarge(packet) {
+			logging.Infof("Dropping the message on %v resumed by %v: it exceeds the client's Maximum Packet Size\n", msg.Topic, client.ClientId)
+			continue
+		}
+		inflight[msg.PacketId] = msg
+		resend = append(resend, packet)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	for packetId, msg := range inflight {
+		client.outbound[packetId] = msg
+		client.released[packetId] = released[packetId]
+	}
+	for _, packetId := range session.Received {
+		client.inboundQos2[packetId] = true
+	}
+	return resend, nil
+}
+
+// restoreSubscriptions subscribes the client again to the topic filters of the resumed session, nil => none.
+// Those the client may no longer subscribe to are dropped.
+func (client *Client) restoreSubscriptions(session *broker.Session) {
+	if session == nil {
+		return
+	}
+	for _, sub := range session.Subscriptions {
+		filter := sub.Filter
+		if sub.ShareName != "" {
+			filter = mqtt.SharePrefix + "/" + sub.ShareName + "/" + sub.Filter
+		}
+		client.subscriptionId = sub.Id
+		opts := sub.Options
+		if err := client.subscribe(filter, &opts); err != nil {
+			logging.Infof("Dropping the subscription to %v resumed by %v: %v\n", filter, client.ClientId, err.Error())
+		}
+	}
+	client.subscriptionId = 0
+}
+
+// refuse sends a CONNACK refusing the connection for the given reason, then returns it so the connection is closed.
+func (client *Client) refuse(reasonErr *mqtt.ReasonError) error {
+	client.connackErr = reasonErr
+	if err := client.SendPacket(mqtt.ConnackCode); err != nil {
+		return err
+	}
+	return reasonErr
+}
 
-	// send a CONNACK packet.
-	return client.SendPacket(mqtt.ConnackCode)
+// refuseOnReason refuses the connection if err has a reason code, and returns err as it is otherwise.
+func (client *Client) refuseOnReason(err error) error {
+	var reasonErr *mqtt.ReasonError
+	if errors.As(err, &reasonErr) {
+		return client.refuse(reasonErr)
+	}
+	return err
 }
+
 func (client *Client) handleConnack() error {
-	log.Fatalln("Invalid Operation.")
-	return nil
+	return errServerOnly("CONNACK")
 }
 func (client *Client) handlePublish() error {
-	fmt.Println("Handle Publish")
-	log.Fatalln("Not yet implemented.")
-	return nil
+	dup, qos, retain, err := mqtt.GetPublishFlags(client.flags)
+	if err != nil {
+		return err
+	} else if retain && client.hasProps() {
+		// CONNACK told the client Retain Available is 0.
+		return mqtt.NewReasonError(mqtt.ReasonRetainNotSupported, "retained messages are not supported")
+	}
+	// older clients can't be told, so their retained messages are published like any other.
+	retain = false
+
+	_, topic, err := client.Rdr.ReadUtf8Str()
+	if err != nil {
+		return err
+	} else if !mqtt.ValidTopicName(topic) {
+		msg := fmt.Sprintf("invalid topic name `%v`", topic)
+		return mqtt.NewReasonError(mqtt.ReasonTopicNameInvalid, msg)
+	}
+	client.incoming = &mqtt.Message{Topic: topic, Qos: qos, Retain: retain, Dup: dup}
+	if qos > 0 {
+		packetId, err := mqtt.GetPacketId(client.Rdr)
+		if err != nil {
+			return err
+		}
+		client.incoming.PacketId = packetId
+	}
+
+	// Handle the properties!
+	props, userProps, err := client.readProps(mqtt.PublishCode)
+	if err != nil {
+		return err
+	}
+	err = client.setProperties(mqtt.PublishCode, props)
+	if err != nil {
+		return err
+	}
+	client.incoming.UserProperties = userProps
+
+	// the payload is everything left in the packet.
+	payload, err := utils.ReadBytesToSlice(client.Rdr.RemainingLength(), client.Rdr)
+	if err != nil {
+		return err
+	}
+	client.incoming.Payload = payload
+
+	msg := client.incoming
+	client.incoming = nil
+	// checking the payload is optional, it can be large.
+	if msg.PayloadFormatIndicator == 1 && client.Broker.ValidatePayloadFormat() && !utf8.Valid(msg.Payload) {
+		reasonErr := errPayloadFormatInvalid(msg.Topic)
+		switch qos {
+		case 1:
+			return client.sendAck(mqtt.PubackCode, msg.PacketId, reasonErr)
+		case 2:
+			return client.sendAck(mqtt.PubrecCode, msg.PacketId, reasonErr)
+		default:
+			return reasonErr // there's no acknowledgement to report it in, so the connection is closed.
+		}
+	}
+	if !client.authorize(auth.AccessPublish, msg.Topic) {
+		reasonErr := errTopicNotAuthorized(msg.Topic)
+		switch qos {
+		case 1:
+			return client.sendAck(mqtt.PubackCode, msg.PacketId, reasonErr)
+		case 2:
+			return client.sendAck(mqtt.PubrecCode, msg.PacketId, reasonErr)
+		default:
+			return nil // dropped, like a message nobody is subscribed to.
+		}
+	}
+	switch qos {
+	case 1:
+		var reasonErr error
+		if client.Broker.Publish(client.ClientId, msg) == 0 {
+			reasonErr = errNoMatchingSubscribers(msg.Topic)
+		}
+		return client.sendAck(mqtt.PubackCode, msg.PacketId, reasonErr)
+	case 2:
+		// the message is routed as soon as it arrives. A resent PUBLISH must not be routed again until it is released.
+		client.mu.Lock()
+		seen := client.inboundQos2[msg.PacketId]
+		client.inboundQos2[msg.PacketId] = true
+		client.mu.Unlock()
+		var reasonErr error
+		if !seen && client.Broker.Publish(client.ClientId, msg) == 0 {
+			reasonErr = errNoMatchingSubscribers(msg.Topic)
+		}
+		return client.sendAck(mqtt.PubrecCode, msg.PacketId, reasonErr)
+	default:
+		client.Broker.Publish(client.ClientId, msg)
+		return nil
+	}
+}
+
+func errNoMatchingSubscribers(topic string) error {
+	msg := fmt.Sprintf("no subscribers for topic %v", topic)
+	return mqtt.NewReasonError(mqtt.ReasonNoMatchingSubscribers, msg)
+}
+
+func errPayloadFormatInvalid(topic string) error {
+	msg := fmt.Sprintf("payload published to %v is not valid UTF-8", topic)
+	return mqtt.NewReasonError(mqtt.ReasonPayloadFormatInvalid, msg)
+}
+
+func errTopicNotAuthorized(topic string) error {
+	msg := fmt.Sprintf("not authorized to use topic %v", topic)
+	return mqtt.NewReasonError(mqtt.ReasonNotAuthorized, msg)
+}
+
+// errServerOnly is the Protocol Error of a client sending a packet that only servers may send.
+func errServerOnly(packetName string) error {
+	msg := fmt.Sprintf("%v packets are only sent by servers", packetName)
+	return mqtt.NewReasonError(mqtt.ReasonProtocolError, msg)
 }
+
+func errPacketIdNotFound(packetId uint16) error {
+	msg := fmt.Sprintf("packet identifier %d not found", packetId)
+	return mqtt.NewReasonError(mqtt.ReasonPacketIdNotFound, msg)
+}
+
+// readAck reads the variable header shared by PUBACK, PUBREC, PUBREL, and PUBCOMP.
+// The reason code is Success if the client omitted it.
+func (client *Client) readAck(packetCode int) (uint16, byte, error) {
+	packetId, err := mqtt.GetPacketId(client.Rdr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if client.Rdr.RemainingLength() == 0 {
+		return packetId, mqtt.ReasonSuccess, nil
+	} else if !client.hasProps() {
+		msg := fmt.Sprintf("unexpected %d bytes after the packet identifier", client.Rdr.RemainingLength())
+		return 0, 0, mqtt.NewReasonError(mqtt.ReasonMalformedPacket, msg)
+	}
+	reasonCode, err := client.Rdr.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	if client.Rdr.RemainingLength() == 0 {
+		return packetId, reasonCode, nil
+	}
+	props, _, err := client.readProps(packetCode)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = client.setProperties(packetCode, props)
+	if err != nil {
+		return 0, 0, err
+	}
+	return packetId, reasonCode, nil
+}
+
+// handlePuback completes a QoS 1 message sent to the client.
 func (client *Client) handlePuback() error {
-	fmt.Println("Handle Puback")
-	log.Fatalln("Not yet implemented.")
+	packetId, _, err := client.readAck(mqtt.PubackCode)
+	if err != nil {
+		return err
+	}
+	if client.release(packetId) {
+		client.Broker.Ack(client.ClientId, packetId)
+	}
 	return nil
 }
+
+// handlePubrec is the client's first response to a QoS 2 message sent to it.
 func (client *Client) handlePubrec() error {
-	fmt.Println("Handle Pubrec")
-	log.Fatalln("Not yet implemented.")
-	return nil
+	packetId, reasonCode, err := client.readAck(mqtt.PubrecCode)
+	if err != nil {
+		return err
+	}
+	client.mu.Lock()
+	_, ok := client.outbound[packetId]
+	client.mu.Unlock()
+	if !ok {
+		return client.sendAck(mqtt.PubrelCode, packetId, errPacketIdNotFound(packetId))
+	}
+	// the client has the message now, whatever happens next it must not be sent to anyone else.
+	client.Broker.Ack(client.ClientId, packetId)
+	if reasonCode >= mqtt.ReasonUnspecifiedError {
+		client.release(packetId)
+		return nil
+	}
+	client.mu.Lock()
+	client.released[packetId] = true
+	client.mu.Unlock()
+	return client.sendAck(mqtt.PubrelCode, packetId, nil)
 }
+
+// handlePubrel releases a QoS 2 message received from the client.
 func (client *Client) handlePubrel() error {
-	fmt.Println("Handle Pubrel")
-	log.Fatalln("Not yet implemented.")
-	return nil
+	packetId, _, err := client.readAck(mqtt.PubrelCode)
+	if err != nil {
+		return err
+	}
+	client.mu.Lock()
+	ok := client.inboundQos2[packetId]
+	delete(client.inboundQos2, packetId)
+	client.mu.Unlock()
+	if !ok {
+		return client.sendAck(mqtt.PubcompCode, packetId, errPacketIdNotFound(packetId))
+	}
+	return client.sendAck(mqtt.PubcompCode, packetId, nil)
 }
+
+// handlePubcomp completes a QoS 2 message sent to the client.
 func (client *Client) handlePubcomp() error {
-	fmt.Println("Handle Pubcomp")
-	log.Fatalln("Not yet implemented.")
+	packetId, _, err := client.readAck(mqtt.PubcompCode)
+	if err != nil {
+		return err
+	}
+	client.release(packetId)
 	return nil
 }
+
 func (client *Client) handleSubscribe() error {
-	log.Fatalln("Invalid Operation.")
+	packetId, err := mqtt.GetPacketId(client.Rdr)
+	if err != nil {
+		return err
+	}
+
+	// Handle the properties!
+	props, _, err := client.readProps(mqtt.SubscribeCode)
+	if err != nil {
+		return err
+	}
+	client.subscriptionId = 0
+	err = client.setProperties(mqtt.SubscribeCode, props)
+	if err != nil {
+		return err
+	}
+
+	//// Process the payload ////
+	reasonCodes := make([]byte, 0)
+	reasons := make([]string, 0)
+	for client.Rdr.RemainingLength() > 0 {
+		_, filter, err := client.Rdr.ReadUtf8Str()
+		if err != nil {
+			return err
+		}
+		b, err := client.Rdr.ReadByte()
+		if err != nil {
+			return err
+		} else if !client.hasProps() && b&0xFC != 0 {
+			// only the QoS bits existed before v5.0, the rest are reserved.
+			msg := fmt.Sprintf("invalid reserved bits in requested QoS %08b", b)
+			return mqtt.NewReasonError(mqtt.ReasonMalformedPacket, msg)
+		}
+		opts, err := mqtt.GetSubscriptionOptions(b)
+		if err != nil {
+			return err
+		} else if opts.NoLocal && strings.HasPrefix(filter, mqtt.SharePrefix+"/") {
+			msg := fmt.Sprintf("No Local cannot be set on shared subscription %v", filter)
+			return mqtt.NewReasonError(mqtt.ReasonProtocolError, msg)
+		}
+		err = client.subscribe(filter, opts)
+		if err != nil {
+			reasonCodes = append(reasonCodes, mqtt.GetReasonCode(err))
+			reasons = append(reasons, err.Error())
+		} else {
+			reasonCodes = append(reasonCodes, opts.Qos) // the reason code for each Granted QoS is the QoS itself.
+		}
+	}
+	if len(reasonCodes) == 0 {
+		return mqtt.NewReasonError(mqtt.ReasonProtocolError, "SUBSCRIBE must contain at least one topic filter")
+	}
+	return client.sendSubAck(mqtt.SubackCode, packetId, reasonCodes, strings.Join(reasons, "; "))
+}
+
+// subscribe adds a single subscription from a SUBSCRIBE packet.
+// Returns a ReasonError if the subscription is refused.
+func (client *Client) subscribe(filter string, opts *mqtt.SubscriptionOptions) error {
+	shareName, topicFilter, _, err := mqtt.ParseSharedFilter(filter)
+	if err != nil {
+		return mqtt.NewReasonError(mqtt.ReasonTopicFilterInvalid, err.Error())
+	} else if !mqtt.ValidTopicFilter(topicFilter) {
+		msg := fmt.Sprintf("invalid topic filter `%v`", filter)
+		return mqtt.NewReasonError(mqtt.ReasonTopicFilterInvalid, msg)
+	} else if !client.authorize(auth.AccessSubscribe, topicFilter) {
+		return errTopicNotAuthorized(filter)
+	}
+	client.Broker.Subscribe(&broker.Subscription{
+		ClientId:  client.ClientId,
+		Filter:    topicFilter,
+		ShareName: shareName,
+		Options:   *opts,
+		Id:        client.subscriptionId,
+	})
 	return nil
 }
+
 func (client *Client) handleSuback() error {
-	fmt.Println("Handle Suback")
-	log.Fatalln("Not yet implemented.")
-	return nil
+	return errServerOnly("SUBACK")
 }
 func (client *Client) handleUnsubscribe() error {
-	log.Fatalln("Invalid Operation.")
-	return nil
+	packetId, err := mqtt.GetPacketId(client.Rdr)
+	if err != nil {
+		return err
+	}
+
+	// Handle the properties!
+	props, _, err := client.readProps(mqtt.UnsubscribeCode)
+	if err != nil {
+		return err
+	}
+	err = client.setProperties(mqtt.UnsubscribeCode, props)
+	if err != nil {
+		return err
+	}
+
+	//// Process the payload ////
+	reasonCodes := make([]byte, 0)
+	reasons := make([]string, 0)
+	for client.Rdr.RemainingLength() > 0 {
+		_, filter, err := client.Rdr.ReadUtf8Str()
+		if err != nil {
+			return err
+		}
+		if client.Broker.Unsubscribe(client.ClientId, filter) {
+			reasonCodes = append(reasonCodes, mqtt.ReasonSuccess)
+			continue
+		}
+		reasonCodes = append(reasonCodes, mqtt.ReasonNoSubscriptionExisted)
+		reasons = append(reasons, fmt.Sprintf("no subscription to %v", filter))
+	}
+	if len(reasonCodes) == 0 {
+		return mqtt.NewReasonError(mqtt.ReasonProtocolError, "UNSUBSCRIBE must contain at least one topic filter")
+	}
+	return client.sendSubAck(mqtt.UnsubackCode, packetId, reasonCodes, strings.Join(reasons, "; "))
 }
 func (client *Client) handleUnsuback() error {
-	fmt.Println("Handle Unsuback")
-	log.Fatalln("Not yet implemented.")
-	return nil
+	return errServerOnly("UNSUBACK")
 }
 func (client *Client) handlePingreq() error {
-	log.Fatalln("Invalid Operation.")
-	return nil
+	if client.Rdr.RemainingLength() > 0 {
+		return mqtt.NewReasonError(mqtt.ReasonMalformedPacket, "PINGREQ has no variable header or payload")
+	}
+	return client.SendPacket(mqtt.PingrespCode)
 }
 func (client *Client) handlePingresp() error {
-	fmt.Println("Handle Pingresp")
-	log.Fatalln("Not yet implemented.")
-	return nil
+	return errServerOnly("PINGRESP")
 }
 func (client *Client) handleDisconnect() error {
-	fmt.Println("Handle Disconnect")
-	log.Fatalln("Not yet implemented.")
-	return nil
+	logging.Debugf("Handle Disconnect\n")
+	if !client.hasProps() && client.Rdr.RemainingLength() > 0 {
+		return mqtt.NewReasonError(mqtt.ReasonMalformedPacket, "DISCONNECT has no variable header before MQTT v5.0")
+	}
+	// the reason code and properties may be omitted.
+	reasonCode := byte(mqtt.ReasonSuccess)
+	if client.Rdr.RemainingLength() > 0 {
+		b, err := client.Rdr.ReadByte()
+		if err != nil {
+			return err
+		}
+		reasonCode = b
+		logging.Debugf("Reason Code: %d\n", reasonCode)
+	}
+	if client.Rdr.RemainingLength() > 0 {
+		props, _, err := client.readProps(mqtt.DisconnectCode)
+		if err != nil {
+			return err
+		}
+		err = client.setProperties(mqtt.DisconnectCode, props)
+		if err != nil {
+			return err
+		}
+	}
+	if reasonCode != mqtt.ReasonDisconnectWithWill {
+		client.WillProps = nil // a normal disconnection discards the Will Message.
+	}
+	return ErrDisconnect
 }
 func (client *Client) handleAuth() error {
-	fmt.Println("Handle Auth")
-	log.Fatalln("Not yet implemented.")
-	return nil
+	if client.AuthMethod == "" {
+		return mqtt.NewReasonError(mqtt.ReasonProtocolError, "AUTH is only allowed after CONNECT with an Authentication Method")
+	}
+	// the reason code and properties may only be omitted for Success, which the client never sends.
+	if client.Rdr.RemainingLength() == 0 {
+		return mqtt.NewReasonError(mqtt.ReasonProtocolError, "AUTH from the client must have a reason code")
+	}
+	reasonCode, err := client.Rdr.ReadByte()
+	if err != nil {
+		return err
+	}
+	props, _, err := client.readProps(mqtt.AuthCode)
+	if err != nil {
+		return err
+	}
+	client.AuthData = nil
+	err = client.setProperties(mqtt.AuthCode, props)
+	if err != nil && client.state != Connected {
+		return client.refuseOnReason(err)
+	} else if err != nil {
+		return err
+	}
+
+	switch {
+	case reasonCode == mqtt.ReasonContinueAuthentication && client.authExchange != nil:
+		return client.continueAuth(client.AuthData)
+	case reasonCode == mqtt.ReasonReAuthenticate && client.authExchange == nil && client.state == Connected:
+		// the method may have been removed from the broker since the client connected.
+		a := client.Broker.Authenticator(client.AuthMethod)
+		if a == nil {
+			msg := fmt.Sprintf("unsupported authentication method %v", client.AuthMethod)
+			return mqtt.NewReasonError(mqtt.ReasonBadAuthenticationMethod, msg)
+		}
+		client.authExchange = a.Start(client.ClientId)
+		return client.continueAuth(client.AuthData)
+	default:
+		msg := fmt.Sprintf("unexpected AUTH reason code %#x", reasonCode)
+		return mqtt.NewReasonError(mqtt.ReasonProtocolError, msg)
+	}
+}
+
+// continueAuth passes the client's Authentication Data to the exchange in progress, and answers with the next step.
+// Once the exchange is done, the connection is accepted, or re-authentication succeeds.
+// If it fails, a new connection is refused, and an established one is disconnected.
+func (client *Client) continueAuth(data []byte) error {
+	reply, done, err := client.authExchange.Next(data)
+	if err != nil {
+		client.authExchange = nil
+		reasonErr := authError(err)
+		if client.state != Connected {
+			return client.refuse(reasonErr)
+		}
+		return reasonErr // ProcessPacket disconnects the client with it.
+	} else if !done {
+		return client.sendAuth(mqtt.ReasonContinueAuthentication, reply)
+	}
+	client.setIdentity(client.authExchange.Identity())
+	client.authExchange = nil
+	if client.state != Connected {
+		client.serverAuthData = reply
+		return client.accept()
+	}
+	return client.sendAuth(mqtt.ReasonSuccess, reply)
+}
+
+// setIdentity applies what the client was granted when it authenticated. id may be nil.
+func (client *Client) setIdentity(id *auth.Identity) {
+	if id == nil {
+		client.authorizer = nil
+		return
+	}
+	if id.UserName != "" {
+		client.UserName = id.UserName
+	}
+	client.authorizer = id.Authorizer
+}
+
+// authorize checks if the client may publish to the topic name, or subscribe to the topic filter.
+// Both its own Authorizer, from when it authenticated, and the broker's must allow it.
+func (client *Client) authorize(access auth.Access, topic string) bool {
+	if client.Listener.anonymous() {
+		return true
+	}
+	if client.authorizer != nil && !client.Broker.IsResponseTopic(client.ClientId, access, topic) &&
+		!client.authorizer.Authorize(client.ClientId, client.UserName, access, topic) {
+		return false
+	}
+	return client.Broker.Authorize(client.ClientId, client.UserName, access, topic)
+}
+
+// authError returns the reason to refuse or disconnect a client that failed authentication with err.
+func authError(err error) *mqtt.ReasonError {
+	var reasonErr *mqtt.ReasonError
+	if errors.As(err, &reasonErr) {
+		return reasonErr
+	}
+	return mqtt.NewReasonError(mqtt.ReasonNotAuthorized, err.Error())
 }
@@ -3,74 +3,444 @@ package client
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"time"
 
+	"github.com/M4THYOU/some_mqtt_broker/internal/broker"
 	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+	"github.com/M4THYOU/some_mqtt_broker/pkg/packet"
 )
 
+// SendPacket builds a packet of the given type from the client's current state and writes it to the connection.
 func (client *Client) SendPacket(packetCode uint8) error {
-	packet, err := client.buildPacket(mqtt.ConnackCode)
+	packet, err := client.buildPacket(packetCode)
 	if err != nil {
 		return err
 	}
+	return client.write(packet)
+}
+
+// writeTimeout is how long a client has to take each packet, so one that stops reading can't hold up the clients publishing to it.
+const writeTimeout = time.Second * 30
+
+// write sends the complete packet. Safe to call from any goroutine.
+func (client *Client) write(packet []byte) error {
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+	client.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 	return mqtt.SendPacket(client.Conn, packet)
 }
 
 func (client *Client) buildPacket(packetCode uint8) ([]byte, error) {
-	packet := []byte{}
-	var reqType byte
-	if packetCode == mqtt.PublishCode {
-		// TODO HANDLE PUBLISH FLAGS!!
-		reqType = mqtt.SetRequestType(packetCode, false, false, 0)
-	} else {
-		reqType = mqtt.SetRequestType(packetCode, false, false, 0)
-	}
-	packet = append(packet, reqType)
-
 	// BUILD THE VARIABLE HEADER!
 	varHeader, err := client.buildVarHeader(packetCode)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println(varHeader)
-
-	return packet, nil
+	return mqtt.BuildPacket(mqtt.SetRequestType(packetCode, false, false, 0), varHeader)
 }
 
+// buildVarHeader builds the variable header and payload for packets that only depend on the client's state.
+// Packets that need more than that have their own send function.
 func (client *Client) buildVarHeader(packetCode uint8) (header []byte, err error) {
 	switch packetCode {
-	case mqtt.ConnectCode:
-		// err = client.handleConnect()
 	case mqtt.ConnackCode:
-		// err = client.handleConnack()
-	case mqtt.PublishCode:
-		// err = client.handlePublish()
-	case mqtt.PubackCode:
-		// err = client.handlePuback()
-	case mqtt.PubrecCode:
-		// err = client.handlePubrec()
-	case mqtt.PubrelCode:
-		// err = client.handlePubrel()
-	case mqtt.PubcompCode:
-		// err = client.handlePubcomp()
-	case mqtt.SubscribeCode:
-		// err = client.handleSubscribe()
-	case mqtt.SubackCode:
-		// err = client.handleSuback()
-	case mqtt.UnsubscribeCode:
-		// err = client.handleUnsubscribe()
-	case mqtt.UnsubackCode:
-		// err = client.handleUnsuback()
-	case mqtt.PingreqCode:
-		// err = client.handlePingreq()
+		header, err = client.buildConnack()
 	case mqtt.PingrespCode:
-		// err = client.handlePingresp()
-	case mqtt.DisconnectCode:
-		// err = client.handleDisconnect()
-	case mqtt.AuthCode:
-		// err = client.handleAuth()
+		header = []byte{} // no variable header or payload.
+	case mqtt.PublishCode:
+		err = errors.New("use Deliver to send a PUBLISH packet")
+	case mqtt.PubackCode, mqtt.PubrecCode, mqtt.PubrelCode, mqtt.PubcompCode:
+		err = errors.New("use sendAck to send a PUBACK, PUBREC, PUBREL, or PUBCOMP packet")
+	case mqtt.SubackCode, mqtt.UnsubackCode:
+		err = errors.New("use sendSubAck to send a SUBACK or UNSUBACK packet")
 	default:
 		msg := fmt.Sprintf("server cannot send packet of type: %d", packetCode)
 		return nil, errors.New(msg)
 	}
 	return header, err
 }
+
+// putProps appends the properties, prefixed by their length.
+func putProps(w, props *packet.Writer) error {
+	buf, err := props.Bytes()
+	if err != nil {
+		return err
+	}
+	w.PutVarByteInt(uint32(len(buf)))
+	w.PutBytes(buf)
+	return nil
+}
+
+func (client *Client) buildConnack() ([]byte, error) {
+	w := packet.NewWriter()
+	// Connect Acknowledge Flags, where v3.1 has no Session Present.
+	if client.sessionPresent && client.connackErr == nil && client.ProtocolLevel != mqtt.ProtocolLevel31 {
+		w.PutByte(0x01)
+	} else {
+		w.PutByte(0x00)
+	}
+	if !client.hasProps() {
+		w.PutByte(mqtt.GetConnackReturnCode(mqtt.GetReasonCode(client.connackErr)))
+		return w.Bytes()
+	}
+	w.PutByte(mqtt.GetReasonCode(client.connackErr))
+
+	props := packet.NewWriter()
+	if client.connackErr == nil {
+		// Retained messages aren't stored, so the client must not send any.
+		props.PutByte(mqtt.RetainAvailableCode)
+		props.PutByte(0)
+		if client.maxPacketSize != 0 {
+			props.PutByte(mqtt.MaxPacketSizeCode)
+			props.PutUint32(client.maxPacketSize)
+		}
+		if client.assignedClientId != "" {
+			props.PutByte(mqtt.AssignedClientIdCode)
+			props.PutUtf8Str(client.assignedClientId)
+		}
+		if client.ReturnResponseInfo && client.ResponseInfo != "" {
+			props.PutByte(mqtt.ResponseInfoCode)
+			props.PutUtf8Str(client.ResponseInfo)
+		}
+		if client.AuthMethod != "" {
+			props.PutByte(mqtt.AuthenticationMethodCode)
+			props.PutUtf8Str(client.AuthMethod)
+			if client.serverAuthData != nil {
+				props.PutByte(mqtt.AuthenticationDataCode)
+				props.PutBinaryData(client.serverAuthData)
+			}
+		}
+	}
+	if client.serverReference != "" {
+		props.PutByte(mqtt.ServerReferenceCode)
+		props.PutUtf8Str(client.serverReference)
+	}
+	if client.connackErr != nil {
+		client.putProblemInfo(props, mqtt.ConnackCode, client.connackErr.Error(), nil)
+	}
+	if err := putProps(w, props); err != nil {
+		return nil, err
+	}
+	return w.Bytes()
+}
+
+// allowProblemInfo checks if a Reason String or User Properties may be sent to the client in a packet of the given type.
+// Clients that set Request Problem Information to 0 only get them in PUBLISH, CONNACK, and DISCONNECT packets.
+func (client *Client) allowProblemInfo(packetCode uint8) bool {
+	if client.ReturnProblemInfo {
+		return true
+	}
+	return packetCode == mqtt.PublishCode || packetCode == mqtt.ConnackCode || packetCode == mqtt.DisconnectCode
+}
+
+// putProblemInfo adds the Reason String and User Properties to props, if the client allows them in this packet type.
+func (client *Client) putProblemInfo(props *packet.Writer, packetCode uint8, reason string, userProps []mqtt.UserProperty) {
+	if !client.allowProblemInfo(packetCode) {
+		return
+	}
+	if reason != "" {
+		props.PutByte(mqtt.ReasonStringCode)
+		props.PutUtf8Str(reason)
+	}
+	putUserProps(props, userProps)
+}
+
+// putUserProps adds each User Property to props, keeping their order.
+func putUserProps(props *packet.Writer, userProps []mqtt.UserProperty) {
+	for _, p := range userProps {
+		props.PutByte(mqtt.UserPropertyCode)
+		props.PutUtf8Str(p.Key)
+		props.PutUtf8Str(p.Value)
+	}
+}
+
+// tooLarge checks if the packet exceeds the client's Maximum Packet Size.
+func (client *Client) tooLarge(packet []byte) bool {
+	return client.MaxPacketSize != 0 && len(packet) > int(client.MaxPacketSize)
+}
+
+// sendAck sends a PUBACK, PUBREC, PUBREL, or PUBCOMP packet.
+// The reason code and Reason String come from reasonErr, nil => Success.
+func (client *Client) sendAck(packetCode uint8, packetId uint16, reasonErr error) error {
+	packet, err := client.buildAck(packetCode, packetId, reasonErr, true)
+	if err == nil && client.tooLarge(packet) {
+		// the Reason String is optional, it must be dropped rather than exceed the client's limit.
+		packet, err = client.buildAck(packetCode, packetId, reasonErr, false)
+	}
+	if err != nil {
+		return err
+	}
+	return client.write(packet)
+}
+
+func (client *Client) buildAck(packetCode uint8, packetId uint16, reasonErr error, withReason bool) ([]byte, error) {
+	w := packet.NewWriter()
+	w.PutUint16(packetId)
+	if !client.hasProps() {
+		// before v5.0 acks are only the packet identifier, failures can't be reported.
+		body, err := w.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		return mqtt.BuildPacket(mqtt.SetRequestType(packetCode, false, false, 0), body)
+	}
+	props := packet.NewWriter()
+	if reasonErr != nil && withReason {
+		client.putProblemInfo(props, packetCode, reasonErr.Error(), nil)
+	}
+	// the reason code can be omitted when it's Success and there are no properties.
+	if reasonErr != nil || props.Len() > 0 {
+		w.PutByte(mqtt.GetReasonCode(reasonErr))
+	}
+	if props.Len() > 0 {
+		if err := putProps(w, props); err != nil {
+			return nil, err
+		}
+	}
+	body, err := w.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return mqtt.BuildPacket(mqtt.SetRequestType(packetCode, false, false, 0), body)
+}
+
+// SendDisconnect sends a DISCONNECT packet to the client and closes the connection.
+// serverReference is only included if it's not empty.
+// Servers can't send DISCONNECT before MQTT v5.0, so older clients only have their connection closed.
+func (client *Client) SendDisconnect(reasonCode byte, serverReference string) error {
+	if !client.hasProps() {
+		return client.Conn.Close()
+	}
+	w := packet.NewWriter()
+	w.PutByte(reasonCode)
+	props := packet.NewWriter()
+	if serverReference != "" {
+		props.PutByte(mqtt.ServerReferenceCode)
+		props.PutUtf8Str(serverReference)
+	}
+	if err := putProps(w, props); err != nil {
+		return err
+	}
+	body, err := w.Bytes()
+	if err != nil {
+		return err
+	}
+	packet, err := mqtt.BuildPacket(mqtt.SetRequestType(mqtt.DisconnectCode, false, false, 0), body)
+	if err != nil {
+		return err
+	}
+	err = client.write(packet)
+	client.Conn.Close() // the read loop ends on its own once the connection is closed.
+	return err
+}
+
+// sendAuth sends an AUTH packet with the client's Authentication Method, and data as the Authentication Data, nil => none.
+func (client *Client) sendAuth(reasonCode byte, data []byte) error {
+	w := packet.NewWriter()
+	w.PutByte(reasonCode)
+	props := packet.NewWriter()
+	props.PutByte(mqtt.AuthenticationMethodCode)
+	props.PutUtf8Str(client.AuthMethod)
+	if data != nil {
+		props.PutByte(mqtt.AuthenticationDataCode)
+		props.PutBinaryData(data)
+	}
+	if err := putProps(w, props); err != nil {
+		return err
+	}
+	body, err := w.Bytes()
+	if err != nil {
+		return err
+	}
+	packet, err := mqtt.BuildPacket(mqtt.SetRequestType(mqtt.AuthCode, false, false, 0), body)
+	if err != nil {
+		return err
+	}
+	return client.write(packet)
+}
+
+// sendSubAck sends a SUBACK or UNSUBACK packet, with one reason code per topic filter of the request.
+// reason is the Reason String, empty => none.
+func (client *Client) sendSubAck(packetCode uint8, packetId uint16, reasonCodes []byte, reason string) error {
+	packet, err := client.buildSubAck(packetCode, packetId, reasonCodes, reason)
+	if err == nil && client.tooLarge(packet) {
+		packet, err = client.buildSubAck(packetCode, packetId, reasonCodes, "")
+	}
+	if err != nil {
+		return err
+	}
+	return client.write(packet)
+}
+
+func (client *Client) buildSubAck(packetCode uint8, packetId uint16, reasonCodes []byte, reason string) ([]byte, error) {
+	w := packet.NewWriter()
+	w.PutUint16(packetId)
+	if client.hasProps() {
+		props := packet.NewWriter()
+		client.putProblemInfo(props, packetCode, reason, nil)
+		if err := putProps(w, props); err != nil {
+			return nil, err
+		}
+		w.PutBytes(reasonCodes)
+	} else if packetCode == mqtt.SubackCode {
+		// UNSUBACK has no payload before v5.0.
+		for _, code := range reasonCodes {
+			w.PutByte(mqtt.GetSubackReturnCode(code))
+		}
+	}
+	body, err := w.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return mqtt.BuildPacket(mqtt.SetRequestType(packetCode, false, false, 0), body)
+}
+
+func (client *Client) buildPublish(msg *mqtt.Message) ([]byte, error) {
+	w := packet.NewWriter()
+	w.PutUtf8Str(msg.Topic)
+	if msg.Qos > 0 {
+		w.PutUint16(msg.PacketId)
+	}
+	// the properties are dropped for clients that don't support them.
+	if client.hasProps() {
+		if err := putPublishProps(w, msg); err != nil {
+			return nil, err
+		}
+	}
+
+	w.PutBytes(msg.Payload)
+	body, err := w.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return mqtt.BuildPacket(mqtt.SetRequestType(mqtt.PublishCode, msg.Dup, msg.Retain, int(msg.Qos)), body)
+}
+
+func putPublishProps(w *packet.Writer, msg *mqtt.Message) error {
+	props := packet.NewWriter()
+	if msg.PayloadFormatIndicator != 0 {
+		props.PutByte(mqtt.PayloadFormatIndicatorCode)
+		props.PutByte(msg.PayloadFormatIndicator)
+	}
+	if msg.MessageExpiryInterval != 0 {
+		props.PutByte(mqtt.MessageExpiryIntervalCode)
+		props.PutUint32(msg.MessageExpiryInterval)
+	}
+	if msg.ContentType != "" {
+		props.PutByte(mqtt.ContentTypeCode)
+		props.PutUtf8Str(msg.ContentType)
+	}
+	if msg.ResponseTopic != "" {
+		props.PutByte(mqtt.ResponseTopicCode)
+		props.PutUtf8Str(msg.ResponseTopic)
+	}
+	if msg.CorrelationData != nil {
+		props.PutByte(mqtt.CorrelationDataCode)
+		props.PutBinaryData(msg.CorrelationData)
+	}
+	putUserProps(props, msg.UserProperties)
+	for _, id := range msg.SubscriptionIds {
+		props.PutByte(mqtt.SubscriptionIdCode)
+		props.PutVarByteInt(id)
+	}
+	return putProps(w, props)
+}
+
+// NextPacketId reserves a packet identifier for a QoS 1 or 2 message that is about to be delivered.
+// Fails if the client already has Receive Maximum messages in flight.
+func (client *Client) NextPacketId() (uint16, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if len(client.outbound) >= int(client.ReceiveMaximum) {
+		msg := fmt.Sprintf("client already has %d messages in flight", len(client.outbound))
+		return 0, errors.New(msg)
+	}
+	for i := 0; i < 65535; i++ {
+		client.nextPacketId++
+		if client.nextPacketId == 0 {
+			client.nextPacketId = 1
+		}
+		if _, ok := client.outbound[client.nextPacketId]; !ok {
+			client.outbound[client.nextPacketId] = nil // reserved until Deliver stores the message.
+			return client.nextPacketId, nil
+		}
+	}
+	return 0, errors.New("no packet identifiers available")
+}
+
+// Deliver sends the message to the client in a PUBLISH packet. QoS 1 and 2 messages need a packet identifier from NextPacketId.
+func (client *Client) Deliver(msg *mqtt.Message) error {
+	packet, err := client.buildPublish(msg)
+	if err == nil && client.MaxPacketSize != 0 && len(packet) > int(client.MaxPacketSize) {
+		errMsg := fmt.Sprintf("packet of %d bytes exceeds the client's Maximum Packet Size", len(packet))
+		err = errors.New(errMsg)
+	}
+	if err != nil {
+		client.release(msg.PacketId)
+		return err
+	}
+	if msg.Qos > 0 {
+		client.mu.Lock()
+		client.outbound[msg.PacketId] = msg
+		client.mu.Unlock()
+	}
+	return client.write(packet)
+}
+
+// Inflight returns how many QoS 1 and 2 messages, sent or received, are waiting for the rest of their handshake.
+func (client *Client) Inflight() int {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return len(client.outbound) + len(client.inboundQos2)
+}
+
+// release frees the packet identifier of a message sent to the client.
+// Returns false if no message was in flight with that identifier.
+func (client *Client) release(packetId uint16) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if _, ok := client.outbound[packetId]; !ok {
+		return false
+	}
+	delete(client.outbound, packetId)
+	delete(client.released, packetId)
+	return true
+}
+
+// sessionNeverExpires is the Session Expiry Interval of a session that never expires.
+const sessionNeverExpires = 0xFFFFFFFF
+
+// Session returns what is kept of the client's session if the broker restarts: the messages in flight, both ways.
+// Returns nil if the session ends with the connection, which is when the Session Expiry Interval is 0,
+// or before MQTT v5.0, with Clean Session.
+func (client *Client) Session() *broker.Session {
+	session := &broker.Session{ClientId: client.ClientId}
+	if !client.hasProps() && client.connectFlags.CleanStart {
+		return nil
+	} else if client.hasProps() && client.SessionExpiryInterval == 0 {
+		return nil
+	} else if client.hasProps() && client.SessionExpiryInterval != sessionNeverExpires {
+		session.Expires = time.Now().Add(time.Duration(client.SessionExpiryInterval) * time.Second)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	for packetId, msg := range client.outbound {
+		if msg == nil {
+			continue // reserved, but never sent.
+		}
+		session.Messages = append(session.Messages, msg)
+		if client.released[packetId] {
+			session.Released = append(session.Released, packetId)
+		}
+	}
+	for packetId := range client.inboundQos2 {
+		session.Received = append(session.Received, packetId)
+	}
+	// in the order they were sent, as far as packet identifiers tell.
+	sort.Slice(session.Messages, func(i, j int) bool {
+		return session.Messages[i].PacketId < session.Messages[j].PacketId
+	})
+	return session
+}
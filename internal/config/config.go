@@ -0,0 +1,410 @@
+// Package config reads the broker's configuration from a YAML file, the environment and command line flags,
+// on top of the values in the defaults package.
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/M4THYOU/some_mqtt_broker/internal/client"
+	"github.com/M4THYOU/some_mqtt_broker/internal/defaults"
+	"github.com/M4THYOU/some_mqtt_broker/internal/listener"
+	"github.com/M4THYOU/some_mqtt_broker/internal/logging"
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the whole configuration of the broker.
+type Config struct {
+	Listeners   []Listener  `yaml:"listeners"`
+	Limits      Limits      `yaml:"limits"`
+	Auth        Auth        `yaml:"auth"`
+	Broker      Broker      `yaml:"broker"`
+	Redirect    Redirect    `yaml:"redirect"`
+	Persistence Persistence `yaml:"persistence"`
+	Logging     Logging     `yaml:"logging"`
+}
+
+// Listener configures one of the listeners.
+type Listener struct {
+	Name    string `yaml:"name"`    // unique, so the environment and flags can refer to it.
+	Type    string `yaml:"type"`    // one of: tcp, tls, websocket, unix.
+	Address string `yaml:"address"` // host:port, or the socket's path for unix.
+	Path    string `yaml:"path"`    // websocket only.
+	TLS     *TLS   `yaml:"tls"`     // required for tls, makes websocket listeners wss.
+
+	MaxConnections int    `yaml:"max_connections"` // 0 => no limit.
+	SocketMode     string `yaml:"socket_mode"`     // octal permissions of the unix socket, e.g. "0660".
+	ProxyProtocol  bool   `yaml:"proxy_protocol"`  // connections start with a PROXY protocol header.
+
+	// ProtocolVersions are the MQTT versions accepted: 3.1, 3.1.1 and 5. Empty => all of them.
+	ProtocolVersions []string `yaml:"protocol_versions"`
+	Anonymous        bool     `yaml:"anonymous"`        // clients are neither asked for a password nor restricted to topics.
+	PeerCredentials  bool     `yaml:"peer_credentials"` // unix only: clients are named after the local user that connected.
+}
+
+// TLS configures the TLS of a listener.
+type TLS struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	MinVersion   string `yaml:"min_version"`   // one of: 1.0, 1.1, 1.2, 1.3. Empty => defaults.TLSMinVersion.
+	CipherSuites string `yaml:"cipher_suites"` // comma separated names for TLS 1.2 and below. Empty => Go's defaults.
+	ClientAuth   string `yaml:"client_auth"`   // whether clients must send a certificate, one of: none, optional, required. Empty => defaults.TLSClientAuth.
+	ClientCAFile string `yaml:"client_ca_file"`
+	CRLFile      string `yaml:"crl_file"`
+}
+
+// Limits on what clients may send.
+type Limits struct {
+	MaxPacketSize  uint32        `yaml:"max_packet_size"` // bytes. 0 => no limit.
+	ConnectTimeout time.Duration `yaml:"connect_timeout"` // for CONNECT and any enhanced authentication. 0 => no limit.
+}
+
+// Auth configures how clients are authenticated and authorized.
+type Auth struct {
+	PasswordFile string `yaml:"password_file"` // empty => no password file. A missing file is an error.
+	ACLFile      string `yaml:"acl_file"`      // empty => no ACL. A missing file is an error.
+	JWKSFile     string `yaml:"jwks_file"`     // empty => JWTs aren't accepted. A missing file is an error.
+	ScramFile    string `yaml:"scram_file"`    // empty => SCRAM isn't offered. A missing file is an error.
+
+	CertIdentity   string `yaml:"cert_identity"` // which field of a client certificate identifies the client. Empty => none.
+	CertAsClientId bool   `yaml:"cert_as_client_id"`
+
+	Webhook Webhook `yaml:"webhook"`
+}
+
+// Webhook configures the HTTP endpoint deciding whether clients may connect, publish and subscribe.
+type Webhook struct {
+	URL      string        `yaml:"url"` // empty => no webhook.
+	Timeout  time.Duration `yaml:"timeout"`
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	FailOpen bool          `yaml:"fail_open"`
+}
+
+// Broker configures how messages are routed.
+type Broker struct {
+	SharedSubStrategy     string        `yaml:"shared_sub_strategy"` // one of: round-robin, random, sticky, least-inflight.
+	ResponseInfo          string        `yaml:"response_info"`       // %c => client ID.
+	GrantResponseTopics   bool          `yaml:"grant_response_topics"`
+	RejectNonCharacters   bool          `yaml:"reject_non_characters"`
+	ValidatePayloadFormat bool          `yaml:"validate_payload_format"`
+	TLSReloadInterval     time.Duration `yaml:"tls_reload_interval"` // how often certificate files are checked for changes.
+	ShutdownTimeout       time.Duration `yaml:"shutdown_timeout"`    // how long clients get to complete their QoS 1 and 2 handshakes.
+}
+
+// Redirect configures moving clients to another server.
+type Redirect struct {
+	File        string        `yaml:"file"` // read on SIGUSR1.
+	DrainPeriod time.Duration `yaml:"drain_period"`
+}
+
+// Persistence configures keeping sessions across restarts.
+type Persistence struct {
+	File string `yaml:"file"` // written on shutdown, read on start. Empty => sessions end with the broker.
+}
+
+// Logging configures where the broker's output goes, and how much of it there is.
+type Logging struct {
+	File  string `yaml:"file"`  // appended to. Empty => standard output.
+	Level string `yaml:"level"` // one of: debug, info, error.
+}
+
+// Default returns the configuration from the defaults package.
+// It has the plain TCP listener, the TLS listener if there is a certificate at defaults.TLSCertFile,
+// the WebSocket listener if defaults.WebSocketPort is set, and the Unix socket listener if defaults.UnixSocket is set.
+func Default() *Config {
+	c := &Config{
+		Limits: Limits{MaxPacketSize: defaults.MaxPacketSize, ConnectTimeout: defaults.ConnectTimeout},
+		Auth: Auth{
+			PasswordFile:   defaults.PasswordFile,
+			ACLFile:        defaults.ACLFile,
+			JWKSFile:       defaults.JWKSFile,
+			ScramFile:      defaults.ScramFile,
+			CertIdentity:   defaults.CertIdentity,
+			CertAsClientId: defaults.CertAsClientId,
+			Webhook: Webhook{
+				URL:      defaults.WebhookURL,
+				Timeout:  defaults.WebhookTimeout,
+				CacheTTL: defaults.WebhookCacheTTL,
+				FailOpen: defaults.WebhookFailOpen,
+			},
+		},
+		Broker: Broker{
+			SharedSubStrategy:     defaults.SharedSubStrategy,
+			ResponseInfo:          defaults.ResponseInfo,
+			GrantResponseTopics:   defaults.GrantResponseTopics,
+			RejectNonCharacters:   defaults.RejectNonCharacters,
+			ValidatePayloadFormat: defaults.ValidatePayloadFormat,
+			TLSReloadInterval:     defaults.TLSReloadInterval,
+			ShutdownTimeout:       defaults.ShutdownTimeout,
+		},
+		Redirect:    Redirect{File: defaults.RedirectFile, DrainPeriod: defaults.RedirectDrainPeriod},
+		Persistence: Persistence{File: defaults.PersistenceFile},
+		Logging:     Logging{Level: defaults.LogLevel},
+	}
+	c.Listeners = []Listener{{Name: "default", Type: listener.TCP, Address: defaults.Host + ":" + defaults.Port, ProxyProtocol: defaults.ProxyProtocol}}
+	if _, err := os.Stat(defaults.TLSCertFile); err == nil {
+		c.Listeners = append(c.Listeners, Listener{
+			Name: "tls", Type: listener.TLS, Address: defaults.Host + ":" + defaults.TLSPort, TLS: defaultTLS(), ProxyProtocol: defaults.ProxyProtocol,
+		})
+	}
+	if defaults.WebSocketPort != "" {
+		ws := Listener{Name: "websocket", Type: listener.WebSocket, Address: defaults.Host + ":" + defaults.WebSocketPort, Path: defaults.WebSocketPath, ProxyProtocol: defaults.ProxyProtocol}
+		if defaults.WebSocketTLS {
+			ws.TLS = defaultTLS()
+		}
+		c.Listeners = append(c.Listeners, ws)
+	}
+	if defaults.UnixSocket != "" {
+		c.Listeners = append(c.Listeners, Listener{
+			Name: "unix", Type: listener.Unix, Address: defaults.UnixSocket, SocketMode: fmt.Sprintf("%#o", defaults.UnixSocketMode), PeerCredentials: defaults.UnixPeerCredentials,
+		})
+	}
+	return c
+}
+
+func defaultTLS() *TLS {
+	return &TLS{
+		CertFile:     defaults.TLSCertFile,
+		KeyFile:      defaults.TLSKeyFile,
+		MinVersion:   defaults.TLSMinVersion,
+		CipherSuites: defaults.TLSCipherSuites,
+		ClientAuth:   defaults.TLSClientAuth,
+		ClientCAFile: defaults.TLSClientCAFile,
+		CRLFile:      defaults.TLSCRLFile,
+	}
+}
+
+// ReadFile reads the YAML file on top of the defaults. Listeners in the file replace the default ones.
+// Unknown keys are an error, so typos don't go unnoticed.
+func ReadFile(path string) (*Config, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := Default()
+	c.Listeners = nil
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		msg := fmt.Sprintf("%v: %v", path, err.Error())
+		return nil, errors.New(msg)
+	}
+	if c.Listeners == nil {
+		c.Listeners = Default().Listeners
+	}
+	return c, nil
+}
+
+// Validate checks the configuration, without reading any of the files it refers to.
+func (c *Config) Validate() error {
+	if len(c.Listeners) == 0 {
+		return errors.New("no listeners")
+	} else if _, err := logging.ParseLevel(c.Logging.Level); err != nil {
+		return errors.New("logging: " + err.Error())
+	}
+	names := make(map[string]bool)
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		if l.Name == "" {
+			msg := fmt.Sprintf("listener %d has no name", i+1)
+			return errors.New(msg)
+		} else if names[l.Name] {
+			msg := fmt.Sprintf("more than one listener is named %v", l.Name)
+			return errors.New(msg)
+		}
+		names[l.Name] = true
+		if _, err := l.ListenerConfig(); err != nil {
+			return err
+		}
+		if _, err := l.ClientListener(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListenerConfig returns the settings to start the listener with.
+func (l *Listener) ListenerConfig() (listener.Config, error) {
+	c := listener.Config{
+		Name:           l.Name,
+		Type:           l.Type,
+		Address:        l.Address,
+		Path:           l.Path,
+		MaxConnections: l.MaxConnections,
+		ProxyProtocol:  l.ProxyProtocol,
+	}
+	switch l.Type {
+	case listener.TCP, listener.TLS, listener.WebSocket, listener.Unix:
+	default:
+		msg := fmt.Sprintf("listener %v: invalid type `%v`, expected one of: tcp, tls, websocket, unix", l.Name, l.Type)
+		return c, errors.New(msg)
+	}
+	if l.Address == "" {
+		msg := fmt.Sprintf("listener %v has no address", l.Name)
+		return c, errors.New(msg)
+	} else if l.Type == listener.WebSocket && !strings.HasPrefix(l.Path, "/") {
+		msg := fmt.Sprintf("listener %v: the path must start with /, got `%v`", l.Name, l.Path)
+		return c, errors.New(msg)
+	} else if l.Type == listener.TLS && l.TLS == nil {
+		msg := fmt.Sprintf("listener %v needs TLS settings", l.Name)
+		return c, errors.New(msg)
+	} else if l.MaxConnections < 0 {
+		msg := fmt.Sprintf("listener %v: max_connections can't be negative", l.Name)
+		return c, errors.New(msg)
+	}
+	if l.SocketMode != "" {
+		mode, err := strconv.ParseUint(l.SocketMode, 8, 32)
+		if err != nil || mode > 0777 {
+			msg := fmt.Sprintf("listener %v: invalid socket mode `%v`, expected octal permissions like 0660", l.Name, l.SocketMode)
+			return c, errors.New(msg)
+		}
+		c.SocketMode = os.FileMode(mode)
+	}
+	if l.TLS != nil {
+		opts, err := l.TLS.options()
+		if err != nil {
+			msg := fmt.Sprintf("listener %v: %v", l.Name, err.Error())
+			return c, errors.New(msg)
+		}
+		c.TLS = opts
+	}
+	return c, nil
+}
+
+// options parses the TLS settings. The minimum version and client auth left out get their defaults.
+func (t *TLS) options() (*listener.TLSOptions, error) {
+	if t.CertFile == "" || t.KeyFile == "" {
+		return nil, errors.New("tls needs a cert_file and a key_file")
+	}
+	version, auth := t.MinVersion, t.ClientAuth
+	if version == "" {
+		version = defaults.TLSMinVersion
+	}
+	if auth == "" {
+		auth = defaults.TLSClientAuth
+	}
+	minVersion, err := listener.ParseTLSVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := listener.ParseCipherSuites(t.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	clientAuth, err := listener.ParseClientAuth(auth)
+	if err != nil {
+		return nil, err
+	}
+	opts := &listener.TLSOptions{
+		CertFile:     t.CertFile,
+		KeyFile:      t.KeyFile,
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+		ClientAuth:   clientAuth,
+		CRLFile:      t.CRLFile,
+	}
+	if clientAuth != tls.NoClientCert {
+		opts.ClientCAFile = t.ClientCAFile
+	}
+	return opts, nil
+}
+
+var protocolLevels = map[string]byte{
+	"3.1":   mqtt.ProtocolLevel31,
+	"3.1.1": mqtt.ProtocolLevel311,
+	"5":     mqtt.ProtocolLevel5,
+	"5.0":   mqtt.ProtocolLevel5,
+}
+
+// ClientListener returns the settings of the clients connecting through the listener.
+func (l *Listener) ClientListener() (*client.Listener, error) {
+	settings := &client.Listener{Name: l.Name, Anonymous: l.Anonymous, PeerCredentials: l.PeerCredentials}
+	if l.PeerCredentials && l.Type != listener.Unix {
+		msg := fmt.Sprintf("listener %v: only unix listeners have peer credentials", l.Name)
+		return nil, errors.New(msg)
+	}
+	for _, v := range l.ProtocolVersions {
+		level, ok := protocolLevels[v]
+		if !ok {
+			msg := fmt.Sprintf("listener %v: invalid protocol version `%v`, expected one of: 3.1, 3.1.1, 5", l.Name, v)
+			return nil, errors.New(msg)
+		}
+		settings.ProtocolLevels = append(settings.ProtocolLevels, level)
+	}
+	return settings, nil
+}
+
+// RestartChanges describes the changes from c to next that only apply once the broker is restarted:
+// listeners added, removed or rebound, where sessions are kept, and where the output goes.
+// The rest applies while clients stay connected.
+func (c *Config) RestartChanges(next *Config) []string {
+	changes := make([]string, 0)
+	previous := make(map[string]*Listener)
+	for i := range c.Listeners {
+		previous[c.Listeners[i].Name] = &c.Listeners[i]
+	}
+	for i := range next.Listeners {
+		l := &next.Listeners[i]
+		prev, ok := previous[l.Name]
+		if !ok {
+			changes = append(changes, "listener "+l.Name+" was added")
+			continue
+		}
+		delete(previous, l.Name)
+		for _, key := range prev.restartKeys(l) {
+			changes = append(changes, "listener "+l.Name+": "+key+" changed")
+		}
+	}
+	for i := range c.Listeners {
+		if previous[c.Listeners[i].Name] != nil {
+			changes = append(changes, "listener "+c.Listeners[i].Name+" was removed")
+		}
+	}
+	if c.Persistence.File != next.Persistence.File {
+		changes = append(changes, "persistence.file changed")
+	}
+	if c.Logging.File != next.Logging.File {
+		changes = append(changes, "logging.file changed")
+	}
+	if c.Broker.TLSReloadInterval != next.Broker.TLSReloadInterval {
+		changes = append(changes, "broker.tls_reload_interval changed")
+	}
+	return changes
+}
+
+// restartKeys returns the keys of the settings changed from l to next that the running listener can't apply.
+// Its TLS files and versions, and the settings of its clients, can be.
+func (l *Listener) restartKeys(next *Listener) []string {
+	keys := make([]string, 0)
+	if l.Type != next.Type {
+		keys = append(keys, "type")
+	}
+	if l.Address != next.Address {
+		keys = append(keys, "address")
+	}
+	if l.Path != next.Path {
+		keys = append(keys, "path")
+	}
+	if (l.TLS == nil) != (next.TLS == nil) {
+		keys = append(keys, "tls")
+	}
+	if l.MaxConnections != next.MaxConnections {
+		keys = append(keys, "max_connections")
+	}
+	if l.SocketMode != next.SocketMode {
+		keys = append(keys, "socket_mode")
+	}
+	if l.ProxyProtocol != next.ProxyProtocol {
+		keys = append(keys, "proxy_protocol")
+	}
+	return keys
+}
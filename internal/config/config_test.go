@@ -0,0 +1,234 @@
+package config
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/M4THYOU/some_mqtt_broker/pkg/mqtt"
+)
+
+const testConfig = `
+listeners:
+  - name: main
+    type: tcp
+    address: 127.0.0.1:1883
+    max_connections: 100
+  - name: local
+    type: unix
+    address: /tmp/mqtt.sock
+    socket_mode: "0600"
+    peer_credentials: true
+    protocol_versions: [3.1.1, 5]
+limits:
+  max_packet_size: 1024
+auth:
+  acl_file: /etc/mqtt/acl.conf
+  webhook:
+    timeout: 3s
+persistence:
+  file: /var/lib/mqtt/sessions.json
+logging:
+  file: /var/log/mqtt.log
+  level: debug
+`
+
+func writeTestConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "mqtt.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err.Error())
+	}
+	return path
+}
+
+// testEnv returns a lookup for the environment variables in env.
+func testEnv(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	c, err := ReadFile(writeTestConfig(t, testConfig))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err.Error())
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err.Error())
+	}
+	if len(c.Listeners) != 2 {
+		t.Fatalf("got %d listeners, expected 2", len(c.Listeners))
+	}
+	if c.Limits.MaxPacketSize != 1024 || c.Auth.ACLFile != "/etc/mqtt/acl.conf" || c.Persistence.File != "/var/lib/mqtt/sessions.json" {
+		t.Fatalf("unexpected settings: %+v", c)
+	}
+	if c.Logging.File != "/var/log/mqtt.log" || c.Logging.Level != "debug" {
+		t.Fatalf("unexpected settings: %+v", c)
+	}
+	// settings missing from the file keep their defaults.
+	if c.Auth.Webhook.Timeout != time.Second*3 || c.Auth.PasswordFile != Default().Auth.PasswordFile {
+		t.Fatalf("unexpected auth settings: %+v", c.Auth)
+	}
+
+	l, err := c.Listeners[1].ListenerConfig()
+	if err != nil {
+		t.Fatalf("ListenerConfig failed: %v", err.Error())
+	}
+	if l.Name != "local" || l.SocketMode != 0600 {
+		t.Fatalf("unexpected listener: %+v", l)
+	}
+	settings, err := c.Listeners[1].ClientListener()
+	if err != nil {
+		t.Fatalf("ClientListener failed: %v", err.Error())
+	}
+	if !settings.PeerCredentials || len(settings.ProtocolLevels) != 2 || settings.ProtocolLevels[1] != mqtt.ProtocolLevel5 {
+		t.Fatalf("unexpected client settings: %+v", settings)
+	}
+
+	if _, err := ReadFile(writeTestConfig(t, "limits:\n  max_packet_sise: 1024\n")); err == nil {
+		t.Fatalf("ReadFile should have failed for an unknown key")
+	}
+	c, err = ReadFile(writeTestConfig(t, ""))
+	if err != nil {
+		t.Fatalf("ReadFile failed for an empty file: %v", err.Error())
+	}
+	if len(c.Listeners) == 0 || c.Listeners[0].Name != "default" {
+		t.Fatalf("an empty file should keep the default listeners, got %+v", c.Listeners)
+	}
+	if c.Logging.Level != "info" || c.Persistence.File != "" {
+		t.Fatalf("an empty file should keep the default logging and persistence, got %+v %+v", c.Logging, c.Persistence)
+	}
+
+	// a tls block with only the certificate gets the default version and client auth.
+	c, err = ReadFile(writeTestConfig(t, "listeners:\n  - {name: a, type: tls, address: ':8883', tls: {cert_file: a.crt, key_file: a.key}}\n"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err.Error())
+	}
+	l, err = c.Listeners[0].ListenerConfig()
+	if err != nil {
+		t.Fatalf("ListenerConfig failed for a tls block without min_version and client_auth: %v", err.Error())
+	}
+	if l.TLS.MinVersion != tls.VersionTLS12 || l.TLS.ClientAuth != tls.NoClientCert || l.TLS.CertFile != "a.crt" {
+		t.Fatalf("unexpected TLS options: %+v", l.TLS)
+	}
+}
+
+func checkInvalidConfig(t *testing.T, content string) {
+	c, err := ReadFile(writeTestConfig(t, content))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err.Error())
+	}
+	if err := c.Validate(); err == nil {
+		t.Fatalf("Validate should have failed for:\n%v", content)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	checkInvalidConfig(t, "listeners:\n  - {name: a, type: udp, address: ':1883'}\n")
+	checkInvalidConfig(t, "listeners:\n  - {type: tcp, address: ':1883'}\n")
+	checkInvalidConfig(t, "listeners:\n  - {name: a, type: tcp, address: ':1883'}\n  - {name: a, type: tcp, address: ':1884'}\n")
+	checkInvalidConfig(t, "listeners:\n  - {name: a, type: tcp}\n")
+	checkInvalidConfig(t, "listeners:\n  - {name: a, type: tls, address: ':8883'}\n")
+	checkInvalidConfig(t, "listeners:\n  - {name: a, type: tcp, address: ':1883', tls: {cert_file: a.pem}}\n")
+	checkInvalidConfig(t, "listeners:\n  - {name: a, type: websocket, address: ':8080', path: mqtt}\n")
+	checkInvalidConfig(t, "listeners:\n  - {name: a, type: unix, address: a.sock, socket_mode: '0999'}\n")
+	checkInvalidConfig(t, "listeners:\n  - {name: a, type: tcp, address: ':1883', peer_credentials: true}\n")
+	checkInvalidConfig(t, "listeners:\n  - {name: a, type: tcp, address: ':1883', protocol_versions: [4]}\n")
+	checkInvalidConfig(t, "listeners:\n  - {name: a, type: tls, address: ':8883', tls: {min_version: '0.9'}}\n")
+	checkInvalidConfig(t, "logging:\n  level: verbose\n")
+}
+
+func TestLoad(t *testing.T) {
+	path := writeTestConfig(t, testConfig)
+	env := map[string]string{
+		"MQTT_CONFIG":                      path,
+		"MQTT_LIMITS_MAX_PACKET_SIZE":      "2048",
+		"MQTT_AUTH_ACL_FILE":               "env.acl",
+		"MQTT_LISTENERS_MAIN_ADDRESS":      ":1884",
+		"MQTT_LISTENERS_LOCAL_ANONYMOUS":   "true",
+		"MQTT_AUTH_WEBHOOK_CACHE_TTL":      "1m",
+		"MQTT_LISTENERS_UNKNOWN_ADDRESS":   ":1",
+		"MQTT_BROKER_GRANT_RESPONSE_TOPIC": "ignored",
+		"MQTT_LOGGING_LEVEL":               "error",
+	}
+	args := []string{"--auth.acl_file", "flag.acl", "--listeners.local.protocol_versions=5", "--check-config"}
+	c, opts, err := Load("broker", args, testEnv(env))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err.Error())
+	}
+	if opts.ConfigFile != path || !opts.CheckConfig {
+		t.Fatalf("unexpected options: %+v", opts)
+	}
+	if c.Limits.MaxPacketSize != 2048 || c.Auth.Webhook.CacheTTL != time.Minute || c.Logging.Level != "error" {
+		t.Fatalf("the environment should override the file: %+v", c)
+	}
+	if c.Auth.ACLFile != "flag.acl" {
+		t.Fatalf("flags should override the environment, got ACL file %v", c.Auth.ACLFile)
+	}
+	if c.Listeners[0].Address != ":1884" || !c.Listeners[1].Anonymous || len(c.Listeners[1].ProtocolVersions) != 1 {
+		t.Fatalf("unexpected listeners: %+v", c.Listeners)
+	}
+
+	// --config takes precedence over MQTT_CONFIG.
+	other := writeTestConfig(t, "limits:\n  max_packet_size: 10\n")
+	c, _, err = Load("broker", []string{"--config", other}, testEnv(map[string]string{"MQTT_CONFIG": path}))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err.Error())
+	}
+	if c.Limits.MaxPacketSize != 10 || c.Listeners[0].Name != "default" {
+		t.Fatalf("unexpected config from --config: %+v", c)
+	}
+
+	if _, _, err := Load("broker", nil, testEnv(map[string]string{"MQTT_LIMITS_MAX_PACKET_SIZE": "big"})); err == nil {
+		t.Fatalf("Load should have failed for an invalid environment variable")
+	}
+	if _, _, err := Load("broker", []string{"--listeners.main.address=:1"}, testEnv(nil)); err == nil {
+		t.Fatalf("Load should have failed for a flag of an unknown listener")
+	}
+	if _, _, err := Load("broker", []string{"--config", filepath.Join(os.TempDir(), "missing.yaml")}, testEnv(nil)); err == nil {
+		t.Fatalf("Load should have failed for a missing file")
+	}
+}
+
+func TestRestartChanges(t *testing.T) {
+	c, err := ReadFile(writeTestConfig(t, testConfig))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err.Error())
+	}
+	next, err := ReadFile(writeTestConfig(t, testConfig))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err.Error())
+	}
+	// what running listeners and the broker can apply.
+	next.Limits.MaxPacketSize = 10
+	next.Auth.ACLFile = "other.acl"
+	next.Listeners[1].Anonymous = true
+	next.Listeners[1].ProtocolVersions = []string{"5"}
+	next.Logging.Level = "error"
+	if changes := c.RestartChanges(next); len(changes) != 0 {
+		t.Fatalf("got changes %v, expected none", changes)
+	}
+
+	next.Listeners[0].Address = ":1884"
+	next.Listeners[0].TLS = &TLS{}
+	next.Listeners[1].Name = "other"
+	next.Persistence.File = "other.json"
+	next.Logging.File = ""
+	expected := []string{
+		"listener main: address changed",
+		"listener main: tls changed",
+		"listener other was added",
+		"listener local was removed",
+		"persistence.file changed",
+		"logging.file changed",
+	}
+	changes := c.RestartChanges(next)
+	if strings.Join(changes, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("got changes %q, expected %q", changes, expected)
+	}
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix starts the names of the environment variables overriding the configuration, e.g. MQTT_AUTH_ACL_FILE.
+const EnvPrefix = "MQTT_"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setting is a value of the configuration that the environment and flags can override.
+// It is named after its YAML keys, with listeners named after their name, e.g. listeners.default.address.
+type setting struct {
+	name  string
+	value reflect.Value
+}
+
+// envName returns the environment variable overriding the setting, e.g. MQTT_LISTENERS_DEFAULT_ADDRESS.
+func (s *setting) envName() string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(s.name))
+}
+
+// settings returns every value of the configuration that can be overridden.
+// The TLS settings of a listener are only there if it has some already.
+func (c *Config) settings() []setting {
+	return appendSettings(nil, "", reflect.ValueOf(c).Elem())
+}
+
+func appendSettings(settings []setting, prefix string, v reflect.Value) []setting {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("yaml")
+		f := v.Field(i)
+		switch {
+		case key == "name":
+			// listeners are found by name, so it can't be changed.
+		case f.Type() == durationType:
+			settings = append(settings, setting{prefix + key, f})
+		case f.Kind() == reflect.Struct:
+			settings = appendSettings(settings, prefix+key+".", f)
+		case f.Kind() == reflect.Ptr:
+			if !f.IsNil() {
+				settings = appendSettings(settings, prefix+key+".", f.Elem())
+			}
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Struct:
+			for j := 0; j < f.Len(); j++ {
+				name := f.Index(j).FieldByName("Name").String()
+				settings = appendSettings(settings, prefix+key+"."+name+".", f.Index(j))
+			}
+		default:
+			settings = append(settings, setting{prefix + key, f})
+		}
+	}
+	return settings
+}
+
+// settingValue sets a setting from a string, for flags and the environment.
+type settingValue struct {
+	v reflect.Value
+}
+
+func (s settingValue) String() string {
+	if !s.v.IsValid() {
+		return ""
+	} else if s.v.Kind() == reflect.Slice {
+		return strings.Join(s.v.Interface().([]string), ",")
+	}
+	return fmt.Sprint(s.v.Interface())
+}
+
+// Set parses the string for the setting's type. Lists are comma separated.
+func (s settingValue) Set(str string) error {
+	v := s.v
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(str)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(str, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(str, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Slice:
+		list := make([]string, 0)
+		for _, item := range strings.Split(str, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		msg := fmt.Sprintf("can't set a %v", v.Type())
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// IsBoolFlag lets boolean flags be given without a value, e.g. --auth.webhook.fail_open.
+func (s settingValue) IsBoolFlag() bool {
+	return s.v.IsValid() && s.v.Kind() == reflect.Bool
+}
+
+// ApplyEnv overrides the settings with the MQTT_* variables found by lookup, e.g. os.LookupEnv.
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	for _, s := range c.settings() {
+		str, ok := lookup(s.envName())
+		if !ok {
+			continue
+		}
+		if err := (settingValue{s.value}).Set(str); err != nil {
+			msg := fmt.Sprintf("invalid %v `%v`: %v", s.envName(), str, err.Error())
+			return errors.New(msg)
+		}
+	}
+	return nil
+}
+
+// Options are what the command line asks for, besides the configuration.
+type Options struct {
+	ConfigFile  string // empty => no configuration file.
+	CheckConfig bool   // only check the configuration, and exit.
+}
+
+// Load returns the configuration from the defaults, the file given with --config or MQTT_CONFIG,
+// the MQTT_* environment variables, then the flags, each overriding the previous ones.
+// Every setting has a flag named after it, e.g. --auth.acl_file or --listeners.default.address.
+func Load(name string, args []string, lookup func(string) (string, bool)) (*Config, *Options, error) {
+	opts := &Options{}
+	opts.ConfigFile, _ = lookup(EnvPrefix + "CONFIG")
+	// the file must be read before the flags are defined, since they depend on its listeners.
+	for i, arg := range args {
+		arg = strings.TrimLeft(arg, "-")
+		if arg == "config" && i+1 < len(args) {
+			opts.ConfigFile = args[i+1]
+		} else if strings.HasPrefix(arg, "config=") {
+			opts.ConfigFile = strings.TrimPrefix(arg, "config=")
+		}
+	}
+
+	c := Default()
+	if opts.ConfigFile != "" {
+		var err error
+		if c, err = ReadFile(opts.ConfigFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := c.ApplyEnv(lookup); err != nil {
+		return nil, nil, err
+	}
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&opts.ConfigFile, "config", opts.ConfigFile, "YAML configuration file (env "+EnvPrefix+"CONFIG)")
+	flags.BoolVar(&opts.CheckConfig, "check-config", false, "check the configuration and exit")
+	for _, s := range c.settings() {
+		flags.Var(settingValue{s.value}, s.name, "(env "+s.envName()+")")
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	} else if flags.NArg() > 0 {
+		msg := fmt.Sprintf("unexpected argument `%v`", flags.Arg(0))
+		return nil, nil, errors.New(msg)
+	}
+	return c, opts, nil
+}
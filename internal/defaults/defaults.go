@@ -1,10 +1,61 @@
 package defaults
 
+import "time"
+
 const (
-	Host          = "localhost"
-	Port          = "1883"
-	ConType       = "tcp"
-	MaxPacketSize = 65536 // bytes
+	Host           = "localhost"
+	Port           = "1883"
+	MaxPacketSize  = 65536            // bytes
+	ConnectTimeout = time.Second * 10 // for new connections to send CONNECT and complete any enhanced authentication.
+
+	TLSPort           = "8883"
+	TLSCertFile       = "server.crt"     // PEM certificate chain for the TLS listener. Missing => no TLS listener.
+	TLSKeyFile        = "server.key"     // PEM private key for the TLS listener.
+	TLSMinVersion     = "1.2"            // one of: 1.0, 1.1, 1.2, 1.3.
+	TLSCipherSuites   = ""               // comma separated names for TLS 1.2 and below. Empty => Go's defaults.
+	TLSReloadInterval = time.Second * 10 // how often the certificate files are checked for changes.
+	TLSClientAuth     = "none"           // whether clients must send a certificate, one of: none, optional, required.
+	TLSClientCAFile   = "ca.crt"         // PEM bundle of the CAs client certificates are verified with, unless TLSClientAuth is none.
+	TLSCRLFile        = ""               // revoked client certificates, signed by a client CA. Empty => none.
+	CertIdentity      = ""               // which field of a client certificate identifies the client: cn, dns, email or uri. Empty => none.
+	CertAsClientId    = false            // the certificate identity replaces the Client ID. false => the User Name.
+
+	WebSocketPort = "8080"  // for MQTT over WebSockets, e.g. from browsers. Empty => no WebSocket listener.
+	WebSocketPath = "/mqtt" // the HTTP path clients connect to.
+	WebSocketTLS  = false   // wss, with the TLS certificate and settings above.
+
+	UnixSocket          = ""    // path of a Unix socket for local clients. Empty => no Unix socket listener.
+	UnixSocketMode      = 0660  // permissions of the socket file, deciding which local users may connect.
+	UnixPeerCredentials = false // clients on the Unix socket are named after the local user that connected, without a password.
+
+	ProxyProtocol = false // connections to the TCP, TLS and WebSocket listeners start with a PROXY protocol header, from a proxy like HAProxy.
+
+	SharedSubStrategy   = "round-robin" // one of: round-robin, random, sticky, least-inflight.
+	ResponseInfo        = "reply/%c/"   // sent to clients that request Response Information. %c => client ID.
+	GrantResponseTopics = false         // clients may always use the topics under their Response Information. Clients choose their own IDs, so only enable it with %c if they can't pick another's.
+
+	RejectNonCharacters   = false // the spec allows non-characters in UTF-8 strings, but they are usually a mistake.
+	ValidatePayloadFormat = true  // payloads with a Payload Format Indicator of 1 are checked to be valid UTF-8.
+
+	// The authentication files are only read if configured, and must then exist, so a missing file never opens up the broker.
+	ScramFile    = "" // SCRAM-SHA-1 and SCRAM-SHA-256 credentials. Empty => SCRAM isn't offered.
+	PasswordFile = "" // <user>:<hash> lines, managed with mqttpasswd and read again on SIGHUP. Empty => any User Name and Password are accepted.
+	ACLFile      = "" // which topics each client may publish and subscribe to, read again on SIGHUP. Empty => every topic is allowed.
+	JWKSFile     = "" // keys for verifying JWTs sent as the password or with the JWT Authentication Method, read again on SIGHUP. Empty => JWTs aren't accepted.
+
+	WebhookURL      = ""               // asked whether clients may connect, publish and subscribe. Empty => no webhook.
+	WebhookTimeout  = time.Second * 5  // for each request to the webhook.
+	WebhookCacheTTL = time.Second * 60 // how long the webhook's decisions are remembered.
+	WebhookFailOpen = false            // allow what the webhook can't decide because it is down. false => refuse it.
+
+	RedirectFile        = "redirect.conf"  // read on SIGUSR1. Holds: <server reference> [moved]
+	RedirectDrainPeriod = time.Second * 60 // connected clients are redirected gradually over this period.
+
+	ShutdownTimeout = time.Second * 10 // on SIGTERM and SIGINT, how long clients get to complete their QoS 1 and 2 handshakes.
+
+	PersistenceFile = "" // sessions that outlive their connection are kept in it across restarts. Empty => they end with the broker.
+
+	LogLevel = "info" // one of: debug (every packet), info (connections and clients refused), error.
 )
 
 // Default values as defined in the spec.
@@ -0,0 +1,154 @@
+package listener
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/M4THYOU/some_mqtt_broker/internal/logging"
+)
+
+// Listener types.
+const (
+	TCP       = "tcp"
+	TLS       = "tls"
+	WebSocket = "websocket"
+	Unix      = "unix"
+)
+
+// Config describes a listener.
+type Config struct {
+	Name    string // for logging. Empty => the type and address.
+	Type    string // one of the listener types.
+	Address string // host:port to bind, or the socket's path for Unix.
+	Path    string // the HTTP path of WebSocket listeners.
+	// TLS settings, required for TLS listeners. Makes WebSocket listeners use wss.
+	TLS *TLSOptions
+	// MaxConnections is how many connections may be open at once. More are closed as soon as they are accepted.
+	// 0 => no limit.
+	MaxConnections int
+	SocketMode     os.FileMode // permissions of the socket file of Unix listeners. 0 => the umask decides.
+	// ProxyProtocol requires connections to start with a PROXY protocol v1 or v2 header, for listeners behind a proxy
+	// like HAProxy. Their remote address is then the original client's. Connections without one are closed.
+	ProxyProtocol bool
+}
+
+// String returns the name of the listener.
+func (c *Config) String() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Type + " " + c.Address
+}
+
+// Listen starts the listener. If it uses TLS, the reloader of its files is returned too, whose Watch should be started.
+func Listen(c Config) (net.Listener, *CertReloader, error) {
+	var config *tls.Config
+	var certs *CertReloader
+	if c.TLS != nil && c.Type != TLS && c.Type != WebSocket {
+		msg := fmt.Sprintf("listener %v can't use TLS, only tls and websocket listeners can", c.String())
+		return nil, nil, errors.New(msg)
+	} else if c.TLS != nil {
+		var err error
+		if config, certs, err = NewTLSConfig(*c.TLS); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var l net.Listener
+	var err error
+	switch c.Type {
+	case TCP, WebSocket:
+		l, err = net.Listen("tcp", c.Address)
+	case TLS:
+		if config == nil {
+			msg := fmt.Sprintf("listener %v needs TLS settings", c.String())
+			return nil, nil, errors.New(msg)
+		}
+		l, err = net.Listen("tcp", c.Address)
+	case Unix:
+		l, err = listenUnix(c.Address, c.SocketMode)
+	default:
+		msg := fmt.Sprintf("invalid listener type `%v`, expected one of: tcp, tls, websocket, unix", c.Type)
+		return nil, nil, errors.New(msg)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// the proxy's header comes first, then the TLS handshake, then the WebSocket upgrade.
+	if c.ProxyProtocol {
+		l = newProxyListener(l)
+	}
+	if config != nil {
+		l = tls.NewListener(l, config)
+	}
+	if c.Type == WebSocket {
+		l = NewWebSocketListener(l, c.Path)
+	}
+	if c.MaxConnections > 0 {
+		l = &limitListener{Listener: l, name: c.String(), sem: make(chan struct{}, c.MaxConnections)}
+	}
+	return l, certs, nil
+}
+
+// limitListener closes the connections it accepts beyond its limit.
+type limitListener struct {
+	net.Listener
+	name string
+	sem  chan struct{} // holds a value for each open connection.
+}
+
+// Accept returns the next connection under the limit.
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.sem <- struct{}{}:
+			return &limitConn{Conn: conn, release: func() { <-l.sem }}, nil
+		default:
+			logging.Infof("Listener %v is at its limit of %d connections, closing the connection from %v\n", l.name, cap(l.sem), conn.RemoteAddr())
+			conn.Close()
+		}
+	}
+}
+
+// limitConn frees its place under the limit once it is closed.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// ConnectionState returns the TLS state of the connection. The zero value if it isn't TLS.
+func (c *limitConn) ConnectionState() tls.ConnectionState {
+	return connectionState(c.Conn)
+}
+
+// PeerCredentials returns the credentials of the process on the other end of a Unix socket.
+func (c *limitConn) PeerCredentials() (uid, gid uint32, ok bool) {
+	return peerCredentials(c.Conn)
+}
+
+// ProxyHeader returns the PROXY protocol header the connection started with, if any.
+func (c *limitConn) ProxyHeader() *ProxyHeader {
+	return ProxyHeaderOf(c.Conn)
+}
+
+// connectionState returns the TLS state of a connection, which may be wrapped. The zero value if it isn't TLS.
+func connectionState(conn net.Conn) tls.ConnectionState {
+	if c, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return c.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
@@ -0,0 +1,73 @@
+package listener
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// checkClosed checks if the server closed the connection, without sending anything.
+func checkClosed(t *testing.T, conn net.Conn, shouldBeClosed bool) {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	_, err := conn.Read(make([]byte, 1))
+	ne, ok := err.(net.Error)
+	timedOut := ok && ne.Timeout()
+	if shouldBeClosed && timedOut {
+		t.Fatalf("the connection should have been closed")
+	} else if !shouldBeClosed && !timedOut {
+		t.Fatalf("the connection should be open, got: %v", err)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	l, _, err := Listen(Config{Type: TCP, Address: "127.0.0.1:0", MaxConnections: 1})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err.Error())
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	conn := <-accepted
+	second, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	checkClosed(t, second, true)
+	checkClosed(t, first, false)
+
+	// closing a connection makes room for another.
+	conn.Close()
+	third, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	(<-accepted).Close()
+}
+
+func TestListenInvalid(t *testing.T) {
+	if _, _, err := Listen(Config{Type: "udp", Address: "127.0.0.1:0"}); err == nil {
+		t.Fatalf("Listen should have failed for an invalid type")
+	}
+	if _, _, err := Listen(Config{Type: TLS, Address: "127.0.0.1:0"}); err == nil {
+		t.Fatalf("Listen should have failed for a TLS listener without TLS settings")
+	}
+	if _, _, err := Listen(Config{Type: TCP, Address: "127.0.0.1:0", TLS: &TLSOptions{}}); err == nil {
+		t.Fatalf("Listen should have failed for a TCP listener with TLS settings")
+	}
+}
@@ -0,0 +1,24 @@
+package listener
+
+import (
+	"net"
+	"syscall"
+)
+
+// readPeerCredentials reads the user and group IDs of the peer process with SO_PEERCRED.
+func readPeerCredentials(conn *net.UnixConn) (uid, gid uint32, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, 0, err
+	} else if credErr != nil {
+		return 0, 0, credErr
+	}
+	return cred.Uid, cred.Gid, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package listener
+
+import (
+	"errors"
+	"net"
+)
+
+// readPeerCredentials fails, peer credentials are only read on Linux.
+func readPeerCredentials(conn *net.UnixConn) (uid, gid uint32, err error) {
+	return 0, 0, errors.New("peer credentials are only supported on Linux")
+}
@@ -0,0 +1,324 @@
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/M4THYOU/some_mqtt_broker/internal/logging"
+)
+
+const (
+	proxyHeaderTimeout = time.Second * 5 // for the proxy to send the header, once the connection is accepted.
+	proxyV1MaxLength   = 107             // including the CRLF.
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 TLV types.
+const (
+	pp2TypeAuthority     = 0x02
+	pp2TypeSSL           = 0x20
+	pp2SubtypeSSLVersion = 0x21
+	pp2SubtypeSSLCN      = 0x22
+	pp2ClientSSL         = 0x01
+	pp2ClientCertConn    = 0x02
+)
+
+// ProxyHeader is what a proxy said about the connection it forwarded, with the PROXY protocol.
+type ProxyHeader struct {
+	Version byte // 1 or 2.
+	Local   bool // v2 only: the proxy opened the connection itself, with the LOCAL command, e.g. for a health check.
+	// Source and Destination are the addresses of the original connection.
+	// nil => the proxy opened the connection itself, e.g. for a health check, or didn't know them.
+	Source, Destination net.Addr
+	Authority           string    // v2 only: the host name the client asked for, e.g. its TLS SNI.
+	TLS                 *ProxyTLS // v2 only: the proxy terminated TLS. nil => it didn't, or didn't say.
+}
+
+// ProxyTLS describes the TLS connection a proxy terminated.
+type ProxyTLS struct {
+	Version      string // e.g. TLSv1.3.
+	CommonName   string // of the client's certificate, if it sent one.
+	CertVerified bool   // the client sent a certificate, and the proxy verified it.
+}
+
+// proxyListener reads the PROXY protocol header of each connection before Accept returns it.
+// Connections without a valid header are closed, so clients can't pretend to be someone else by connecting directly.
+type proxyListener struct {
+	net.Listener
+	conns chan net.Conn
+
+	done chan struct{} // closed once the listener fails.
+	err  error
+}
+
+func newProxyListener(l net.Listener) *proxyListener {
+	p := &proxyListener{Listener: l, conns: make(chan net.Conn), done: make(chan struct{})}
+	go p.serve()
+	return p
+}
+
+// serve accepts connections and reads their headers concurrently, so a slow proxy doesn't hold up the others.
+func (l *proxyListener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+		go func() {
+			pc, err := readProxyHeader(conn)
+			if err != nil {
+				logging.Infof("Closing the connection from %v: %v\n", conn.RemoteAddr(), err.Error())
+				conn.Close()
+				return
+			}
+			select {
+			case l.conns <- pc:
+			case <-l.done:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// Accept waits for the next connection with a valid header.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// proxyConn is a connection forwarded by a proxy. Its remote address is that of the original client.
+type proxyConn struct {
+	net.Conn
+	rdr    *bufio.Reader // holds whatever was sent after the header.
+	header *ProxyHeader
+}
+
+// readProxyHeader reads the header of a v1 or v2 PROXY protocol connection.
+func readProxyHeader(conn net.Conn) (*proxyConn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	rdr := bufio.NewReader(conn)
+	start, err := rdr.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	var header *ProxyHeader
+	if bytes.Equal(start, proxyV2Signature) {
+		header, err = readProxyV2(rdr)
+	} else if bytes.HasPrefix(start, []byte("PROXY ")) {
+		header, err = readProxyV1(rdr)
+	} else {
+		err = errors.New("no PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, rdr: rdr, header: header}, nil
+}
+
+// readProxyV1 reads a human-readable header, e.g. "PROXY TCP4 192.0.2.1 192.0.2.2 56324 1883\r\n".
+func readProxyV1(rdr *bufio.Reader) (*ProxyHeader, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLength {
+			return nil, errors.New("PROXY protocol v1 header is too long")
+		}
+		b, err := rdr.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	header := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	} else if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		msg := fmt.Sprintf("invalid PROXY protocol v1 header `%v`", strings.TrimSpace(string(line)))
+		return nil, errors.New(msg)
+	}
+	src, err := proxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := proxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	header.Source, header.Destination = src, dst
+	return header, nil
+}
+
+func proxyV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if addr.IP == nil || err != nil {
+		msg := fmt.Sprintf("invalid address in PROXY protocol v1 header: %v %v", ip, port)
+		return nil, errors.New(msg)
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+// readProxyV2 reads a binary header.
+func readProxyV2(rdr *bufio.Reader) (*ProxyHeader, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(rdr, fixed[:]); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		msg := fmt.Sprintf("unsupported PROXY protocol version %d", fixed[12]>>4)
+		return nil, errors.New(msg)
+	}
+	command := fixed[12] & 0x0F
+	family := fixed[13]
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(rdr, body); err != nil {
+		return nil, err
+	}
+	header := &ProxyHeader{Version: 2}
+	switch command {
+	case 0x0: // LOCAL, opened by the proxy itself.
+		header.Local = true
+		return header, nil
+	case 0x1: // PROXY
+	default:
+		msg := fmt.Sprintf("invalid PROXY protocol v2 command %#x", command)
+		return nil, errors.New(msg)
+	}
+
+	// the length of the addresses, by the address family in the high 4 bits. The transport, stream or datagram, doesn't change it.
+	addrLen, ok := map[byte]int{0x1: 12, 0x2: 36, 0x3: 216}[family>>4]
+	if !ok {
+		// AF_UNSPEC, or a family this doesn't know: nothing says where the addresses end, so the rest is ignored.
+		return header, nil
+	} else if len(body) < addrLen {
+		return nil, errors.New("PROXY protocol v2 header is too short for its addresses")
+	}
+	// only stream addresses are kept, the others can't be where an MQTT connection came from.
+	switch family {
+	case 0x11: // TCP over IPv4
+		header.Source = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}
+		header.Destination = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:]))}
+	case 0x21: // TCP over IPv6
+		header.Source = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}
+		header.Destination = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:]))}
+	case 0x31: // Unix stream
+		header.Source = &net.UnixAddr{Name: string(bytes.TrimRight(body[0:108], "\x00")), Net: "unix"}
+		header.Destination = &net.UnixAddr{Name: string(bytes.TrimRight(body[108:216], "\x00")), Net: "unix"}
+	}
+	if err := header.readTLVs(body[addrLen:]); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// readTLVs reads the TLVs the header understands, ignoring the others.
+func (h *ProxyHeader) readTLVs(b []byte) error {
+	return readTLVs(b, func(typ byte, value []byte) error {
+		switch typ {
+		case pp2TypeAuthority:
+			h.Authority = string(value)
+		case pp2TypeSSL:
+			// client flags, then whether the certificate was verified, then sub-TLVs.
+			if len(value) < 5 {
+				return errors.New("PROXY protocol v2 SSL TLV is too short")
+			} else if value[0]&pp2ClientSSL == 0 {
+				return nil
+			}
+			t := &ProxyTLS{CertVerified: value[0]&pp2ClientCertConn != 0 && binary.BigEndian.Uint32(value[1:5]) == 0}
+			err := readTLVs(value[5:], func(typ byte, value []byte) error {
+				switch typ {
+				case pp2SubtypeSSLVersion:
+					t.Version = string(value)
+				case pp2SubtypeSSLCN:
+					t.CommonName = string(value)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			h.TLS = t
+		}
+		return nil
+	})
+}
+
+// readTLVs calls f with the type and value of each TLV in b.
+func readTLVs(b []byte, f func(typ byte, value []byte) error) error {
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return errors.New("truncated PROXY protocol v2 TLV")
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return errors.New("truncated PROXY protocol v2 TLV")
+		}
+		if err := f(b[0], b[3:3+n]); err != nil {
+			return err
+		}
+		b = b[3+n:]
+	}
+	return nil
+}
+
+// Read reads what was sent after the header.
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.rdr.Read(p)
+}
+
+// RemoteAddr returns the address of the original client, or the proxy's if it didn't say.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the original client connected to, or the local end if the proxy didn't say.
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ProxyHeader returns the header the connection started with.
+func (c *proxyConn) ProxyHeader() *ProxyHeader {
+	return c.header
+}
+
+// PeerCredentials returns the credentials of the process on the other end of a Unix socket, i.e. the proxy's.
+// They are only those of the client if the proxy opened the connection itself, so ok is false for forwarded ones.
+func (c *proxyConn) PeerCredentials() (uid, gid uint32, ok bool) {
+	if !c.header.Local {
+		return 0, 0, false
+	}
+	return peerCredentials(c.Conn)
+}
+
+// ProxyHeaderOf returns the PROXY protocol header a connection started with, or nil if its listener doesn't use it.
+// Connections through TLS listeners only have the original addresses, as their RemoteAddr and LocalAddr.
+func ProxyHeaderOf(conn net.Conn) *ProxyHeader {
+	if c, ok := conn.(interface{ ProxyHeader() *ProxyHeader }); ok {
+		return c.ProxyHeader()
+	}
+	return nil
+}
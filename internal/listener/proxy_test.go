@@ -0,0 +1,209 @@
+package listener
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func startTestProxyListener(t *testing.T, config Config) net.Listener {
+	config.Address, config.ProxyProtocol = "127.0.0.1:0", true
+	l, _, err := Listen(config)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err.Error())
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// checkProxyHeader sends the header followed by MQTT bytes, and checks the connection's remote address.
+func checkProxyHeader(t *testing.T, l net.Listener, header []byte, expectedRemote string) *ProxyHeader {
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write(append(header, 0x10, 0x00)); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err.Error())
+	}
+	defer conn.Close()
+	if expectedRemote == "" {
+		expectedRemote = client.LocalAddr().String()
+	}
+	if conn.RemoteAddr().String() != expectedRemote {
+		t.Fatalf("got remote address %v, expected %v", conn.RemoteAddr(), expectedRemote)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil || buf[0] != 0x10 {
+		t.Fatalf("the bytes after the header should be read, got %v %v", buf, err)
+	}
+	return ProxyHeaderOf(conn)
+}
+
+// checkProxyRefused checks that a connection starting with the bytes is closed.
+func checkProxyRefused(t *testing.T, l net.Listener, start []byte) {
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write(start)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("the connection starting with %q should have been closed, got: %v", start, err)
+	}
+}
+
+// proxyV2Header builds a v2 header with the command, family, addresses and TLVs.
+func proxyV2Header(command, family byte, body []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(body)))
+	return append(header, body...)
+}
+
+func tlv(typ byte, value []byte) []byte {
+	return append([]byte{typ, byte(len(value) >> 8), byte(len(value))}, value...)
+}
+
+func TestProxyProtocolV1(t *testing.T) {
+	l := startTestProxyListener(t, Config{Type: TCP})
+	h := checkProxyHeader(t, l, []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 1883\r\n"), "192.0.2.1:56324")
+	if h == nil || h.Version != 1 || h.Destination.String() != "192.0.2.2:1883" {
+		t.Fatalf("got header %+v", h)
+	}
+	checkProxyHeader(t, l, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 1883\r\n"), "[2001:db8::1]:56324")
+	// the proxy doesn't know, so the address is the proxy's.
+	checkProxyHeader(t, l, []byte("PROXY UNKNOWN\r\n"), "")
+
+	checkProxyRefused(t, l, []byte{0x10, 0x0C, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x02, 0x00, 0x3C, 0x00, 0x00})
+	checkProxyRefused(t, l, []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n"))
+	checkProxyRefused(t, l, []byte("PROXY TCP4 not-an-ip 192.0.2.2 56324 1883\r\n"))
+	checkProxyRefused(t, l, append([]byte("PROXY TCP4 "), make([]byte, 120)...))
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	l := startTestProxyListener(t, Config{Type: TCP})
+	addrs := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xDC, 0x04, 0x07, 0x5B}
+	ssl := []byte{pp2ClientSSL | pp2ClientCertConn, 0, 0, 0, 0}
+	ssl = append(ssl, tlv(pp2SubtypeSSLVersion, []byte("TLSv1.3"))...)
+	ssl = append(ssl, tlv(pp2SubtypeSSLCN, []byte("gateway-7"))...)
+	body := append(append([]byte{}, addrs...), tlv(pp2TypeAuthority, []byte("mqtt.example.com"))...)
+	body = append(body, tlv(0xEE, []byte("unknown TLVs are ignored"))...)
+	body = append(body, tlv(pp2TypeSSL, ssl)...)
+
+	h := checkProxyHeader(t, l, proxyV2Header(0x1, 0x11, body), "192.0.2.1:56324")
+	if h == nil || h.Version != 2 || h.Destination.String() != "192.0.2.2:1883" || h.Authority != "mqtt.example.com" {
+		t.Fatalf("got header %+v", h)
+	} else if h.TLS == nil || h.TLS.Version != "TLSv1.3" || h.TLS.CommonName != "gateway-7" || !h.TLS.CertVerified {
+		t.Fatalf("got TLS %+v", h.TLS)
+	}
+	// health checks from the proxy itself.
+	if h := checkProxyHeader(t, l, proxyV2Header(0x0, 0x00, nil), ""); h.Source != nil || !h.Local {
+		t.Fatalf("a LOCAL header should have no addresses, got %+v", h)
+	}
+
+	// the addresses of other families are skipped, whatever they look like, before the TLVs.
+	h = checkProxyHeader(t, l, proxyV2Header(0x1, 0x12, append(append([]byte{}, addrs...), tlv(pp2TypeAuthority, []byte("udp"))...)), "")
+	if h.Source != nil || h.Authority != "udp" {
+		t.Fatalf("a datagram header should only have its TLVs, got %+v", h)
+	}
+	unspec := []byte{0xFF, 0xFF, 0xFF, 0x01}
+	if h := checkProxyHeader(t, l, proxyV2Header(0x1, 0x00, unspec), ""); h.Source != nil || h.Authority != "" {
+		t.Fatalf("an AF_UNSPEC header should have no addresses or TLVs, got %+v", h)
+	}
+
+	checkProxyRefused(t, l, proxyV2Header(0x1, 0x11, addrs[:6]))
+	checkProxyRefused(t, l, proxyV2Header(0x1, 0x11, append(addrs, pp2TypeAuthority, 0x00, 0x10)))
+	checkProxyRefused(t, l, proxyV2Header(0x2, 0x11, addrs))
+}
+
+func TestProxyProtocolTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeTestCert(t, certFile, keyFile, 1)
+	l := startTestProxyListener(t, Config{Type: TLS, TLS: &TLSOptions{CertFile: certFile, KeyFile: keyFile}})
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// the proxy passes TLS through, after its header.
+		conn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 8883\r\n"))
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		tlsConn.Write([]byte{0xC0, 0x00})
+		tlsConn.Read(make([]byte, 1))
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err.Error())
+	}
+	defer conn.Close()
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil || buf[0] != 0xC0 {
+		t.Fatalf("the bytes after the handshake should be read, got %v %v", buf, err)
+	} else if conn.RemoteAddr().String() != "192.0.2.1:56324" {
+		t.Fatalf("got remote address %v, expected 192.0.2.1:56324", conn.RemoteAddr())
+	}
+}
+
+func TestProxyProtocolUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.sock")
+	l, _, err := Listen(Config{Type: Unix, Address: path, SocketMode: 0600, ProxyProtocol: true})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err.Error())
+	}
+	defer l.Close()
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	addrs := make([]byte, 216)
+	copy(addrs, "/run/client.sock")
+	copy(addrs[108:], "/run/mqtt.sock")
+	client.Write(proxyV2Header(0x1, 0x31, append(addrs, tlv(pp2TypeAuthority, []byte("local"))...)))
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err.Error())
+	}
+	defer conn.Close()
+	if h := ProxyHeaderOf(conn); h == nil || conn.RemoteAddr().String() != "/run/client.sock" || h.Authority != "local" {
+		t.Fatalf("got remote address %v and header %+v", conn.RemoteAddr(), h)
+	}
+	// the process that connected is the proxy, not the client, so a forwarded connection has no credentials.
+	if uid, _, ok := peerCredentials(conn); ok {
+		t.Fatalf("a forwarded connection should have no peer credentials, got uid %d", uid)
+	}
+
+	// a connection the proxy opened itself is the proxy's.
+	local, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	local.Write(proxyV2Header(0x0, 0x00, nil))
+	conn, err = l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err.Error())
+	}
+	defer conn.Close()
+	uid, _, ok := peerCredentials(conn)
+	if runtime.GOOS != "linux" {
+		return
+	} else if !ok || uid != uint32(os.Getuid()) {
+		t.Fatalf("got peer credentials %d %t, expected uid %d", uid, ok, os.Getuid())
+	}
+}
@@ -0,0 +1,328 @@
+package listener
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/M4THYOU/some_mqtt_broker/internal/logging"
+)
+
+// TLSOptions are the settings of a TLS listener.
+type TLSOptions struct {
+	CertFile   string // PEM certificate chain, read again whenever it changes.
+	KeyFile    string // PEM private key, read again whenever it changes.
+	MinVersion uint16 // e.g. tls.VersionTLS12.
+	// CipherSuites only applies up to TLS 1.2, the TLS 1.3 suites are not configurable. nil => Go's defaults.
+	CipherSuites []uint16
+
+	ClientAuth   tls.ClientAuthType // whether clients must send a certificate.
+	ClientCAFile string             // PEM bundle of the CAs client certificates are verified with. Empty => none.
+	CRLFile      string             // revoked client certificates, signed by one of the client CAs. Empty => none.
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses a TLS version like "1.2".
+func ParseTLSVersion(s string) (uint16, error) {
+	v, ok := tlsVersions[s]
+	if !ok {
+		msg := fmt.Sprintf("unsupported TLS version `%v`, expected one of: 1.0, 1.1, 1.2, 1.3", s)
+		return 0, errors.New(msg)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites parses a comma separated list of cipher suite names, like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+// Only the suites Go considers secure are accepted. An empty string returns nil, for Go's defaults.
+func ParseCipherSuites(s string) ([]uint16, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	ids := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		ids[suite.Name] = suite.ID
+	}
+	suites := make([]uint16, 0)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := ids[name]
+		if !ok {
+			msg := fmt.Sprintf("unsupported or insecure cipher suite `%v`", name)
+			return nil, errors.New(msg)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// ParseClientAuth parses whether clients must send a certificate: none, optional or required.
+// Certificates that are sent are always verified.
+func ParseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch s {
+	case "none":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "required":
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		msg := fmt.Sprintf("invalid client certificate mode `%v`, expected one of: none, optional, required", s)
+		return 0, errors.New(msg)
+	}
+}
+
+// CertReloader serves a certificate that is loaded again when its files change,
+// so it can be rotated without dropping connections. The client CA bundle and CRL are reloaded the same way.
+// Only new handshakes get the new files.
+type CertReloader struct {
+	loadMu sync.Mutex // one load at a time, so an older one can't replace a newer one.
+
+	mu      sync.RWMutex
+	opts    TLSOptions
+	cert    *tls.Certificate
+	config  *tls.Config // for each handshake, built from the files.
+	modTime time.Time   // the latest modification time of the files, when they were loaded.
+}
+
+// NewCertReloader loads the files of the options.
+func NewCertReloader(opts TLSOptions) (*CertReloader, error) {
+	r := &CertReloader{}
+	if err := r.SetOptions(opts); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// options returns the options the current files were loaded with.
+func (r *CertReloader) options() TLSOptions {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.opts
+}
+
+// files returns the paths of every file loaded for the options.
+func files(opts TLSOptions) []string {
+	files := []string{opts.CertFile, opts.KeyFile}
+	if opts.ClientCAFile != "" {
+		files = append(files, opts.ClientCAFile)
+	}
+	if opts.CRLFile != "" {
+		files = append(files, opts.CRLFile)
+	}
+	return files
+}
+
+// Reload loads the files again. If any of them is invalid, the previous ones are kept.
+func (r *CertReloader) Reload() error {
+	r.loadMu.Lock()
+	defer r.loadMu.Unlock()
+	return r.load(r.options())
+}
+
+// SetOptions replaces the options, e.g. with other files or a higher minimum version, and loads their files.
+// Only new handshakes use them. If any of the files is invalid, the previous options and files are kept.
+func (r *CertReloader) SetOptions(opts TLSOptions) error {
+	r.loadMu.Lock()
+	defer r.loadMu.Unlock()
+	return r.load(opts)
+}
+
+func (r *CertReloader) load(opts TLSOptions) error {
+	modTime, err := latestModTime(opts)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   opts.MinVersion,
+		CipherSuites: opts.CipherSuites,
+		ClientAuth:   opts.ClientAuth,
+	}
+	if opts.ClientCAFile != "" {
+		cas, err := readCertificates(opts.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		for _, ca := range cas {
+			config.ClientCAs.AddCert(ca)
+		}
+		if opts.CRLFile != "" {
+			crl, err := readCRL(opts.CRLFile, cas)
+			if err != nil {
+				return err
+			}
+			config.VerifyPeerCertificate = crl.verifyPeerCertificate
+		}
+	} else if opts.ClientAuth != tls.NoClientCert {
+		return errors.New("client certificates can't be verified without a CA bundle")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.opts = opts
+	r.cert = &cert
+	r.config = config
+	r.modTime = modTime
+	return nil
+}
+
+func latestModTime(opts TLSOptions) (time.Time, error) {
+	var latest time.Time
+	for _, path := range files(opts) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Watch checks the files for changes every interval, and reloads them when they do, until stop is closed.
+func (r *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		opts := r.options()
+		modTime, err := latestModTime(opts)
+		r.mu.RLock()
+		changed := err == nil && !modTime.Equal(r.modTime)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		// the files may be half written, in which case the next tick tries again.
+		if err := r.Reload(); err != nil {
+			logging.Errorf("Error reloading certificates, keeping the previous ones: %v\n", err.Error())
+			continue
+		}
+		logging.Infof("Reloaded certificate %v\n", opts.CertFile)
+	}
+}
+
+// GetCertificate returns the current certificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// GetConfigForClient returns the configuration for a handshake, built from the current files.
+func (r *CertReloader) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.config, nil
+}
+
+// NewTLSConfig returns the server configuration for the options.
+// The files are served by the returned reloader, whose Watch should be started to pick up changes.
+func NewTLSConfig(opts TLSOptions) (*tls.Config, *CertReloader, error) {
+	certs, err := NewCertReloader(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := &tls.Config{
+		GetCertificate:     certs.GetCertificate,
+		GetConfigForClient: certs.GetConfigForClient,
+		MinVersion:         opts.MinVersion,
+		CipherSuites:       opts.CipherSuites,
+	}
+	return config, certs, nil
+}
+
+// readCertificates reads every certificate in a PEM file.
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	certs := make([]*x509.Certificate, 0)
+	for {
+		var block *pem.Block
+		block, buf = pem.Decode(buf)
+		if block == nil {
+			break
+		} else if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		msg := fmt.Sprintf("no certificates in %v", path)
+		return nil, errors.New(msg)
+	}
+	return certs, nil
+}
+
+// crl is a certificate revocation list, checked against client certificates.
+type crl struct {
+	issuer  []byte              // raw subject of the CA that signed the list.
+	revoked map[string]struct{} // serial numbers.
+}
+
+// readCRL reads a PEM or DER encoded CRL, which must be signed by one of the CAs.
+func readCRL(path string, cas []*x509.Certificate) (*crl, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	list, err := x509.ParseCRL(buf)
+	if err != nil {
+		return nil, err
+	}
+	for _, ca := range cas {
+		if ca.CheckCRLSignature(list) != nil {
+			continue
+		}
+		c := &crl{issuer: ca.RawSubject, revoked: make(map[string]struct{})}
+		for _, cert := range list.TBSCertList.RevokedCertificates {
+			c.revoked[cert.SerialNumber.String()] = struct{}{}
+		}
+		return c, nil
+	}
+	msg := fmt.Sprintf("%v is not signed by any of the client CAs", path)
+	return nil, errors.New(msg)
+}
+
+// verifyPeerCertificate refuses certificates on the list, once the chain has been verified.
+func (c *crl) verifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if _, ok := c.revoked[cert.SerialNumber.String()]; ok && bytes.Equal(cert.RawIssuer, c.issuer) {
+				msg := fmt.Sprintf("certificate %v has been revoked", cert.Subject.CommonName)
+				return errors.New(msg)
+			}
+		}
+	}
+	return nil
+}
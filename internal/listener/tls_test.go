@@ -0,0 +1,366 @@
+package listener
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for localhost, with the serial number, to certFile and keyFile.
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTestTLS listens with the config on a random port, and accepts connections until the test ends.
+func startTestTLS(t *testing.T, config *tls.Config) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+				conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// dialTestTLS returns the serial number of the server's certificate.
+func dialTestTLS(t *testing.T, addr string, config *tls.Config) int64 {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatalf("TLS handshake failed: %v", err.Error())
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeTestCert(t, certFile, keyFile, 1)
+	config, certs, err := NewTLSConfig(TLSOptions{CertFile: certFile, KeyFile: keyFile, MinVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Fatalf("NewTLSConfig failed: %v", err.Error())
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go certs.Watch(time.Millisecond*10, stop)
+	addr := startTestTLS(t, config)
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+	if serial := dialTestTLS(t, addr, clientConfig); serial != 1 {
+		t.Fatalf("got certificate %d, expected 1", serial)
+	}
+
+	writeTestCert(t, certFile, keyFile, 2)
+	// make sure the change is seen, even on filesystems with coarse modification times.
+	later := time.Now().Add(time.Second)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	deadline := time.Now().Add(time.Second * 5)
+	for dialTestTLS(t, addr, clientConfig) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate was not reloaded")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// a broken certificate keeps the previous one.
+	if err := ioutil.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err := certs.Reload(); err == nil {
+		t.Fatalf("Reload should have failed for an invalid certificate")
+	}
+	if serial := dialTestTLS(t, addr, clientConfig); serial != 2 {
+		t.Fatalf("got certificate %d, expected 2", serial)
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeTestCert(t, certFile, keyFile, 1)
+	config, _, err := NewTLSConfig(TLSOptions{CertFile: certFile, KeyFile: keyFile, MinVersion: tls.VersionTLS13})
+	if err != nil {
+		t.Fatalf("NewTLSConfig failed: %v", err.Error())
+	}
+	addr := startTestTLS(t, config)
+	if _, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Fatalf("a TLS 1.2 client should have been refused")
+	}
+	dialTestTLS(t, addr, &tls.Config{InsecureSkipVerify: true})
+}
+
+func TestTLSSetOptions(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	otherCert, otherKey := filepath.Join(dir, "other.crt"), filepath.Join(dir, "other.key")
+	writeTestCert(t, certFile, keyFile, 1)
+	writeTestCert(t, otherCert, otherKey, 2)
+	config, certs, err := NewTLSConfig(TLSOptions{CertFile: certFile, KeyFile: keyFile, MinVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Fatalf("NewTLSConfig failed: %v", err.Error())
+	}
+	addr := startTestTLS(t, config)
+	tls12 := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}
+	if serial := dialTestTLS(t, addr, tls12); serial != 1 {
+		t.Fatalf("got certificate %d, expected 1", serial)
+	}
+
+	if err := certs.SetOptions(TLSOptions{CertFile: otherCert, KeyFile: otherKey, MinVersion: tls.VersionTLS13}); err != nil {
+		t.Fatalf("SetOptions failed: %v", err.Error())
+	}
+	if _, err := tls.Dial("tcp", addr, tls12); err == nil {
+		t.Fatalf("a TLS 1.2 client should have been refused")
+	}
+	if serial := dialTestTLS(t, addr, &tls.Config{InsecureSkipVerify: true}); serial != 2 {
+		t.Fatalf("got certificate %d, expected 2", serial)
+	}
+
+	// missing files keep the previous options.
+	if err := certs.SetOptions(TLSOptions{CertFile: filepath.Join(dir, "missing.crt"), KeyFile: keyFile}); err == nil {
+		t.Fatalf("SetOptions should have failed for a missing certificate")
+	}
+	if err := certs.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err.Error())
+	}
+	if serial := dialTestTLS(t, addr, &tls.Config{InsecureSkipVerify: true}); serial != 2 {
+		t.Fatalf("got certificate %d, expected 2", serial)
+	}
+}
+
+func checkParseTLSVersion(t *testing.T, s string, expected uint16, shouldPass bool) {
+	v, err := ParseTLSVersion(s)
+	if err != nil && shouldPass {
+		t.Fatalf("ParseTLSVersion failed: %v", err.Error())
+	} else if err == nil && !shouldPass {
+		t.Fatalf("ParseTLSVersion should have failed: %v", s)
+	} else if v != expected {
+		t.Fatalf("ParseTLSVersion(%q) got %#x, expected %#x", s, v, expected)
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	checkParseTLSVersion(t, "1.2", tls.VersionTLS12, true)
+	checkParseTLSVersion(t, "1.3", tls.VersionTLS13, true)
+	checkParseTLSVersion(t, "1.4", 0, false)
+	checkParseTLSVersion(t, "", 0, false)
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	suites, err := ParseCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384")
+	if err != nil {
+		t.Fatalf("ParseCipherSuites failed: %v", err.Error())
+	} else if len(suites) != 2 || suites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 || suites[1] != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+		t.Fatalf("got %v", suites)
+	}
+	if suites, err := ParseCipherSuites(""); err != nil || suites != nil {
+		t.Fatalf("an empty list should return nil for Go's defaults, got %v %v", suites, err)
+	}
+	if _, err := ParseCipherSuites("TLS_RSA_WITH_RC4_128_SHA"); err == nil {
+		t.Fatalf("ParseCipherSuites should have failed for an insecure suite")
+	}
+}
+
+// testCA issues client certificates and CRLs for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert, key}
+}
+
+// issue returns a client certificate for the common name.
+func (ca *testCA) issue(t *testing.T, commonName string, serial int64) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeCRL writes a CRL revoking the serial numbers.
+func (ca *testCA) writeCRL(t *testing.T, path string, serials ...int64) {
+	revoked := make([]pkix.RevokedCertificate, 0)
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	template := &x509.RevocationList{
+		Number:              big.NewInt(1),
+		ThisUpdate:          time.Now().Add(-time.Minute),
+		NextUpdate:          time.Now().Add(time.Hour),
+		RevokedCertificates: revoked,
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkDialClientCert(t *testing.T, addr string, cert *tls.Certificate, shouldPass bool) {
+	config := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err == nil {
+		// with TLS 1.3, the server's verdict on the client certificate only arrives with the first read.
+		conn.Write([]byte{0})
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		if ne, ok := err.(net.Error); err == io.EOF || ok && ne.Timeout() {
+			err = nil
+		}
+		conn.Close()
+	}
+	if err != nil && shouldPass {
+		t.Fatalf("TLS handshake failed: %v", err.Error())
+	} else if err == nil && !shouldPass {
+		t.Fatalf("TLS handshake should have failed")
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	caFile, crlFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.crl")
+	writeTestCert(t, certFile, keyFile, 1)
+	ca := newTestCA(t)
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ca.writeCRL(t, crlFile, 13)
+
+	opts := TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAFile: caFile, CRLFile: crlFile}
+	config, certs, err := NewTLSConfig(opts)
+	if err != nil {
+		t.Fatalf("NewTLSConfig failed: %v", err.Error())
+	}
+	addr := startTestTLS(t, config)
+	gateway := ca.issue(t, "gateway-7", 12)
+	revoked := ca.issue(t, "gateway-8", 13)
+	stranger := newTestCA(t).issue(t, "gateway-7", 12)
+	checkDialClientCert(t, addr, &gateway, true)
+	checkDialClientCert(t, addr, &revoked, false)
+	checkDialClientCert(t, addr, &stranger, false)
+	checkDialClientCert(t, addr, nil, false)
+
+	// an updated CRL applies to the next handshakes.
+	ca.writeCRL(t, crlFile, 12)
+	if err := certs.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err.Error())
+	}
+	checkDialClientCert(t, addr, &gateway, false)
+	checkDialClientCert(t, addr, &revoked, true)
+
+	// a CRL from another CA is refused.
+	newTestCA(t).writeCRL(t, crlFile)
+	if err := certs.Reload(); err == nil {
+		t.Fatalf("Reload should have failed for a CRL from another CA")
+	}
+
+	opts.ClientAuth, opts.CRLFile = tls.VerifyClientCertIfGiven, ""
+	config, _, err = NewTLSConfig(opts)
+	if err != nil {
+		t.Fatalf("NewTLSConfig failed: %v", err.Error())
+	}
+	addr = startTestTLS(t, config)
+	checkDialClientCert(t, addr, nil, true)
+	checkDialClientCert(t, addr, &gateway, true)
+	checkDialClientCert(t, addr, &stranger, false)
+}
+
+func TestParseClientAuth(t *testing.T) {
+	for s, expected := range map[string]tls.ClientAuthType{"none": tls.NoClientCert, "optional": tls.VerifyClientCertIfGiven, "required": tls.RequireAndVerifyClientCert} {
+		if res, err := ParseClientAuth(s); err != nil || res != expected {
+			t.Fatalf("ParseClientAuth(%q) got %v %v, expected %v", s, res, err, expected)
+		}
+	}
+	if _, err := ParseClientAuth("maybe"); err == nil {
+		t.Fatalf("ParseClientAuth should have failed for maybe")
+	}
+}
@@ -0,0 +1,72 @@
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// listenUnix listens on the socket path, with the file permissions. mode 0 => the umask decides.
+// A socket file left behind by a broker that is gone is replaced.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			msg := fmt.Sprintf("%v is in use by another process", path)
+			return nil, errors.New(msg)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return &unixListener{l}, nil
+}
+
+// unixListener accepts connections along with the credentials of the processes that opened them.
+type unixListener struct {
+	*net.UnixListener
+}
+
+// Accept waits for the next connection, and reads its peer credentials.
+func (l *unixListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		return nil, err
+	}
+	c := &unixConn{UnixConn: conn}
+	c.uid, c.gid, c.credErr = readPeerCredentials(conn)
+	return c, nil
+}
+
+// unixConn is a Unix socket connection, with the credentials of the process on the other end.
+type unixConn struct {
+	*net.UnixConn
+	uid, gid uint32
+	credErr  error // why the credentials couldn't be read.
+}
+
+// PeerCredentials returns the user and group IDs of the process that connected.
+// ok is false if they couldn't be read, e.g. because the platform doesn't support it.
+func (c *unixConn) PeerCredentials() (uid, gid uint32, ok bool) {
+	return c.uid, c.gid, c.credErr == nil
+}
+
+// peerCredentials returns the credentials of the process on the other end of a connection, which may be wrapped.
+// ok is false if it isn't a Unix socket or they couldn't be read.
+func peerCredentials(conn net.Conn) (uid, gid uint32, ok bool) {
+	if c, isPeer := conn.(interface{ PeerCredentials() (uint32, uint32, bool) }); isPeer {
+		return c.PeerCredentials()
+	}
+	return 0, 0, false
+}
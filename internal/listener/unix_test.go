@@ -0,0 +1,53 @@
+package listener
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.sock")
+	// a socket file left behind by a broker that is gone.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, _, err := Listen(Config{Type: Unix, Address: path, SocketMode: 0600})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err.Error())
+	}
+	defer l.Close()
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Fatalf("got socket permissions %v, expected 0600", info.Mode().Perm())
+	}
+	if _, _, err := Listen(Config{Type: Unix, Address: path}); err == nil {
+		t.Fatalf("Listen should have failed for a socket in use")
+	}
+
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err.Error())
+	}
+	defer conn.Close()
+	uid, gid, ok := peerCredentials(conn)
+	if runtime.GOOS != "linux" {
+		return
+	} else if !ok {
+		t.Fatalf("peer credentials should have been read")
+	} else if uid != uint32(os.Getuid()) || gid != uint32(os.Getgid()) {
+		t.Fatalf("got peer credentials %d:%d, expected %d:%d", uid, gid, os.Getuid(), os.Getgid())
+	}
+}
@@ -0,0 +1,387 @@
+package listener
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes, RFC 6455 section 5.2.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// WebSocket close status codes, RFC 6455 section 7.4.1.
+const (
+	wsCloseNormal        = 1000
+	wsCloseProtocolError = 1002
+	wsCloseUnsupported   = 1003
+)
+
+const (
+	wsGUID              = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11" // appended to the client's key to compute the accept key.
+	wsMaxControlPayload = 125
+	wsHandshakeTimeout  = time.Second * 10
+)
+
+// wsSubprotocols are the subprotocols MQTT clients ask for, from most to least preferred.
+// mqttv3.1 is only sent by old MQTT v3.1 clients.
+var wsSubprotocols = []string{"mqtt", "mqttv3.1"}
+
+// WebSocketListener accepts MQTT connections over WebSockets, e.g. from browsers.
+// Each MQTT connection is an HTTP request upgraded to a WebSocket, which is returned by Accept
+// as a net.Conn reading and writing the payloads of binary frames.
+type WebSocketListener struct {
+	l      net.Listener
+	server *http.Server
+	conns  chan net.Conn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	err       error // why the HTTP server stopped.
+}
+
+// NewWebSocketListener serves WebSocket upgrades at the path, on the connections accepted by l.
+// l may be a TLS listener, for wss.
+func NewWebSocketListener(l net.Listener, path string) *WebSocketListener {
+	w := &WebSocketListener{
+		l:      l,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, w.handleUpgrade)
+	w.server = &http.Server{Handler: mux, ReadHeaderTimeout: wsHandshakeTimeout}
+	go func() {
+		w.err = w.server.Serve(l)
+		w.Close()
+	}()
+	return w
+}
+
+// Accept waits for the next WebSocket connection.
+func (w *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-w.conns:
+		return conn, nil
+	case <-w.closed:
+		if w.err != nil && w.err != http.ErrServerClosed {
+			return nil, w.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening. Connections that were already accepted stay open.
+func (w *WebSocketListener) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.closed)
+		err = w.server.Close()
+	})
+	return err
+}
+
+// Addr returns the listener's network address.
+func (w *WebSocketListener) Addr() net.Addr {
+	return w.l.Addr()
+}
+
+// handleUpgrade performs the opening handshake of RFC 6455 section 4.2, and hands the connection to Accept.
+func (w *WebSocketListener) handleUpgrade(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	} else if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(rw, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	} else if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		rw.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(rw, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(rw, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	subprotocol := selectSubprotocol(r.Header)
+	if subprotocol == "" {
+		http.Error(rw, "the mqtt subprotocol is required", http.StatusBadRequest)
+		return
+	}
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, "can't upgrade the connection", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	h := sha1.Sum([]byte(key + wsGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(h[:]) + "\r\n" +
+		"Sec-WebSocket-Protocol: " + subprotocol + "\r\n\r\n"
+	// the server's deadlines for the request are still set on the hijacked connection.
+	conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case w.conns <- newWebSocketConn(conn, buf.Reader):
+	case <-w.closed:
+		conn.Close()
+	}
+}
+
+// headerContains checks if one of the comma separated values of the header is the token, ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectSubprotocol returns the MQTT subprotocol to use from those the client asked for. Empty => none of them.
+func selectSubprotocol(h http.Header) string {
+	for _, subprotocol := range wsSubprotocols {
+		for _, value := range h.Values("Sec-WebSocket-Protocol") {
+			for _, v := range strings.Split(value, ",") {
+				if strings.TrimSpace(v) == subprotocol {
+					return subprotocol
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// webSocketConn is a net.Conn over a WebSocket. Reads return the payloads of the binary frames as one stream,
+// so MQTT packets may be split across frames, or share one. Each write is sent as one binary frame.
+type webSocketConn struct {
+	net.Conn
+	rdr *bufio.Reader // may hold data read during the handshake.
+
+	// the frame being read.
+	remaining int64 // payload bytes left to read.
+	mask      [4]byte
+	maskPos   int
+	inMessage bool // a binary message has started, so the next data frame must be a continuation.
+
+	writeMu sync.Mutex // control frames are written while reading, concurrently with the client's writes.
+	closed  bool       // a close frame was sent.
+}
+
+func newWebSocketConn(conn net.Conn, rdr *bufio.Reader) *webSocketConn {
+	return &webSocketConn{Conn: conn, rdr: rdr}
+}
+
+// Read reads the payloads of binary frames, answering control frames on the way.
+// Returns io.EOF once the client closes the WebSocket.
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.rdr.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// nextFrame reads the header of the next frame, leaving the payload of data frames for Read. Control frames are handled whole.
+func (c *webSocketConn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.rdr, header[:]); err != nil {
+		return err
+	}
+	final := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := int64(header[1] & 0x7F)
+	if header[0]&0x70 != 0 {
+		return c.fail(wsCloseProtocolError, "reserved bits set without an extension")
+	} else if !masked {
+		return c.fail(wsCloseProtocolError, "client frames must be masked")
+	}
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.rdr, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.rdr, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+		if length < 0 {
+			return c.fail(wsCloseProtocolError, "invalid payload length")
+		}
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.rdr, mask[:]); err != nil {
+		return err
+	}
+
+	if opcode >= wsClose {
+		if !final || length > wsMaxControlPayload {
+			return c.fail(wsCloseProtocolError, "invalid control frame")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.rdr, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		return c.handleControl(opcode, payload)
+	}
+
+	switch opcode {
+	case wsBinary:
+		if c.inMessage {
+			return c.fail(wsCloseProtocolError, "expected a continuation frame")
+		}
+	case wsContinuation:
+		if !c.inMessage {
+			return c.fail(wsCloseProtocolError, "unexpected continuation frame")
+		}
+	case wsText:
+		// MQTT is only sent in binary frames [MQTT-6.0.0-1].
+		return c.fail(wsCloseUnsupported, "text frames aren't supported")
+	default:
+		msg := fmt.Sprintf("unknown opcode %#x", opcode)
+		return c.fail(wsCloseProtocolError, msg)
+	}
+	c.inMessage = !final
+	c.remaining = length
+	c.mask = mask
+	c.maskPos = 0
+	return nil
+}
+
+// handleControl answers a ping, or a close with io.EOF.
+func (c *webSocketConn) handleControl(opcode byte, payload []byte) error {
+	switch opcode {
+	case wsPing:
+		return c.writeFrame(wsPong, payload)
+	case wsPong:
+		return nil
+	case wsClose:
+		code := wsCloseNormal
+		if len(payload) >= 2 {
+			code = int(binary.BigEndian.Uint16(payload))
+		}
+		c.sendClose(code, "")
+		return io.EOF
+	default:
+		msg := fmt.Sprintf("unknown opcode %#x", opcode)
+		return c.fail(wsCloseProtocolError, msg)
+	}
+}
+
+func (c *webSocketConn) unmask(p []byte) {
+	for i := range p {
+		p[i] ^= c.mask[c.maskPos%4]
+		c.maskPos++
+	}
+}
+
+// fail closes the WebSocket because the client broke the protocol.
+func (c *webSocketConn) fail(code int, reason string) error {
+	c.sendClose(code, reason)
+	c.Conn.Close()
+	return errors.New("websocket: " + reason)
+}
+
+// sendClose sends a close frame, unless one was already sent.
+func (c *webSocketConn) sendClose(code int, reason string) {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > wsMaxControlPayload {
+		payload = payload[:wsMaxControlPayload]
+	}
+	c.writeFrame(wsClose, payload)
+}
+
+// Write sends p as one binary frame.
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame writes a whole, unmasked frame, as servers must.
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if opcode == wsClose {
+		c.closed = true
+	}
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame and closes the connection.
+func (c *webSocketConn) Close() error {
+	c.sendClose(wsCloseNormal, "")
+	return c.Conn.Close()
+}
+
+// ConnectionState returns the TLS state of the connection, for wss. The zero value if it isn't TLS.
+func (c *webSocketConn) ConnectionState() tls.ConnectionState {
+	return connectionState(c.Conn)
+}
+
+// ProxyHeader returns the PROXY protocol header the connection started with, if any.
+func (c *webSocketConn) ProxyHeader() *ProxyHeader {
+	return ProxyHeaderOf(c.Conn)
+}
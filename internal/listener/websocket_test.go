@@ -0,0 +1,170 @@
+package listener
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func startTestWebSocket(t *testing.T) *WebSocketListener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWebSocketListener(l, "/mqtt")
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+// dialTestWebSocket sends the opening handshake and returns the HTTP status.
+func dialTestWebSocket(t *testing.T, addr, path, subprotocol string) (net.Conn, *bufio.Reader, int) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	req := "GET " + path + " HTTP/1.1\r\nHost: " + addr + "\r\n" +
+		"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"
+	if subprotocol != "" {
+		req += "Sec-WebSocket-Protocol: " + subprotocol + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	rdr := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(rdr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// the example key of RFC 6455 section 1.3.
+		if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+			t.Fatalf("got Sec-WebSocket-Accept %v", accept)
+		} else if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != "mqtt" {
+			t.Fatalf("got subprotocol %v, expected mqtt", p)
+		}
+	}
+	return conn, rdr, resp.StatusCode
+}
+
+// writeTestFrame writes a masked frame, as clients must.
+func writeTestFrame(t *testing.T, conn net.Conn, firstByte byte, payload string) {
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame := []byte{firstByte, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFrame(t *testing.T, rdr *bufio.Reader) (byte, []byte) {
+	var header [2]byte
+	if _, err := io.ReadFull(rdr, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[1]&0x80 != 0 {
+		t.Fatalf("server frames must not be masked")
+	}
+	payload := make([]byte, header[1]&0x7F)
+	if _, err := io.ReadFull(rdr, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0], payload
+}
+
+func acceptTestWebSocket(t *testing.T, w *WebSocketListener) net.Conn {
+	conn, err := w.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestWebSocket(t *testing.T) {
+	w := startTestWebSocket(t)
+	client, rdr, status := dialTestWebSocket(t, w.Addr().String(), "/mqtt", "mqttv3.1, mqtt")
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %v, expected 101", status)
+	}
+	conn := acceptTestWebSocket(t, w)
+
+	// a packet split across a message of three frames, then two packets in one frame.
+	writeTestFrame(t, client, wsBinary, "\x10\x04")
+	writeTestFrame(t, client, wsContinuation, "ab")
+	writeTestFrame(t, client, 0x80|wsContinuation, "cd")
+	writeTestFrame(t, client, 0x80|wsPing, "are you there")
+	writeTestFrame(t, client, 0x80|wsBinary, "\xc0\x00\xe0\x00")
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Read failed: %v", err.Error())
+	} else if !cmp.Equal(buf, []byte("\x10\x04abcd\xc0\x00\xe0\x00")) {
+		t.Fatalf("got %q", buf)
+	}
+	if firstByte, payload := readTestFrame(t, rdr); firstByte != 0x80|wsPong || string(payload) != "are you there" {
+		t.Fatalf("expected a pong echoing the ping, got %#x %q", firstByte, payload)
+	}
+
+	if _, err := conn.Write([]byte("\xd0\x00")); err != nil {
+		t.Fatalf("Write failed: %v", err.Error())
+	}
+	if firstByte, payload := readTestFrame(t, rdr); firstByte != 0x80|wsBinary || string(payload) != "\xd0\x00" {
+		t.Fatalf("expected a binary frame, got %#x %q", firstByte, payload)
+	}
+
+	writeTestFrame(t, client, 0x80|wsClose, "\x03\xe8")
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Fatalf("Read should return EOF once the client closes, got: %v", err)
+	}
+	if firstByte, payload := readTestFrame(t, rdr); firstByte != 0x80|wsClose || string(payload) != "\x03\xe8" {
+		t.Fatalf("expected the close to be answered, got %#x %q", firstByte, payload)
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	w := startTestWebSocket(t)
+	if _, _, status := dialTestWebSocket(t, w.Addr().String(), "/mqtt", ""); status != http.StatusBadRequest {
+		t.Fatalf("got status %v without the mqtt subprotocol, expected 400", status)
+	}
+	if _, _, status := dialTestWebSocket(t, w.Addr().String(), "/other", "mqtt"); status != http.StatusNotFound {
+		t.Fatalf("got status %v for another path, expected 404", status)
+	}
+}
+
+func checkWebSocketProtocolError(t *testing.T, w *WebSocketListener, frame []byte, expectedCode uint16) {
+	client, rdr, _ := dialTestWebSocket(t, w.Addr().String(), "/mqtt", "mqtt")
+	conn := acceptTestWebSocket(t, w)
+	if _, err := client.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 2)); err == nil || err == io.EOF {
+		t.Fatalf("Read should fail for frame %v, got: %v", frame, err)
+	}
+	firstByte, payload := readTestFrame(t, rdr)
+	if firstByte != 0x80|wsClose || len(payload) < 2 {
+		t.Fatalf("expected a close frame for frame %v, got %#x %q", frame, firstByte, payload)
+	} else if code := binary.BigEndian.Uint16(payload); code != expectedCode {
+		t.Fatalf("got close code %v (%q) for frame %v, expected %v", code, payload[2:], frame, expectedCode)
+	}
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	w := startTestWebSocket(t)
+	mask := []byte{0, 0, 0, 0}
+	// MQTT must be sent in binary frames.
+	checkWebSocketProtocolError(t, w, append([]byte{0x80 | wsText, 0x82}, append(mask, 0x10, 0x00)...), wsCloseUnsupported)
+	checkWebSocketProtocolError(t, w, []byte{0x80 | wsBinary, 0x02, 0x10, 0x00}, wsCloseProtocolError)
+	checkWebSocketProtocolError(t, w, append([]byte{0x80 | wsContinuation, 0x82}, append(mask, 0x10, 0x00)...), wsCloseProtocolError)
+	checkWebSocketProtocolError(t, w, append([]byte{0x80 | wsPing, 0xFE, 0x00, 0x80}, mask...), wsCloseProtocolError)
+}
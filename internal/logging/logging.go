@@ -0,0 +1,67 @@
+// Package logging prints the broker's messages to standard output, leaving out those below the configured level.
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// Level is how important a message is.
+type Level int32
+
+const (
+	Debug Level = iota // every packet processed, for troubleshooting.
+	Info               // connections, listeners, reloads and clients that are refused or dropped.
+	Error              // only what went wrong in the broker.
+)
+
+var levelNames = map[string]Level{
+	"debug": Debug,
+	"info":  Info,
+	"error": Error,
+}
+
+// ParseLevel returns the level with the given name, one of: debug, info, error.
+func ParseLevel(name string) (Level, error) {
+	level, ok := levelNames[name]
+	if !ok {
+		msg := fmt.Sprintf("invalid log level `%v`, expected one of: debug, info, error", name)
+		return 0, errors.New(msg)
+	}
+	return level, nil
+}
+
+// level is the lowest level printed. It is changed while clients are logging, so it is only accessed atomically.
+var level = int32(Info)
+
+// SetLevel changes the lowest level printed, from the next message on.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+// Enabled checks if messages of the level are printed.
+func Enabled(l Level) bool {
+	return int32(l) >= atomic.LoadInt32(&level)
+}
+
+func printf(l Level, format string, args ...interface{}) {
+	if Enabled(l) {
+		fmt.Printf(format, args...)
+	}
+}
+
+// Debugf prints the message like fmt.Printf, if the level is debug.
+func Debugf(format string, args ...interface{}) {
+	printf(Debug, format, args...)
+}
+
+// Infof prints the message like fmt.Printf, unless the level is error.
+func Infof(format string, args ...interface{}) {
+	printf(Info, format, args...)
+}
+
+// Errorf prints the message like fmt.Printf, whatever the level.
+func Errorf(format string, args ...interface{}) {
+	printf(Error, format, args...)
+}
@@ -0,0 +1,35 @@
+package logging
+
+import "testing"
+
+func TestParseLevel(t *testing.T) {
+	l, err := ParseLevel("debug")
+	if err != nil || l != Debug {
+		t.Fatalf("got %v, %v, expected debug", l, err)
+	}
+	l, err = ParseLevel("error")
+	if err != nil || l != Error {
+		t.Fatalf("got %v, %v, expected error", l, err)
+	}
+	if _, err := ParseLevel(""); err == nil {
+		t.Fatalf("ParseLevel should have failed for an empty name")
+	}
+	if _, err := ParseLevel("warning"); err == nil {
+		t.Fatalf("ParseLevel should have failed for warning")
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	defer SetLevel(Info)
+	if Enabled(Debug) || !Enabled(Info) || !Enabled(Error) {
+		t.Fatalf("only info and error should be enabled by default")
+	}
+	SetLevel(Error)
+	if Enabled(Info) || !Enabled(Error) {
+		t.Fatalf("only error should be enabled at the error level")
+	}
+	SetLevel(Debug)
+	if !Enabled(Debug) {
+		t.Fatalf("debug should be enabled at the debug level")
+	}
+}
@@ -0,0 +1,91 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/M4THYOU/some_mqtt_broker/pkg/packet"
+)
+
+// Message is an Application Message, as carried by a PUBLISH packet.
+type Message struct {
+	Topic    string
+	Payload  []byte
+	Qos      uint8
+	Retain   bool
+	Dup      bool
+	PacketId uint16 // only set for QoS > 0. Unique per connection, not per message!
+
+	// Publish Properties
+	PayloadFormatIndicator uint8 // 0 or 1.
+	MessageExpiryInterval  uint32
+	ContentType            string
+	ResponseTopic          string
+	CorrelationData        []byte
+	UserProperties         []UserProperty // forwarded to subscribers unchanged, in the same order.
+	SubscriptionIds        []uint32       // only used when sending to subscribers.
+}
+
+// Copy returns a copy of the message, so per-subscriber fields can be changed without affecting other subscribers.
+// The payload, correlation data, and user properties are shared since they are never modified once received.
+func (msg *Message) Copy() *Message {
+	c := *msg
+	c.SubscriptionIds = nil
+	return &c
+}
+
+type SubscriptionOptions struct {
+	Qos               uint8 // maximum QoS the server can send to the client with.
+	NoLocal           bool  // if true, messages must not be sent back to the client that published them.
+	RetainAsPublished bool
+	RetainHandling    uint8 // 0, 1, or 2. Not 3!
+}
+
+// GetPublishFlags parses the flags of a PUBLISH packet's fixed header. Only the 4 lowest bits of b are used.
+func GetPublishFlags(b byte) (dup bool, qos uint8, retain bool, err error) {
+	dup = ((b & 0x08) >> 3) == 1
+	qos = (b & 0x06) >> 1
+	retain = (b & 0x01) == 1
+	if qos > 2 {
+		return false, 0, false, errors.New("invalid QoS")
+	} else if dup && qos == 0 {
+		return false, 0, false, errors.New("DUP flag must be 0 for QoS 0 messages")
+	}
+	return dup, qos, retain, nil
+}
+
+// GetSubscriptionOptions parses the given byte into the options of a single SUBSCRIBE topic filter.
+func GetSubscriptionOptions(b byte) (*SubscriptionOptions, error) {
+	qos := b & 0x03
+	noLocal := ((b & 0x04) >> 2) == 1
+	retainAsPublished := ((b & 0x08) >> 3) == 1
+	retainHandling := (b & 0x30) >> 4
+	reserved := (b & 0xC0) != 0
+	if reserved {
+		return nil, errors.New("invalid reserved bits")
+	} else if qos > 2 {
+		return nil, errors.New("invalid QoS")
+	} else if retainHandling > 2 {
+		msg := fmt.Sprintf("invalid Retain Handling %d", retainHandling)
+		return nil, errors.New(msg)
+	}
+	return &SubscriptionOptions{qos, noLocal, retainAsPublished, retainHandling}, nil
+}
+
+// GetPacketId reads the following two bytes as a packet identifier. Zero is not a valid packet identifier.
+func GetPacketId(rdr *packet.Reader) (uint16, error) {
+	msb, err := rdr.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	lsb, err := rdr.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	packetId := binary.BigEndian.Uint16([]byte{msb, lsb})
+	if packetId == 0 {
+		return 0, errors.New("invalid packet identifier 0")
+	}
+	return packetId, nil
+}
@@ -0,0 +1,68 @@
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/M4THYOU/some_mqtt_broker/pkg/packet"
+	"github.com/google/go-cmp/cmp"
+)
+
+func checkPublishFlags(t *testing.T, b byte, expectedDup bool, expectedQos uint8, expectedRetain, shouldPass bool) {
+	dup, qos, retain, err := GetPublishFlags(b)
+	if err != nil && shouldPass {
+		t.Fatalf("Invalid publish flags: %v", err.Error())
+	} else if err == nil && !shouldPass {
+		t.Fatalf("Should have been invalid publish flags: %04b", b)
+	} else if (dup != expectedDup || qos != expectedQos || retain != expectedRetain) && shouldPass {
+		t.Fatalf("Got:\n%v %v %v\nExpected:\n%v %v %v", dup, qos, retain, expectedDup, expectedQos, expectedRetain)
+	}
+}
+func TestGetPublishFlags(t *testing.T) {
+	checkPublishFlags(t, publishFirstByte1, false, 0, false, true)
+	checkPublishFlags(t, publishFirstByte2, false, 0, true, true)
+	checkPublishFlags(t, publishFirstByte4, false, 1, true, true)
+	checkPublishFlags(t, publishFirstByte5, false, 2, false, true)
+	checkPublishFlags(t, publishFirstByte10, true, 1, true, true)
+	checkPublishFlags(t, publishFirstByte11, true, 2, false, true)
+	checkPublishFlags(t, 0x06, false, 0, false, false)              // QoS 3
+	checkPublishFlags(t, publishFirstByte7, false, 0, false, false) // DUP with QoS 0
+}
+
+func checkSubscriptionOptions(t *testing.T, b byte, expected *SubscriptionOptions, shouldPass bool) {
+	opts, err := GetSubscriptionOptions(b)
+	if err != nil && shouldPass {
+		t.Fatalf("Invalid subscription options: %v", err.Error())
+	} else if err == nil && !shouldPass {
+		t.Fatalf("Should have been invalid subscription options: %08b", b)
+	} else if !cmp.Equal(opts, expected) && shouldPass {
+		t.Fatalf("Got:\n%v\nExpected:\n%v", opts, expected)
+	}
+}
+func TestGetSubscriptionOptions(t *testing.T) {
+	checkSubscriptionOptions(t, 0x00, &SubscriptionOptions{0, false, false, 0}, true) // 00000000
+	checkSubscriptionOptions(t, 0x02, &SubscriptionOptions{2, false, false, 0}, true) // 00000010
+	checkSubscriptionOptions(t, 0x05, &SubscriptionOptions{1, true, false, 0}, true)  // 00000101
+	checkSubscriptionOptions(t, 0x2E, &SubscriptionOptions{2, true, true, 2}, true)   // 00101110
+	checkSubscriptionOptions(t, 0x03, nil, false)                                     // 00000011: QoS 3
+	checkSubscriptionOptions(t, 0x30, nil, false)                                     // 00110000: Retain Handling 3
+	checkSubscriptionOptions(t, 0x40, nil, false)                                     // 01000000: reserved
+}
+
+func checkPacketId(t *testing.T, buf []byte, expected uint16, shouldPass bool) {
+	rdr := packet.NewReader(bytes.NewReader(buf), dummyRemainingLength)
+	packetId, err := GetPacketId(rdr)
+	if err != nil && shouldPass {
+		t.Fatalf("GetPacketId failed: %v", err.Error())
+	} else if err == nil && !shouldPass {
+		t.Fatalf("GetPacketId should have failed: %v", buf)
+	} else if packetId != expected && shouldPass {
+		t.Fatalf("Got:\n%v\nExpected:\n%v", packetId, expected)
+	}
+}
+func TestGetPacketId(t *testing.T) {
+	checkPacketId(t, []byte{0x00, 0x01}, 1, true)
+	checkPacketId(t, []byte{0xFF, 0xFF}, 65535, true)
+	checkPacketId(t, []byte{0x00, 0x00}, 0, false)
+	checkPacketId(t, []byte{0x00}, 0, false)
+}
@@ -1,7 +1,9 @@
 package mqtt
 
 import (
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 
@@ -30,6 +32,43 @@ const (
 	WillPropsCode   = 0x00 // not defined by the spec, but we use this in getProps.
 )
 
+var packetNames = map[byte]string{
+	ConnectCode:     "CONNECT",
+	ConnackCode:     "CONNACK",
+	PublishCode:     "PUBLISH",
+	PubackCode:      "PUBACK",
+	PubrecCode:      "PUBREC",
+	PubrelCode:      "PUBREL",
+	PubcompCode:     "PUBCOMP",
+	SubscribeCode:   "SUBSCRIBE",
+	SubackCode:      "SUBACK",
+	UnsubscribeCode: "UNSUBSCRIBE",
+	UnsubackCode:    "UNSUBACK",
+	PingreqCode:     "PINGREQ",
+	PingrespCode:    "PINGRESP",
+	DisconnectCode:  "DISCONNECT",
+	AuthCode:        "AUTH",
+}
+
+// PacketName returns the name of the packet type, e.g. CONNECT, for messages.
+func PacketName(packetCode byte) string {
+	if name, ok := packetNames[packetCode]; ok {
+		return name
+	}
+	return fmt.Sprintf("packet type %d", packetCode)
+}
+
+// Protocol names and levels sent in CONNECT, one level per supported version of the spec.
+const (
+	ProtocolName     = "MQTT"
+	ProtocolName31   = "MQIsdp" // only used by MQTT v3.1.
+	ProtocolLevel31  = 3
+	ProtocolLevel311 = 4
+	ProtocolLevel5   = 5
+
+	MaxClientIdLength31 = 23 // MQTT v3.1 servers must refuse longer client IDs, and empty ones.
+)
+
 // All the properties!
 const (
 	PayloadFormatIndicatorCode = 0x01
@@ -69,6 +108,14 @@ type ConnectFlags struct {
 	WillFlag     bool
 	CleanStart   bool
 }
+
+// UserProperty is a single User Property name and value pair.
+// The same name may appear more than once in a packet, and the order of the pairs must be kept.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
 type WillProps struct {
 	WillDelayInterval      uint32
 	PayloadFormatIndicator uint8 // 0 or 1.
@@ -76,25 +123,31 @@ type WillProps struct {
 	ContentType            string
 	ResponseTopic          string
 	CorrelationData        []byte
-	UserProperty           []byte
+	UserProperty           []UserProperty
 	Topic                  string
 	Payload                []byte
 }
 
 // GetClientId gets the client ID from the next available bytes in the reader.
-// If length is 0, assigns one randomly.
+// If length is 0, the server must assign one with NewClientId.
 func GetClientId(rdr *packet.Reader) (string, error) {
 	_, clientId, err := rdr.ReadUtf8Str()
 	if err != nil {
 		return "", err
 	}
-	if clientId == "" {
-		// TODO implement some auto assigning clientId method.
-		clientId = "one randomly" // LOL
-	}
 	return clientId, nil
 }
 
+// NewClientId returns a random client ID, for a client that connected without one.
+// It is 23 characters long, the most every server must accept.
+func NewClientId() (string, error) {
+	buf := make([]byte, 9)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "auto-" + hex.EncodeToString(buf), nil
+}
+
 // getStringPropParams should only be called by getProps. Note that this function also works for Binary Data.
 // Returns the number of bytes to be read, the new total of bytes read, and possibly an error.
 func getStringPropParams(i int, rdr *packet.Reader) (count, newI int, err error) {
@@ -117,64 +170,29 @@ func getBinaryDataPropParams(i int, rdr *packet.Reader) (count, newI int, err er
 	return getStringPropParams(i, rdr)
 }
 
-// getStringPairProp reads the entire UTF-8 string pair into a byte array. Should only be called by getProps.
-// Returns number of bytes read, the slice, and possibly an error.
-func getStringPairProp(rdr *packet.Reader) (int, []byte, error) {
-	buf := make([]byte, 0)
-	msb, err := rdr.ReadByte()
+// getStringPairProp reads a UTF-8 string pair into a UserProperty. Should only be called by getProps.
+// Returns number of bytes read, the pair, and possibly an error.
+func getStringPairProp(rdr *packet.Reader) (int, UserProperty, error) {
+	keyRead, key, err := rdr.ReadUtf8Str()
 	if err != nil {
-		return 0, nil, err
+		return 0, UserProperty{}, err
 	}
-	lsb, err := rdr.ReadByte()
+	valueRead, value, err := rdr.ReadUtf8Str()
 	if err != nil {
-		return 0, nil, err
+		return 0, UserProperty{}, err
 	}
-	buf = append(buf, msb)
-	buf = append(buf, lsb)
-	count := int(binary.BigEndian.Uint16(buf))
-	for i := 0; i < count; i++ {
-		b, err := rdr.ReadByte()
-		if err != nil {
-			return 0, nil, err
-		}
-		buf = append(buf, b)
-	}
-	bytesRead := count + 2
-
-	// Do the exact same thing as above, for the second string.
-	msb, err = rdr.ReadByte()
-	if err != nil {
-		return 0, nil, err
-	}
-	lsb, err = rdr.ReadByte()
-	if err != nil {
-		return 0, nil, err
-	}
-	buf = append(buf, msb)
-	buf = append(buf, lsb)
-	numBuf := []byte{msb, lsb}
-	count = int(binary.BigEndian.Uint16(numBuf))
-	for i := 0; i < count; i++ {
-		b, err := rdr.ReadByte()
-		if err != nil {
-			return 0, nil, err
-		}
-		buf = append(buf, b)
-	}
-	bytesRead += (count + 2)
-
-	return bytesRead, buf, nil
+	return keyRead + valueRead, UserProperty{Key: key, Value: value}, nil
 }
 
 // GetProps gets all the properties for this packet. Throws error if that prop is not valid for the specified packetCode.
 // packetCode is one of the defined
-func GetProps(rdr *packet.Reader, propLength, packetCode int) (map[int][]byte, [][]byte, error) {
+func GetProps(rdr *packet.Reader, propLength, packetCode int) (map[int][]byte, []UserProperty, error) {
 	if (packetCode == PingreqCode) || (packetCode == PingrespCode) {
 		return nil, nil, errors.New("getProps not valid for pingReq or pingResp packets")
 	}
 
 	m := make(map[int][]byte)
-	userProps := make([][]byte, 0)
+	userProps := make([]UserProperty, 0)
 
 	for i := 0; i < propLength; {
 		b, err := rdr.ReadByte()
@@ -182,6 +200,8 @@ func GetProps(rdr *packet.Reader, propLength, packetCode int) (map[int][]byte, [
 			return nil, nil, err
 		}
 		count := 0
+		isString := false     // UTF-8 Encoded String properties must be validated once read.
+		isVarByteInt := false // count can't tell, an empty string or binary data also has a count of 0.
 		var validCodes []int
 		switch b {
 		case PayloadFormatIndicatorCode:
@@ -192,6 +212,7 @@ func GetProps(rdr *packet.Reader, propLength, packetCode int) (map[int][]byte, [
 			count = 4
 		case ContentTypeCode, ResponseTopicCode: // UTF-8 String
 			validCodes = []int{PublishCode, WillPropsCode}
+			isString = true
 			count, i, err = getStringPropParams(i, rdr)
 			if err != nil {
 				return nil, nil, err
@@ -204,12 +225,13 @@ func GetProps(rdr *packet.Reader, propLength, packetCode int) (map[int][]byte, [
 			}
 		case SubscriptionIdCode: // Variable Byte Integer
 			validCodes = []int{PublishCode, SubscribeCode}
-			count = 0
+			isVarByteInt = true
 		case SessionExpiryIntervalCode:
 			validCodes = []int{ConnectCode, ConnackCode, DisconnectCode}
 			count = 4
 		case AssignedClientIdCode:
 			validCodes = []int{ConnackCode}
+			isString = true
 			count, i, err = getStringPropParams(i, rdr)
 			if err != nil {
 				return nil, nil, err
@@ -219,6 +241,7 @@ func GetProps(rdr *packet.Reader, propLength, packetCode int) (map[int][]byte, [
 			count = 2
 		case AuthenticationMethodCode:
 			validCodes = []int{ConnectCode, ConnackCode, AuthCode}
+			isString = true
 			count, i, err = getStringPropParams(i, rdr)
 			if err != nil {
 				return nil, nil, err
@@ -237,18 +260,21 @@ func GetProps(rdr *packet.Reader, propLength, packetCode int) (map[int][]byte, [
 			count = 4
 		case ResponseInfoCode:
 			validCodes = []int{ConnackCode}
+			isString = true
 			count, i, err = getStringPropParams(i, rdr)
 			if err != nil {
 				return nil, nil, err
 			}
 		case ServerReferenceCode:
 			validCodes = []int{ConnackCode, DisconnectCode}
+			isString = true
 			count, i, err = getStringPropParams(i, rdr)
 			if err != nil {
 				return nil, nil, err
 			}
 		case ReasonStringCode:
 			validCodes = []int{ConnackCode, PubackCode, PubrecCode, PubrelCode, PubcompCode, SubackCode, UnsubackCode, DisconnectCode, AuthCode}
+			isString = true
 			count, i, err = getStringPropParams(i, rdr)
 			if err != nil {
 				return nil, nil, err
@@ -283,12 +309,13 @@ func GetProps(rdr *packet.Reader, propLength, packetCode int) (map[int][]byte, [
 
 		var prop []byte
 		if b == 0x26 { // get the string pair.
-			count, prop, err = getStringPairProp(rdr)
+			var pair UserProperty
+			count, pair, err = getStringPairProp(rdr)
 			if err != nil {
 				return nil, nil, err
 			}
-			userProps = append(userProps, prop)
-		} else if count == 0 { // this indicates it must be a Variable Byte Integer!
+			userProps = append(userProps, pair)
+		} else if isVarByteInt {
 			numRead, val, err := rdr.ReadVarByteInt()
 			if err != nil {
 				return nil, nil, err
@@ -304,6 +331,11 @@ func GetProps(rdr *packet.Reader, propLength, packetCode int) (map[int][]byte, [
 		if err != nil {
 			return nil, nil, err
 		}
+		if isString {
+			if err := rdr.CheckUtf8(prop); err != nil {
+				return nil, nil, err
+			}
+		}
 
 		i += (count + 1)
 	}
@@ -332,18 +364,27 @@ func GetConnectFlags(b byte) (*ConnectFlags, error) {
 	return flags, nil
 }
 
-// VerifyProtocol verifies that the following bytes from the reader represent the correct protocol. Hint: it must be MQTT.
+// VerifyProtocol verifies that the following bytes from the reader represent the correct protocol. Hint: it must be MQTT,
+// or MQIsdp for legacy v3.1 clients. Returns the protocol name, to check the protocol level against.
 // Assumes there are enough bytes to process the request.
-func VerifyProtocol(rdr *packet.Reader) (err error) {
+func VerifyProtocol(rdr *packet.Reader) (string, error) {
 	_, s, err := rdr.ReadUtf8Str()
 	if err != nil {
-		return err
+		return "", err
+	}
+	if s != ProtocolName && s != ProtocolName31 {
+		msg := fmt.Sprintf("Got invalid protocol `%v` expected `%v` or `%v`", s, ProtocolName, ProtocolName31)
+		return "", errors.New(msg)
 	}
-	if s != "MQTT" {
-		msg := fmt.Sprintf("Got invalid protocol `%v` expected `MQTT`", s)
-		return errors.New(msg)
+	return s, nil
+}
+
+// ValidProtocolLevel checks if the protocol level is supported, and matches the protocol name sent before it.
+func ValidProtocolLevel(name string, level byte) bool {
+	if name == ProtocolName31 {
+		return level == ProtocolLevel31
 	}
-	return nil
+	return level == ProtocolLevel311 || level == ProtocolLevel5
 }
 
 // GetKeepAlive reads the following two bytes and turns it into a 2 bytes integer
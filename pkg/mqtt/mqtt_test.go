@@ -54,33 +54,53 @@ const (
 // 	}
 // }
 
-func checkSliceProtocol(t *testing.T, buf []byte, shouldPass bool) {
+func checkSliceProtocol(t *testing.T, buf []byte, expected string, shouldPass bool) {
 	rdr := packet.NewReader(bytes.NewReader(buf), dummyRemainingLength)
-	err := VerifyProtocol(rdr)
+	name, err := VerifyProtocol(rdr)
 	if err != nil && shouldPass {
 		t.Fatalf("Invalid protocol: %v", err.Error())
 	} else if err == nil && !shouldPass {
 		t.Fatalf("Should have been an invalid protocol: %v", buf)
+	} else if name != expected && shouldPass {
+		t.Fatalf("Got:\n%v\nExpected:\n%v", name, expected)
 	}
 }
 
 func TestVerifyProtocol(t *testing.T) {
 	buf := []byte{0, 4, 'M', 'Q', 'T', 'T'}
-	checkSliceProtocol(t, buf, true)
+	checkSliceProtocol(t, buf, "MQTT", true)
 	buf = []byte{0, 4, 'M', 'Q', 'T', 'T', 'T', 'T', 0x2d}
-	checkSliceProtocol(t, buf, true)
+	checkSliceProtocol(t, buf, "MQTT", true)
+	buf = []byte{0, 6, 'M', 'Q', 'I', 's', 'd', 'p'}
+	checkSliceProtocol(t, buf, "MQIsdp", true)
+	buf = []byte{0, 6, 'M', 'Q', 'I', 'S', 'D', 'P'}
+	checkSliceProtocol(t, buf, "", false)
 	buf = []byte{0, 4, 'm', 'Q', 'T', 'T'}
-	checkSliceProtocol(t, buf, false)
+	checkSliceProtocol(t, buf, "", false)
 	buf = []byte{0, 5, 'M', 'Q', 'T', 'T', 'T'}
-	checkSliceProtocol(t, buf, false)
+	checkSliceProtocol(t, buf, "", false)
 	buf = []byte{0, 4, 'm', 'q', 't', 't'}
-	checkSliceProtocol(t, buf, false)
+	checkSliceProtocol(t, buf, "", false)
 	buf = []byte{0, 1, 'M', 'Q', 'T', 'T'}
-	checkSliceProtocol(t, buf, false)
+	checkSliceProtocol(t, buf, "", false)
 	buf = []byte{0, 0, 4, 'M', 'Q', 'T', 'T'} // expects first byte to be LSB of the protocol. SHOULD BE 4!
-	checkSliceProtocol(t, buf, false)
+	checkSliceProtocol(t, buf, "", false)
 	buf = []byte{1, 4, 'M', 'Q', 'T', 'T'}
-	checkSliceProtocol(t, buf, false)
+	checkSliceProtocol(t, buf, "", false)
+}
+
+func checkValidProtocolLevel(t *testing.T, name string, level byte, expected bool) {
+	if ValidProtocolLevel(name, level) != expected {
+		t.Fatalf("ValidProtocolLevel(%v, %d) should be %t", name, level, expected)
+	}
+}
+func TestValidProtocolLevel(t *testing.T) {
+	checkValidProtocolLevel(t, "MQTT", 5, true)
+	checkValidProtocolLevel(t, "MQTT", 4, true)
+	checkValidProtocolLevel(t, "MQTT", 3, false)
+	checkValidProtocolLevel(t, "MQTT", 6, false)
+	checkValidProtocolLevel(t, "MQIsdp", 3, true)
+	checkValidProtocolLevel(t, "MQIsdp", 4, false)
 }
 
 func checkConnectFlags(t *testing.T, b byte, expected *ConnectFlags, shouldPass bool) {
@@ -169,7 +189,7 @@ func TestGetStringPropParams(t *testing.T) {
 	checkStringPropParams(t, 7, example, expectedCount, false)
 }
 
-func checkStringPairProp(t *testing.T, buf, expected []byte, expectedRead int, shouldPass bool) {
+func checkStringPairProp(t *testing.T, buf []byte, expected UserProperty, expectedRead int, shouldPass bool) {
 	rdr := packet.NewReader(bytes.NewReader(buf), dummyRemainingLength)
 	numRead, res, err := getStringPairProp(rdr)
 	if err != nil && shouldPass {
@@ -184,7 +204,7 @@ func checkStringPairProp(t *testing.T, buf, expected []byte, expectedRead int, s
 }
 func TestGetStringPairProp(t *testing.T) {
 	buf := []byte{0x00, 0x05, 0x41, 0xF0, 0xAA, 0x9B, 0x94, 0x00, 0x05, 0x41, 0xF0, 0xAA, 0x9B, 0x94}
-	expected := buf
+	expected := UserProperty{Key: "A\U0002A6D4", Value: "A\U0002A6D4"}
 	expectedRead := 14
 	checkStringPairProp(t, buf, expected, expectedRead, true)
 	buf = []byte{0x00, 0x05, 0x41, 0xF0, 0xAA, 0x9B, 0x94}
@@ -194,13 +214,15 @@ func TestGetStringPairProp(t *testing.T) {
 	buf = []byte{0x00, 0x05, 0x41, 0xF0, 0xAA, 0x9B, 0x94, 0x00}
 	checkStringPairProp(t, buf, expected, expectedRead, false)
 	buf = []byte{0x00, 0x04, 0xF0, 0xAA, 0x9B, 0x94, 0x00, 0x05, 0x41, 0xF0, 0xAA, 0x9B, 0x94, 0x05}
-	expected = []byte{0x00, 0x04, 0xF0, 0xAA, 0x9B, 0x94, 0x00, 0x05, 0x41, 0xF0, 0xAA, 0x9B, 0x94}
+	expected = UserProperty{Key: "\U0002A6D4", Value: "A\U0002A6D4"}
 	expectedRead = 13
 	checkStringPairProp(t, buf, expected, expectedRead, true)
 	buf = []byte{0xF0, 0x00, 0x04, 0xF0, 0xAA, 0x9B, 0x94, 0x00, 0x05, 0x41, 0xF0, 0xAA, 0x9B, 0x94, 0x05}
 	checkStringPairProp(t, buf, expected, expectedRead, false)
 	buf = []byte{0x00, 0x02, 0xF0, 0xF0, 0x00, 0x00, 0x41, 0xF0, 0xAA, 0x9B, 0x94, 0x05}
-	expected = []byte{0x00, 0x02, 0xF0, 0xF0, 0x00, 0x00}
+	checkStringPairProp(t, buf, expected, expectedRead, false) // not valid UTF-8.
+	buf = []byte{0x00, 0x02, 0x41, 0x42, 0x00, 0x00, 0x41, 0xF0, 0xAA, 0x9B, 0x94, 0x05}
+	expected = UserProperty{Key: "AB", Value: ""}
 	expectedRead = 6
 	checkStringPairProp(t, buf, expected, expectedRead, true)
 }
@@ -218,7 +240,7 @@ func checkClientId(t *testing.T, buf []byte, expected string, shouldPass bool) {
 }
 func TestGetClientId(t *testing.T) {
 	buf := []byte{0x00, 0x00}
-	expected := "one randomly"
+	expected := "" // assigned by the server afterwards.
 	checkClientId(t, buf, expected, true)
 	buf = []byte{0x00, 0x01, 0x32}
 	expected = "2"
@@ -230,6 +252,20 @@ func TestGetClientId(t *testing.T) {
 	checkClientId(t, buf, expected, false)
 }
 
+func TestNewClientId(t *testing.T) {
+	a, err := NewClientId()
+	if err != nil {
+		t.Fatalf("NewClientId failed: %v", err.Error())
+	}
+	b, err := NewClientId()
+	if err != nil {
+		t.Fatalf("NewClientId failed: %v", err.Error())
+	}
+	if a == b || len(a) != MaxClientIdLength31 {
+		t.Fatalf("expected two different client IDs of %d characters, got %v and %v", MaxClientIdLength31, a, b)
+	}
+}
+
 // Below are all the tests for the getProps function. They are split into 15 different functions, 1 for each packet type.
 // Each one tests on every property identifier at least once, plus some extra cases that may be unique to that packet.
 var (
@@ -261,9 +297,12 @@ var (
 	wildcardSubAvailable   []byte = []byte{0x28, 0x01}                                                                         // 1
 	subIdAvailable         []byte = []byte{0x29, 0x00}                                                                         // 0
 	sharedSubAvailable     []byte = []byte{0x2A, 0x01}                                                                         // 1
+
+	userPropertyPair  = UserProperty{Key: "A", Value: "cd"}
+	userPropertyPair2 = UserProperty{Key: "cd", Value: "A"}
 )
 
-func checkProps(t *testing.T, propLen, packetCode int, buf []byte, expectedM map[int][]byte, expectedUserProps [][]byte, shouldPass bool) {
+func checkProps(t *testing.T, propLen, packetCode int, buf []byte, expectedM map[int][]byte, expectedUserProps []UserProperty, shouldPass bool) {
 	rdr := packet.NewReader(bytes.NewReader(buf), dummyRemainingLength)
 	m, userProps, err := GetProps(rdr, propLen, packetCode)
 	if err != nil && shouldPass {
@@ -282,17 +321,17 @@ func checkProps(t *testing.T, propLen, packetCode int, buf []byte, expectedM map
 func basicUserPropsTest(t *testing.T, packetCode int, shouldPass bool) {
 	// simple one.
 	expected := map[int][]byte{}
-	expectedUProps := [][]byte{userProperty[1:]}
+	expectedUProps := []UserProperty{userPropertyPair}
 	checkProps(t, 8, packetCode, userProperty, expected, expectedUProps, shouldPass)
 	// multiple userProps, using the same one.
 	payload := append(userProperty, userProperty...)
 	expected = map[int][]byte{}
-	expectedUProps = [][]byte{userProperty[1:], userProperty[1:]}
+	expectedUProps = []UserProperty{userPropertyPair, userPropertyPair}
 	checkProps(t, 16, packetCode, payload, expected, expectedUProps, shouldPass)
 	// multiple userProps, using different ones.
 	payload = append(userProperty, userProperty2...)
 	expected = map[int][]byte{}
-	expectedUProps = [][]byte{userProperty[1:], userProperty2[1:]}
+	expectedUProps = []UserProperty{userPropertyPair, userPropertyPair2}
 	checkProps(t, 16, packetCode, payload, expected, expectedUProps, shouldPass)
 }
 
@@ -308,30 +347,30 @@ func TestGetPropsCONNECT(t *testing.T) {
 	checkProps(t, 7, packetCode, correlationData, nil, nil, false)
 	checkProps(t, 2, packetCode, subscriptionId, nil, nil, false)
 	expected := map[int][]byte{SessionExpiryIntervalCode: sessionExpiryInterval[1:]}
-	checkProps(t, 2, packetCode, sessionExpiryInterval, expected, [][]byte{}, true)
+	checkProps(t, 2, packetCode, sessionExpiryInterval, expected, []UserProperty{}, true)
 	checkProps(t, 4, packetCode, assignedClientId, nil, nil, false)
 	checkProps(t, 3, packetCode, serverKeepAlive, nil, nil, false)
 	expected = map[int][]byte{AuthenticationMethodCode: authenticationMethod[3:]}
-	checkProps(t, 14, packetCode, authenticationMethod, expected, [][]byte{}, true)
+	checkProps(t, 14, packetCode, authenticationMethod, expected, []UserProperty{}, true)
 	expected = map[int][]byte{AuthenticationDataCode: authenticationData[3:]}
-	checkProps(t, 5, packetCode, authenticationData, expected, [][]byte{}, true)
+	checkProps(t, 5, packetCode, authenticationData, expected, []UserProperty{}, true)
 	expected = map[int][]byte{RequestProblemInfoCode: requestProblemInfo[1:]}
-	checkProps(t, 2, packetCode, requestProblemInfo, expected, [][]byte{}, true)
+	checkProps(t, 2, packetCode, requestProblemInfo, expected, []UserProperty{}, true)
 	checkProps(t, 5, packetCode, willDelayInterval, nil, nil, false)
 	expected = map[int][]byte{RequestResponseInfoCode: requestResponseInfo[1:]}
-	checkProps(t, 2, packetCode, requestResponseInfo, expected, [][]byte{}, true)
+	checkProps(t, 2, packetCode, requestResponseInfo, expected, []UserProperty{}, true)
 	checkProps(t, 14, packetCode, responseInfo, nil, nil, false)
 	checkProps(t, 14, packetCode, serverReference, nil, nil, false)
 	checkProps(t, 9, packetCode, reasonString, nil, nil, false)
 	expected = map[int][]byte{ReceiveMaxCode: receiveMax[1:]}
-	checkProps(t, 3, packetCode, receiveMax, expected, [][]byte{}, true)
+	checkProps(t, 3, packetCode, receiveMax, expected, []UserProperty{}, true)
 	expected = map[int][]byte{TopicAliasMaxCode: topicAliasMax[1:]}
-	checkProps(t, 3, packetCode, topicAliasMax, expected, [][]byte{}, true)
+	checkProps(t, 3, packetCode, topicAliasMax, expected, []UserProperty{}, true)
 	checkProps(t, 3, packetCode, topicAlias, nil, nil, false)
 	checkProps(t, 2, packetCode, maxQoS, nil, nil, false)
 	checkProps(t, 2, packetCode, retainAvailable, nil, nil, false)
 	expected = map[int][]byte{MaxPacketSizeCode: maxPacketSize[1:]}
-	checkProps(t, 5, packetCode, maxPacketSize, expected, [][]byte{}, true)
+	checkProps(t, 5, packetCode, maxPacketSize, expected, []UserProperty{}, true)
 	checkProps(t, 2, packetCode, wildcardSubAvailable, nil, nil, false)
 	checkProps(t, 2, packetCode, subIdAvailable, nil, nil, false)
 	checkProps(t, 2, packetCode, sharedSubAvailable, nil, nil, false)
@@ -339,32 +378,39 @@ func TestGetPropsCONNECT(t *testing.T) {
 	// Special ones.
 	payload := append(authenticationData, append(sessionExpiryInterval, authenticationMethod...)...)
 	expected = map[int][]byte{AuthenticationMethodCode: authenticationMethod[3:], AuthenticationDataCode: authenticationData[3:], SessionExpiryIntervalCode: sessionExpiryInterval[1:]}
-	checkProps(t, 24, packetCode, payload, expected, [][]byte{}, true)
+	checkProps(t, 24, packetCode, payload, expected, []UserProperty{}, true)
 	// multiple different properties with one invalid
 	payload = append(authenticationData, append(sessionExpiryInterval, append(authenticationMethod, serverKeepAlive...)...)...)
 	checkProps(t, 27, packetCode, payload, nil, nil, false)
 	// userProps + other props in some random order.
 	payload = append(authenticationData, append(userProperty, append(sessionExpiryInterval, append(userProperty2, authenticationMethod...)...)...)...)
 	expected = map[int][]byte{AuthenticationMethodCode: authenticationMethod[3:], AuthenticationDataCode: authenticationData[3:], SessionExpiryIntervalCode: sessionExpiryInterval[1:]}
-	expectedUProps := [][]byte{userProperty[1:], userProperty2[1:]}
+	expectedUProps := []UserProperty{userPropertyPair, userPropertyPair2}
 	checkProps(t, 40, packetCode, payload, expected, expectedUProps, true)
 	// Empty props
-	checkProps(t, 0, packetCode, []byte{}, map[int][]byte{}, [][]byte{}, true)
+	checkProps(t, 0, packetCode, []byte{}, map[int][]byte{}, []UserProperty{}, true)
 }
 
 func TestGetPropsWILL(t *testing.T) {
 	// The basics
 	packetCode := WillPropsCode
 	expected := map[int][]byte{PayloadFormatIndicatorCode: payloadFormatIndicator[1:]}
-	checkProps(t, 2, packetCode, payloadFormatIndicator, expected, [][]byte{}, true)
+	checkProps(t, 2, packetCode, payloadFormatIndicator, expected, []UserProperty{}, true)
 	expected = map[int][]byte{MessageExpiryIntervalCode: messageExpiryInterval[1:]}
-	checkProps(t, 5, packetCode, messageExpiryInterval, expected, [][]byte{}, true)
+	checkProps(t, 5, packetCode, messageExpiryInterval, expected, []UserProperty{}, true)
 	expected = map[int][]byte{ContentTypeCode: contentType[3:]}
-	checkProps(t, 5, packetCode, contentType, expected, [][]byte{}, true)
+	checkProps(t, 5, packetCode, contentType, expected, []UserProperty{}, true)
 	expected = map[int][]byte{ResponseTopicCode: responseTopic[3:]}
-	checkProps(t, 11, packetCode, responseTopic, expected, [][]byte{}, true)
+	checkProps(t, 11, packetCode, responseTopic, expected, []UserProperty{}, true)
 	expected = map[int][]byte{CorrelationDataCode: correlationData[3:]}
-	checkProps(t, 7, packetCode, correlationData, expected, [][]byte{}, true)
+	checkProps(t, 7, packetCode, correlationData, expected, []UserProperty{}, true)
+	// UTF-8 strings must be valid, binary data can be anything.
+	checkProps(t, 5, packetCode, []byte{ContentTypeCode, 0x00, 0x02, 0xC0, 0x80}, nil, nil, false)
+	expected = map[int][]byte{CorrelationDataCode: {0xC0, 0x80}}
+	checkProps(t, 5, packetCode, []byte{CorrelationDataCode, 0x00, 0x02, 0xC0, 0x80}, expected, []UserProperty{}, true)
+	// empty strings and binary data are allowed.
+	expected = map[int][]byte{ContentTypeCode: {}, CorrelationDataCode: {}}
+	checkProps(t, 6, packetCode, []byte{ContentTypeCode, 0x00, 0x00, CorrelationDataCode, 0x00, 0x00}, expected, []UserProperty{}, true)
 	checkProps(t, 2, packetCode, subscriptionId, nil, nil, false)
 	checkProps(t, 2, packetCode, sessionExpiryInterval, nil, nil, false)
 	checkProps(t, 4, packetCode, assignedClientId, nil, nil, false)
@@ -373,7 +419,7 @@ func TestGetPropsWILL(t *testing.T) {
 	checkProps(t, 5, packetCode, authenticationData, nil, nil, false)
 	checkProps(t, 2, packetCode, requestProblemInfo, nil, nil, false)
 	expected = map[int][]byte{WillDelayIntervalCode: willDelayInterval[1:]}
-	checkProps(t, 5, packetCode, willDelayInterval, expected, [][]byte{}, true)
+	checkProps(t, 5, packetCode, willDelayInterval, expected, []UserProperty{}, true)
 	checkProps(t, 2, packetCode, requestResponseInfo, nil, nil, false)
 	checkProps(t, 14, packetCode, responseInfo, nil, nil, false)
 	checkProps(t, 14, packetCode, serverReference, nil, nil, false)
@@ -392,15 +438,15 @@ func TestGetPropsWILL(t *testing.T) {
 	// multiple different valid properties
 	payload := append(willDelayInterval, append(correlationData, messageExpiryInterval...)...)
 	expected = map[int][]byte{CorrelationDataCode: correlationData[3:], MessageExpiryIntervalCode: messageExpiryInterval[1:], WillDelayIntervalCode: willDelayInterval[1:]}
-	checkProps(t, 17, packetCode, payload, expected, [][]byte{}, true)
+	checkProps(t, 17, packetCode, payload, expected, []UserProperty{}, true)
 	// multiple different properties with one invalid
 	payload = append(authenticationData, append(willDelayInterval, append(messageExpiryInterval, correlationData...)...)...)
 	checkProps(t, 27, packetCode, payload, nil, nil, false)
 	// userProps + other props in some random order.
 	payload = append(willDelayInterval, append(userProperty, append(responseTopic, append(userProperty2, contentType...)...)...)...)
 	expected = map[int][]byte{WillDelayIntervalCode: willDelayInterval[1:], ContentTypeCode: contentType[3:], ResponseTopicCode: responseTopic[3:]}
-	expectedUProps := [][]byte{userProperty[1:], userProperty2[1:]}
+	expectedUProps := []UserProperty{userPropertyPair, userPropertyPair2}
 	checkProps(t, 41, packetCode, payload, expected, expectedUProps, true)
 	// Empty props
-	checkProps(t, 0, packetCode, []byte{}, map[int][]byte{}, [][]byte{}, true)
+	checkProps(t, 0, packetCode, []byte{}, map[int][]byte{}, []UserProperty{}, true)
 }
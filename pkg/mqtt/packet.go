@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 
+	"github.com/M4THYOU/some_mqtt_broker/pkg/packet"
 	"github.com/M4THYOU/some_mqtt_broker/pkg/utils"
 )
 
@@ -39,3 +40,13 @@ func SendPacket(conn net.Conn, packet []byte) error {
 	}
 	return nil
 }
+
+// BuildPacket prepends the fixed header to the given variable header and payload.
+// firstByte should come from SetRequestType.
+func BuildPacket(firstByte byte, body []byte) ([]byte, error) {
+	w := packet.NewWriter()
+	w.PutByte(firstByte)
+	w.PutVarByteInt(uint32(len(body)))
+	w.PutBytes(body)
+	return w.Bytes()
+}
@@ -2,6 +2,8 @@ package mqtt
 
 import (
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func checkRequestType(t *testing.T, firstByte, expected byte, shouldPass bool) {
@@ -79,3 +81,19 @@ func TestSetRequestType(t *testing.T) {
 	checkSetRequestType(t, DisconnectCode, disconnectFirstByte, false, false, 0, true)
 	checkSetRequestType(t, AuthCode, authFirstByte, false, false, 0, true)
 }
+
+func checkBuildPacket(t *testing.T, firstByte byte, body, expected []byte) {
+	buf, err := BuildPacket(firstByte, body)
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err.Error())
+	} else if !cmp.Equal(buf, expected) {
+		t.Fatalf("Got:\n%v\nExpected:\n%v", buf, expected)
+	}
+}
+func TestBuildPacket(t *testing.T) {
+	checkBuildPacket(t, pingrespFirstByte, []byte{}, []byte{pingrespFirstByte, 0x00})
+	checkBuildPacket(t, pubackFirstByte, []byte{0x00, 0x01}, []byte{pubackFirstByte, 0x02, 0x00, 0x01})
+	body := make([]byte, 200)
+	expected := append([]byte{publishFirstByte1, 0xC8, 0x01}, body...)
+	checkBuildPacket(t, publishFirstByte1, body, expected)
+}
@@ -0,0 +1,119 @@
+package mqtt
+
+import "errors"
+
+// Reason codes as defined in the spec.
+// Some values are shared by several packet types, so only the first name is defined for them.
+const (
+	ReasonSuccess                     = 0x00 // also Normal disconnection and Granted QoS 0.
+	ReasonGrantedQoS1                 = 0x01
+	ReasonGrantedQoS2                 = 0x02
+	ReasonDisconnectWithWill          = 0x04
+	ReasonNoMatchingSubscribers       = 0x10
+	ReasonNoSubscriptionExisted       = 0x11
+	ReasonContinueAuthentication      = 0x18
+	ReasonReAuthenticate              = 0x19
+	ReasonUnspecifiedError            = 0x80
+	ReasonMalformedPacket             = 0x81
+	ReasonProtocolError               = 0x82
+	ReasonImplementationSpecificError = 0x83
+	ReasonUnsupportedProtocolVersion  = 0x84
+	ReasonClientIdNotValid            = 0x85
+	ReasonBadUserNameOrPassword       = 0x86
+	ReasonNotAuthorized               = 0x87
+	ReasonServerUnavailable           = 0x88
+	ReasonServerBusy                  = 0x89
+	ReasonBanned                      = 0x8A
+	ReasonServerShuttingDown          = 0x8B
+	ReasonBadAuthenticationMethod     = 0x8C
+	ReasonKeepAliveTimeout            = 0x8D
+	ReasonSessionTakenOver            = 0x8E
+	ReasonTopicFilterInvalid          = 0x8F
+	ReasonTopicNameInvalid            = 0x90
+	ReasonPacketIdInUse               = 0x91
+	ReasonPacketIdNotFound            = 0x92
+	ReasonReceiveMaxExceeded          = 0x93
+	ReasonTopicAliasInvalid           = 0x94
+	ReasonPacketTooLarge              = 0x95
+	ReasonMessageRateTooHigh          = 0x96
+	ReasonQuotaExceeded               = 0x97
+	ReasonAdministrativeAction        = 0x98
+	ReasonPayloadFormatInvalid        = 0x99
+	ReasonRetainNotSupported          = 0x9A
+	ReasonQoSNotSupported             = 0x9B
+	ReasonUseAnotherServer            = 0x9C
+	ReasonServerMoved                 = 0x9D
+	ReasonSharedSubNotSupported       = 0x9E
+	ReasonConnectionRateExceeded      = 0x9F
+	ReasonMaxConnectTime              = 0xA0
+	ReasonSubIdsNotSupported          = 0xA1
+	ReasonWildcardSubNotSupported     = 0xA2
+)
+
+// CONNACK return codes and the SUBACK failure code of MQTT v3.1.1, which has no reason codes.
+const (
+	ReturnCodeAccepted              = 0x00
+	ReturnCodeUnacceptableProtocol  = 0x01
+	ReturnCodeIdentifierRejected    = 0x02
+	ReturnCodeServerUnavailable     = 0x03
+	ReturnCodeBadUserNameOrPassword = 0x04
+	ReturnCodeNotAuthorized         = 0x05
+	ReturnCodeSubackFailure         = 0x80
+)
+
+// ReasonError is an error that is reported to the client as a reason code, with the message as its Reason String.
+// Code may also be a reason code that isn't a failure, like No matching subscribers.
+type ReasonError struct {
+	Code   byte
+	Reason string
+}
+
+// NewReasonError returns an error reported to the client with the given reason code and Reason String.
+func NewReasonError(code byte, reason string) *ReasonError {
+	return &ReasonError{code, reason}
+}
+
+func (e *ReasonError) Error() string {
+	return e.Reason
+}
+
+// GetReasonCode returns the reason code to report err with.
+// nil => Success, and any error that isn't a ReasonError => Unspecified error.
+func GetReasonCode(err error) byte {
+	if err == nil {
+		return ReasonSuccess
+	}
+	var reasonErr *ReasonError
+	if errors.As(err, &reasonErr) {
+		return reasonErr.Code
+	}
+	return ReasonUnspecifiedError
+}
+
+// GetConnackReturnCode returns the MQTT v3.1.1 CONNACK return code closest to the given reason code.
+// Refusals that v3.1.1 has no return code for become Server unavailable.
+func GetConnackReturnCode(reasonCode byte) byte {
+	switch reasonCode {
+	case ReasonSuccess:
+		return ReturnCodeAccepted
+	case ReasonUnsupportedProtocolVersion:
+		return ReturnCodeUnacceptableProtocol
+	case ReasonClientIdNotValid:
+		return ReturnCodeIdentifierRejected
+	case ReasonBadUserNameOrPassword:
+		return ReturnCodeBadUserNameOrPassword
+	case ReasonNotAuthorized, ReasonBanned:
+		return ReturnCodeNotAuthorized
+	default:
+		return ReturnCodeServerUnavailable
+	}
+}
+
+// GetSubackReturnCode returns the MQTT v3.1.1 SUBACK return code for the given reason code.
+// The granted QoS is the same in both versions, but v3.1.1 only has a single failure code.
+func GetSubackReturnCode(reasonCode byte) byte {
+	if reasonCode >= ReasonUnspecifiedError {
+		return ReturnCodeSubackFailure
+	}
+	return reasonCode
+}
@@ -0,0 +1,49 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func checkGetReasonCode(t *testing.T, err error, expected byte) {
+	if code := GetReasonCode(err); code != expected {
+		t.Fatalf("GetReasonCode(%v) got %#x, expected %#x", err, code, expected)
+	}
+}
+func TestGetReasonCode(t *testing.T) {
+	checkGetReasonCode(t, nil, ReasonSuccess)
+	checkGetReasonCode(t, errors.New("something broke"), ReasonUnspecifiedError)
+	err := NewReasonError(ReasonTopicFilterInvalid, "invalid topic filter")
+	checkGetReasonCode(t, err, ReasonTopicFilterInvalid)
+	checkGetReasonCode(t, fmt.Errorf("subscribe: %w", err), ReasonTopicFilterInvalid)
+	if err.Error() != "invalid topic filter" {
+		t.Fatalf("Error() got %v, expected the Reason String", err.Error())
+	}
+}
+
+func checkGetConnackReturnCode(t *testing.T, reasonCode, expected byte) {
+	if code := GetConnackReturnCode(reasonCode); code != expected {
+		t.Fatalf("GetConnackReturnCode(%#x) got %#x, expected %#x", reasonCode, code, expected)
+	}
+}
+func TestGetConnackReturnCode(t *testing.T) {
+	checkGetConnackReturnCode(t, ReasonSuccess, ReturnCodeAccepted)
+	checkGetConnackReturnCode(t, ReasonUnsupportedProtocolVersion, ReturnCodeUnacceptableProtocol)
+	checkGetConnackReturnCode(t, ReasonClientIdNotValid, ReturnCodeIdentifierRejected)
+	checkGetConnackReturnCode(t, ReasonBadUserNameOrPassword, ReturnCodeBadUserNameOrPassword)
+	checkGetConnackReturnCode(t, ReasonNotAuthorized, ReturnCodeNotAuthorized)
+	checkGetConnackReturnCode(t, ReasonUseAnotherServer, ReturnCodeServerUnavailable)
+	checkGetConnackReturnCode(t, ReasonUnspecifiedError, ReturnCodeServerUnavailable)
+}
+
+func TestGetSubackReturnCode(t *testing.T) {
+	for _, code := range []byte{ReasonGrantedQoS1, ReasonGrantedQoS2, ReasonSuccess} {
+		if GetSubackReturnCode(code) != code {
+			t.Fatalf("GetSubackReturnCode(%#x) should not change a granted QoS", code)
+		}
+	}
+	if code := GetSubackReturnCode(ReasonTopicFilterInvalid); code != ReturnCodeSubackFailure {
+		t.Fatalf("GetSubackReturnCode(%#x) got %#x, expected %#x", ReasonTopicFilterInvalid, code, ReturnCodeSubackFailure)
+	}
+}
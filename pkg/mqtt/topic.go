@@ -0,0 +1,131 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SharePrefix is the first level of every shared subscription's topic filter.
+const SharePrefix = "$share"
+
+// ValidTopicName checks if the given string may be used as the topic of a PUBLISH packet.
+// Topic names must be at least one character long and must not contain wildcards or the null character.
+func ValidTopicName(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	return !strings.ContainsAny(s, "+#\x00")
+}
+
+// ValidTopicFilter checks if the given string may be used as a topic filter in a SUBSCRIBE or UNSUBSCRIBE packet.
+// Wildcards must occupy an entire level and the multi-level wildcard must be the last character.
+func ValidTopicFilter(s string) bool {
+	if len(s) == 0 || strings.Contains(s, "\x00") {
+		return false
+	}
+	levels := strings.Split(s, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		} else if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// TopicMatches checks if the topic name is matched by the topic filter.
+// Assumes both have already been validated.
+func TopicMatches(filter, topic string) bool {
+	// topics starting with '$' are reserved, wildcards at the first level must not match them.
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true // '#' also matches the parent level, so "a/#" matches "a".
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// FilterCovers checks if every topic name matched by filter is also matched by pattern.
+// Assumes both are valid topic filters.
+func FilterCovers(pattern, filter string) bool {
+	if isWildcard(pattern[:1]) && strings.HasPrefix(filter, "$") {
+		return false
+	}
+	patternLevels := strings.Split(pattern, "/")
+	filterLevels := strings.Split(filter, "/")
+	for i, level := range patternLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(filterLevels) || filterLevels[i] == "#" {
+			return false
+		}
+		if level != "+" && level != filterLevels[i] {
+			return false // a literal level doesn't cover '+' either.
+		}
+	}
+	return len(patternLevels) == len(filterLevels)
+}
+
+// FiltersOverlap checks if at least one topic name is matched by both filters.
+// Assumes both are valid topic filters.
+func FiltersOverlap(a, b string) bool {
+	if (isWildcard(a[:1]) && strings.HasPrefix(b, "$")) || (isWildcard(b[:1]) && strings.HasPrefix(a, "$")) {
+		return false
+	}
+	aLevels := strings.Split(a, "/")
+	bLevels := strings.Split(b, "/")
+	if len(aLevels) > len(bLevels) {
+		aLevels, bLevels = bLevels, aLevels
+	}
+	for i, level := range aLevels {
+		if level == "#" || bLevels[i] == "#" {
+			return true
+		}
+		if level != "+" && bLevels[i] != "+" && level != bLevels[i] {
+			return false
+		}
+	}
+	// "a/#" also matches "a", so the longer filter may only have a trailing '#' left.
+	return len(aLevels) == len(bLevels) || (len(bLevels) == len(aLevels)+1 && bLevels[len(aLevels)] == "#")
+}
+
+func isWildcard(level string) bool {
+	return level == "+" || level == "#"
+}
+
+// ParseSharedFilter splits a topic filter of the form $share/{ShareName}/{filter} into its share name and filter.
+// isShared is false if the filter is not a shared subscription, in which case the filter is returned unchanged.
+func ParseSharedFilter(s string) (shareName, filter string, isShared bool, err error) {
+	if !strings.HasPrefix(s, SharePrefix+"/") {
+		return "", s, false, nil
+	}
+	parts := strings.SplitN(s, "/", 3)
+	if len(parts) != 3 {
+		msg := fmt.Sprintf("shared subscription %v is missing a topic filter", s)
+		return "", "", true, errors.New(msg)
+	}
+	shareName, filter = parts[1], parts[2]
+	if len(shareName) == 0 || strings.ContainsAny(shareName, "+#") {
+		msg := fmt.Sprintf("invalid share name `%v` in %v", shareName, s)
+		return "", "", true, errors.New(msg)
+	}
+	if !ValidTopicFilter(filter) {
+		msg := fmt.Sprintf("invalid topic filter `%v` in %v", filter, s)
+		return "", "", true, errors.New(msg)
+	}
+	return shareName, filter, true, nil
+}
@@ -0,0 +1,122 @@
+package mqtt
+
+import "testing"
+
+func checkValidTopicName(t *testing.T, s string, expected bool) {
+	if res := ValidTopicName(s); res != expected {
+		t.Fatalf("ValidTopicName(%q) got %v, expected %v", s, res, expected)
+	}
+}
+func TestValidTopicName(t *testing.T) {
+	checkValidTopicName(t, "a/b/c", true)
+	checkValidTopicName(t, "/", true)
+	checkValidTopicName(t, "$SYS/uptime", true)
+	checkValidTopicName(t, "", false)
+	checkValidTopicName(t, "a/+/c", false)
+	checkValidTopicName(t, "a/#", false)
+	checkValidTopicName(t, "a\x00b", false)
+}
+
+func checkValidTopicFilter(t *testing.T, s string, expected bool) {
+	if res := ValidTopicFilter(s); res != expected {
+		t.Fatalf("ValidTopicFilter(%q) got %v, expected %v", s, res, expected)
+	}
+}
+func TestValidTopicFilter(t *testing.T) {
+	checkValidTopicFilter(t, "a/b/c", true)
+	checkValidTopicFilter(t, "#", true)
+	checkValidTopicFilter(t, "+", true)
+	checkValidTopicFilter(t, "a/+/c/#", true)
+	checkValidTopicFilter(t, "+/+", true)
+	checkValidTopicFilter(t, "", false)
+	checkValidTopicFilter(t, "a/#/c", false)
+	checkValidTopicFilter(t, "a#", false)
+	checkValidTopicFilter(t, "a/b+", false)
+	checkValidTopicFilter(t, "a\x00", false)
+}
+
+func checkTopicMatches(t *testing.T, filter, topic string, expected bool) {
+	if res := TopicMatches(filter, topic); res != expected {
+		t.Fatalf("TopicMatches(%q, %q) got %v, expected %v", filter, topic, res, expected)
+	}
+}
+func TestTopicMatches(t *testing.T) {
+	checkTopicMatches(t, "a/b", "a/b", true)
+	checkTopicMatches(t, "a/b", "a/c", false)
+	checkTopicMatches(t, "a/+", "a/b", true)
+	checkTopicMatches(t, "a/+", "a/b/c", false)
+	checkTopicMatches(t, "a/+/c", "a/b/c", true)
+	checkTopicMatches(t, "a/#", "a", true)
+	checkTopicMatches(t, "a/#", "a/b/c", true)
+	checkTopicMatches(t, "#", "a/b/c", true)
+	checkTopicMatches(t, "+", "a", true)
+	checkTopicMatches(t, "+/+", "/a", true)
+	checkTopicMatches(t, "a/b/c", "a/b", false)
+	checkTopicMatches(t, "#", "$SYS/uptime", false)
+	checkTopicMatches(t, "+/uptime", "$SYS/uptime", false)
+	checkTopicMatches(t, "$SYS/#", "$SYS/uptime", true)
+}
+
+func checkFilterCovers(t *testing.T, pattern, filter string, expected bool) {
+	if res := FilterCovers(pattern, filter); res != expected {
+		t.Fatalf("FilterCovers(%q, %q) got %v, expected %v", pattern, filter, res, expected)
+	}
+}
+func TestFilterCovers(t *testing.T) {
+	checkFilterCovers(t, "a/b", "a/b", true)
+	checkFilterCovers(t, "a/+", "a/b", true)
+	checkFilterCovers(t, "a/+", "a/+", true)
+	checkFilterCovers(t, "a/#", "a/+/c", true)
+	checkFilterCovers(t, "a/#", "a", true)
+	checkFilterCovers(t, "#", "a/#", true)
+	checkFilterCovers(t, "a/b", "a/+", false)
+	checkFilterCovers(t, "a/+", "a/#", false)
+	checkFilterCovers(t, "a/+", "a/b/c", false)
+	checkFilterCovers(t, "a/b/c", "a/b", false)
+	checkFilterCovers(t, "#", "$SYS/#", false)
+	checkFilterCovers(t, "$SYS/#", "$SYS/uptime", true)
+}
+
+func checkFiltersOverlap(t *testing.T, a, b string, expected bool) {
+	if res := FiltersOverlap(a, b); res != expected {
+		t.Fatalf("FiltersOverlap(%q, %q) got %v, expected %v", a, b, res, expected)
+	}
+	if res := FiltersOverlap(b, a); res != expected {
+		t.Fatalf("FiltersOverlap(%q, %q) got %v, expected %v", b, a, res, expected)
+	}
+}
+func TestFiltersOverlap(t *testing.T) {
+	checkFiltersOverlap(t, "a/b", "a/b", true)
+	checkFiltersOverlap(t, "#", "secret/x", true)
+	checkFiltersOverlap(t, "a/+/c", "a/b/+", true)
+	checkFiltersOverlap(t, "a", "a/#", true)
+	checkFiltersOverlap(t, "+/b", "a/+", true)
+	checkFiltersOverlap(t, "a/b", "a/c", false)
+	checkFiltersOverlap(t, "a", "a/b", false)
+	checkFiltersOverlap(t, "a/+", "a/b/c", false)
+	checkFiltersOverlap(t, "#", "$SYS/uptime", false)
+	checkFiltersOverlap(t, "$SYS/#", "$SYS/uptime", true)
+}
+
+func checkParseSharedFilter(t *testing.T, s, expectedName, expectedFilter string, expectedShared, shouldPass bool) {
+	shareName, filter, isShared, err := ParseSharedFilter(s)
+	if err != nil && shouldPass {
+		t.Fatalf("ParseSharedFilter failed: %v", err.Error())
+	} else if err == nil && !shouldPass {
+		t.Fatalf("ParseSharedFilter should have failed: %v", s)
+	} else if isShared != expectedShared {
+		t.Fatalf("isShared got %v, expected %v for %v", isShared, expectedShared, s)
+	} else if (shareName != expectedName || filter != expectedFilter) && shouldPass {
+		t.Fatalf("Got:\n%v %v\nExpected:\n%v %v", shareName, filter, expectedName, expectedFilter)
+	}
+}
+func TestParseSharedFilter(t *testing.T) {
+	checkParseSharedFilter(t, "a/b", "", "a/b", false, true)
+	checkParseSharedFilter(t, "$share/workers/jobs/#", "workers", "jobs/#", true, true)
+	checkParseSharedFilter(t, "$share/g/a/+/c", "g", "a/+/c", true, true)
+	checkParseSharedFilter(t, "$sharex/g/a", "", "$sharex/g/a", false, true)
+	checkParseSharedFilter(t, "$share/g", "", "", true, false)
+	checkParseSharedFilter(t, "$share//a", "", "", true, false)
+	checkParseSharedFilter(t, "$share/g+/a", "", "", true, false)
+	checkParseSharedFilter(t, "$share/g/a/#/b", "", "", true, false)
+}
@@ -9,13 +9,24 @@ import (
 
 // bytesRead <= remainingLength, always.
 type Reader struct {
-	rdr             *bufio.Reader
-	remainingLength int
+	rdr                 *bufio.Reader
+	remainingLength     int
+	rejectNonCharacters bool // passed to ValidUtf8 for every UTF-8 string read.
 }
 
 // NewReader returns a new Reader whose buffer has the default size.
 func NewReader(rdr io.Reader, remainingLength int) *Reader {
-	return &Reader{bufio.NewReader(rdr), remainingLength}
+	return &Reader{rdr: bufio.NewReader(rdr), remainingLength: remainingLength}
+}
+
+// SetRejectNonCharacters makes every UTF-8 string read afterwards fail if it contains a Unicode non-character.
+func (rdr *Reader) SetRejectNonCharacters(v bool) {
+	rdr.rejectNonCharacters = v
+}
+
+// CheckUtf8 checks that b is a valid UTF-8 Encoded String, for strings that weren't read with ReadUtf8Str.
+func (rdr *Reader) CheckUtf8(b []byte) error {
+	return ValidUtf8(b, rdr.rejectNonCharacters)
 }
 
 // SetRemainingLength sets the remaining length of the packet currently being read.
@@ -23,6 +34,11 @@ func (rdr *Reader) SetRemainingLength(v int) {
 	rdr.remainingLength = v
 }
 
+// RemainingLength returns the number of bytes of the current packet that have not been read yet.
+func (rdr *Reader) RemainingLength() int {
+	return rdr.remainingLength
+}
+
 // ReadByte reads and returns a single byte.
 // If no byte is available, returns an error.
 func (rdr *Reader) ReadByte() (byte, error) {
@@ -66,7 +82,13 @@ func (rdr *Reader) ReadVarByteInt() (int, uint32, error) {
 // Returns number of bytes read, the string, and possibly an error.
 func (rdr *Reader) ReadUtf8Str() (int, string, error) {
 	bytesRead, s, err := rdr.ReadBinaryData()
-	return bytesRead, string(s), err
+	if err != nil {
+		return bytesRead, "", err
+	}
+	if err := rdr.CheckUtf8(s); err != nil {
+		return bytesRead, "", err
+	}
+	return bytesRead, string(s), nil
 }
 
 // ReadBinaryData returns an slice of bytes representing Binary Data according to MQTT v5.0 Spec.
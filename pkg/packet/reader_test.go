@@ -183,6 +183,10 @@ func TestReadUtf8Str(t *testing.T) {
 	checkReadUtf8Str(t, buf, 1, expected, false)
 	buf = []byte{0x00, 0xFF}
 	checkReadUtf8Str(t, buf, 2, expected, false)
+	buf = []byte{0x00, 0x03, 0x31, 0x00, 0x38} // U+0000
+	checkReadUtf8Str(t, buf, 5, expected, false)
+	buf = []byte{0x00, 0x03, 0xED, 0xA0, 0x80} // U+D800
+	checkReadUtf8Str(t, buf, 5, expected, false)
 }
 
 func checkReadBinaryData(t *testing.T, buf []byte, expectedByteCount int, expected []byte, shouldPass bool) {
@@ -0,0 +1,34 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// ValidUtf8 checks that b is a well-formed UTF-8 Encoded String according to MQTT v5.0 Spec.
+// Malformed sequences, overlong encodings, surrogates (U+D800 to U+DFFF), and U+0000 are never allowed.
+// If rejectNonCharacters, the non-characters U+FDD0 to U+FDEF and U+nFFFE, U+nFFFF are not allowed either.
+func ValidUtf8(b []byte, rejectNonCharacters bool) error {
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size <= 1 {
+			// utf8.DecodeRune also returns RuneError for surrogates and overlong encodings.
+			msg := fmt.Sprintf("malformed UTF-8 sequence at byte %d", i)
+			return errors.New(msg)
+		} else if r == 0 {
+			msg := fmt.Sprintf("UTF-8 string must not contain U+0000, found at byte %d", i)
+			return errors.New(msg)
+		} else if rejectNonCharacters && isNonCharacter(r) {
+			msg := fmt.Sprintf("UTF-8 string must not contain the non-character %U, found at byte %d", r, i)
+			return errors.New(msg)
+		}
+		i += size
+	}
+	return nil
+}
+
+// isNonCharacter checks if r is one of the 66 code points that Unicode reserves as non-characters.
+func isNonCharacter(r rune) bool {
+	return (r >= 0xFDD0 && r <= 0xFDEF) || r&0xFFFE == 0xFFFE
+}
@@ -0,0 +1,29 @@
+package packet
+
+import "testing"
+
+func checkValidUtf8(t *testing.T, buf []byte, rejectNonCharacters, shouldPass bool) {
+	err := ValidUtf8(buf, rejectNonCharacters)
+	if err != nil && shouldPass {
+		t.Fatalf("ValidUtf8 failed: %v", err.Error())
+	} else if err == nil && !shouldPass {
+		t.Fatalf("ValidUtf8 should have failed: %v", buf)
+	}
+}
+func TestValidUtf8(t *testing.T) {
+	checkValidUtf8(t, []byte{}, true, true)
+	checkValidUtf8(t, []byte("some/topic"), true, true)
+	checkValidUtf8(t, []byte{0x41, 0xF0, 0xAA, 0x9B, 0x94}, true, true) // "A" U+2A6D4
+	checkValidUtf8(t, []byte{0xEF, 0xBB, 0xBF, 0x41}, true, true)       // BOM then "A", must not be stripped or rejected.
+	checkValidUtf8(t, []byte{0x41, 0x00, 0x42}, false, false)           // U+0000
+	checkValidUtf8(t, []byte{0xF0, 0xF0}, false, false)                 // truncated
+	checkValidUtf8(t, []byte{0x41, 0x80}, false, false)                 // unexpected continuation byte
+	checkValidUtf8(t, []byte{0xC0, 0x80}, false, false)                 // overlong U+0000
+	checkValidUtf8(t, []byte{0xED, 0xA0, 0x80}, false, false)           // U+D800 surrogate
+	checkValidUtf8(t, []byte{0xF4, 0x90, 0x80, 0x80}, false, false)     // above U+10FFFF
+	checkValidUtf8(t, []byte{0xEF, 0xBF, 0xBF}, false, true)            // U+FFFF
+	checkValidUtf8(t, []byte{0xEF, 0xBF, 0xBF}, true, false)            // U+FFFF
+	checkValidUtf8(t, []byte{0xEF, 0xB7, 0x90}, true, false)            // U+FDD0
+	checkValidUtf8(t, []byte{0xEF, 0xB7, 0xB0}, true, true)             // U+FDF0
+	checkValidUtf8(t, []byte{0xF4, 0x8F, 0xBF, 0xBE}, true, false)      // U+10FFFE
+}
@@ -0,0 +1,99 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// MaxVarByteInt is the largest value that can be encoded as a Variable Byte Integer.
+const MaxVarByteInt = 268435455
+
+// Writer builds the bytes of an outgoing packet.
+// The first error encountered is kept and returned by Bytes, so callers don't need to check every write.
+type Writer struct {
+	buf []byte
+	err error
+}
+
+// NewWriter returns a new, empty Writer.
+func NewWriter() *Writer {
+	return &Writer{buf: make([]byte, 0)}
+}
+
+// PutByte appends a single byte.
+func (w *Writer) PutByte(b byte) {
+	w.buf = append(w.buf, b)
+}
+
+// PutBytes appends the bytes as is, without any length prefix.
+func (w *Writer) PutBytes(b []byte) {
+	w.buf = append(w.buf, b...)
+}
+
+// PutUint16 appends a Two Byte Integer according to MQTT v5.0 Spec.
+func (w *Writer) PutUint16(v uint16) {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, v)
+	w.buf = append(w.buf, buf...)
+}
+
+// PutUint32 appends a Four Byte Integer according to MQTT v5.0 Spec.
+func (w *Writer) PutUint32(v uint32) {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, v)
+	w.buf = append(w.buf, buf...)
+}
+
+// PutVarByteInt appends the encoded Variable Byte Integer according to MQTT v5.0 Spec.
+func (w *Writer) PutVarByteInt(v uint32) {
+	if v > MaxVarByteInt {
+		w.setErr(fmt.Sprintf("variable byte integer %d is too large", v))
+		return
+	}
+	for {
+		b := byte(v % 128)
+		v /= 128
+		if v > 0 {
+			b |= 0x80
+		}
+		w.buf = append(w.buf, b)
+		if v == 0 {
+			break
+		}
+	}
+}
+
+// PutUtf8Str appends the encoded UTF-8 string according to MQTT v5.0 Spec.
+func (w *Writer) PutUtf8Str(s string) {
+	w.PutBinaryData([]byte(s))
+}
+
+// PutBinaryData appends the encoded Binary Data according to MQTT v5.0 Spec.
+func (w *Writer) PutBinaryData(b []byte) {
+	if len(b) > 65535 {
+		w.setErr(fmt.Sprintf("data of length %d is too long to encode", len(b)))
+		return
+	}
+	w.PutUint16(uint16(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+// Len returns the number of bytes written so far.
+func (w *Writer) Len() int {
+	return len(w.buf)
+}
+
+// Bytes returns the bytes written so far, or the first error encountered while writing them.
+func (w *Writer) Bytes() ([]byte, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	return w.buf, nil
+}
+
+func (w *Writer) setErr(msg string) {
+	if w.err == nil {
+		w.err = errors.New("packet.Writer: " + msg)
+	}
+}
@@ -0,0 +1,86 @@
+package packet
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func checkPutVarByteInt(t *testing.T, v uint32, expected []byte, shouldPass bool) {
+	w := NewWriter()
+	w.PutVarByteInt(v)
+	buf, err := w.Bytes()
+	if err != nil && shouldPass {
+		t.Fatalf("PutVarByteInt failed: %v", err.Error())
+	} else if err == nil && !shouldPass {
+		t.Fatalf("PutVarByteInt should have failed: %v", v)
+	} else if !cmp.Equal(buf, expected) && shouldPass {
+		t.Fatalf("Got:\n%v\nExpected:\n%v", buf, expected)
+	}
+	if !shouldPass {
+		return
+	}
+	// Whatever we write, the reader must be able to read back.
+	rdr := NewReader(bytes.NewReader(buf), len(buf))
+	_, val, err := rdr.ReadVarByteInt()
+	if err != nil {
+		t.Fatalf("ReadVarByteInt failed: %v", err.Error())
+	} else if val != v {
+		t.Fatalf("round trip got %d, expected %d", val, v)
+	}
+}
+func TestPutVarByteInt(t *testing.T) {
+	checkPutVarByteInt(t, 0, []byte{0x00}, true)
+	checkPutVarByteInt(t, 127, []byte{0x7F}, true)
+	checkPutVarByteInt(t, 128, []byte{0x80, 0x01}, true)
+	checkPutVarByteInt(t, 12927, []byte{0xFF, 0x64}, true)
+	checkPutVarByteInt(t, 16384, []byte{0x80, 0x80, 0x01}, true)
+	checkPutVarByteInt(t, 2097152, []byte{0x80, 0x80, 0x80, 0x01}, true)
+	checkPutVarByteInt(t, 268435455, []byte{0xFF, 0xFF, 0xFF, 0x7F}, true)
+	checkPutVarByteInt(t, 268435456, nil, false)
+}
+
+func checkPutUtf8Str(t *testing.T, s string, expected []byte, shouldPass bool) {
+	w := NewWriter()
+	w.PutUtf8Str(s)
+	buf, err := w.Bytes()
+	if err != nil && shouldPass {
+		t.Fatalf("PutUtf8Str failed: %v", err.Error())
+	} else if err == nil && !shouldPass {
+		t.Fatalf("PutUtf8Str should have failed for string of length %d", len(s))
+	} else if !cmp.Equal(buf, expected) && shouldPass {
+		t.Fatalf("Got:\n%v\nExpected:\n%v", buf, expected)
+	}
+}
+func TestPutUtf8Str(t *testing.T) {
+	checkPutUtf8Str(t, "118", []byte{0x00, 0x03, 0x31, 0x31, 0x38}, true)
+	checkPutUtf8Str(t, "", []byte{0x00, 0x00}, true)
+	checkPutUtf8Str(t, strings.Repeat("a", 65536), nil, false)
+}
+
+func TestWriterBytes(t *testing.T) {
+	w := NewWriter()
+	w.PutByte(0x20)
+	w.PutUint16(0x0102)
+	w.PutUint32(0x03040506)
+	w.PutBinaryData([]byte{0xAA})
+	w.PutBytes([]byte{0xBB, 0xCC})
+	expected := []byte{0x20, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x00, 0x01, 0xAA, 0xBB, 0xCC}
+	buf, err := w.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes failed: %v", err.Error())
+	} else if !cmp.Equal(buf, expected) {
+		t.Fatalf("Got:\n%v\nExpected:\n%v", buf, expected)
+	} else if w.Len() != len(expected) {
+		t.Fatalf("Len got %d, expected %d", w.Len(), len(expected))
+	}
+
+	// the first error sticks, even if later writes are fine.
+	w.PutVarByteInt(MaxVarByteInt + 1)
+	w.PutByte(0x01)
+	if _, err := w.Bytes(); err == nil {
+		t.Fatalf("Bytes should have returned the earlier error")
+	}
+}